@@ -0,0 +1,259 @@
+package kupool
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 连接被准入控制拒绝的原因，作为 OpClose 的内容发给客户端
+var (
+	ErrTooManyConns        = errors.New("too many connections")
+	ErrTooManyConnsFromIP  = errors.New("too many connections from this address")
+	ErrTooManyPending      = errors.New("too many pending handshakes")
+	ErrAcceptRateExceeded  = errors.New("connection rate exceeded")
+	admissionRefuseReasons = []error{ErrTooManyConns, ErrTooManyConnsFromIP, ErrTooManyPending, ErrAcceptRateExceeded}
+)
+
+// AdmissionOptions 连接准入限制，各项为 0 表示不限制
+type AdmissionOptions struct {
+	MaxConns      int     // 全局最大连接数，含握手中的连接
+	MaxConnsPerIP int     // 每个来源（按下面的前缀聚合）的最大连接数
+	IPv4Prefix    int     // 按来源计数时 IPv4 地址的前缀长度，默认 32
+	IPv6Prefix    int     // 按来源计数时 IPv6 地址的前缀长度，默认 64
+	MaxPending    int     // 同时进行中的握手（Acceptor.Accept）数
+	AcceptRate    float64 // 每秒接受的新连接数（令牌桶）
+	AcceptBurst   int     // 令牌桶容量，默认为 AcceptRate 向上取整
+}
+
+// AdmissionStats 准入控制的计数
+type AdmissionStats struct {
+	Active   int               `json:"active"`   // 当前连接数，含握手中
+	Pending  int               `json:"pending"`  // 握手中的连接数
+	Admitted uint64            `json:"admitted"` // 累计放行
+	Refused  map[string]uint64 `json:"refused"`  // 累计拒绝，按原因
+}
+
+// Admission 在 Acceptor 运行之前决定是否接受新连接，由各传输的 Server 共用。nil 表示不限制
+type Admission struct {
+	opts AdmissionOptions
+	now  func() time.Time
+
+	mu      sync.Mutex
+	active  int
+	pending int
+	perIP   map[netip.Prefix]int
+	tokens  float64
+	last    time.Time
+
+	admitted atomic.Uint64
+	refused  map[error]*atomic.Uint64
+}
+
+// NewAdmission NewAdmission
+func NewAdmission(opts AdmissionOptions) *Admission {
+	if opts.IPv4Prefix <= 0 || opts.IPv4Prefix > 32 {
+		opts.IPv4Prefix = 32
+	}
+	if opts.IPv6Prefix <= 0 || opts.IPv6Prefix > 128 {
+		opts.IPv6Prefix = 64
+	}
+	if opts.AcceptRate > 0 && opts.AcceptBurst <= 0 {
+		opts.AcceptBurst = int(opts.AcceptRate + 0.999)
+	}
+	a := &Admission{
+		opts:    opts,
+		now:     time.Now,
+		perIP:   make(map[netip.Prefix]int),
+		tokens:  float64(opts.AcceptBurst),
+		refused: make(map[error]*atomic.Uint64),
+	}
+	for _, err := range admissionRefuseReasons {
+		a.refused[err] = new(atomic.Uint64)
+	}
+	return a
+}
+
+// Admit 为来自 remote 的新连接申请名额，被拒绝时返回原因。
+// 放行后握手成功调用 Ticket.Established，连接关闭时调用 Ticket.Release。
+// remote 为 nil 表示来源尚未确定（如等待 PROXY 头部），此时只检查全局、握手与速率限制，
+// 来源确定后调用 Ticket.Bind 检查按来源的限制
+func (a *Admission) Admit(remote net.Addr) (*Ticket, error) {
+	if a == nil {
+		return nil, nil
+	}
+	var (
+		key   netip.Prefix
+		keyed bool
+	)
+	if remote != nil {
+		key, keyed = a.sourceOf(remote)
+	}
+	a.mu.Lock()
+	err := a.check(key, keyed)
+	if err == nil {
+		a.active++
+		a.pending++
+		if keyed {
+			a.perIP[key]++
+		}
+	}
+	a.mu.Unlock()
+	if err != nil {
+		a.refused[err].Add(1)
+		return nil, err
+	}
+	t := &Ticket{a: a, key: key, keyed: keyed, bound: remote != nil}
+	if t.bound {
+		a.admitted.Add(1)
+	}
+	return t, nil
+}
+
+func (a *Admission) check(key netip.Prefix, keyed bool) error {
+	if a.opts.MaxConns > 0 && a.active >= a.opts.MaxConns {
+		return ErrTooManyConns
+	}
+	if a.opts.MaxConnsPerIP > 0 && keyed && a.perIP[key] >= a.opts.MaxConnsPerIP {
+		return ErrTooManyConnsFromIP
+	}
+	if a.opts.MaxPending > 0 && a.pending >= a.opts.MaxPending {
+		return ErrTooManyPending
+	}
+	if a.opts.AcceptRate > 0 {
+		// 令牌桶最后检查，被其他限制拒绝的连接不消耗令牌
+		now := a.now()
+		if !a.last.IsZero() {
+			a.tokens += now.Sub(a.last).Seconds() * a.opts.AcceptRate
+			if burst := float64(a.opts.AcceptBurst); a.tokens > burst {
+				a.tokens = burst
+			}
+		}
+		a.last = now
+		if a.tokens < 1 {
+			return ErrAcceptRateExceeded
+		}
+		a.tokens--
+	}
+	return nil
+}
+
+// sourceOf 按配置的前缀长度聚合来源地址，非 IP 地址不参与按来源计数
+func (a *Admission) sourceOf(remote net.Addr) (netip.Prefix, bool) {
+	ta, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ip, ok := netip.AddrFromSlice(ta.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ip = ip.Unmap()
+	bits := a.opts.IPv6Prefix
+	if ip.Is4() {
+		bits = a.opts.IPv4Prefix
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+// Stats 当前计数的快照
+func (a *Admission) Stats() AdmissionStats {
+	if a == nil {
+		return AdmissionStats{}
+	}
+	a.mu.Lock()
+	st := AdmissionStats{Active: a.active, Pending: a.pending}
+	a.mu.Unlock()
+	st.Admitted = a.admitted.Load()
+	st.Refused = make(map[string]uint64, len(a.refused))
+	for err, n := range a.refused {
+		st.Refused[err.Error()] = n.Load()
+	}
+	return st
+}
+
+// Ticket 一个已放行连接占用的名额，方法可以在 nil 上调用，均可重复调用
+type Ticket struct {
+	a     *Admission
+	key   netip.Prefix
+	keyed bool
+	// 以下由 a.mu 保护
+	bound       bool
+	established bool
+	released    bool
+}
+
+// Bind 确定以 Admit(nil) 放行的连接的来源并检查按来源的限制，被拒绝时返回原因，
+// 调用方随后仍需 Release。已确定来源的名额上调用无效果
+func (t *Ticket) Bind(remote net.Addr) error {
+	if t == nil {
+		return nil
+	}
+	a := t.a
+	key, keyed := a.sourceOf(remote)
+	a.mu.Lock()
+	if t.bound || t.released {
+		a.mu.Unlock()
+		return nil
+	}
+	var err error
+	if keyed && a.opts.MaxConnsPerIP > 0 && a.perIP[key] >= a.opts.MaxConnsPerIP {
+		err = ErrTooManyConnsFromIP
+	} else {
+		t.bound = true
+		if keyed {
+			t.key, t.keyed = key, true
+			a.perIP[key]++
+		}
+	}
+	a.mu.Unlock()
+	if err != nil {
+		a.refused[err].Add(1)
+		return err
+	}
+	a.admitted.Add(1)
+	return nil
+}
+
+// Established 握手完成，不再计入握手中的连接
+func (t *Ticket) Established() {
+	if t == nil {
+		return
+	}
+	t.a.mu.Lock()
+	defer t.a.mu.Unlock()
+	if t.established || t.released {
+		return
+	}
+	t.established = true
+	t.a.pending--
+}
+
+// Release 连接关闭，归还名额
+func (t *Ticket) Release() {
+	if t == nil {
+		return
+	}
+	t.a.mu.Lock()
+	defer t.a.mu.Unlock()
+	if t.released {
+		return
+	}
+	t.released = true
+	t.a.active--
+	if !t.established {
+		t.a.pending--
+	}
+	if t.keyed {
+		if t.a.perIP[t.key]--; t.a.perIP[t.key] <= 0 {
+			delete(t.a.perIP, t.key)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package kupool
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpAddr(s string) net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", s)
+	return a
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	a := NewAdmission(AdmissionOptions{MaxConns: 4, MaxConnsPerIP: 2, IPv4Prefix: 24, MaxPending: 3})
+
+	t1, err := a.Admit(tcpAddr("10.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := a.Admit(tcpAddr("10.0.0.2:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一 /24 内已有两个连接
+	if _, err := a.Admit(tcpAddr("10.0.0.3:1")); !errors.Is(err, ErrTooManyConnsFromIP) {
+		t.Fatalf("expect per-ip limit, got %v", err)
+	}
+	t3, err := a.Admit(tcpAddr("10.0.1.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 三个连接都在握手中
+	if _, err := a.Admit(tcpAddr("10.0.2.1:1")); !errors.Is(err, ErrTooManyPending) {
+		t.Fatalf("expect pending limit, got %v", err)
+	}
+	t1.Established()
+	t1.Established()
+	t4, err := a.Admit(tcpAddr("10.0.2.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Admit(tcpAddr("10.0.3.1:1")); !errors.Is(err, ErrTooManyConns) {
+		t.Fatalf("expect global limit, got %v", err)
+	}
+
+	st := a.Stats()
+	if st.Active != 4 || st.Pending != 3 || st.Admitted != 4 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.Refused[ErrTooManyConnsFromIP.Error()] != 1 || st.Refused[ErrTooManyPending.Error()] != 1 || st.Refused[ErrTooManyConns.Error()] != 1 {
+		t.Fatalf("unexpected refused counts %+v", st.Refused)
+	}
+
+	// 重复 Release 只归还一次名额
+	for _, tk := range []*Ticket{t1, t2, t3, t4, t2} {
+		tk.Release()
+	}
+	if st := a.Stats(); st.Active != 0 || st.Pending != 0 || len(a.perIP) != 0 {
+		t.Fatalf("all tickets released, got %+v", st)
+	}
+	if _, err := a.Admit(tcpAddr("10.0.0.3:1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmissionAcceptRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := NewAdmission(AdmissionOptions{AcceptRate: 2, AcceptBurst: 3, MaxConnsPerIP: 1})
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		tk, err := a.Admit(tcpAddr("10.0.0.1:1"))
+		if err != nil {
+			t.Fatalf("burst #%d: %v", i, err)
+		}
+		tk.Release()
+	}
+	if _, err := a.Admit(tcpAddr("10.0.0.1:1")); !errors.Is(err, ErrAcceptRateExceeded) {
+		t.Fatalf("expect rate limit, got %v", err)
+	}
+	now = now.Add(500 * time.Millisecond)
+	tk, err := a.Admit(tcpAddr("10.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("one token refilled after 500ms: %v", err)
+	}
+	// 被其他限制拒绝的连接不消耗令牌
+	now = now.Add(500 * time.Millisecond)
+	if _, err := a.Admit(tcpAddr("10.0.0.1:1")); !errors.Is(err, ErrTooManyConnsFromIP) {
+		t.Fatalf("expect per-ip limit, got %v", err)
+	}
+	if _, err := a.Admit(tcpAddr("10.0.0.2:1")); err != nil {
+		t.Fatalf("token should still be available: %v", err)
+	}
+	tk.Release()
+
+	var nilAdmission *Admission
+	if tk, err := nilAdmission.Admit(tcpAddr("10.0.0.1:1")); tk != nil || err != nil {
+		t.Fatal("nil admission admits everything")
+	}
+}
+
+// TestAdmissionBind 来源未定时只占全局与握手名额，Bind 时再检查按来源的限制
+func TestAdmissionBind(t *testing.T) {
+	a := NewAdmission(AdmissionOptions{MaxConnsPerIP: 1, MaxPending: 2})
+
+	t1, err := a.Admit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := a.Admit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两个连接都在等待头部，握手名额已满
+	if _, err := a.Admit(nil); !errors.Is(err, ErrTooManyPending) {
+		t.Fatalf("expect pending limit, got %v", err)
+	}
+	if st := a.Stats(); st.Admitted != 0 || st.Pending != 2 {
+		t.Fatalf("unbound tickets are not admitted yet, got %+v", st)
+	}
+
+	if err := t1.Bind(tcpAddr("10.0.0.1:1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Bind(tcpAddr("10.0.0.1:2")); !errors.Is(err, ErrTooManyConnsFromIP) {
+		t.Fatalf("expect per-ip limit on bind, got %v", err)
+	}
+	t2.Release()
+	st := a.Stats()
+	if st.Active != 1 || st.Pending != 1 || st.Admitted != 1 || st.Refused[ErrTooManyConnsFromIP.Error()] != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	t1.Release()
+	if st := a.Stats(); st.Active != 0 || st.Pending != 0 || len(a.perIP) != 0 {
+		t.Fatalf("all tickets released, got %+v", st)
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+)
+
+// BanHandler 封禁管理 HTTP 接口
+//
+//	GET  /admin/bans                          当前生效的封禁
+//	POST /admin/bans/lift?kind=&value=        解除封禁（也接受 DELETE）
+//
+// kind 为 account|ip；要求 Authorization: Bearer <token>，token 为空时不注册路由（返回 404）
+type BanHandler struct {
+	bans  *server.BanManager
+	token string
+}
+
+func NewBanHandler(bans *server.BanManager, token string) *BanHandler {
+	return &BanHandler{bans: bans, token: token}
+}
+
+// Register 注册路由；未配置 token 时不注册
+func (h *BanHandler) Register(mux *http.ServeMux) {
+	if h.token == "" {
+		return
+	}
+	mux.HandleFunc("/admin/bans", h.auth(h.list))
+	mux.HandleFunc("/admin/bans/lift", h.auth(h.lift))
+}
+
+func (h *BanHandler) auth(fn http.HandlerFunc) http.HandlerFunc {
+	return requireToken(h.token, fn)
+}
+
+// requireToken 要求 Authorization: Bearer <token>，token 为空时拒绝全部请求
+func requireToken(token string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (h *BanHandler) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"bans": h.bans.List(time.Now())})
+}
+
+func (h *BanHandler) lift(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	kind := server.BanKind(r.URL.Query().Get("kind"))
+	value := r.URL.Query().Get("value")
+	if (kind != server.BanAccount && kind != server.BanIP) || value == "" {
+		writeError(w, http.StatusBadRequest, errors.New("kind must be account or ip and value is required"))
+		return
+	}
+	ok, err := h.bans.Lift(kind, value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("ban not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"kind": kind, "value": value, "lifted": true})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+)
+
+func TestBanHandler(t *testing.T) {
+	m := server.NewBanManager(server.BanPolicy{Enabled: true, Window: time.Minute, MinRejects: 2, MaxRejectRatio: 0.5, BaseDuration: time.Hour, MaxDuration: time.Hour, ForgiveAfter: time.Hour}, nil)
+	s := &server.Session{ChannelID: "c1", Username: "mallory"}
+	m.Record(s, true, "Invalid result", time.Now())
+	m.Record(s, true, "Invalid result", time.Now())
+	mux := http.NewServeMux()
+	NewBanHandler(m, "secret").Register(mux)
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do(http.MethodGet, "/admin/bans", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 without token, got %d", rec.Code)
+	}
+	rec := do(http.MethodGet, "/admin/bans", "secret")
+	var body struct {
+		Bans []server.Ban `json:"bans"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Bans) != 1 || body.Bans[0].Value != "mallory" {
+		t.Fatalf("unexpected list %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/admin/bans/lift?kind=user&value=mallory", "secret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expect 400 for bad kind, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/admin/bans/lift?kind=account&value=mallory", "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("lift failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodDelete, "/admin/bans/lift?kind=account&value=mallory", "secret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expect 404 on second lift, got %d", rec.Code)
+	}
+	if _, banned := m.Check("mallory", "", time.Now()); banned {
+		t.Fatal("ban should be lifted")
+	}
+}
+
+// TestBanHandlerWithoutToken 未配置 token 时不暴露管理接口
+func TestBanHandlerWithoutToken(t *testing.T) {
+	m := server.NewBanManager(server.DefaultBanPolicy(), nil)
+	mux := http.NewServeMux()
+	NewBanHandler(m, "").Register(mux)
+	for _, path := range []string{"/admin/bans", "/admin/bans/lift?kind=account&value=u"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		if rec.Code != http.StatusNotFound && rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expect 404 or 401 without admin token, got %d", path, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	requireToken("", func(w http.ResponseWriter, r *http.Request) {})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("empty token must not authorize, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/JellyTony/kupool/app/server"
+)
+
+// ChannelHandler 连接管理 HTTP 接口
+//
+//	GET /admin/channels    当前连接：用户名、远端地址、最近读活动与业务消息时间、心跳往返时长
+//
+// 要求 Authorization: Bearer <token>，token 为空时不注册路由（返回 404）
+type ChannelHandler struct {
+	app   *server.AppServer
+	token string
+}
+
+func NewChannelHandler(app *server.AppServer, token string) *ChannelHandler {
+	return &ChannelHandler{app: app, token: token}
+}
+
+// Register 注册路由；未配置 token 时不注册
+func (h *ChannelHandler) Register(mux *http.ServeMux) {
+	if h.token == "" {
+		return
+	}
+	mux.HandleFunc("/admin/channels", requireToken(h.token, h.list))
+}
+
+func (h *ChannelHandler) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"channels": h.app.Channels()})
+}
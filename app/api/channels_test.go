@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestChannelHandlerRequiresToken 未配置 token 时不暴露、配置后校验 token
+func TestChannelHandlerRequiresToken(t *testing.T) {
+	mux := http.NewServeMux()
+	NewChannelHandler(nil, "").Register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/channels", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expect 404 without admin token, got %d", rec.Code)
+	}
+
+	mux = http.NewServeMux()
+	NewChannelHandler(nil, "secret").Register(mux)
+	for _, auth := range []string{"", "Bearer wrong", "Bearer "} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/channels", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("auth %q: expect 401, got %d", auth, rec.Code)
+		}
+	}
+}
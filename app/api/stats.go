@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+)
+
+const (
+	defaultRange    = time.Hour
+	defaultTopLimit = 10
+	maxTopLimit     = 1000
+)
+
+// StatsHandler 统计查询 HTTP 接口
+//
+//	GET /stats?username=&minute=                     单分钟计数
+//	GET /stats/range?username=&start=&end=&bucket=   用户按桶聚合的计数序列
+//	GET /stats/top?start=&end=&limit=&bucket=        提交数最多的用户
+//	GET /stats/total?start=&end=&bucket=             总提交数
+//
+// start/end 为 RFC3339，默认最近一小时；bucket 为 minute|hour|day|auto（默认 auto）；
+// format=csv 时返回 CSV，否则返回 JSON。start 所在的不完整桶不计入，响应中的 bucket 与
+// effective_start 为实际使用的粒度与统计起点
+type StatsHandler struct {
+	store server.StatsStore
+	query server.StatsQuery
+}
+
+func NewStatsHandler(store server.StatsStore) *StatsHandler {
+	h := &StatsHandler{store: store}
+	h.query, _ = store.(server.StatsQuery)
+	return h
+}
+
+// Register 注册路由
+func (h *StatsHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/stats", h.minute)
+	mux.HandleFunc("/stats/range", h.withQuery(h.rangeSeries))
+	mux.HandleFunc("/stats/top", h.withQuery(h.top))
+	mux.HandleFunc("/stats/total", h.withQuery(h.total))
+}
+
+type point struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+func (h *StatsHandler) minute(w http.ResponseWriter, r *http.Request) {
+	u := r.URL.Query().Get("username")
+	ms := r.URL.Query().Get("minute")
+	m := time.Now()
+	if ms != "" {
+		if t, err := time.Parse(time.RFC3339, ms); err == nil {
+			m = t
+		}
+	}
+	cnt, err := h.store.Get(u, m)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"username": u, "minute": m.Truncate(time.Minute).Format(time.RFC3339), "submission_count": cnt})
+}
+
+// withQuery 要求存储实现 StatsQuery，并解析公共的时间范围与粒度参数
+func (h *StatsHandler) withQuery(fn func(http.ResponseWriter, *http.Request, time.Time, time.Time, server.Granularity)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.query == nil {
+			writeError(w, http.StatusNotImplemented, errors.New("stats store does not support queries"))
+			return
+		}
+		start, end, err := parseRange(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		g := server.Granularity(r.URL.Query().Get("bucket"))
+		switch {
+		case g == "" || g == "auto":
+			g = h.query.PickGranularity(start, end)
+		case !g.Valid():
+			writeError(w, http.StatusBadRequest, errors.New("bucket must be one of minute, hour, day, auto"))
+			return
+		}
+		fn(w, r, start, end, g)
+	}
+}
+
+func (h *StatsHandler) rangeSeries(w http.ResponseWriter, r *http.Request, start, end time.Time, g server.Granularity) {
+	u := r.URL.Query().Get("username")
+	if u == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+	m, err := h.query.GetUserSubmissionsByTimeRange(u, start, end, g)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	points := make([]point, 0, len(m))
+	for t, n := range m {
+		points = append(points, point{Time: t.UTC(), Count: n})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	if wantCSV(r) {
+		rows := [][]string{{"time", "count"}}
+		for _, p := range points {
+			rows = append(rows, []string{p.Time.Format(time.RFC3339), strconv.Itoa(p.Count)})
+		}
+		writeCSV(w, rows)
+		return
+	}
+	writeJSON(w, map[string]any{"username": u, "start": start.Format(time.RFC3339), "effective_start": effectiveStart(start, g), "end": end.Format(time.RFC3339), "bucket": g, "points": points})
+}
+
+func (h *StatsHandler) top(w http.ResponseWriter, r *http.Request, start, end time.Time, g server.Granularity) {
+	limit := defaultTopLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxTopLimit {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 1000"))
+			return
+		}
+		limit = n
+	}
+	users, err := h.query.GetTopUsersBySubmissions(start, end, limit, g)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if users == nil {
+		users = []server.UserTotal{}
+	}
+	if wantCSV(r) {
+		rows := [][]string{{"username", "total"}}
+		for _, u := range users {
+			rows = append(rows, []string{u.Username, strconv.Itoa(u.Total)})
+		}
+		writeCSV(w, rows)
+		return
+	}
+	writeJSON(w, map[string]any{"start": start.Format(time.RFC3339), "effective_start": effectiveStart(start, g), "end": end.Format(time.RFC3339), "bucket": g, "users": users})
+}
+
+func (h *StatsHandler) total(w http.ResponseWriter, r *http.Request, start, end time.Time, g server.Granularity) {
+	total, err := h.query.GetTotalSubmissions(start, end, g)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if wantCSV(r) {
+		writeCSV(w, [][]string{
+			{"start", "effective_start", "end", "bucket", "total"},
+			{start.Format(time.RFC3339), effectiveStart(start, g), end.Format(time.RFC3339), string(g), strconv.Itoa(total)},
+		})
+		return
+	}
+	writeJSON(w, map[string]any{"start": start.Format(time.RFC3339), "effective_start": effectiveStart(start, g), "end": end.Format(time.RFC3339), "bucket": g, "total": total})
+}
+
+// effectiveStart 实际统计起点：start 向上对齐到 g 的桶起点
+func effectiveStart(start time.Time, g server.Granularity) string {
+	return g.Ceil(start).UTC().Format(time.RFC3339)
+}
+
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	end := time.Now()
+	if v := q.Get("end"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("end must be RFC3339")
+		}
+		end = t
+	}
+	start := end.Add(-defaultRange)
+	if v := q.Get("start"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("start must be RFC3339")
+		}
+		start = t
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("end must not be before start")
+	}
+	return start, end, nil
+}
+
+func wantCSV(r *http.Request) bool { return r.URL.Query().Get("format") == "csv" }
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeCSV(w http.ResponseWriter, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	_ = cw.WriteAll(rows)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error()})
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/stats"
+)
+
+func newTestMux(t *testing.T) (*http.ServeMux, time.Time) {
+	t.Helper()
+	store := stats.NewMemoryStore()
+	now := time.Now().UTC().Truncate(time.Minute)
+	_ = store.IncrementBy("alice", now.Add(-2*time.Minute), 3)
+	_ = store.IncrementBy("alice", now.Add(-time.Minute), 1)
+	_ = store.IncrementBy("bob", now.Add(-time.Minute), 2)
+	_ = store.IncrementBy("carol", now.Add(-30*time.Hour), 9)
+	mux := http.NewServeMux()
+	NewStatsHandler(store).Register(mux)
+	return mux, now
+}
+
+func get(t *testing.T, mux *http.ServeMux, path string, params url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStatsRange(t *testing.T) {
+	mux, now := newTestMux(t)
+	rec := get(t, mux, "/stats/range", url.Values{
+		"username": {"alice"},
+		"start":    {now.Add(-10 * time.Minute).Format(time.RFC3339)},
+		"end":      {now.Format(time.RFC3339)},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		Bucket string  `json:"bucket"`
+		Points []point `json:"points"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Bucket != "minute" || len(body.Points) != 2 || body.Points[0].Count != 3 || body.Points[1].Count != 1 {
+		t.Fatalf("unexpected body %s", rec.Body.String())
+	}
+
+	rec = get(t, mux, "/stats/range", url.Values{
+		"username": {"alice"},
+		"start":    {now.Add(-10 * time.Minute).Truncate(time.Hour).Format(time.RFC3339)},
+		"end":      {now.Format(time.RFC3339)},
+		"bucket":   {"hour"},
+		"format":   {"csv"},
+	})
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Header().Get("Content-Type") != "text/csv" || lines[0] != "time,count" {
+		t.Fatalf("unexpected csv %q", rec.Body.String())
+	}
+	total := 0
+	for _, l := range lines[1:] {
+		parts := strings.Split(l, ",")
+		ts, _ := time.Parse(time.RFC3339, parts[0])
+		if !ts.Equal(ts.Truncate(time.Hour)) {
+			t.Fatalf("expect hourly bucket, got %s", parts[0])
+		}
+		n, _ := strconv.Atoi(parts[1])
+		total += n
+	}
+	if total != 4 {
+		t.Fatalf("hour bucket should aggregate minutes: %q", rec.Body.String())
+	}
+}
+
+func TestStatsTopAndTotal(t *testing.T) {
+	mux, now := newTestMux(t)
+	rng := url.Values{
+		"start": {now.Add(-time.Hour).Format(time.RFC3339)},
+		"end":   {now.Format(time.RFC3339)},
+	}
+	rec := get(t, mux, "/stats/top", url.Values{"start": rng["start"], "end": rng["end"], "limit": {"1"}})
+	var top struct {
+		Users []struct {
+			Username string `json:"username"`
+			Total    int    `json:"total"`
+		} `json:"users"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &top)
+	if len(top.Users) != 1 || top.Users[0].Username != "alice" || top.Users[0].Total != 4 {
+		t.Fatalf("unexpected top %s", rec.Body.String())
+	}
+
+	rec = get(t, mux, "/stats/total", rng)
+	var total struct {
+		Total int `json:"total"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &total)
+	if total.Total != 6 {
+		t.Fatalf("expect total 6, got %s", rec.Body.String())
+	}
+
+	// 跨度较大时自动切换到更粗粒度，仍能统计到 30 小时前的数据
+	rec = get(t, mux, "/stats/total", url.Values{
+		"start":  {now.Add(-48 * time.Hour).Format(time.RFC3339)},
+		"end":    {now.Format(time.RFC3339)},
+		"format": {"csv"},
+	})
+	if !strings.Contains(rec.Body.String(), ",15\n") {
+		t.Fatalf("expect total 15 in csv, got %q", rec.Body.String())
+	}
+}
+
+func TestStatsBadRequest(t *testing.T) {
+	mux, _ := newTestMux(t)
+	cases := []struct {
+		path   string
+		params url.Values
+	}{
+		{"/stats/range", url.Values{}},
+		{"/stats/range", url.Values{"username": {"alice"}, "bucket": {"week"}}},
+		{"/stats/total", url.Values{"start": {"yesterday"}}},
+		{"/stats/top", url.Values{"limit": {"0"}}},
+	}
+	for _, c := range cases {
+		if rec := get(t, mux, c.path, c.params); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %v: expect 400, got %d", c.path, c.params, rec.Code)
+		}
+	}
+}
+
+// TestStatsEffectiveStart start 落在小时中间时按小时统计从下一个整点开始，并在响应中返回实际粒度与起点
+func TestStatsEffectiveStart(t *testing.T) {
+	store := stats.NewMemoryStore()
+	start := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour).Add(59 * time.Minute)
+	_ = store.IncrementBy("alice", start.Add(-time.Minute), 2)
+	_ = store.IncrementBy("alice", start.Add(2*time.Minute), 3)
+	mux := http.NewServeMux()
+	NewStatsHandler(store).Register(mux)
+
+	rec := get(t, mux, "/stats/total", url.Values{
+		"start":  {start.Format(time.RFC3339)},
+		"end":    {start.Add(time.Hour).Format(time.RFC3339)},
+		"bucket": {"hour"},
+	})
+	var body struct {
+		Bucket         string `json:"bucket"`
+		EffectiveStart string `json:"effective_start"`
+		Total          int    `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := start.Truncate(time.Hour).Add(time.Hour).Format(time.RFC3339)
+	if body.Bucket != "hour" || body.EffectiveStart != want || body.Total != 3 {
+		t.Fatalf("expect hour from %s with total 3, got %s", want, rec.Body.String())
+	}
+
+	rec = get(t, mux, "/stats/total", url.Values{
+		"start": {start.Format(time.RFC3339)},
+		"end":   {start.Add(time.Hour).Format(time.RFC3339)},
+	})
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Bucket != "minute" || body.EffectiveStart != start.Format(time.RFC3339) || body.Total != 3 {
+		t.Fatalf("auto should pick minutes here, got %s", rec.Body.String())
+	}
+}
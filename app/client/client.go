@@ -3,170 +3,129 @@ package client
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
-	"net"
 	"time"
 
-	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
 	"github.com/JellyTony/kupool/logger"
-	"github.com/JellyTony/kupool/protocol"
-	"github.com/JellyTony/kupool/tcp"
+	"github.com/JellyTony/kupool/sdk"
 )
 
+// Client kupool-client 的挖矿逻辑：收到任务立即提交一次，随后按最小提交间隔提交、至少每分钟一次；
+// 连接、认证、断线重连与请求关联由 sdk.Client 完成
 type Client struct {
-	cli         kupool.Client
-	username    string
-	jobID       int
-	serverNonce string
-	nextID      int
+	sdk      *sdk.Client
+	username string
+	// submitInterval 两次提交的最小间隔，应与服务端限速策略一致
+	submitInterval time.Duration
+	clk            clock.Clock
 }
 
+// DefaultSubmitInterval 与服务端默认限速（每会话每秒 1 次）一致
+const DefaultSubmitInterval = time.Second
+
 func NewClient(username string) *Client {
-	c := &Client{username: username, nextID: 1}
-	c.cli = tcp.NewClient(username, "client", tcp.ClientOptions{})
-	c.cli.SetDialer(&dialer{username: username})
+	c := &Client{sdk: sdk.NewClient(username), username: username, submitInterval: DefaultSubmitInterval, clk: clock.Real()}
+	c.sdk.OnSubmitResult(logResult)
 	return c
 }
 
-func (c *Client) Connect(addr string) error { return c.cli.Connect(addr) }
+// SetSubmitInterval 设置最小提交间隔，服务端放宽或收紧限速时同步调整，需在 Mine 之前调用
+func (c *Client) SetSubmitInterval(d time.Duration) {
+	if d > 0 {
+		c.submitInterval = d
+	}
+}
 
-func (c *Client) Run(ctx context.Context) error {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	minuteTicker := time.NewTicker(time.Minute)
-	defer minuteTicker.Stop()
-	lastSubmit := time.Time{}
+// SetClock 设置提交节奏、请求超时与重连退避使用的时钟（默认真实时钟），需在 Mine 之前调用
+func (c *Client) SetClock(clk clock.Clock) {
+	c.clk = clock.OrReal(clk)
+	c.sdk.SetClock(c.clk)
+}
+
+// SetTransport 设置连接矿池的传输（默认 sdk.TCP），需在 Mine 之前调用
+func (c *Client) SetTransport(t sdk.Transport) { c.sdk.SetTransport(t) }
+
+// SetPools 设置矿池列表，需在 Mine 之前调用
+func (c *Client) SetPools(pools ...sdk.Pool) { c.sdk.SetPools(pools...) }
+
+// SetReconnect 设置重连退避与探测参数，需在 Mine 之前调用
+func (c *Client) SetReconnect(opts sdk.ReconnectOptions) { c.sdk.SetReconnect(opts) }
 
-	readCh := make(chan kupool.Frame)
+// SetRequestTimeout 设置等待每个提交响应的上限，需在 Mine 之前调用
+func (c *Client) SetRequestTimeout(d time.Duration) { c.sdk.SetRequestTimeout(d) }
+
+// Stats 返回提交的接受、拒绝、超时与断线计数
+func (c *Client) Stats() sdk.RequestStats { return c.sdk.Stats() }
+
+// Mine 保持与矿池的连接并持续挖矿，直到 ctx 结束。重连后不再提交旧连接上的任务，
+// 等新连接上的下一个任务再继续
+func (c *Client) Mine(ctx context.Context) error {
 	errCh := make(chan error, 1)
+	go func() { errCh <- c.sdk.Run(ctx) }()
 
-	go func() {
-		for {
-			frame, err := c.cli.Read()
-			if err != nil {
-				errCh <- err
-				return
-			}
-			readCh <- frame
-		}
-	}()
+	ticker := c.clk.NewTicker(c.submitInterval)
+	defer ticker.Stop()
+	minuteTicker := c.clk.NewTicker(time.Minute)
+	defer minuteTicker.Stop()
+	lastSubmit := time.Time{}
 
 	for {
 		select {
-		case <-ctx.Done():
-			return ctx.Err()
 		case err := <-errCh:
 			return err
-		case frame := <-readCh:
-			if frame.GetOpCode() != kupool.OpBinary {
-				logger.WithFields(logger.Fields{
-					"module": "client",
-					"body":   frame.GetPayload(),
-				}).Infof("unexpected op code: %d", frame.GetOpCode())
-				continue
-			}
-
-			var resp protocol.Response
-			if err := protocol.Decode(frame.GetPayload(), &resp); err == nil && resp.ID != 0 {
-				if !resp.Result && resp.Error != nil {
-					logger.Warnf("submit failed: %s", *resp.Error)
-				} else {
-					logger.WithFields(logger.Fields{"module": "client", "id": resp.ID}).Info("submit ok")
-				}
-				continue
-			}
-
-			var msg protocol.Request
-			if err := protocol.Decode(frame.GetPayload(), &msg); err != nil {
-				continue
-			}
-			if msg.Method == "job" {
-				var p protocol.JobParams
-				_ = protocol.Decode(msg.Params, &p)
-				c.jobID = p.JobID
-				c.serverNonce = p.ServerNonce
-				logger.WithFields(logger.Fields{"module": "client", "job_id": p.JobID, "server_nonce": p.ServerNonce}).Info("job received")
-
-				clientNonce := randNonce()
-				res := computeSHA256Hex(c.serverNonce + clientNonce)
-				id := c.nextID
-				c.nextID++
-				req := protocol.Request{ID: &id, Method: "submit"}
-				sp, _ := protocol.Encode(protocol.SubmitParams{JobID: c.jobID, ClientNonce: clientNonce, Result: res})
-				req.Params = sp
-				data, _ := protocol.Encode(req)
-				_ = c.cli.Send(data)
-				logger.WithFields(logger.Fields{"module": "client", "job_id": c.jobID, "client_nonce": clientNonce}).Info("submit sent (immediate)")
-				lastSubmit = time.Now()
-			}
-
-		case <-ticker.C:
-			if c.serverNonce == "" {
+		case job := <-c.sdk.Jobs():
+			logger.WithFields(logger.Fields{"module": "client", "job_id": job.ID, "server_nonce": job.ServerNonce}).Info("job received")
+			c.submit(job.ID, "immediate")
+			lastSubmit = c.clk.Now()
+
+		case <-ticker.C():
+			job, ok := c.sdk.Job()
+			if !ok {
 				continue
 			}
-			if !lastSubmit.IsZero() && time.Since(lastSubmit) < time.Second {
+			if !lastSubmit.IsZero() && c.clk.Since(lastSubmit) < c.submitInterval {
 				logger.WithFields(logger.Fields{"module": "client"}).Debug("skip submit due to rate limit")
 				continue
 			}
-			clientNonce := randNonce()
-			res := computeSHA256Hex(c.serverNonce + clientNonce)
-			id := c.nextID
-			c.nextID++
-			req := protocol.Request{ID: &id, Method: "submit"}
-			sp, _ := protocol.Encode(protocol.SubmitParams{JobID: c.jobID, ClientNonce: clientNonce, Result: res})
-			req.Params = sp
-			data, _ := protocol.Encode(req)
-			_ = c.cli.Send(data)
-			logger.WithFields(logger.Fields{"module": "client", "job_id": c.jobID, "client_nonce": clientNonce}).Info("submit sent")
-			lastSubmit = time.Now()
-
-		case <-minuteTicker.C:
-			if c.serverNonce == "" {
+			c.submit(job.ID, "interval")
+			lastSubmit = c.clk.Now()
+
+		case <-minuteTicker.C():
+			job, ok := c.sdk.Job()
+			if !ok {
 				continue
 			}
-			if time.Since(lastSubmit) >= time.Minute {
-				clientNonce := randNonce()
-				res := computeSHA256Hex(c.serverNonce + clientNonce)
-				id := c.nextID
-				c.nextID++
-				req := protocol.Request{ID: &id, Method: "submit"}
-				sp, _ := protocol.Encode(protocol.SubmitParams{JobID: c.jobID, ClientNonce: clientNonce, Result: res})
-				req.Params = sp
-				data, _ := protocol.Encode(req)
-				_ = c.cli.Send(data)
-				logger.WithFields(logger.Fields{"module": "client", "job_id": c.jobID, "client_nonce": clientNonce}).Info("submit sent (minute guard)")
-				lastSubmit = time.Now()
+			if c.clk.Since(lastSubmit) >= time.Minute {
+				c.submit(job.ID, "minute guard")
+				lastSubmit = c.clk.Now()
 			}
 		}
 	}
 }
 
-func (c *Client) Close() {
-	c.cli.Close()
-	logger.WithFields(logger.Fields{"module": "client"}).Info("close")
-}
-
-type dialer struct{ username string }
-
-func (d *dialer) DialAndHandshake(ctx kupool.DialerContext) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", ctx.Address, ctx.Timeout)
+// submit 以随机 client_nonce 提交 jobID，结果由 logResult 记录
+func (c *Client) submit(jobID int, reason string) {
+	clientNonce := randNonce()
+	log := logger.WithFields(logger.Fields{"module": "client", "job_id": jobID, "client_nonce": clientNonce, "reason": reason})
+	s, err := c.sdk.Submit(jobID, clientNonce)
 	if err != nil {
-		return nil, err
+		log.WithError(err).Warn("submit not sent")
+		return
 	}
+	log.WithField("id", s.ID()).Info("submit sent")
+}
 
-	logger.WithFields(logger.Fields{"module": "client", "address": conn.RemoteAddr().String()}).Info("client connected")
-
-	id := 1
-	req := protocol.Request{ID: &id, Method: "authorize"}
-	p, _ := protocol.Encode(protocol.AuthorizeParams{Username: d.username})
-	req.Params = p
-	data, _ := protocol.Encode(req)
-	_ = tcp.WriteFrame(conn, kupool.OpBinary, data)
-
-	logger.WithFields(logger.Fields{"module": "client", "id": id}).Info("authorize ok")
-
-	return conn, nil
+func logResult(r sdk.SubmitResult) {
+	log := logger.WithFields(logger.Fields{"module": "client", "id": r.ID, "job_id": r.JobID, "latency": r.Latency})
+	switch {
+	case r.Err != nil:
+		log.WithError(r.Err).Warn("submit failed")
+	case !r.Accepted:
+		log.Warnf("submit rejected: %s", r.Reason)
+	default:
+		log.Info("submit ok")
+	}
 }
 
 func randNonce() string {
@@ -174,8 +133,3 @@ func randNonce() string {
 	_, _ = rand.Read(b)
 	return hex.EncodeToString(b)
 }
-
-func computeSHA256Hex(s string) string {
-	h := sha256.Sum256([]byte(s))
-	return hex.EncodeToString(h[:])
-}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/sdk"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+// testPool 最小的矿池服务端：认证即通过，记录认证与提交，由测试推送任务
+type testPool struct {
+	t    *testing.T
+	addr string
+	srv  kupool.Server
+
+	mu      sync.Mutex
+	authed  int
+	submits []protocol.SubmitParams
+}
+
+func startPool(t *testing.T, addr string) *testPool {
+	t.Helper()
+	p := &testPool{t: t, addr: addr}
+	s := tcp.NewServer(addr)
+	s.SetAcceptor(p)
+	s.SetMessageListener(p)
+	s.SetStateListener(p)
+	p.srv = s
+	go func() { _ = s.Start() }()
+	t.Cleanup(p.kill)
+	waitFor(t, "pool listening", func() bool { return s.(*tcp.Server).Addr() != nil })
+	return p
+}
+
+func (p *testPool) Accept(conn kupool.Conn, timeout time.Duration) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	f, err := conn.ReadFrame()
+	if err != nil {
+		return "", err
+	}
+	var req protocol.Request
+	if err := protocol.Decode(f.GetPayload(), &req); err != nil || req.Method != "authorize" {
+		return "", errors.New("unauthorized")
+	}
+	data, _ := protocol.Encode(protocol.Response{ID: *req.ID, Result: true})
+	if err := conn.WriteFrame(kupool.OpBinary, data); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	p.authed++
+	p.mu.Unlock()
+	return conn.RemoteAddr().String(), nil
+}
+
+func (p *testPool) Receive(ag kupool.Agent, payload []byte) {
+	var req protocol.Request
+	var sp protocol.SubmitParams
+	if protocol.Decode(payload, &req) != nil || req.Method != "submit" || protocol.Decode(req.Params, &sp) != nil {
+		return
+	}
+	p.mu.Lock()
+	p.submits = append(p.submits, sp)
+	p.mu.Unlock()
+	data, _ := protocol.Encode(protocol.Response{ID: *req.ID, Result: true})
+	_ = ag.Push(data)
+}
+
+func (p *testPool) Disconnect(string) error { return nil }
+
+// job 向全部连接推送任务
+func (p *testPool) job(id int) {
+	params, _ := protocol.Encode(protocol.JobParams{JobID: id, ServerNonce: "nonce"})
+	data, _ := protocol.Encode(protocol.Request{Method: "job", Params: params})
+	for _, ch := range p.srv.(*tcp.Server).All() {
+		_ = ch.Push(data)
+	}
+}
+
+// kill 关闭监听与全部连接，不发送任何通知
+func (p *testPool) kill() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = p.srv.Shutdown(ctx)
+}
+
+func (p *testPool) conns() int { return len(p.srv.(*tcp.Server).All()) }
+
+func (p *testPool) authCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.authed
+}
+
+func (p *testPool) submitted(jobID int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, s := range p.submits {
+		if s.JobID == jobID {
+			n++
+		}
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func startMining(t *testing.T, pools ...sdk.Pool) {
+	t.Helper()
+	c := NewClient("alice")
+	c.SetSubmitInterval(time.Hour)
+	c.SetPools(pools...)
+	c.SetReconnect(sdk.ReconnectOptions{MinBackoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, ProbeInterval: 50 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Mine(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Mine should stop with the context, got %v", err)
+		}
+	})
+}
+
+// TestReconnectAfterRestart 服务端被杀掉后客户端退避重试，重启后重新认证，并在下一个任务上继续提交
+func TestReconnectAfterRestart(t *testing.T) {
+	addr := freeAddr(t)
+	pool := startPool(t, addr)
+	startMining(t, sdk.Pool{Addr: addr})
+
+	waitFor(t, "authorize", func() bool { return pool.authCount() == 1 })
+	pool.job(1)
+	waitFor(t, "submit on job 1", func() bool { return pool.submitted(1) == 1 })
+
+	pool.kill()
+	time.Sleep(150 * time.Millisecond) // 期间重连失败，进入退避
+	restarted := startPool(t, addr)
+	waitFor(t, "re-authorize", func() bool { return restarted.authCount() == 1 && restarted.conns() == 1 })
+	if n := restarted.submitted(1); n != 0 {
+		t.Fatalf("should not submit the stale job after reconnecting, got %d", n)
+	}
+	restarted.job(2)
+	waitFor(t, "submit on job 2", func() bool { return restarted.submitted(2) == 1 })
+}
@@ -0,0 +1,223 @@
+package harness
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+// Client 走真实 tcp 连接的脚本化客户端：后台协程读取帧，任务进入队列，响应按请求 id 分发
+type Client struct {
+	Username string
+
+	h    *Harness
+	conn *tcp.TcpConn
+	wmu  sync.Mutex // 串行化写帧，允许并发提交
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan protocol.Response
+
+	jobs   chan protocol.JobParams
+	notes  chan protocol.Request // 任务之外的服务端通知，如 client.reconnect
+	closed chan struct{}
+	err    error
+}
+
+// Connect 建立连接并完成认证，失败时终止测试
+func (h *Harness) Connect(username string) *Client {
+	h.T.Helper()
+	c, resp, err := h.Dial(username)
+	if err != nil {
+		h.T.Fatalf("harness: connect %s: %v", username, err)
+	}
+	if !resp.Result {
+		h.T.Fatalf("harness: authorize %s rejected: %s", username, ErrorOf(resp))
+	}
+	return c
+}
+
+// Dial 建立连接并发送认证请求，返回认证响应；认证被拒时服务端随后会断开连接
+func (h *Harness) Dial(username string) (*Client, protocol.Response, error) {
+	raw, err := net.DialTimeout("tcp", h.Addr, DefaultTimeout)
+	if err != nil {
+		return nil, protocol.Response{}, err
+	}
+	c := &Client{
+		Username: username,
+		h:        h,
+		conn:     tcp.NewConn(raw),
+		nextID:   1,
+		pending:  make(map[int]chan protocol.Response),
+		jobs:     make(chan protocol.JobParams, 64),
+		notes:    make(chan protocol.Request, 16),
+		closed:   make(chan struct{}),
+	}
+	h.T.Cleanup(c.Close)
+	go c.readLoop()
+	resp, err := c.call("authorize", protocol.AuthorizeParams{Username: username})
+	return c, resp, err
+}
+
+func (c *Client) readLoop() {
+	defer close(c.closed)
+	for {
+		f, err := c.conn.ReadFrame()
+		if err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			return
+		}
+		if f.GetOpCode() == kupool.OpClose {
+			c.mu.Lock()
+			c.err = errors.New("closed by server: " + string(f.GetPayload()))
+			c.mu.Unlock()
+			return
+		}
+		if f.GetOpCode() != kupool.OpBinary {
+			continue
+		}
+		var req protocol.Request
+		if protocol.Decode(f.GetPayload(), &req) == nil && req.Method == "job" {
+			var p protocol.JobParams
+			_ = protocol.Decode(req.Params, &p)
+			select {
+			case c.jobs <- p:
+			default:
+				// 积压的任务过多时丢弃最旧的一个
+				<-c.jobs
+				c.jobs <- p
+			}
+			continue
+		}
+		if req.Method != "" {
+			select {
+			case c.notes <- req:
+			default:
+			}
+			continue
+		}
+		var resp protocol.Response
+		if protocol.Decode(f.GetPayload(), &resp) != nil {
+			continue
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[resp.ID]
+		delete(c.pending, resp.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// call 发送请求并等待同 id 的响应
+func (c *Client) call(method string, params interface{}) (protocol.Response, error) {
+	raw, err := protocol.Encode(params)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	ch := make(chan protocol.Response, 1)
+	c.mu.Lock()
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+	data, _ := protocol.Encode(protocol.Request{ID: &id, Method: method, Params: raw})
+	c.wmu.Lock()
+	err = c.conn.WriteFrame(kupool.OpBinary, data)
+	c.wmu.Unlock()
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-c.closed:
+		return protocol.Response{}, c.Err()
+	case <-time.After(DefaultTimeout):
+		return protocol.Response{}, errors.New("timeout waiting for response to " + method)
+	}
+}
+
+// NextJob 等待下一个推送的任务
+func (c *Client) NextJob() protocol.JobParams {
+	c.h.T.Helper()
+	select {
+	case p := <-c.jobs:
+		return p
+	case <-c.closed:
+		c.h.T.Fatalf("harness: %s closed while waiting for job: %v", c.Username, c.Err())
+	case <-time.After(DefaultTimeout):
+		c.h.T.Fatalf("harness: %s timeout waiting for job", c.Username)
+	}
+	return protocol.JobParams{}
+}
+
+// NextNotification 等待下一个任务之外的服务端通知，并校验其 method
+func (c *Client) NextNotification(method string) protocol.Request {
+	c.h.T.Helper()
+	select {
+	case req := <-c.notes:
+		if req.Method != method {
+			c.h.T.Fatalf("harness: %s expect %s notification, got %s", c.Username, method, req.Method)
+		}
+		return req
+	case <-c.closed:
+		c.h.T.Fatalf("harness: %s closed while waiting for %s: %v", c.Username, method, c.Err())
+	case <-time.After(DefaultTimeout):
+		c.h.T.Fatalf("harness: %s timeout waiting for %s", c.Username, method)
+	}
+	return protocol.Request{}
+}
+
+// Submit 以正确结果提交 job
+func (c *Client) Submit(job protocol.JobParams, clientNonce string) protocol.Response {
+	c.h.T.Helper()
+	return c.SubmitResult(job.JobID, clientNonce, Result(job.ServerNonce, clientNonce))
+}
+
+// SubmitResult 以任意结果提交，用于构造错误用例
+func (c *Client) SubmitResult(jobID int, clientNonce, result string) protocol.Response {
+	c.h.T.Helper()
+	resp, err := c.call("submit", protocol.SubmitParams{JobID: jobID, ClientNonce: clientNonce, Result: result})
+	if err != nil {
+		c.h.T.Fatalf("harness: %s submit: %v", c.Username, err)
+	}
+	return resp
+}
+
+// Closed 服务端断开或 Close 后关闭
+func (c *Client) Closed() <-chan struct{} { return c.closed }
+
+// Err 读循环退出的原因
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close 关闭连接，可重复调用
+func (c *Client) Close() { _ = c.conn.Close() }
+
+// Result 计算 SHA256(server_nonce + client_nonce)
+func Result(serverNonce, clientNonce string) string {
+	h := sha256.Sum256([]byte(serverNonce + clientNonce))
+	return hex.EncodeToString(h[:])
+}
+
+// ErrorOf 返回响应中的错误信息，成功时为空
+func ErrorOf(resp protocol.Response) string {
+	if resp.Error == nil {
+		return ""
+	}
+	return *resp.Error
+}
@@ -0,0 +1,229 @@
+// Package harness 在进程内启动完整的 AppServer（随机端口、内存统计与内存队列、clock.Fake），
+// 通过真实 tcp 连接驱动脚本化客户端，对响应、事件与最终统计计数做端到端断言
+package harness
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/events"
+	"github.com/JellyTony/kupool/mq"
+	"github.com/JellyTony/kupool/stats"
+)
+
+// DefaultTimeout 等待响应、任务、事件与统计落库的真实时间上限
+const DefaultTimeout = 3 * time.Second
+
+// Options 服务端配置，零值使用下列默认值
+type Options struct {
+	Interval      time.Duration // 任务轮换间隔，默认 1 分钟
+	Expire        time.Duration // 任务过期时间，默认 0（不过期）
+	HistoryWindow time.Duration // 任务历史保留时长，默认 1 小时
+	RateLimit     *server.RateLimitConfig
+	BanPolicy     *server.BanPolicy
+	Consumer      server.ConsumerOptions
+	QueueSize     int                     // 内存队列容量，默认 1024
+	Setup         func(*server.AppServer) // Start 之前的额外配置
+}
+
+// Harness 一个运行中的 AppServer 及其依赖；测试结束时自动关闭
+type Harness struct {
+	T     testing.TB
+	App   *server.AppServer
+	Clock *clock.Fake
+	Store *stats.MemoryStore
+	Queue *mq.MemoryQueue
+	Addr  string
+
+	opts Options
+
+	mu     sync.Mutex
+	events []events.Envelope
+	notify chan struct{}
+}
+
+// Start 在 127.0.0.1 的随机端口启动 AppServer，返回时首个任务已生成
+func Start(t testing.TB, opts Options) *Harness {
+	t.Helper()
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.HistoryWindow <= 0 {
+		opts.HistoryWindow = time.Hour
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+	opts.Consumer = withConsumerDefaults(opts.Consumer)
+
+	clk := clock.NewFake(time.Time{})
+	store := stats.NewMemoryStore()
+	store.SetClock(clk)
+	queue := mq.NewMemoryQueue(opts.QueueSize)
+	evts, err := queue.SubscribeEvents("#")
+	if err != nil {
+		t.Fatalf("harness: subscribe events: %v", err)
+	}
+
+	app := server.NewAppServer("127.0.0.1:0", store, store, queue, opts.Interval, opts.Expire, opts.HistoryWindow)
+	app.SetClock(clk)
+	app.SetConsumerOptions(opts.Consumer)
+	if opts.RateLimit != nil {
+		if err := app.SetRateLimit(*opts.RateLimit); err != nil {
+			t.Fatalf("harness: rate limit: %v", err)
+		}
+	}
+	if opts.BanPolicy != nil {
+		app.SetBanPolicy(*opts.BanPolicy)
+	}
+	if opts.Setup != nil {
+		opts.Setup(app)
+	}
+
+	h := &Harness{T: t, App: app, Clock: clk, Store: store, Queue: queue, opts: opts, notify: make(chan struct{}, 1)}
+	go h.collect(evts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startErr := make(chan error, 1)
+	go func() { startErr <- app.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		_ = app.Shutdown(context.Background())
+	})
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		select {
+		case err := <-startErr:
+			t.Fatalf("harness: server exited: %v", err)
+		default:
+		}
+		// 首个任务在轮换 ticker 创建之后生成，此后 Rotate 推进时钟一定会触发轮换
+		if addr := app.Addr(); addr != nil {
+			if id, _ := app.CurrentJob(); id > 0 {
+				h.Addr = addr.String()
+				return h
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("harness: server did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func withConsumerDefaults(o server.ConsumerOptions) server.ConsumerOptions {
+	if o.Workers <= 0 {
+		o.Workers = server.DefaultStatsWorkers
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = server.DefaultStatsBatchSize
+	}
+	if o.BatchWindow <= 0 {
+		o.BatchWindow = server.DefaultStatsBatchWindow
+	}
+	return o
+}
+
+// Interval 任务轮换间隔
+func (h *Harness) Interval() time.Duration { return h.opts.Interval }
+
+// Advance 推进时钟；跨过轮换间隔时会触发任务轮换
+func (h *Harness) Advance(d time.Duration) { h.Clock.Advance(d) }
+
+// Rotate 推进一个轮换间隔，触发一次任务轮换并广播给所有会话
+func (h *Harness) Rotate() { h.Clock.Advance(h.opts.Interval) }
+
+// Job 当前任务
+func (h *Harness) Job() (jobID int, serverNonce string) { return h.App.CurrentJob() }
+
+// collect 持续收集事件，避免内存队列在订阅者缓冲满时丢弃
+func (h *Harness) collect(ch <-chan events.Envelope) {
+	for e := range ch {
+		h.mu.Lock()
+		h.events = append(h.events, e)
+		h.mu.Unlock()
+		select {
+		case h.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Events 返回目前收到的事件，kinds 非空时只返回这些类型
+func (h *Harness) Events(kinds ...events.Kind) []events.Envelope {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []events.Envelope
+	for _, e := range h.events {
+		if len(kinds) == 0 || containsKind(kinds, e.Kind) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func containsKind(kinds []events.Kind, k events.Kind) bool {
+	for _, x := range kinds {
+		if x == k {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitEvents 等待至少 n 个 kind 类型的事件并返回全部该类型事件
+func (h *Harness) WaitEvents(kind events.Kind, n int) []events.Envelope {
+	h.T.Helper()
+	timeout := time.After(DefaultTimeout)
+	for {
+		if got := h.Events(kind); len(got) >= n {
+			return got
+		}
+		select {
+		case <-h.notify:
+		case <-timeout:
+			h.T.Fatalf("harness: expect %d %s events, got %d", n, kind, len(h.Events(kind)))
+		}
+	}
+}
+
+// ExpectCount 等待 username 在 minute 所在分钟的提交计数达到 want。
+// 统计消费者按批次窗口写入，等待期间每次推进一个批次窗口的时钟
+func (h *Harness) ExpectCount(username string, minute time.Time, want int) {
+	h.T.Helper()
+	got := h.waitStat(want, func() (int, error) { return h.Store.Get(username, minute) })
+	if got != want {
+		h.T.Fatalf("harness: %s submissions at %s: expect %d, got %d", username, minute.Truncate(time.Minute).Format(time.RFC3339), want, got)
+	}
+}
+
+// ExpectTotal 等待全部用户在 [start, end] 内的提交总数达到 want
+func (h *Harness) ExpectTotal(start, end time.Time, want int) {
+	h.T.Helper()
+	got := h.waitStat(want, func() (int, error) {
+		return h.Store.GetTotalSubmissions(start, end, server.GranularityMinute)
+	})
+	if got != want {
+		h.T.Fatalf("harness: total submissions: expect %d, got %d", want, got)
+	}
+}
+
+func (h *Harness) waitStat(want int, get func() (int, error)) int {
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		got, err := get()
+		if err != nil {
+			h.T.Fatalf("harness: read stats: %v", err)
+		}
+		if got >= want || time.Now().After(deadline) {
+			return got
+		}
+		h.Clock.Advance(h.opts.Consumer.BatchWindow)
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,214 @@
+package harness
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/events"
+	"github.com/JellyTony/kupool/protocol"
+)
+
+// TestEndToEnd 多个客户端经过两轮任务轮换提交，覆盖正确、错误、重复、过频、旧任务与未知任务，
+// 最后核对事件与统计计数
+func TestEndToEnd(t *testing.T) {
+	h := Start(t, Options{})
+	start := h.Clock.Now()
+	const n = 3
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = h.Connect("miner" + strconv.Itoa(i))
+	}
+
+	h.Rotate()
+	first := make([]int, n)
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			job := c.NextJob()
+			first[i] = job.JobID
+			if r := c.Submit(job, "a"); !r.Result {
+				t.Errorf("%s: valid share rejected: %s", c.Username, ErrorOf(r))
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	for _, id := range first[1:] {
+		if id != first[0] {
+			t.Fatal("all sessions receive the same broadcast job")
+		}
+	}
+
+	c0 := clients[0]
+	job, _ := h.Job()
+	if r := c0.Submit(currentJob(h), "b"); ErrorOf(r) != server.ErrSubmitTooFrequent.Error() {
+		t.Fatalf("expect rate limit within the same second, got %+v", r)
+	}
+	h.Advance(time.Second)
+	if r := c0.SubmitResult(job, "c", "deadbeef"); ErrorOf(r) != "Invalid result" {
+		t.Fatalf("expect Invalid result, got %+v", r)
+	}
+	// 无效与重复的提交同样消耗配额
+	h.Advance(time.Second)
+	if r := c0.Submit(currentJob(h), "a"); ErrorOf(r) != server.ErrDuplicateSubmission.Error() {
+		t.Fatalf("expect duplicate, got %+v", r)
+	}
+	h.Advance(time.Second)
+	if r := c0.Submit(currentJob(h), "d"); !r.Result {
+		t.Fatalf("second share: %s", ErrorOf(r))
+	}
+
+	oldJob := currentJob(h)
+	h.Rotate()
+	for _, c := range clients {
+		if next := c.NextJob(); next.JobID != oldJob.JobID+1 {
+			t.Fatalf("%s: expect job %d, got %d", c.Username, oldJob.JobID+1, next.JobID)
+		}
+	}
+	// 旧任务在保留期内按它自己的 server_nonce 校验
+	if r := clients[1].Submit(oldJob, "old"); !r.Result {
+		t.Fatalf("old job share: %s", ErrorOf(r))
+	}
+	if r := clients[2].SubmitResult(oldJob.JobID+100, "x", "00"); ErrorOf(r) != "Task does not exist" {
+		t.Fatalf("expect Task does not exist, got %+v", r)
+	}
+
+	accepted := h.WaitEvents(events.KindShareAccepted, n+2)
+	if len(accepted) != n+2 {
+		t.Fatalf("expect %d accepted events, got %d", n+2, len(accepted))
+	}
+	if got := len(h.WaitEvents(events.KindShareRejected, 4)); got != 4 {
+		t.Fatalf("expect 4 rejected events, got %d", got)
+	}
+	if got := len(h.WaitEvents(events.KindSessionOpened, n)); got != n {
+		t.Fatalf("expect %d session.opened, got %d", n, got)
+	}
+
+	// 首轮在第 1 分钟，第二份与旧任务提交分别在第 1、2 分钟
+	firstMinute := start.Add(h.Interval())
+	h.ExpectCount("miner0", firstMinute, 2)
+	h.ExpectCount("miner2", firstMinute, 1)
+	h.ExpectCount("miner1", firstMinute.Add(h.Interval()), 1)
+	h.ExpectTotal(start, h.Clock.Now(), n+2)
+}
+
+// currentJob 服务端当前任务，供不依赖推送顺序的断言使用
+func currentJob(h *Harness) protocol.JobParams {
+	id, nonce := h.Job()
+	return protocol.JobParams{JobID: id, ServerNonce: nonce}
+}
+
+// TestBannedMinerDisconnected 连续提交错误结果的矿工被封禁并断开，重新认证被拒绝；
+// 同一 IP 上的正常矿工拒绝占比低于阈值，不受影响
+func TestBannedMinerDisconnected(t *testing.T) {
+	policy := server.BanPolicy{Enabled: true, Window: time.Minute, MinRejects: 3, MaxRejectRatio: 0.6, BaseDuration: time.Hour, MaxDuration: time.Hour, ForgiveAfter: time.Hour}
+	h := Start(t, Options{BanPolicy: &policy})
+	bad := h.Connect("cheater")
+	good := h.Connect("honest")
+	h.Rotate()
+	job := bad.NextJob()
+	_ = good.NextJob()
+	for i := 0; i < 3; i++ {
+		h.Advance(time.Second)
+		if r := good.Submit(job, "g"+strconv.Itoa(i)); !r.Result {
+			t.Fatalf("honest share rejected: %s", ErrorOf(r))
+		}
+		_ = bad.SubmitResult(job.JobID, strconv.Itoa(i), "deadbeef")
+	}
+	// 断开延迟到拒绝响应写出之后
+	h.Advance(time.Second)
+	select {
+	case <-bad.Closed():
+	case <-time.After(DefaultTimeout):
+		t.Fatal("banned miner should be disconnected")
+	}
+	_, resp, err := h.Dial("cheater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result || !strings.HasPrefix(ErrorOf(resp), server.ErrBanned.Error()) {
+		t.Fatalf("banned account must not authorize, got %+v", resp)
+	}
+	if r := good.Submit(job, "after"); !r.Result {
+		t.Fatalf("other miners unaffected: %s", ErrorOf(r))
+	}
+	if got := h.WaitEvents(events.KindSessionClosed, 1); len(got) != 1 || got[0].SessionClosed.Username != "cheater" {
+		t.Fatalf("expect only the cheater closed, got %+v", got)
+	}
+}
+
+// TestGracefulDrain 关闭时先停止接受连接并通知重连，宽限期内的提交照常处理并计入统计，
+// 客户端全部断开后立即完成关闭
+func TestGracefulDrain(t *testing.T) {
+	h := Start(t, Options{Setup: func(app *server.AppServer) {
+		app.SetDrainOptions(server.DrainOptions{Grace: DefaultTimeout, ReconnectHost: "pool2:8080", ReconnectDelay: 1500 * time.Millisecond})
+	}})
+	leaving := h.Connect("leaving")
+	staying := h.Connect("staying")
+	h.Rotate()
+	job := leaving.NextJob()
+	_ = staying.NextJob()
+
+	done := make(chan struct{})
+	go func() {
+		_ = h.App.Shutdown(context.Background())
+		close(done)
+	}()
+	for _, c := range []*Client{leaving, staying} {
+		var p protocol.ReconnectParams
+		if err := protocol.Decode(c.NextNotification("client.reconnect").Params, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Host != "pool2:8080" || p.Wait != 2 {
+			t.Fatalf("unexpected reconnect params %+v", p)
+		}
+	}
+	if conn, err := net.DialTimeout("tcp", h.Addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("listener should be closed while draining")
+	}
+	leaving.Close()
+	if r := staying.Submit(job, "late"); !r.Result {
+		t.Fatalf("submit within the grace period rejected: %s", ErrorOf(r))
+	}
+	staying.Close()
+
+	select {
+	case <-done:
+	case <-time.After(DefaultTimeout):
+		t.Fatal("shutdown should finish once every client has left")
+	}
+	if st := h.App.Status(); st.Notified != 2 || st.ForcedClose != 0 || !st.ServerClosed {
+		t.Fatalf("unexpected shutdown status %+v", st)
+	}
+	if got, _ := h.Store.Get("staying", h.Clock.Now()); got != 1 {
+		t.Fatalf("share accepted while draining must be counted, got %d", got)
+	}
+}
+
+// TestDrainClosesStragglers 宽限期结束后仍未断开的连接在通知写出后被关闭
+func TestDrainClosesStragglers(t *testing.T) {
+	h := Start(t, Options{Setup: func(app *server.AppServer) {
+		app.SetDrainOptions(server.DrainOptions{Grace: 50 * time.Millisecond})
+	}})
+	c := h.Connect("stubborn")
+	if err := h.App.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.NextNotification("client.reconnect")
+	select {
+	case <-c.Closed():
+	case <-time.After(DefaultTimeout):
+		t.Fatal("straggler should be closed after the grace period")
+	}
+	if st := h.App.Status(); st.Notified != 1 || st.ForcedClose != 1 {
+		t.Fatalf("unexpected shutdown status %+v", st)
+	}
+}
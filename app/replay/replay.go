@@ -0,0 +1,332 @@
+// Package replay 把 recorder 录制的 trace 回放到服务端并比对响应。
+//
+// 每个录制连接各自建立一条新连接，按录制顺序发送 in 帧，并等待与 out 帧对应的实际帧：
+// 响应按请求 id 对应，任务推送按顺序对应，关闭帧对应关闭帧。新服务端的 job_id 与 server_nonce
+// 与录制时不同，因此提交会改写为对应的实时任务；录制时结果正确的提交按新的 server_nonce 重新计算，
+// 结果错误的提交保持错误
+package replay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/recorder"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+// DefaultTimeout 等待单个预期帧的默认上限，需覆盖服务端的任务轮换间隔
+const DefaultTimeout = time.Minute
+
+// Options 回放参数
+type Options struct {
+	Speed   float64       // 按录制间隔的倍速发送，<=0 时不等待原始间隔
+	Timeout time.Duration // 等待每个预期帧的上限，默认 DefaultTimeout
+}
+
+// Mismatch 一处与录制不一致的帧
+type Mismatch struct {
+	Conn     uint64
+	Channel  string
+	Index    int // 会话内的记录序号
+	Expected string
+	Got      string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("conn %d (%s) #%d: expected %s, got %s", m.Conn, m.Channel, m.Index, m.Expected, m.Got)
+}
+
+// Report 回放结果
+type Report struct {
+	Sessions   int
+	Sent       int
+	Matched    int
+	Mismatches []Mismatch
+}
+
+// OK 没有任何不一致
+func (r Report) OK() bool { return len(r.Mismatches) == 0 }
+
+// Run 并发回放 recs 中的全部会话到 addr，各会话保持录制时的相对起始时间
+func Run(ctx context.Context, addr string, recs []recorder.Record, opts Options) (Report, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	sessions := recorder.Sessions(recs)
+	if len(sessions) == 0 {
+		return Report{}, nil
+	}
+	origin := recs[0].Time
+	start := time.Now()
+
+	var (
+		mu     sync.Mutex
+		report = Report{Sessions: len(sessions)}
+		wg     sync.WaitGroup
+		errs   []error
+	)
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s recorder.Session) {
+			defer wg.Done()
+			r := &runner{sess: s, opts: opts, origin: origin, start: start}
+			err := r.run(ctx, addr)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Sent += r.sent
+			report.Matched += r.matched
+			report.Mismatches = append(report.Mismatches, r.mismatches...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("conn %d: %w", s.Conn, err))
+			}
+		}(s)
+	}
+	wg.Wait()
+	return report, errors.Join(errs...)
+}
+
+// frame 实际收到的帧
+type frame struct {
+	op      kupool.OpCode
+	payload []byte
+}
+
+type runner struct {
+	sess          recorder.Session
+	opts          Options
+	origin, start time.Time
+
+	conn    *tcp.TcpConn
+	frames  chan frame
+	readErr error
+	pending []frame // 已收到但尚未被对应的帧
+
+	jobs       map[int]protocol.JobParams // 录制 job_id -> 实时任务
+	nonces     map[int]string             // 录制 job_id -> 录制时的 server_nonce
+	sent       int
+	matched    int
+	mismatches []Mismatch
+}
+
+func (r *runner) run(ctx context.Context, addr string) error {
+	if err := r.sleepUntil(ctx, r.sess.Records[0].Time); err != nil {
+		return err
+	}
+	raw, err := net.DialTimeout("tcp", addr, r.opts.Timeout)
+	if err != nil {
+		return err
+	}
+	r.conn = tcp.NewConn(raw)
+	defer r.conn.Close()
+	r.frames = make(chan frame, 64)
+	r.jobs = make(map[int]protocol.JobParams)
+	r.nonces = make(map[int]string)
+	go r.readLoop()
+
+	for i, rec := range r.sess.Records {
+		switch rec.Dir {
+		case recorder.DirIn:
+			if err := r.sleepUntil(ctx, rec.Time); err != nil {
+				return err
+			}
+			if err := r.send(rec); err != nil {
+				// 服务端已断开，剩余的预期帧照常记为不一致
+				r.mismatch(i, describe(rec.OpCode, []byte(rec.Payload)), "<send failed: "+err.Error()+">")
+			}
+		case recorder.DirOut:
+			r.expect(ctx, i, rec)
+		}
+	}
+	return nil
+}
+
+// sleepUntil 按倍速等待到录制时间 t 对应的回放时刻
+func (r *runner) sleepUntil(ctx context.Context, t time.Time) error {
+	if r.opts.Speed <= 0 {
+		return ctx.Err()
+	}
+	at := r.start.Add(time.Duration(float64(t.Sub(r.origin)) / r.opts.Speed))
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *runner) readLoop() {
+	defer close(r.frames)
+	for {
+		f, err := r.conn.ReadFrame()
+		if err != nil {
+			r.readErr = err
+			return
+		}
+		r.frames <- frame{op: f.GetOpCode(), payload: f.GetPayload()}
+	}
+}
+
+func (r *runner) send(rec recorder.Record) error {
+	payload := []byte(rec.Payload)
+	if rec.OpCode == kupool.OpBinary {
+		payload = r.rewrite(payload)
+	}
+	r.sent++
+	return r.conn.WriteFrame(rec.OpCode, payload)
+}
+
+// rewrite 把提交中的录制 job_id 换成对应的实时任务，并按需重新计算结果
+func (r *runner) rewrite(payload []byte) []byte {
+	var req protocol.Request
+	if protocol.Decode(payload, &req) != nil || req.Method != "submit" {
+		return payload
+	}
+	var p protocol.SubmitParams
+	if protocol.Decode(req.Params, &p) != nil {
+		return payload
+	}
+	live, ok := r.jobs[p.JobID]
+	if !ok {
+		return payload
+	}
+	if p.Result == result(r.nonces[p.JobID], p.ClientNonce) {
+		p.Result = result(live.ServerNonce, p.ClientNonce)
+	}
+	p.JobID = live.JobID
+	params, err := protocol.Encode(p)
+	if err != nil {
+		return payload
+	}
+	req.Params = params
+	out, err := protocol.Encode(req)
+	if err != nil {
+		return payload
+	}
+	return out
+}
+
+// expect 等待与录制的 out 帧对应的实际帧并比对
+func (r *runner) expect(ctx context.Context, i int, rec recorder.Record) {
+	want := []byte(rec.Payload)
+	key := keyOf(rec.OpCode, want)
+	got, err := r.take(ctx, key)
+	if err != nil {
+		r.mismatch(i, describe(rec.OpCode, want), "<"+err.Error()+">")
+		return
+	}
+	if key == "job" {
+		r.mapJob(want, got.payload)
+	}
+	if !equal(rec.OpCode, want, got) {
+		r.mismatch(i, describe(rec.OpCode, want), describe(got.op, got.payload))
+		return
+	}
+	r.matched++
+}
+
+// take 取出第一个与 key 对应的帧，其余帧留待后续对应
+func (r *runner) take(ctx context.Context, key string) (frame, error) {
+	for j, f := range r.pending {
+		if keyOf(f.op, f.payload) == key {
+			r.pending = append(r.pending[:j], r.pending[j+1:]...)
+			return f, nil
+		}
+	}
+	timeout := time.After(r.opts.Timeout)
+	for {
+		select {
+		case f, ok := <-r.frames:
+			if !ok {
+				return frame{}, fmt.Errorf("connection closed: %v", r.readErr)
+			}
+			if keyOf(f.op, f.payload) == key {
+				return f, nil
+			}
+			r.pending = append(r.pending, f)
+		case <-timeout:
+			return frame{}, errors.New("timeout")
+		case <-ctx.Done():
+			return frame{}, ctx.Err()
+		}
+	}
+}
+
+func (r *runner) mapJob(recorded, live []byte) {
+	var want, got protocol.JobParams
+	if decodeJob(recorded, &want) != nil || decodeJob(live, &got) != nil {
+		return
+	}
+	r.jobs[want.JobID] = got
+	r.nonces[want.JobID] = want.ServerNonce
+}
+
+func (r *runner) mismatch(i int, expected, got string) {
+	r.mismatches = append(r.mismatches, Mismatch{Conn: r.sess.Conn, Channel: r.sess.Channel, Index: i, Expected: expected, Got: got})
+}
+
+// keyOf 帧的对应关系：任务推送、按 id 的响应、或者 opcode
+func keyOf(op kupool.OpCode, payload []byte) string {
+	if op != kupool.OpBinary {
+		return fmt.Sprintf("op:%d", op)
+	}
+	var req protocol.Request
+	if protocol.Decode(payload, &req) == nil && req.Method != "" {
+		return req.Method
+	}
+	var resp protocol.Response
+	if protocol.Decode(payload, &resp) == nil {
+		return fmt.Sprintf("response:%d", resp.ID)
+	}
+	return "binary"
+}
+
+// equal 任务推送的参数本就不同，不参与比对；响应比对结果与错误信息；其余帧比对原始内容
+func equal(op kupool.OpCode, want []byte, got frame) bool {
+	if op != got.op {
+		return false
+	}
+	switch key := keyOf(op, want); {
+	case key == "job":
+		return true
+	case strings.HasPrefix(key, "response:"):
+		var a, b protocol.Response
+		if protocol.Decode(want, &a) != nil || protocol.Decode(got.payload, &b) != nil {
+			return false
+		}
+		return a.Result == b.Result && errorOf(a) == errorOf(b)
+	}
+	return string(want) == string(got.payload)
+}
+
+func describe(op kupool.OpCode, payload []byte) string {
+	return fmt.Sprintf("op=%d %s", op, payload)
+}
+
+func decodeJob(payload []byte, p *protocol.JobParams) error {
+	var req protocol.Request
+	if err := protocol.Decode(payload, &req); err != nil {
+		return err
+	}
+	return protocol.Decode(req.Params, p)
+}
+
+func errorOf(resp protocol.Response) string {
+	if resp.Error == nil {
+		return ""
+	}
+	return *resp.Error
+}
+
+func result(serverNonce, clientNonce string) string {
+	h := sha256.Sum256([]byte(serverNonce + clientNonce))
+	return hex.EncodeToString(h[:])
+}
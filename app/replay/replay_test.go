@@ -0,0 +1,123 @@
+package replay
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/app/harness"
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/recorder"
+)
+
+// 放宽限速，回放时不依赖两次提交之间的时钟推进
+var relaxed = server.RateLimitConfig{Default: server.RatePolicy{Limit: 1000, Per: time.Second}}
+
+// record 在录制中的服务端上跑一段会话：正确、错误、重复与未知任务各一次
+func record(t *testing.T) []recorder.Record {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	rec, err := recorder.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := harness.Start(t, harness.Options{RateLimit: &relaxed, Setup: func(app *server.AppServer) {
+		if !app.SetRecorder(rec) {
+			t.Fatal("tcp server should support recording")
+		}
+	}})
+	alice := h.Connect("alice")
+	bob := h.Connect("bob")
+	h.Rotate()
+	job := alice.NextJob()
+	_ = bob.NextJob()
+	if r := alice.Submit(job, "a"); !r.Result {
+		t.Fatalf("valid share rejected: %s", harness.ErrorOf(r))
+	}
+	_ = alice.SubmitResult(job.JobID, "b", "deadbeef")
+	_ = alice.Submit(job, "a")
+	_ = bob.SubmitResult(job.JobID+100, "x", "00")
+	alice.Close()
+	bob.Close()
+
+	recs, err := recorder.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+// replayOn 回放到一个新的服务端，后台持续轮换任务以产生推送
+func replayOn(t *testing.T, recs []recorder.Record) Report {
+	h := harness.Start(t, harness.Options{RateLimit: &relaxed})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				h.Rotate()
+			}
+		}
+	}()
+	report, err := Run(context.Background(), h.Addr, recs, Options{Timeout: harness.DefaultTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	recs := record(t)
+	sessions := recorder.Sessions(recs)
+	if len(sessions) != 2 {
+		t.Fatalf("expect 2 sessions, got %d", len(sessions))
+	}
+	first := sessions[0].Records[0]
+	if first.Dir != recorder.DirIn || first.Channel != "" || sessions[0].Channel == "" {
+		t.Fatalf("authorize is recorded before the channel id is known: %+v", first)
+	}
+	outs := 0
+	for _, r := range recs {
+		if r.Dir == recorder.DirOut {
+			outs++
+		}
+	}
+
+	report := replayOn(t, recs)
+	if !report.OK() {
+		t.Fatalf("replay against an equivalent server should match: %v", report.Mismatches)
+	}
+	if report.Sessions != 2 || report.Matched != outs {
+		t.Fatalf("expect %d matched frames, got %+v", outs, report)
+	}
+}
+
+func TestReplayReportsDiff(t *testing.T) {
+	recs := record(t)
+	// 把 alice 第一次提交的录制响应改为失败，回放时应报告这一处差异
+	msg := "tampered"
+	tampered := -1
+	for i, r := range recs {
+		if r.Dir != recorder.DirOut || keyOf(r.OpCode, []byte(r.Payload)) != "response:2" {
+			continue
+		}
+		raw, _ := protocol.Encode(protocol.Response{ID: 2, Result: false, Error: &msg})
+		recs[i].Payload = string(raw)
+		tampered = i
+		break
+	}
+	if tampered < 0 {
+		t.Fatal("submit response not found in trace")
+	}
+	report := replayOn(t, recs)
+	if len(report.Mismatches) != 1 {
+		t.Fatalf("expect exactly one mismatch, got %v", report.Mismatches)
+	}
+	if m := report.Mismatches[0]; m.Conn != recs[tampered].Conn {
+		t.Fatalf("mismatch on wrong session: %v", m)
+	}
+}
@@ -4,9 +4,12 @@ import (
     "crypto/rand"
     "encoding/hex"
     "errors"
+    "fmt"
+    "net"
     "time"
 
     kupool "github.com/JellyTony/kupool"
+    "github.com/JellyTony/kupool/events"
     "github.com/JellyTony/kupool/logger"
     "github.com/JellyTony/kupool/protocol"
 )
@@ -20,6 +23,18 @@ func NewAcceptor(coord *Coordinator) *Acceptor {
 }
 
 func (a *Acceptor) Accept(conn kupool.Conn, timeout time.Duration) (string, error) {
+    remote := ""
+    if addr := conn.RemoteAddr(); addr != nil {
+        remote = addr.String()
+    }
+    remoteIP := remote
+    if host, _, err := net.SplitHostPort(remote); err == nil {
+        remoteIP = host
+    }
+    if b, banned := a.coord.bans.Check("", remoteIP, a.coord.clk.Now()); banned {
+        logger.WithFields(logger.Fields{"module":"app.acceptor","remote":remote,"until":b.Until}).Warn("rejected: ip banned")
+        return "", fmt.Errorf("%w until %s", ErrBanned, b.Until.Format(time.RFC3339))
+    }
     _ = conn.SetReadDeadline(time.Now().Add(timeout))
     frame, err := conn.ReadFrame()
     if err != nil {
@@ -46,26 +61,39 @@ func (a *Acceptor) Accept(conn kupool.Conn, timeout time.Duration) (string, erro
         logger.WithFields(logger.Fields{"module":"app.acceptor"}).Warn("unauthorized: empty username")
         return "", errors.New("unauthorized")
     }
+    if b, banned := a.coord.bans.Check(p.Username, "", a.coord.clk.Now()); banned {
+        logger.WithFields(logger.Fields{"module":"app.acceptor","username":p.Username,"until":b.Until}).Warn("rejected: account banned")
+        err := fmt.Errorf("%w until %s", ErrBanned, b.Until.Format(time.RFC3339))
+        msg := err.Error()
+        data, _ := protocol.Encode(protocol.Response{ID: *req.ID, Result: false, Error: &msg})
+        _ = conn.WriteFrame(kupool.OpBinary, data)
+        return "", err
+    }
     buf := make([]byte, 16)
     if _, err := rand.Read(buf); err != nil {
         return "", err
     }
     chID := hex.EncodeToString(buf)
-    a.coord.RegisterSession(chID, p.Username)
+    a.coord.registerSession(chID, p.Username, remoteIP)
     if a.coord.state != nil {
-        a.coord.mu.Lock()
-        // restore user state into session
+        // restore user state into session; 读库不持有 coord.mu，且不覆盖注册后已收到的更新任务
         latestJobID, latestNonce, lastSubmit, err := a.coord.state.LoadUserState(p.Username)
+        a.coord.mu.RLock()
         s := a.coord.sessions[chID]
-        if err == nil {
-            s.LatestJobID = latestJobID
-            s.LatestServerNonce = latestNonce
+        a.coord.mu.RUnlock()
+        if err == nil && s != nil {
+            s.mu.Lock()
+            if latestJobID > s.LatestJobID {
+                s.LatestJobID = latestJobID
+                s.LatestServerNonce = latestNonce
+            }
             s.LastSubmitAt = lastSubmit
+            s.mu.Unlock()
         }
         // used nonces restoration can be lazy; keep empty to avoid heavy load
-        a.coord.mu.Unlock()
     }
     logger.WithFields(logger.Fields{"module":"app.acceptor","username":p.Username,"channel_id":chID}).Info("authorized")
+    a.coord.emit(events.NewSessionOpened(a.coord.clk.Now(), events.SessionOpened{Username: p.Username, ChannelID: chID, RemoteAddr: remote}))
     resp := protocol.Response{ID: *req.ID, Result: true}
     data, _ := protocol.Encode(resp)
     _ = conn.WriteFrame(kupool.OpBinary, data)
@@ -13,11 +13,15 @@ import (
 
 type fakeStore struct{}
 func (f *fakeStore) Increment(string, time.Time) error { return nil }
+func (f *fakeStore) IncrementBy(string, time.Time, int) error { return nil }
+func (f *fakeStore) BatchIncrement([]StatDelta) error { return nil }
 func (f *fakeStore) Get(string, time.Time) (int, error) { return 0, nil }
 func (f *fakeStore) Close() error { return nil }
 type fakeMQ struct{}
 func (f *fakeMQ) Publish(evt events.SubmitEvent) error { return nil }
 func (f *fakeMQ) Subscribe() <-chan events.SubmitEvent { ch := make(chan events.SubmitEvent); close(ch); return ch }
+func (f *fakeMQ) PublishEvent(events.Envelope) error { return nil }
+func (f *fakeMQ) SubscribeEvents(...string) (<-chan events.Envelope, error) { ch := make(chan events.Envelope); close(ch); return ch, nil }
 func (f *fakeMQ) Close() error { return nil }
 
 type fakePusher struct{ last []byte }
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JellyTony/kupool/logger"
+)
+
+// BanKind 封禁对象类型
+type BanKind string
+
+const (
+	BanAccount BanKind = "account"
+	BanIP      BanKind = "ip"
+)
+
+// Ban 一条封禁记录。Until 之后不再拒绝连接，但记录保留到 Until+ForgiveAfter，
+// 期间再次违规按 Offences 升级封禁时长
+type Ban struct {
+	Kind      BanKind   `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	Offences  int       `json:"offences"`
+	CreatedAt time.Time `json:"created_at"`
+	Until     time.Time `json:"until"`
+}
+
+// Active 封禁在 now 时刻是否生效
+func (b Ban) Active(now time.Time) bool { return now.Before(b.Until) }
+
+// BanStore 由 StateStore 实现以持久化封禁，重启后恢复
+type BanStore interface {
+	SaveBan(b Ban) error
+	DeleteBan(kind BanKind, value string) error
+	LoadBans() ([]Ban, error)
+}
+
+// ErrBanned Acceptor 拒绝被封禁的账号或 IP
+var ErrBanned = errors.New("banned")
+
+// BanPolicy 自动封禁策略：窗口内拒绝次数不少于 MinRejects 且拒绝占比不低于 MaxRejectRatio 时封禁，
+// 首次封禁 BaseDuration，之后每次翻倍，最长 MaxDuration
+type BanPolicy struct {
+	Enabled        bool
+	Window         time.Duration
+	MinRejects     int
+	MaxRejectRatio float64
+	BaseDuration   time.Duration
+	MaxDuration    time.Duration
+	ForgiveAfter   time.Duration
+}
+
+func DefaultBanPolicy() BanPolicy {
+	return BanPolicy{
+		Enabled:        true,
+		Window:         time.Minute,
+		MinRejects:     20,
+		MaxRejectRatio: 0.8,
+		BaseDuration:   5 * time.Minute,
+		MaxDuration:    24 * time.Hour,
+		ForgiveAfter:   24 * time.Hour,
+	}
+}
+
+// score 近似滑动窗口的接受/拒绝计数：当前窗口加上按剩余比例折算的上一窗口
+type score struct {
+	start           time.Time
+	ok, bad         int
+	prevOk, prevBad int
+}
+
+func (s *score) roll(now time.Time, window time.Duration) {
+	switch elapsed := now.Sub(s.start); {
+	case elapsed >= 2*window:
+		*s = score{start: now}
+	case elapsed >= window:
+		s.prevOk, s.prevBad, s.ok, s.bad = s.ok, s.bad, 0, 0
+		s.start = s.start.Add(window)
+	}
+}
+
+func (s *score) add(now time.Time, window time.Duration, rejected bool) (ok, bad float64) {
+	s.roll(now, window)
+	if rejected {
+		s.bad++
+	} else {
+		s.ok++
+	}
+	weight := 1 - float64(now.Sub(s.start))/float64(window)
+	return float64(s.ok) + float64(s.prevOk)*weight, float64(s.bad) + float64(s.prevBad)*weight
+}
+
+type banKey struct {
+	kind  BanKind
+	value string
+}
+
+// BanManager 按会话、账号与 IP 统计拒绝占比并自动封禁；会话超限时封禁其账号
+type BanManager struct {
+	policy BanPolicy
+	store  BanStore
+	mu     sync.Mutex
+	bans   map[banKey]Ban
+	scores map[string]*score
+	calls  int
+}
+
+// NewBanManager store 为 nil 时封禁只保存在内存中
+func NewBanManager(policy BanPolicy, store BanStore) *BanManager {
+	return &BanManager{policy: policy, store: store, bans: make(map[banKey]Ban), scores: make(map[string]*score)}
+}
+
+// Restore 从 BanStore 恢复封禁记录
+func (m *BanManager) Restore() error {
+	if m.store == nil {
+		return nil
+	}
+	bans, err := m.store.LoadBans()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range bans {
+		m.bans[banKey{b.Kind, b.Value}] = b
+	}
+	return nil
+}
+
+// Check 返回 username 或 ip 在 now 时刻生效的封禁，空值不检查
+func (m *BanManager) Check(username, ip string, now time.Time) (Ban, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range []banKey{{BanIP, ip}, {BanAccount, username}} {
+		if k.value == "" {
+			continue
+		}
+		if b, ok := m.bans[k]; ok && b.Active(now) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Record 记录会话的一次提交结果，返回因此新生效的封禁
+func (m *BanManager) Record(s *Session, rejected bool, reason string, now time.Time) []Ban {
+	if !m.policy.Enabled {
+		return nil
+	}
+	m.mu.Lock()
+	forgiven := m.sweep(now)
+	subjects := []struct {
+		key    string
+		target banKey
+	}{
+		{"session:" + s.ChannelID, banKey{BanAccount, s.Username}},
+		{"account:" + s.Username, banKey{BanAccount, s.Username}},
+		{"ip:" + s.RemoteIP, banKey{BanIP, s.RemoteIP}},
+	}
+	var issued []Ban
+	for _, sub := range subjects {
+		if sub.target.value == "" {
+			continue
+		}
+		sc, ok := m.scores[sub.key]
+		if !ok {
+			sc = &score{start: now}
+			m.scores[sub.key] = sc
+		}
+		good, bad := sc.add(now, m.policy.Window, rejected)
+		if !rejected || bad < float64(m.policy.MinRejects) || bad/(good+bad) < m.policy.MaxRejectRatio {
+			continue
+		}
+		delete(m.scores, sub.key)
+		if b, ok := m.bans[sub.target]; ok && b.Active(now) {
+			continue
+		}
+		issued = append(issued, m.ban(sub.target, fmt.Sprintf("%s reject ratio %.2f: %s", sub.key, bad/(good+bad), reason), now))
+	}
+	m.mu.Unlock()
+	// 存储读写放在锁外，避免阻塞其他提交与认证时的封禁检查
+	for _, k := range forgiven {
+		m.forget(k)
+	}
+	for _, b := range issued {
+		m.persist(b)
+	}
+	return issued
+}
+
+// ban 按历史违规次数升级时长，调用方持有 mu
+func (m *BanManager) ban(k banKey, reason string, now time.Time) Ban {
+	offences := 1
+	if prev, ok := m.bans[k]; ok && now.Sub(prev.Until) < m.policy.ForgiveAfter {
+		offences = prev.Offences + 1
+	}
+	d := m.policy.BaseDuration
+	for i := 1; i < offences && d < m.policy.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > m.policy.MaxDuration {
+		d = m.policy.MaxDuration
+	}
+	b := Ban{Kind: k.kind, Value: k.value, Reason: reason, Offences: offences, CreatedAt: now, Until: now.Add(d)}
+	m.bans[k] = b
+	return b
+}
+
+func (m *BanManager) persist(b Ban) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.SaveBan(b); err != nil {
+		logger.WithFields(logger.Fields{"module": "app.ban", "kind": b.Kind, "value": b.Value}).Warnf("save ban failed: %v", err)
+	}
+}
+
+func (m *BanManager) forget(k banKey) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.DeleteBan(k.kind, k.value); err != nil {
+		logger.WithFields(logger.Fields{"module": "app.ban", "kind": k.kind, "value": k.value}).Warnf("delete ban failed: %v", err)
+	}
+}
+
+// sweep 定期清理空闲的计分与已过宽恕期的封禁记录，返回需要从存储中删除的封禁；调用方持有 mu
+func (m *BanManager) sweep(now time.Time) []banKey {
+	if m.calls++; m.calls%sweepEvery != 0 {
+		return nil
+	}
+	for k, sc := range m.scores {
+		if now.Sub(sc.start) >= 2*m.policy.Window {
+			delete(m.scores, k)
+		}
+	}
+	var forgiven []banKey
+	for k, b := range m.bans {
+		if now.Sub(b.Until) >= m.policy.ForgiveAfter {
+			delete(m.bans, k)
+			forgiven = append(forgiven, k)
+		}
+	}
+	return forgiven
+}
+
+// List 返回 now 时刻生效的封禁，按到期时间排序
+func (m *BanManager) List(now time.Time) []Ban {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Ban, 0, len(m.bans))
+	for _, b := range m.bans {
+		if b.Active(now) {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Until.Before(out[j].Until) })
+	return out
+}
+
+// Lift 解除封禁并清空违规次数，记录不存在时返回 false
+func (m *BanManager) Lift(kind BanKind, value string) (bool, error) {
+	k := banKey{kind, value}
+	m.mu.Lock()
+	_, ok := m.bans[k]
+	delete(m.bans, k)
+	m.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if m.store != nil {
+		if err := m.store.DeleteBan(kind, value); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Forget 会话断开时释放其计分
+func (m *BanManager) Forget(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.scores, "session:"+s.ChannelID)
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+func testBanPolicy() BanPolicy {
+	return BanPolicy{Enabled: true, Window: time.Minute, MinRejects: 3, MaxRejectRatio: 0.5, BaseDuration: time.Minute, MaxDuration: 3 * time.Minute, ForgiveAfter: time.Hour}
+}
+
+func TestBanEscalation(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	m := NewBanManager(testBanPolicy(), nil)
+	s := &Session{ChannelID: "c1", Username: "u1"}
+	offend := func() Ban {
+		t.Helper()
+		var issued []Ban
+		for i := 0; i < 3; i++ {
+			issued = append(issued, m.Record(s, true, "Invalid result", clk.Now())...)
+		}
+		if len(issued) != 1 || issued[0].Kind != BanAccount {
+			t.Fatalf("expect one account ban, got %+v", issued)
+		}
+		return issued[0]
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		b := offend()
+		if b.Offences != i+1 || b.Until.Sub(clk.Now()) != want {
+			t.Fatalf("offence %d: expect %v, got %d %v", i+1, want, b.Offences, b.Until.Sub(clk.Now()))
+		}
+		if _, banned := m.Check("u1", "", clk.Now()); !banned {
+			t.Fatal("ban should be active")
+		}
+		clk.Advance(want)
+		if _, banned := m.Check("u1", "", clk.Now()); banned {
+			t.Fatal("ban should have expired")
+		}
+		// 跳过滑动窗口，避免上一轮的拒绝计入下一轮
+		clk.Advance(2 * time.Minute)
+	}
+	// 超过宽恕期后违规次数清零
+	clk.Advance(time.Hour)
+	if b := offend(); b.Offences != 1 {
+		t.Fatalf("expect offences reset after forgive period, got %d", b.Offences)
+	}
+}
+
+func TestBanRequiresRejectRatio(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	m := NewBanManager(testBanPolicy(), nil)
+	s := &Session{ChannelID: "c1", Username: "u1", RemoteIP: "10.0.0.1"}
+	for i := 0; i < 10; i++ {
+		m.Record(s, false, "", clk.Now())
+		m.Record(s, false, "", clk.Now())
+		if bans := m.Record(s, true, "Duplicate submission", clk.Now()); len(bans) != 0 {
+			t.Fatalf("round %d: ratio below threshold must not ban", i)
+		}
+	}
+	// 同一 IP 下换账号不影响 IP 维度的累计
+	other := &Session{ChannelID: "c2", Username: "u2", RemoteIP: "10.0.0.1"}
+	m = NewBanManager(testBanPolicy(), nil)
+	m.Record(s, true, "x", clk.Now())
+	m.Record(other, true, "x", clk.Now())
+	bans := m.Record(&Session{ChannelID: "c3", Username: "u3", RemoteIP: "10.0.0.1"}, true, "x", clk.Now())
+	if len(bans) != 1 || bans[0].Kind != BanIP || bans[0].Value != "10.0.0.1" {
+		t.Fatalf("expect ip ban, got %+v", bans)
+	}
+	if _, banned := m.Check("u9", "10.0.0.1", clk.Now()); !banned {
+		t.Fatal("any account from a banned ip is rejected")
+	}
+}
+
+type memBanStore struct{ bans map[string]Ban }
+
+func (s *memBanStore) SaveBan(b Ban) error { s.bans[string(b.Kind)+b.Value] = b; return nil }
+func (s *memBanStore) DeleteBan(kind BanKind, value string) error {
+	delete(s.bans, string(kind)+value)
+	return nil
+}
+func (s *memBanStore) LoadBans() ([]Ban, error) {
+	var out []Ban
+	for _, b := range s.bans {
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func TestBanRestoreAndLift(t *testing.T) {
+	store := &memBanStore{bans: map[string]Ban{}}
+	now := time.Now()
+	m := NewBanManager(testBanPolicy(), store)
+	s := &Session{ChannelID: "c1", Username: "u1"}
+	for i := 0; i < 3; i++ {
+		m.Record(s, true, "Invalid result", now)
+	}
+	m = NewBanManager(testBanPolicy(), store)
+	if err := m.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if list := m.List(now); len(list) != 1 || list[0].Value != "u1" {
+		t.Fatalf("restored bans mismatch: %+v", list)
+	}
+	if ok, _ := m.Lift(BanAccount, "u1"); !ok || len(store.bans) != 0 {
+		t.Fatal("lift should delete the persisted ban")
+	}
+	if ok, _ := m.Lift(BanAccount, "u1"); ok {
+		t.Fatal("second lift reports missing ban")
+	}
+}
+
+// slowBanStore DeleteBan 阻塞到 release 关闭
+type slowBanStore struct {
+	memBanStore
+	deleting chan BanKind
+	release  chan struct{}
+}
+
+func (s *slowBanStore) DeleteBan(kind BanKind, value string) error {
+	s.deleting <- kind
+	<-s.release
+	return errors.New("store unavailable")
+}
+
+// TestBanSweepDeletesOutsideLock 清理过期封禁时的存储删除不持有锁，不阻塞并发的封禁检查
+func TestBanSweepDeletesOutsideLock(t *testing.T) {
+	store := &slowBanStore{memBanStore: memBanStore{bans: map[string]Ban{}}, deleting: make(chan BanKind, 1), release: make(chan struct{})}
+	now := time.Now()
+	m := NewBanManager(testBanPolicy(), store)
+	s := &Session{ChannelID: "c1", Username: "u1"}
+	for i := 0; i < 3; i++ {
+		m.Record(s, true, "Invalid result", now)
+	}
+	later := now.Add(2 * time.Hour)
+	m.mu.Lock()
+	m.calls = sweepEvery - 1
+	m.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Record(&Session{ChannelID: "c2", Username: "u2"}, false, "", later)
+	}()
+	select {
+	case <-store.deleting:
+	case <-time.After(3 * time.Second):
+		t.Fatal("forgiven ban should be deleted from the store")
+	}
+	checked := make(chan struct{})
+	go func() {
+		m.Check("u1", "", later)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Check blocked behind the store delete")
+	}
+	close(store.release)
+	<-done
+	if list := m.List(later); len(list) != 0 {
+		t.Fatalf("forgiven ban should be gone, got %+v", list)
+	}
+}
+
+// kickChannel 只实现 Close，其余方法不会被调用
+type kickChannel struct {
+	kupool.Channel
+	closed *int32
+}
+
+func (c kickChannel) Close() error { atomic.AddInt32(c.closed, 1); return nil }
+
+type kickPusher struct {
+	nopPusher
+	closed int32
+}
+
+func (p *kickPusher) Get(id string) (kupool.Channel, bool) {
+	return kickChannel{closed: &p.closed}, true
+}
+
+// TestBannedAccountKickedAndRejected 超限后断开该账号的全部会话，重新认证被拒绝
+func TestBannedAccountKickedAndRejected(t *testing.T) {
+	srv := &kickPusher{}
+	clk := clock.NewFake(time.Time{})
+	coord := NewCoordinator(srv, &fakeStore{}, nil, &fakeMQ{}, time.Second, 0, time.Hour)
+	coord.SetClock(clk)
+	coord.SetBanPolicy(testBanPolicy())
+	coord.RegisterSession("c1", "u1")
+	coord.RegisterSession("c2", "u1")
+	coord.RegisterSession("c3", "u2")
+	coord.recordOutcome("c1", errors.New("Task does not exist"))
+	for i := 0; i < 3; i++ {
+		coord.recordOutcome("c1", errInvalidResult)
+	}
+	if _, banned := coord.bans.Check("u1", "", clk.Now()); !banned {
+		t.Fatal("expect u1 banned")
+	}
+	clk.Advance(disconnectDelay - time.Millisecond)
+	if atomic.LoadInt32(&srv.closed) != 0 {
+		t.Fatal("close is delayed so the reject response can be written")
+	}
+	clk.Advance(time.Millisecond)
+	if n := atomic.LoadInt32(&srv.closed); n != 2 {
+		t.Fatalf("expect both u1 sessions closed, got %d", n)
+	}
+
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	resp := make(chan protocol.Response, 1)
+	go func() {
+		id := 1
+		p, _ := protocol.Encode(protocol.AuthorizeParams{Username: "u1"})
+		raw, _ := protocol.Encode(protocol.Request{ID: &id, Method: "authorize", Params: p})
+		_ = tcp.WriteFrame(c, kupool.OpBinary, raw)
+		f, err := tcp.NewConn(c).ReadFrame()
+		var r protocol.Response
+		if err == nil {
+			_ = protocol.Decode(f.GetPayload(), &r)
+		}
+		resp <- r
+	}()
+	if _, err := NewAcceptor(coord).Accept(tcp.NewConn(s), time.Second); !errors.Is(err, ErrBanned) {
+		t.Fatalf("expect ErrBanned, got %v", err)
+	}
+	if r := <-resp; r.Result || r.Error == nil {
+		t.Fatalf("expect error response, got %+v", r)
+	}
+}
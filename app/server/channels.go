@@ -0,0 +1,44 @@
+package server
+
+import (
+	"sort"
+
+	kupool "github.com/JellyTony/kupool"
+)
+
+// ChannelInfo 单个连接的概况，供管理接口与监控使用
+type ChannelInfo struct {
+	ID       string `json:"id"`
+	Username string `json:"username,omitempty"`
+	Remote   string `json:"remote"`
+	kupool.Liveness
+}
+
+// Channels 返回当前全部连接按 id 排序的概况；底层 Channel 不支持心跳时 Liveness 为空
+func (a *AppServer) Channels() []ChannelInfo {
+	m, ok := a.srv.(interface{ All() []kupool.Channel })
+	if !ok {
+		return nil
+	}
+	a.coord.mu.RLock()
+	users := make(map[string]string, len(a.coord.sessions))
+	for id, s := range a.coord.sessions {
+		users[id] = s.Username
+	}
+	a.coord.mu.RUnlock()
+
+	chs := m.All()
+	infos := make([]ChannelInfo, 0, len(chs))
+	for _, ch := range chs {
+		info := ChannelInfo{ID: ch.ID(), Username: users[ch.ID()]}
+		if addr := ch.RemoteAddr(); addr != nil {
+			info.Remote = addr.String()
+		}
+		if hb, ok := ch.(kupool.Heartbeater); ok {
+			info.Liveness = hb.Liveness()
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
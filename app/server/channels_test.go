@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/mq"
+)
+
+func TestChannels(t *testing.T) {
+	store := newMemStore()
+	app := startTestApp(t, "127.0.0.1:9100", store, store, mq.NewMemoryQueue(16), 0, func(a *AppServer) {
+		a.SetHeartbeat(kupool.HeartbeatOptions{Interval: testInterval})
+	})
+	alice := app.authorize(t, "alice")
+	app.authorize(t, "bob")
+
+	infos := app.Channels()
+	if len(infos) != 2 {
+		t.Fatalf("expect 2 channels, got %+v", infos)
+	}
+	users := map[string]ChannelInfo{}
+	for _, info := range infos {
+		users[info.Username] = info
+	}
+	a, ok := users["alice"]
+	if !ok || a.Remote != alice.LocalAddr().String() {
+		t.Fatalf("unexpected channels %+v", infos)
+	}
+	if a.LastMessage.IsZero() || a.LastRead.Before(a.LastMessage) {
+		t.Fatalf("authorize should count as a message: %+v", a)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/events"
+	"github.com/JellyTony/kupool/logger"
+)
+
+const (
+	DefaultStatsWorkers     = 1
+	DefaultStatsBatchSize   = 256
+	DefaultStatsBatchWindow = 200 * time.Millisecond
+)
+
+// ConsumerOptions 统计消费者配置
+type ConsumerOptions struct {
+	Workers     int           // 并发消费者数量
+	BatchSize   int           // 单批最多聚合的事件数，达到即写入
+	BatchWindow time.Duration // 单批最长聚合时间
+}
+
+func (o ConsumerOptions) withDefaults() ConsumerOptions {
+	if o.Workers <= 0 {
+		o.Workers = DefaultStatsWorkers
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultStatsBatchSize
+	}
+	if o.BatchWindow <= 0 {
+		o.BatchWindow = DefaultStatsBatchWindow
+	}
+	return o
+}
+
+type statKey struct {
+	username string
+	minute   time.Time
+}
+
+// OnceStatsStore 由支持事务的 StatsStore 实现：IncrementOnce 在写入统计的同一事务内记录事件 ID，
+// 已记录过的事件不再计数，没有 ID 的事件总是计数；重启或多节点消费时每个 outbox 事件只计一次
+type OnceStatsStore interface {
+	IncrementOnce(evts []events.SubmitEvent) error
+}
+
+// dedupWindow 存储不支持 OnceStatsStore 时，消费者在内存中记住的最近事件 ID 数量，
+// 只能过滤本节点、本次运行内 outbox relay 重发的事件
+const dedupWindow = 4096
+
+// statsConsumer 从 MQ 消费 SubmitEvent，按 (username, minute) 聚合后批量写入 StatsStore
+type statsConsumer struct {
+	store  StatsStore
+	once   OnceStatsStore
+	opts   ConsumerOptions
+	clk    clock.Clock
+	errors int64
+	wg     sync.WaitGroup
+
+	seenMu sync.Mutex
+	seen   map[string]struct{}
+	order  []string
+}
+
+func newStatsConsumer(store StatsStore, opts ConsumerOptions) *statsConsumer {
+	c := &statsConsumer{store: store, opts: opts.withDefaults(), clk: clock.Real(), seen: make(map[string]struct{})}
+	c.once, _ = store.(OnceStatsStore)
+	return c
+}
+
+// duplicate 判断带 ID 的事件是否已在最近窗口内处理过
+func (c *statsConsumer) duplicate(id string) bool {
+	if id == "" {
+		return false
+	}
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+	if _, ok := c.seen[id]; ok {
+		return true
+	}
+	c.seen[id] = struct{}{}
+	c.order = append(c.order, id)
+	if len(c.order) > dedupWindow {
+		delete(c.seen, c.order[0])
+		c.order = c.order[1:]
+	}
+	return false
+}
+
+// start 启动 Workers 个消费协程，stop 关闭或 ch 关闭时写入剩余批次后退出
+func (c *statsConsumer) start(ch <-chan events.SubmitEvent, stop <-chan struct{}) {
+	for i := 0; i < c.opts.Workers; i++ {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.run(ch, stop)
+		}()
+	}
+}
+
+func (c *statsConsumer) run(ch <-chan events.SubmitEvent, stop <-chan struct{}) {
+	var batch []events.SubmitEvent
+	timer := c.clk.NewTimer(c.opts.BatchWindow)
+	defer timer.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			c.flush(batch)
+			batch = nil
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+		timer.Reset(c.opts.BatchWindow)
+	}
+	for {
+		select {
+		case <-stop:
+			flush()
+			return
+		case <-timer.C():
+			flush()
+		case evt, ok := <-ch:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, evt)
+			if len(batch) >= c.opts.BatchSize {
+				flush()
+			}
+		}
+	}
+}
+
+// flush 写入一批事件：支持 OnceStatsStore 时交给存储在事务内去重，否则按内存窗口去重后聚合写入
+func (c *statsConsumer) flush(batch []events.SubmitEvent) {
+	if c.once != nil {
+		if err := c.once.IncrementOnce(batch); err != nil {
+			logger.WithFields(logger.Fields{"module": "server", "events": len(batch)}).Errorf("store increment once failed: %v", err)
+			atomic.AddInt64(&c.errors, 1)
+			return
+		}
+		logger.WithFields(logger.Fields{"module": "server", "events": len(batch)}).Debug("stats batch flushed")
+		return
+	}
+	counts := make(map[statKey]int)
+	for _, evt := range batch {
+		if c.duplicate(evt.ID) {
+			continue
+		}
+		counts[statKey{username: evt.Username, minute: evt.Time.Truncate(time.Minute)}]++
+	}
+	if len(counts) == 0 {
+		return
+	}
+	deltas := make([]StatDelta, 0, len(counts))
+	for k, n := range counts {
+		deltas = append(deltas, StatDelta{Username: k.username, Minute: k.minute, Count: n})
+	}
+	if err := c.store.BatchIncrement(deltas); err != nil {
+		logger.WithFields(logger.Fields{"module": "server", "rows": len(deltas)}).Errorf("store batch increment failed: %v", err)
+		atomic.AddInt64(&c.errors, 1)
+		return
+	}
+	logger.WithFields(logger.Fields{"module": "server", "rows": len(deltas)}).Debug("stats batch flushed")
+}
+
+func (c *statsConsumer) wait() { c.wg.Wait() }
+
+func (c *statsConsumer) errorCount() int { return int(atomic.LoadInt64(&c.errors)) }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/events"
+)
+
+type batchStore struct {
+	fakeStore
+	mu      sync.Mutex
+	batches [][]StatDelta
+	counts  map[string]int
+}
+
+func (b *batchStore) BatchIncrement(deltas []StatDelta) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.counts == nil {
+		b.counts = make(map[string]int)
+	}
+	b.batches = append(b.batches, deltas)
+	for _, d := range deltas {
+		b.counts[d.Username] += d.Count
+	}
+	return nil
+}
+
+func TestStatsConsumerAggregatesByUserMinute(t *testing.T) {
+	store := &batchStore{}
+	c := newStatsConsumer(store, ConsumerOptions{Workers: 1, BatchSize: 100, BatchWindow: time.Hour})
+	ch := make(chan events.SubmitEvent, 16)
+	stop := make(chan struct{})
+	now := time.Now().Truncate(time.Minute)
+	for i := 0; i < 5; i++ {
+		ch <- events.SubmitEvent{Username: "u1", Time: now.Add(time.Duration(i) * time.Second)}
+	}
+	ch <- events.SubmitEvent{Username: "u2", Time: now}
+	close(ch)
+	c.start(ch, stop)
+	c.wait()
+	if len(store.batches) != 1 {
+		t.Fatalf("expect 1 batch, got %d", len(store.batches))
+	}
+	if len(store.batches[0]) != 2 {
+		t.Fatalf("expect 2 rows, got %d", len(store.batches[0]))
+	}
+	if store.counts["u1"] != 5 || store.counts["u2"] != 1 {
+		t.Fatalf("unexpected counts %v", store.counts)
+	}
+}
+
+func TestStatsConsumerFlushOnSize(t *testing.T) {
+	store := &batchStore{}
+	c := newStatsConsumer(store, ConsumerOptions{Workers: 1, BatchSize: 3, BatchWindow: time.Hour})
+	ch := make(chan events.SubmitEvent)
+	stop := make(chan struct{})
+	c.start(ch, stop)
+	for i := 0; i < 7; i++ {
+		ch <- events.SubmitEvent{Username: "u", Time: time.Now()}
+	}
+	close(ch)
+	c.wait()
+	if len(store.batches) != 3 {
+		t.Fatalf("expect 3 batches, got %d", len(store.batches))
+	}
+	if store.counts["u"] != 7 {
+		t.Fatalf("expect 7, got %d", store.counts["u"])
+	}
+}
+
+func TestStatsConsumerFlushOnWindow(t *testing.T) {
+	store := &batchStore{}
+	c := newStatsConsumer(store, ConsumerOptions{Workers: 4, BatchSize: 1000, BatchWindow: time.Second})
+	clk := clock.NewFake(time.Time{})
+	c.clk = clk
+	ch := make(chan events.SubmitEvent)
+	stop := make(chan struct{})
+	defer func() { close(stop); c.wait() }()
+	c.start(ch, stop)
+	clk.BlockUntil(4)
+	for i := 0; i < 20; i++ {
+		ch <- events.SubmitEvent{Username: "u", Time: clk.Now()}
+	}
+	count := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.counts["u"]
+	}
+	clk.Advance(999 * time.Millisecond)
+	if n := count(); n != 0 {
+		t.Fatalf("flushed before the window: %d", n)
+	}
+	clk.Advance(time.Millisecond)
+	waitFor(t, "window flush", func() bool { return count() == 20 })
+}
@@ -3,13 +3,20 @@ package server
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"sort"
 	"time"
 
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/events"
 	"github.com/JellyTony/kupool/logger"
 	"github.com/JellyTony/kupool/protocol"
 )
 
 func NewCoordinator(p ServerPusher, store StatsStore, state StateStore, mq MessageQueue, interval time.Duration, expire time.Duration, historyWindow time.Duration) *Coordinator {
+	limiter, _ := newSubmitLimiter(DefaultRateLimitConfig())
+	banStore, _ := state.(BanStore)
 	return &Coordinator{
 		sessions:      make(map[string]*Session),
 		srv:           p,
@@ -19,27 +26,150 @@ func NewCoordinator(p ServerPusher, store StatsStore, state StateStore, mq Messa
 		nonceInterval: interval,
 		historyWindow: historyWindow,
 		history:       make(map[int]JobRecord),
+		jobMisses:     make(map[int]time.Time),
 		expireAfter:   expire,
+		nonceFilter:   NewExactNonceFilter,
+		limiter:       limiter,
+		bans:          NewBanManager(DefaultBanPolicy(), banStore),
+		clk:           clock.Real(),
 		stopCh:        make(chan struct{}),
 	}
 }
 
+// DefaultHistoryWindow historyWindow 与 expireAfter 均未设置时任务历史的保留时长
+const DefaultHistoryWindow = 24 * time.Hour
+
+// SetNonceFilter 设置新会话使用的重复 nonce 过滤器，需在接受连接之前调用
+func (c *Coordinator) SetNonceFilter(f NonceFilterFactory) {
+	if f != nil {
+		c.nonceFilter = f
+	}
+}
+
+// SetRateLimit 设置提交限速策略，需在接受连接之前调用
+func (c *Coordinator) SetRateLimit(cfg RateLimitConfig) error {
+	l, err := newSubmitLimiter(cfg)
+	if err != nil {
+		return err
+	}
+	c.limiter = l
+	return nil
+}
+
+// SetClock 设置任务轮换、过期、限速与封禁使用的时钟（默认真实时钟），需在 StartBroadcast 之前调用
+func (c *Coordinator) SetClock(clk clock.Clock) {
+	c.clk = clock.OrReal(clk)
+}
+
+// Clock 返回协调器使用的时钟
+func (c *Coordinator) Clock() clock.Clock { return c.clk }
+
+// SetBanPolicy 设置自动封禁策略，需在接受连接之前调用
+func (c *Coordinator) SetBanPolicy(p BanPolicy) {
+	banStore, _ := c.state.(BanStore)
+	c.bans = NewBanManager(p, banStore)
+}
+
+// Bans 返回封禁管理器，供管理接口查询与解封
+func (c *Coordinator) Bans() *BanManager { return c.bans }
+
+// CurrentJob 返回当前任务号与 server_nonce，尚未生成任务时 jobID 为 0
+func (c *Coordinator) CurrentJob() (jobID int, serverNonce string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.jobID, c.serverNonce
+}
+
+// recordOutcome 把提交结果计入封禁评分：结果错误、重复与过频计为拒绝，其余错误与无法确认的疑似重复不计；
+// 产生新封禁时断开被封账号或 IP 的全部会话
+func (c *Coordinator) recordOutcome(channelID string, err error) {
+	var probable probableDuplicateError
+	if errors.As(err, &probable) {
+		return
+	}
+	rejected := err != nil
+	if rejected && !errors.Is(err, errInvalidResult) && !errors.Is(err, ErrDuplicateSubmission) && !errors.Is(err, ErrSubmitTooFrequent) {
+		return
+	}
+	c.mu.RLock()
+	s, ok := c.sessions[channelID]
+	c.mu.RUnlock()
+	if !ok {
+		return
+	}
+	reason := ""
+	if rejected {
+		reason = err.Error()
+	}
+	for _, b := range c.bans.Record(s, rejected, reason, c.clk.Now()) {
+		logger.WithFields(logger.Fields{"module": "app.coordinator", "kind": b.Kind, "value": b.Value, "until": b.Until, "offences": b.Offences}).Warn("banned")
+		c.kick(b)
+	}
+}
+
+type channelGetter interface {
+	Get(id string) (kupool.Channel, bool)
+}
+
+// kick 断开被封账号或 IP 的全部会话，给拒绝响应留出写出时间
+func (c *Coordinator) kick(b Ban) {
+	g, ok := c.srv.(channelGetter)
+	if !ok {
+		return
+	}
+	c.mu.RLock()
+	var ids []string
+	for id, s := range c.sessions {
+		if (b.Kind == BanAccount && s.Username == b.Value) || (b.Kind == BanIP && s.RemoteIP == b.Value) {
+			ids = append(ids, id)
+		}
+	}
+	c.mu.RUnlock()
+	for _, id := range ids {
+		if ch, ok := g.Get(id); ok {
+			c.clk.AfterFunc(disconnectDelay, func() { _ = ch.Close() })
+		}
+	}
+}
+
 func (c *Coordinator) RegisterSession(channelID, username string) {
+	c.registerSession(channelID, username, "")
+}
+
+// registerSession 注册会话，remoteIP 用于按来源 IP 限速
+func (c *Coordinator) registerSession(channelID, username, remoteIP string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.sessions[channelID] = &Session{ChannelID: channelID, Username: username, UsedNonces: make(map[int]map[string]struct{})}
+	c.sessions[channelID] = &Session{ChannelID: channelID, Username: username, UsedNonces: c.nonceFilter(), RemoteIP: remoteIP}
 }
 
-func (c *Coordinator) UnregisterSession(channelID string) {
+// UnregisterSession 移除会话并返回被移除的会话，不存在时返回 nil
+func (c *Coordinator) UnregisterSession(channelID string) *Session {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	s := c.sessions[channelID]
 	delete(c.sessions, channelID)
+	if s != nil {
+		c.limiter.forget(s)
+		c.bans.Forget(s)
+	}
+	return s
+}
+
+// emit 发布事件流；发布失败只记录日志，不影响主流程
+func (c *Coordinator) emit(evt events.Envelope) {
+	if c.mq == nil {
+		return
+	}
+	if err := c.mq.PublishEvent(evt); err != nil {
+		logger.WithFields(logger.Fields{"module": "app.coordinator", "kind": evt.Kind}).Warnf("publish event failed: %v", err)
+	}
 }
 
 func (c *Coordinator) StartBroadcast() { go c.loop() }
 
 func (c *Coordinator) loop() {
-	ticker := time.NewTicker(c.nonceInterval)
+	ticker := c.clk.NewTicker(c.nonceInterval)
 	defer ticker.Stop()
 	// restore latest job/history if possible
 	c.restore()
@@ -48,7 +178,7 @@ func (c *Coordinator) loop() {
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			c.run()
 			continue
 		case <-c.stopCh:
@@ -58,21 +188,63 @@ func (c *Coordinator) loop() {
 }
 
 func (c *Coordinator) run() {
-	c.rotateJob()
-	c.broadcastJob()
+	if c.rotateJob() {
+		c.broadcastJob()
+	}
+}
+
+// HistoryEvictor 由在内存中保存任务与已用 nonce 的 StateStore 实现：任务离开历史窗口后
+// 与会话的 UsedNonces.EvictBefore 一起调用，释放任务号小于 minJobID 的记录（最新任务除外）
+type HistoryEvictor interface {
+	EvictJobsBefore(minJobID int)
+}
+
+// JobAllocator 由可在多节点间共享的 StateStore 实现：在共享任务表中分配全局唯一的任务号并写入，
+// 未实现时使用本地递增的任务号并通过 SaveJob 写入
+type JobAllocator interface {
+	CreateJob(nonce string, createdAt time.Time) (jobID int, err error)
 }
 
-func (c *Coordinator) rotateJob() {
+// rotateJob 生成新任务并返回 true。使用 JobAllocator 时任务号由共享任务表分配，分配失败或任务号
+// 没有递增时放弃本次轮换并返回 false，保持当前任务，下个周期重试；不会发布任务表中不存在的任务号
+func (c *Coordinator) rotateJob() bool {
 	buf := make([]byte, 16)
 	_, _ = rand.Read(buf)
+	nonce := hex.EncodeToString(buf)
+	now := c.clk.Now()
+	alloc, shared := c.state.(JobAllocator)
+	jobID := 0
+	if shared {
+		id, err := alloc.CreateJob(nonce, now)
+		if err != nil {
+			logger.WithFields(logger.Fields{"module": "app.coordinator"}).Warnf("create job failed, keep current job: %v", err)
+			return false
+		}
+		jobID = id
+	}
 	c.mu.Lock()
-	c.jobID++
-	c.serverNonce = hex.EncodeToString(buf)
-	c.history[c.jobID] = JobRecord{Nonce: c.serverNonce, CreatedAt: time.Now()}
+	if jobID <= c.jobID {
+		if shared {
+			current := c.jobID
+			c.mu.Unlock()
+			logger.WithFields(logger.Fields{"module": "app.coordinator", "job_id": jobID, "current": current}).Warn("allocated job id not increasing, keep current job")
+			return false
+		}
+		jobID = c.jobID + 1
+	}
+	c.jobID = jobID
+	if jobID > c.maxJobID {
+		c.maxJobID = jobID
+	}
+	c.serverNonce = nonce
+	c.history[jobID] = JobRecord{Nonce: nonce, CreatedAt: now}
 	c.mu.Unlock()
-	if c.state != nil {
-		_ = c.state.SaveJob(c.jobID, c.serverNonce, time.Now())
+	c.pruneHistory(now)
+	if !shared && c.state != nil {
+		_ = c.state.SaveJob(jobID, nonce, now)
 	}
+	c.emit(events.NewJobRotated(now, events.JobRotated{JobID: jobID, ServerNonce: nonce}))
+	return true
 }
 
 type broadcastMsg struct {
@@ -92,18 +264,168 @@ func (c *Coordinator) broadcastJob() {
 	c.mu.RUnlock()
 	msg := broadcastMsg{ID: nil, Method: "job", Params: protocol.JobParams{JobID: jobID, ServerNonce: nonce}}
 	data, _ := protocol.Encode(msg)
-	c.mu.Lock()
 	for _, s := range sessions {
-		s.LatestJobID = jobID
-		s.LatestServerNonce = nonce
+		s.setLatestJob(jobID, nonce)
 		_ = c.srv.Push(s.ChannelID, data)
 	}
-	c.mu.Unlock()
 
 	logger.WithFields(logger.Fields{"module": "app.coordinator", "job_id": jobID, "nonce": nonce, "sessions": len(sessions)}).Info("broadcast job")
 }
 
-func (c *Coordinator) Stop() { close(c.stopCh) }
+// job 返回历史中的任务，已被清理或不存在时 ok 为 false
+func (c *Coordinator) job(id int) (JobRecord, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rec, ok := c.history[id]
+	return rec, ok
+}
+
+// historyRetention 任务历史的保留时长：取 historyWindow 与 expireAfter 中较大者，
+// 保证未过期的任务仍可校验
+func (c *Coordinator) historyRetention() time.Duration {
+	window := c.historyWindow
+	if c.expireAfter > window {
+		window = c.expireAfter
+	}
+	if window <= 0 {
+		window = DefaultHistoryWindow
+	}
+	return window
+}
+
+// pruneHistory 清理超出保留时长的任务，并最多保留 ceil(retention/interval)+1 个任务（按任务号保留最新的）；
+// 当前任务始终保留。最早的任务变化时同步释放各会话中对应任务的 nonce 集合
+func (c *Coordinator) pruneHistory(now time.Time) {
+	window := c.historyRetention()
+	cutoff := now.Add(-window)
+	c.mu.Lock()
+	ids := make([]int, 0, len(c.history))
+	for id, rec := range c.history {
+		if id != c.jobID && rec.CreatedAt.Before(cutoff) {
+			delete(c.history, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if c.nonceInterval > 0 {
+		if max := int((window+c.nonceInterval-1)/c.nonceInterval) + 1; len(ids) > max {
+			for _, id := range ids[:len(ids)-max] {
+				delete(c.history, id)
+			}
+			ids = ids[len(ids)-max:]
+		}
+	}
+	for id, at := range c.jobMisses {
+		if id < c.minJobID || now.Sub(at) >= jobMissTTL {
+			delete(c.jobMisses, id)
+		}
+	}
+	if len(ids) == 0 || ids[0] <= c.minJobID {
+		c.mu.Unlock()
+		return
+	}
+	minID := ids[0]
+	c.minJobID = minID
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.mu.Unlock()
+	for _, s := range sessions {
+		s.UsedNonces.EvictBefore(minID)
+	}
+	if ev, ok := c.state.(HistoryEvictor); ok {
+		ev.EvictJobsBefore(minID)
+	}
+}
+
+// jobMissTTL 回源未命中的任务号、以及向存储刷新的最新任务号的有效期
+const jobMissTTL = 5 * time.Second
+
+// lookupJob 按 JobID 查询任务：先查本地历史，未命中时回源 StateStore 的共享任务表（如其他节点创建的任务）；
+// 超出保留时长的任务视为不存在。低于窗口起点、高于已知最大任务号或近期回源未命中的任务号不回源，
+// 随机的 job_id 不会逐帧查询存储
+func (c *Coordinator) lookupJob(id int) (JobRecord, bool, error) {
+	if rec, ok := c.job(id); ok {
+		return rec, true, nil
+	}
+	if c.state == nil {
+		return JobRecord{}, false, nil
+	}
+	c.lookupMu.Lock()
+	defer c.lookupMu.Unlock()
+	// 等待期间其他会话可能已回源同一任务号
+	if rec, ok := c.job(id); ok {
+		return rec, true, nil
+	}
+	if !c.mayExist(id) {
+		return JobRecord{}, false, nil
+	}
+	rec, ok, err := c.state.LoadJob(id)
+	if err != nil {
+		return JobRecord{}, false, err
+	}
+	now := c.clk.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok || now.Sub(rec.CreatedAt) > c.historyRetention() {
+		c.jobMisses[id] = now
+		return JobRecord{}, false, nil
+	}
+	if id >= c.minJobID {
+		c.history[id] = rec
+	}
+	if id > c.maxJobID {
+		c.maxJobID = id
+	}
+	return rec, true, nil
+}
+
+// mayExist 本地未命中的任务号是否值得回源，调用方需持有 lookupMu。高于已知最大任务号时
+// 每 jobMissTTL 最多向存储刷新一次最新任务号
+func (c *Coordinator) mayExist(id int) bool {
+	now := c.clk.Now()
+	c.mu.RLock()
+	minID, maxID, latestAt := c.minJobID, c.maxJobID, c.latestAt
+	missAt, missed := c.jobMisses[id]
+	c.mu.RUnlock()
+	if id <= 0 || id < minID || (missed && now.Sub(missAt) < jobMissTTL) {
+		return false
+	}
+	if id <= maxID {
+		return true
+	}
+	if !latestAt.IsZero() && now.Sub(latestAt) < jobMissTTL {
+		return false
+	}
+	latest, _, _, err := c.state.LoadLatestJob()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latestAt = now
+	if err != nil {
+		logger.WithFields(logger.Fields{"module": "app.coordinator"}).Warnf("load latest job failed: %v", err)
+		return false
+	}
+	if latest > c.maxJobID {
+		c.maxJobID = latest
+	}
+	return id <= c.maxJobID
+}
+
+// jobExpired 任务是否已超过 expireAfter；当前任务不会过期
+func (c *Coordinator) jobExpired(id int, rec JobRecord) bool {
+	if c.expireAfter <= 0 {
+		return false
+	}
+	c.mu.RLock()
+	current := c.jobID
+	c.mu.RUnlock()
+	return id != current && c.clk.Since(rec.CreatedAt) > c.expireAfter
+}
+
+// Stop 停止任务轮换，可重复调用
+func (c *Coordinator) Stop() { c.stopOnce.Do(func() { close(c.stopCh) }) }
 
 func (c *Coordinator) restore() {
 	if c.state == nil {
@@ -113,6 +435,7 @@ func (c *Coordinator) restore() {
 	if err == nil && jobID > 0 {
 		c.mu.Lock()
 		c.jobID = jobID
+		c.maxJobID = jobID
 		c.serverNonce = nonce
 		c.history[jobID] = JobRecord{Nonce: nonce, CreatedAt: createdAt}
 		c.mu.Unlock()
@@ -125,4 +448,5 @@ func (c *Coordinator) restore() {
 		}
 		c.mu.Unlock()
 	}
+	c.pruneHistory(c.clk.Now())
 }
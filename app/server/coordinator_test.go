@@ -1,6 +1,7 @@
 package server
 
 import (
+    "errors"
     "testing"
     "time"
 )
@@ -19,3 +20,50 @@ func TestCoordinatorBroadcast(t *testing.T) {
     s1 := coord.sessions["c1"]
     if s1.LatestJobID == 0 || s1.LatestServerNonce == "" { t.Fatal("session updated") }
 }
+
+type allocStore struct {
+    *memStore
+    next int
+}
+func (a *allocStore) CreateJob(nonce string, createdAt time.Time) (int, error) {
+    a.next += 10
+    return a.next, a.SaveJob(a.next, nonce, createdAt)
+}
+
+func TestCoordinatorUsesJobAllocator(t *testing.T) {
+    store := &allocStore{memStore: newMemStore()}
+    coord := NewCoordinator(&memPusher{}, &fakeStore{}, store, &fakeMQ{}, time.Second, 0, time.Hour)
+    coord.rotateJob()
+    coord.rotateJob()
+    if coord.jobID != 20 { t.Fatalf("expect allocated job id 20, got %d", coord.jobID) }
+    if rec, ok, _ := store.LoadJob(20); !ok || rec.Nonce != coord.serverNonce { t.Fatal("job not in shared table") }
+}
+
+type failingAllocStore struct {
+    *allocStore
+    fail   bool
+    repeat bool
+}
+func (f *failingAllocStore) CreateJob(nonce string, createdAt time.Time) (int, error) {
+    if f.fail { return 0, errors.New("db down") }
+    if f.repeat { return f.next, nil }
+    return f.allocStore.CreateJob(nonce, createdAt)
+}
+
+// TestCoordinatorAllocatorFailureKeepsJob 分配失败或任务号不递增时保持当前任务且不广播，任务表中不存在的任务号不会发布
+func TestCoordinatorAllocatorFailureKeepsJob(t *testing.T) {
+    store := &failingAllocStore{allocStore: &allocStore{memStore: newMemStore()}}
+    p := &memPusher{}
+    coord := NewCoordinator(p, &fakeStore{}, store, &fakeMQ{}, time.Second, 0, time.Hour)
+    coord.RegisterSession("c1", "u1")
+    coord.run()
+    if coord.jobID != 10 || p.count != 1 { t.Fatalf("expect job 10 broadcast once, got %d/%d", coord.jobID, p.count) }
+    for _, mode := range []string{"fail", "repeat"} {
+        store.fail, store.repeat = mode == "fail", mode == "repeat"
+        coord.run()
+        if coord.jobID != 10 || p.count != 1 { t.Fatalf("%s: expect job 10 kept without broadcast, got %d/%d", mode, coord.jobID, p.count) }
+    }
+    store.fail, store.repeat = false, false
+    coord.run()
+    if _, ok, _ := store.LoadJob(coord.jobID); !ok || coord.jobID != 20 || p.count != 2 { t.Fatalf("expect job 20 from the table, got %d", coord.jobID) }
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/protocol"
+)
+
+// DefaultDrainGrace 关闭时通知客户端重连后，等待客户端断开与在途提交完成的默认时长
+const DefaultDrainGrace = 10 * time.Second
+
+// drainPoll 排空期间检查会话与在途消息的间隔
+const drainPoll = 20 * time.Millisecond
+
+// DrainOptions 关闭时排空连接的参数
+type DrainOptions struct {
+	Grace          time.Duration // 发出 client.reconnect 后的宽限期，期间照常处理提交；<=0 时不等待
+	ReconnectHost  string        // 通知客户端改连的地址（host:port），为空表示重连原地址
+	ReconnectDelay time.Duration // 建议客户端重连前等待的时长，按秒向上取整
+}
+
+// DefaultDrainOptions 宽限 10 秒、重连原地址、不等待
+func DefaultDrainOptions() DrainOptions {
+	return DrainOptions{Grace: DefaultDrainGrace}
+}
+
+type notifyMsg struct {
+	ID     any    `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
+// notifyReconnect 向全部会话推送 client.reconnect，返回通知的会话数
+func (c *Coordinator) notifyReconnect(host string, delay time.Duration) int {
+	wait := int((delay + time.Second - 1) / time.Second)
+	data, _ := protocol.Encode(notifyMsg{Method: "client.reconnect", Params: protocol.ReconnectParams{Host: host, Wait: wait}})
+	c.mu.RLock()
+	ids := make([]string, 0, len(c.sessions))
+	for id := range c.sessions {
+		ids = append(ids, id)
+	}
+	c.mu.RUnlock()
+	for _, id := range ids {
+		_ = c.srv.Push(id, data)
+	}
+	return len(ids)
+}
+
+// sessionCount 当前会话数
+func (c *Coordinator) sessionCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.sessions)
+}
+
+// drain 排空连接：停止接受新连接与任务轮换，通知客户端重连，在宽限期内继续处理提交，
+// 直到客户端全部断开或宽限期结束。宽限与关闭超时使用真实时间
+func (a *AppServer) drain(ctx context.Context) {
+	if s, ok := a.srv.(interface{ StopAccept() error }); ok {
+		if err := s.StopAccept(); err != nil {
+			logger.WithFields(logger.Fields{"module": "app.server", "error": err}).Warn("stop accept failed")
+		}
+	}
+	a.coord.Stop()
+	a.status.Notified = a.coord.notifyReconnect(a.drainOpts.ReconnectHost, a.drainOpts.ReconnectDelay)
+	logger.WithFields(logger.Fields{"module": "app.server", "sessions": a.status.Notified, "grace": a.drainOpts.Grace, "host": a.drainOpts.ReconnectHost}).Info("draining")
+	if a.drainOpts.Grace > 0 {
+		a.waitIdle(ctx, a.drainOpts.Grace, func() bool { return a.coord.sessionCount() == 0 && a.coord.inflight.Load() == 0 })
+	}
+	a.status.ForcedClose = a.coord.sessionCount()
+}
+
+// waitIdle 轮询直到 idle 返回 true、超过 d 或 ctx 结束
+func (a *AppServer) waitIdle(ctx context.Context, d time.Duration, idle func() bool) bool {
+	deadline := time.NewTimer(d)
+	defer deadline.Stop()
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for !idle() {
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			return idle()
+		case <-ctx.Done():
+			return idle()
+		}
+	}
+	return true
+}
@@ -0,0 +1,4 @@
+package server
+
+// RotateJob 供外部测试包（server_test）驱动任务轮换
+func (c *Coordinator) RotateJob() { c.rotateJob() }
@@ -0,0 +1,51 @@
+package server_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/stats"
+)
+
+type nopPusher struct{}
+
+func (nopPusher) Push(string, []byte) error { return nil }
+
+// TestHistoryBoundedOverRotationsWithMemoryStore 数千次轮换后 MemoryStore 中的任务与已用 nonce 同样保持有界
+func TestHistoryBoundedOverRotationsWithMemoryStore(t *testing.T) {
+	interval := 100 * time.Millisecond
+	window := time.Second
+	store := stats.NewMemoryStore()
+	clk := clock.NewFake(time.Time{})
+	store.SetClock(clk)
+	coord := server.NewCoordinator(nopPusher{}, store, store, nil, interval, 0, window)
+	coord.SetClock(clk)
+
+	maxJobs := int(window/interval) + 1
+	for i := 0; i < 5000; i++ {
+		coord.RotateJob()
+		jobID, _ := coord.CurrentJob()
+		_ = store.SaveUsedNonce("u1", jobID, "n"+strconv.Itoa(i))
+		jobs, _ := store.LoadJobHistory(0)
+		if len(jobs) > maxJobs {
+			t.Fatalf("rotation %d: store keeps %d jobs, expect at most %d", i, len(jobs), maxJobs)
+		}
+	}
+	// 任务 k 上提交的是 n(k-1)，离开窗口的任务不应再保留任何已用 nonce
+	jobID, _ := coord.CurrentJob()
+	kept := 0
+	for id := 1; id <= jobID; id++ {
+		if used, _ := store.HasUsedNonce("u1", id, "n"+strconv.Itoa(id-1)); used {
+			kept++
+		}
+	}
+	if kept == 0 || kept > maxJobs {
+		t.Fatalf("store keeps used nonces of %d jobs, expect 1..%d", kept, maxJobs)
+	}
+	if used, _ := store.HasUsedNonce("u1", jobID, "n"+strconv.Itoa(jobID-1)); !used {
+		t.Fatal("used nonce of the current job must be kept")
+	}
+}
@@ -13,6 +13,16 @@ import (
 	"github.com/JellyTony/kupool/protocol"
 )
 
+var errInvalidResult = errors.New("Invalid result")
+
+// probableDuplicateError 可能误判的 nonce 过滤器命中且无法向存储确认：按重复提交拒绝
+// （errors.Is 匹配 ErrDuplicateSubmission），但 recordOutcome 不计入封禁评分
+type probableDuplicateError struct{}
+
+func (probableDuplicateError) Error() string { return ErrDuplicateSubmission.Error() }
+
+func (probableDuplicateError) Unwrap() error { return ErrDuplicateSubmission }
+
 type Listener struct {
 	coord *Coordinator
 }
@@ -22,80 +32,160 @@ func NewListener(coord *Coordinator) *Listener {
 }
 
 func (l *Listener) Receive(ag kupool.Agent, payload []byte) {
-    var req protocol.Request
-    if err := protocol.Decode(payload, &req); err != nil {
-        logger.WithFields(logger.Fields{"module":"app.listener","stage":"decode","error":err}).Warn("decode error")
-        return
-    }
-    if req.Method != "submit" || req.ID == nil {
-        return
-    }
-    var p protocol.SubmitParams
-    if err := protocol.Decode(req.Params, &p); err != nil {
-        l.respondError(ag, *req.ID, "Invalid result")
-        return
-    }
-    chID := ag.ID()
-    logger.WithFields(logger.Fields{"module":"app.listener","channel_id":chID,"job_id":p.JobID}).Debug("submit received")
-    if err := l.handleSubmit(chID, p); err != nil {
-        l.respondError(ag, *req.ID, err.Error())
-        return
-    }
+	l.coord.inflight.Add(1)
+	defer l.coord.inflight.Add(-1)
+	var req protocol.Request
+	if err := protocol.Decode(payload, &req); err != nil {
+		logger.WithFields(logger.Fields{"module": "app.listener", "stage": "decode", "error": err}).Warn("decode error")
+		return
+	}
+	if req.Method != "submit" || req.ID == nil {
+		return
+	}
+	var p protocol.SubmitParams
+	chID := ag.ID()
+	if err := protocol.Decode(req.Params, &p); err != nil {
+		l.reject(chID, p, errInvalidResult.Error())
+		l.respondError(ag, *req.ID, errInvalidResult.Error())
+		l.coord.recordOutcome(chID, errInvalidResult)
+		return
+	}
+	logger.WithFields(logger.Fields{"module": "app.listener", "channel_id": chID, "job_id": p.JobID}).Debug("submit received")
+	delay, err := l.handleSubmit(chID, p)
+	l.coord.recordOutcome(chID, err)
+	if err != nil {
+		l.reject(chID, p, err.Error())
+		l.respondError(ag, *req.ID, err.Error())
+		if errors.Is(err, errRateDisconnect) {
+			if c, ok := ag.(interface{ Close() error }); ok {
+				logger.WithFields(logger.Fields{"module": "app.listener", "channel_id": chID}).Warn("too many rate limit violations, disconnecting")
+				l.coord.clk.AfterFunc(disconnectDelay, func() { _ = c.Close() })
+			}
+		}
+		return
+	}
 	resp := protocol.Response{ID: *req.ID, Result: true}
 	data, _ := protocol.Encode(resp)
+	if delay > 0 {
+		// delay 动作：配额已预占，到期后再发出响应，不占用会话锁与读协程等待
+		l.coord.clk.AfterFunc(delay, func() { _ = ag.Push(data) })
+		return
+	}
 	_ = ag.Push(data)
 }
 
-func (l *Listener) handleSubmit(channelID string, p protocol.SubmitParams) error {
-	l.coord.mu.Lock()
+// handleSubmit 先申请限速配额，再校验并记录提交；delay 大于 0 时调用方应推迟 delay 再发出成功响应
+func (l *Listener) handleSubmit(channelID string, p protocol.SubmitParams) (time.Duration, error) {
+	l.coord.mu.RLock()
 	s, ok := l.coord.sessions[channelID]
-	l.coord.mu.Unlock()
+	l.coord.mu.RUnlock()
 	if !ok {
-		return errors.New("Task does not exist")
+		return 0, errors.New("Task does not exist")
+	}
+	// 无效与重复的提交同样消耗配额，超限的提交在查询任务表与计算哈希之前被拒绝
+	delay, err := l.coord.limiter.check(s, l.coord.clk.Now())
+	if err != nil {
+		return 0, err
+	}
+	if err = l.accept(s, channelID, p); err != nil {
+		return 0, err
+	}
+	return delay, nil
+}
+
+// accept 在会话的提交锁内校验任务、nonce 与结果，通过后持久化并发布
+func (l *Listener) accept(s *Session, channelID string, p protocol.SubmitParams) error {
+	s.submitMu.Lock()
+	defer s.submitMu.Unlock()
+	latestJobID, latestNonce, _ := s.Latest()
+	// 按提交的 JobID 从任务表取 server nonce 校验，与会话当前的最新任务无关
+	job, ok, err := l.coord.lookupJob(p.JobID)
+	if err != nil {
+		logger.WithFields(logger.Fields{"module": "app.listener", "job_id": p.JobID}).Errorf("load job failed: %v", err)
+		return errors.New("Internal error")
 	}
-    if p.JobID != s.LatestJobID {
-        if rec, ok := l.coord.history[p.JobID]; ok {
-            s.LatestServerNonce = rec.Nonce
-            if l.coord.expireAfter > 0 && time.Since(rec.CreatedAt) > l.coord.expireAfter {
-                return errors.New("Task expired")
-            }
-        } else {
-            return errors.New("Task does not exist")
-        }
-    }
-	now := time.Now()
-    if !s.LastSubmitAt.IsZero() && now.Sub(s.LastSubmitAt) < time.Second {
-        return errors.New("Submission too frequent")
-    }
-    m, ok := s.UsedNonces[p.JobID]
 	if !ok {
-		m = make(map[string]struct{})
-		s.UsedNonces[p.JobID] = m
+		return errors.New("Task does not exist")
+	}
+	if l.coord.jobExpired(p.JobID, job) {
+		return errors.New("Task expired")
 	}
-	if _, dup := m[p.ClientNonce]; dup {
-		return errors.New("Duplicate submission")
+	if s.UsedNonces.Contains(p.JobID, p.ClientNonce) {
+		if err := l.confirmDuplicate(s, p); err != nil {
+			return err
+		}
 	}
-	computed := sha256.Sum256([]byte(s.LatestServerNonce + p.ClientNonce))
+	computed := sha256.Sum256([]byte(job.Nonce + p.ClientNonce))
 	hexed := hex.EncodeToString(computed[:])
 	if !strings.EqualFold(hexed, p.Result) {
-		return errors.New("Invalid result")
-	}
-    m[p.ClientNonce] = struct{}{}
-    s.LastSubmitAt = now
-    if l.coord.state != nil {
-        _ = l.coord.state.SaveUsedNonce(s.Username, p.JobID, p.ClientNonce)
-        _ = l.coord.state.SaveUserState(s.Username, s.LatestJobID, s.LatestServerNonce, s.LastSubmitAt)
-    }
-    _ = l.coord.mq.Publish(events.SubmitEvent{Username: s.Username, Time: now})
-    logger.WithFields(logger.Fields{"module":"app.listener","username":s.Username,"job_id":p.JobID,"client_nonce":p.ClientNonce}).Info("submit accepted")
-    return nil
+		return errInvalidResult
+	}
+	now := l.coord.clk.Now()
+	submitEvt := events.SubmitEvent{Username: s.Username, Time: now}
+	accepted := events.NewShareAccepted(now, events.ShareAccepted{Username: s.Username, ChannelID: channelID, JobID: p.JobID, ClientNonce: p.ClientNonce})
+	if ob, ok := l.coord.state.(OutboxStore); ok {
+		// 状态与待发布事件在同一事务内落库，由 outbox relay 负责投递到 MQ
+		rec := SubmitRecord{Username: s.Username, JobID: p.JobID, ClientNonce: p.ClientNonce, LatestJobID: latestJobID, LatestServerNonce: latestNonce, SubmitAt: now}
+		if err := ob.RecordSubmit(rec, submitOutboxMessages(submitEvt, accepted)); err != nil {
+			if errors.Is(err, ErrDuplicateSubmission) {
+				s.UsedNonces.Add(p.JobID, p.ClientNonce)
+				return ErrDuplicateSubmission
+			}
+			logger.WithFields(logger.Fields{"module": "app.listener", "username": s.Username, "job_id": p.JobID}).Errorf("record submit failed: %v", err)
+			return errors.New("Internal error")
+		}
+		s.UsedNonces.Add(p.JobID, p.ClientNonce)
+		s.markSubmit(now)
+	} else {
+		s.UsedNonces.Add(p.JobID, p.ClientNonce)
+		s.markSubmit(now)
+		if l.coord.state != nil {
+			_ = l.coord.state.SaveUsedNonce(s.Username, p.JobID, p.ClientNonce)
+			_ = l.coord.state.SaveUserState(s.Username, latestJobID, latestNonce, now)
+		}
+		_ = l.coord.mq.Publish(submitEvt)
+		l.coord.emit(accepted)
+	}
+	logger.WithFields(logger.Fields{"module": "app.listener", "username": s.Username, "job_id": p.JobID, "client_nonce": p.ClientNonce}).Info("submit accepted")
+	return nil
+}
+
+// confirmDuplicate 确认 UsedNonces 的命中：精确过滤器的命中即为重复；可能误判的过滤器向 StateStore 确认，
+// 存储中没有记录时视为误判放行，无法确认时返回 probableDuplicateError
+func (l *Listener) confirmDuplicate(s *Session, p protocol.SubmitParams) error {
+	if pf, ok := s.UsedNonces.(ProbabilisticFilter); !ok || !pf.Probabilistic() {
+		return ErrDuplicateSubmission
+	}
+	if l.coord.state == nil {
+		return probableDuplicateError{}
+	}
+	used, err := l.coord.state.HasUsedNonce(s.Username, p.JobID, p.ClientNonce)
+	if err != nil {
+		logger.WithFields(logger.Fields{"module": "app.listener", "username": s.Username, "job_id": p.JobID}).Warnf("confirm duplicate failed: %v", err)
+		return probableDuplicateError{}
+	}
+	if used {
+		return ErrDuplicateSubmission
+	}
+	return nil
+}
+
+// reject 发布 ShareRejected 事件，会话不存在时 username 为空
+func (l *Listener) reject(channelID string, p protocol.SubmitParams, reason string) {
+	username := ""
+	l.coord.mu.RLock()
+	if s, ok := l.coord.sessions[channelID]; ok {
+		username = s.Username
+	}
+	l.coord.mu.RUnlock()
+	l.coord.emit(events.NewShareRejected(l.coord.clk.Now(), events.ShareRejected{Username: username, ChannelID: channelID, JobID: p.JobID, ClientNonce: p.ClientNonce, Reason: reason}))
 }
 
 func (l *Listener) respondError(ag kupool.Agent, id int, msg string) {
 	resp := protocol.Response{ID: id, Result: false, Error: &msg}
-    data, _ := protocol.Encode(resp)
-    _ = ag.Push(data)
-    logger.WithFields(logger.Fields{"module":"app.listener","error":msg}).Warn("submit rejected")
+	data, _ := protocol.Encode(resp)
+	_ = ag.Push(data)
+	logger.WithFields(logger.Fields{"module": "app.listener", "error": msg}).Warn("submit rejected")
 }
 
 type State struct {
@@ -105,6 +195,8 @@ type State struct {
 func NewState(coord *Coordinator) *State { return &State{coord: coord} }
 
 func (s *State) Disconnect(id string) error {
-	s.coord.UnregisterSession(id)
+	if sess := s.coord.UnregisterSession(id); sess != nil {
+		s.coord.emit(events.NewSessionClosed(s.coord.clk.Now(), events.SessionClosed{Username: sess.Username, ChannelID: id}))
+	}
 	return nil
 }
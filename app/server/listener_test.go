@@ -0,0 +1,295 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/protocol"
+)
+
+type nopPusher struct{}
+
+func (nopPusher) Push(string, []byte) error { return nil }
+
+func newRaceCoordinator() (*Coordinator, *Listener) {
+	coord := NewCoordinator(nopPusher{}, &fakeStore{}, nil, &fakeMQ{}, time.Second, 0, time.Minute)
+	// 放开限速，只验证并发与校验逻辑
+	_ = coord.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 1 << 20, Per: time.Second}})
+	return coord, NewListener(coord)
+}
+
+// TestSubmitOldJobKeepsLatest 提交旧任务时按旧任务 nonce 校验，且不改写会话的最新任务
+func TestSubmitOldJobKeepsLatest(t *testing.T) {
+	coord, lst := newRaceCoordinator()
+	coord.RegisterSession("c1", "u1")
+	coord.run()
+	oldID, oldNonce := coord.jobID, coord.serverNonce
+	coord.run()
+	s := coord.sessions["c1"]
+
+	p := protocol.SubmitParams{JobID: oldID, ClientNonce: "n1", Result: clientResult(oldNonce, "n1")}
+	if _, err := lst.handleSubmit("c1", p); err != nil {
+		t.Fatalf("old job submit: %v", err)
+	}
+	if id, nonce, _ := s.Latest(); id != coord.jobID || nonce != coord.serverNonce {
+		t.Fatalf("latest job overwritten: %d %s", id, nonce)
+	}
+	// 用最新任务的 nonce 计算旧任务的结果应被拒绝
+	p = protocol.SubmitParams{JobID: oldID, ClientNonce: "n2", Result: clientResult(coord.serverNonce, "n2")}
+	if _, err := lst.handleSubmit("c1", p); err == nil || err.Error() != "Invalid result" {
+		t.Fatalf("expect Invalid result, got %v", err)
+	}
+}
+
+// TestSubmitConcurrentSameSession 同一会话并发提交同一 nonce 只有一次被接受；需配合 -race 运行
+func TestSubmitConcurrentSameSession(t *testing.T) {
+	coord, lst := newRaceCoordinator()
+	coord.RegisterSession("c1", "u1")
+	coord.run()
+	jobID, nonce := coord.jobID, coord.serverNonce
+
+	var accepted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := protocol.SubmitParams{JobID: jobID, ClientNonce: "same", Result: clientResult(nonce, "same")}
+			if _, err := lst.handleSubmit("c1", p); err == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Fatalf("expect exactly 1 accepted, got %d", accepted)
+	}
+}
+
+// TestSubmitRacesBroadcast 提交、轮换广播、会话注册与断开并发进行；需配合 -race 运行
+func TestSubmitRacesBroadcast(t *testing.T) {
+	coord, lst := newRaceCoordinator()
+	st := NewState(coord)
+	const sessions = 8
+	for i := 0; i < sessions; i++ {
+		coord.RegisterSession("c"+strconv.Itoa(i), "u"+strconv.Itoa(i))
+	}
+	coord.run()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				coord.run()
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				id := "tmp" + strconv.Itoa(i%4)
+				coord.RegisterSession(id, "tmp")
+				_ = st.Disconnect(id)
+			}
+		}
+	}()
+	var submitters sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		submitters.Add(1)
+		go func(ch string) {
+			defer submitters.Done()
+			for n := 0; n < 200; n++ {
+				coord.mu.RLock()
+				jobID, nonce := coord.jobID, coord.serverNonce
+				coord.mu.RUnlock()
+				cn := strconv.Itoa(n)
+				_, err := lst.handleSubmit(ch, protocol.SubmitParams{JobID: jobID, ClientNonce: cn, Result: clientResult(nonce, cn)})
+				if err != nil && err.Error() == "Invalid result" {
+					t.Errorf("%s: valid share rejected", ch)
+					return
+				}
+			}
+		}("c" + strconv.Itoa(i))
+	}
+	submitters.Wait()
+	close(stop)
+	wg.Wait()
+}
+
+// TestSubmitValidatesAgainstSharedJobTable 两个节点共享 StateStore：B 节点的会话提交 A 节点创建的任务，
+// 按任务表中的 nonce 校验通过；不在任务表中的任务号被拒绝
+func TestSubmitValidatesAgainstSharedJobTable(t *testing.T) {
+	shared := newMemStore()
+	nodeA := NewCoordinator(nopPusher{}, &fakeStore{}, shared, &fakeMQ{}, time.Second, time.Minute, time.Minute)
+	nodeB := NewCoordinator(nopPusher{}, &fakeStore{}, shared, &fakeMQ{}, time.Second, time.Minute, time.Minute)
+	_ = nodeB.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 100, Per: time.Second}})
+	nodeA.rotateJob()
+	nodeA.rotateJob()
+	foreignID, foreignNonce := nodeA.jobID, nodeA.serverNonce
+
+	lst := NewListener(nodeB)
+	nodeB.RegisterSession("c1", "u1")
+	p := protocol.SubmitParams{JobID: foreignID, ClientNonce: "n1", Result: clientResult(foreignNonce, "n1")}
+	if _, err := lst.handleSubmit("c1", p); err != nil {
+		t.Fatalf("foreign job submit: %v", err)
+	}
+	if id, _, _ := nodeB.sessions["c1"].Latest(); id != 0 {
+		t.Fatal("submit must not change the session's latest job")
+	}
+	p = protocol.SubmitParams{JobID: foreignID + 100, ClientNonce: "n2", Result: clientResult(foreignNonce, "n2")}
+	if _, err := lst.handleSubmit("c1", p); err == nil || err.Error() != "Task does not exist" {
+		t.Fatalf("expect Task does not exist, got %v", err)
+	}
+}
+
+// hitFilter 模拟误判：任何 nonce 都命中
+type hitFilter struct{ NonceFilter }
+
+func (hitFilter) Contains(int, string) bool { return true }
+func (hitFilter) Probabilistic() bool       { return true }
+
+// usedNonceStore 在 memStore 之上记录已用 nonce
+type usedNonceStore struct {
+	*memStore
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+func (u *usedNonceStore) SaveUsedNonce(username string, jobID int, clientNonce string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.used[username+"/"+strconv.Itoa(jobID)+"/"+clientNonce] = true
+	return nil
+}
+
+func (u *usedNonceStore) HasUsedNonce(username string, jobID int, clientNonce string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.used[username+"/"+strconv.Itoa(jobID)+"/"+clientNonce], nil
+}
+
+// TestBloomHitConfirmedByStore 过滤器命中但存储中没有记录的提交被接受，存储确认的才按重复拒绝
+func TestBloomHitConfirmedByStore(t *testing.T) {
+	store := &usedNonceStore{memStore: newMemStore(), used: make(map[string]bool)}
+	coord := NewCoordinator(nopPusher{}, &fakeStore{}, store, &fakeMQ{}, time.Second, 0, time.Minute)
+	_ = coord.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 1 << 20, Per: time.Second}})
+	coord.SetNonceFilter(func() NonceFilter { return hitFilter{NewExactNonceFilter()} })
+	coord.RegisterSession("c1", "u1")
+	coord.run()
+	lst := NewListener(coord)
+
+	p := protocol.SubmitParams{JobID: coord.jobID, ClientNonce: "n1", Result: clientResult(coord.serverNonce, "n1")}
+	if _, err := lst.handleSubmit("c1", p); err != nil {
+		t.Fatalf("false positive must not reject: %v", err)
+	}
+	if _, err := lst.handleSubmit("c1", p); !errors.Is(err, ErrDuplicateSubmission) {
+		t.Fatalf("expect confirmed duplicate, got %v", err)
+	}
+}
+
+// TestUnconfirmedBloomHitNotScored 无法向存储确认的命中按重复拒绝，但不计入封禁评分
+func TestUnconfirmedBloomHitNotScored(t *testing.T) {
+	coord := NewCoordinator(nopPusher{}, &fakeStore{}, nil, &fakeMQ{}, time.Second, 0, time.Minute)
+	_ = coord.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 1 << 20, Per: time.Second}})
+	coord.SetBanPolicy(testBanPolicy())
+	coord.SetNonceFilter(func() NonceFilter { return hitFilter{NewExactNonceFilter()} })
+	coord.RegisterSession("c1", "u1")
+	coord.run()
+	lst := NewListener(coord)
+
+	for i := 0; i < 10; i++ {
+		n := "n" + strconv.Itoa(i)
+		_, err := lst.handleSubmit("c1", protocol.SubmitParams{JobID: coord.jobID, ClientNonce: n, Result: clientResult(coord.serverNonce, n)})
+		var probable probableDuplicateError
+		if !errors.Is(err, ErrDuplicateSubmission) || !errors.As(err, &probable) {
+			t.Fatalf("expect unconfirmed duplicate, got %v", err)
+		}
+		coord.recordOutcome("c1", err)
+	}
+	if _, banned := coord.bans.Check("u1", "", coord.clk.Now()); banned {
+		t.Fatal("unconfirmed duplicates must not lead to a ban")
+	}
+}
+
+// countingStore 统计 LoadJob 与 LoadLatestJob 的调用次数，hidden 中的任务号模拟不在任务表中
+type countingStore struct {
+	*memStore
+	mu     sync.Mutex
+	loads  map[int]int
+	latest int
+	hidden map[int]bool
+}
+
+func (c *countingStore) LoadJob(jobID int) (JobRecord, bool, error) {
+	c.mu.Lock()
+	c.loads[jobID]++
+	hidden := c.hidden[jobID]
+	c.mu.Unlock()
+	if hidden {
+		return JobRecord{}, false, nil
+	}
+	return c.memStore.LoadJob(jobID)
+}
+
+func (c *countingStore) LoadLatestJob() (int, string, time.Time, error) {
+	c.mu.Lock()
+	c.latest++
+	c.mu.Unlock()
+	return c.memStore.LoadLatestJob()
+}
+
+// TestLookupUnknownJobsBounded 一批并发的未知任务号最多各回源一次；超出已知范围的任务号不查询任务表
+func TestLookupUnknownJobsBounded(t *testing.T) {
+	shared := newMemStore()
+	nodeA := NewCoordinator(nopPusher{}, &fakeStore{}, shared, &fakeMQ{}, time.Second, 0, time.Hour)
+	for i := 0; i < 5; i++ {
+		nodeA.rotateJob()
+	}
+	store := &countingStore{memStore: shared, loads: make(map[int]int), hidden: map[int]bool{3: true}}
+	nodeB := NewCoordinator(nopPusher{}, &fakeStore{}, store, &fakeMQ{}, time.Second, 0, time.Hour)
+
+	ids := []int{-1, 0, 1, 2, 3, 4, 5, 6, 7, 100, 1 << 30}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		for _, id := range ids {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				_, _, _ = nodeB.lookupJob(id)
+			}(id)
+		}
+	}
+	wg.Wait()
+	for id, n := range store.loads {
+		if n > 1 {
+			t.Fatalf("job %d loaded %d times", id, n)
+		}
+		if id <= 0 || id > 5 {
+			t.Fatalf("job %d outside the known range should not be loaded", id)
+		}
+	}
+	if store.latest > 1 {
+		t.Fatalf("latest job refreshed %d times", store.latest)
+	}
+	if _, ok, _ := nodeB.lookupJob(5); !ok {
+		t.Fatal("foreign job 5 should be found")
+	}
+	if _, ok, _ := nodeB.lookupJob(3); ok {
+		t.Fatal("job 3 is not in the job table")
+	}
+}
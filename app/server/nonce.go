@@ -0,0 +1,165 @@
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// NonceFilter 记录会话在各任务下已提交过的 client nonce，用于拒绝重复提交。
+// 任务离开历史窗口后由 Coordinator 调用 EvictBefore 释放对应的集合
+type NonceFilter interface {
+	// Contains 返回 nonce 是否可能已在 jobID 下提交过
+	Contains(jobID int, nonce string) bool
+	Add(jobID int, nonce string)
+	// EvictBefore 丢弃 jobID 小于 minJobID 的全部记录
+	EvictBefore(minJobID int)
+	// Jobs 返回当前持有记录的任务数
+	Jobs() int
+}
+
+// ProbabilisticFilter 由可能误判的 NonceFilter 实现（如布隆过滤器）：Contains 命中不代表一定提交过，
+// 需要向 StateStore 确认
+type ProbabilisticFilter interface {
+	Probabilistic() bool
+}
+
+// NonceFilterFactory 为每个新会话创建 NonceFilter
+type NonceFilterFactory func() NonceFilter
+
+const (
+	DefaultBloomCapacity = 4096
+	DefaultBloomFPRate   = 0.001
+)
+
+// exactNonceFilter 按任务保存完整的 nonce 集合，无误判，内存随提交数线性增长
+type exactNonceFilter struct {
+	mu   sync.Mutex
+	jobs map[int]map[string]struct{}
+}
+
+// NewExactNonceFilter 默认实现
+func NewExactNonceFilter() NonceFilter {
+	return &exactNonceFilter{jobs: make(map[int]map[string]struct{})}
+}
+
+func (f *exactNonceFilter) Contains(jobID int, nonce string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.jobs[jobID][nonce]
+	return ok
+}
+
+func (f *exactNonceFilter) Add(jobID int, nonce string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.jobs[jobID]
+	if !ok {
+		m = make(map[string]struct{})
+		f.jobs[jobID] = m
+	}
+	m[nonce] = struct{}{}
+}
+
+func (f *exactNonceFilter) EvictBefore(minJobID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id := range f.jobs {
+		if id < minJobID {
+			delete(f.jobs, id)
+		}
+	}
+}
+
+func (f *exactNonceFilter) Jobs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.jobs)
+}
+
+// bloomNonceFilter 每个任务一个固定大小的布隆过滤器，内存与提交数无关；
+// 代价是存在误判：极少数从未提交过的 nonce 会命中，由监听器向 StateStore 确认，不会放过真正的重复
+type bloomNonceFilter struct {
+	mu     sync.Mutex
+	words  int
+	hashes int
+	jobs   map[int][]uint64
+}
+
+// NewBloomNonceFilter 返回按单任务 capacity 个 nonce、误判率 fpRate 设计的过滤器工厂，
+// 适合高频提交的会话；参数非法时使用默认值
+func NewBloomNonceFilter(capacity int, fpRate float64) NonceFilterFactory {
+	if capacity <= 0 {
+		capacity = DefaultBloomCapacity
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultBloomFPRate
+	}
+	bits := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Max(1, math.Round(bits/float64(capacity)*math.Ln2)))
+	words := int(math.Ceil(bits / 64))
+	return func() NonceFilter {
+		return &bloomNonceFilter{words: words, hashes: hashes, jobs: make(map[int][]uint64)}
+	}
+}
+
+// positions 使用双重哈希 h1 + i*h2 生成 k 个位置
+func (f *bloomNonceFilter) positions(nonce string, fn func(word int, mask uint64) bool) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nonce))
+	// FNV 对短字符串的低位分布较差，先经 splitmix64 混合再拆成两个哈希
+	sum := h.Sum64()
+	sum ^= sum >> 30
+	sum *= 0xbf58476d1ce4e5b9
+	sum ^= sum >> 27
+	sum *= 0x94d049bb133111eb
+	sum ^= sum >> 31
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(f.words * 64)
+	for i := 0; i < f.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % m
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomNonceFilter) Probabilistic() bool { return true }
+
+func (f *bloomNonceFilter) Contains(jobID int, nonce string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bits, ok := f.jobs[jobID]
+	if !ok {
+		return false
+	}
+	return f.positions(nonce, func(w int, mask uint64) bool { return bits[w]&mask != 0 })
+}
+
+func (f *bloomNonceFilter) Add(jobID int, nonce string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bits, ok := f.jobs[jobID]
+	if !ok {
+		bits = make([]uint64, f.words)
+		f.jobs[jobID] = bits
+	}
+	f.positions(nonce, func(w int, mask uint64) bool { bits[w] |= mask; return true })
+}
+
+func (f *bloomNonceFilter) EvictBefore(minJobID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id := range f.jobs {
+		if id < minJobID {
+			delete(f.jobs, id)
+		}
+	}
+}
+
+func (f *bloomNonceFilter) Jobs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.jobs)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+)
+
+func TestNonceFilters(t *testing.T) {
+	for name, newFilter := range map[string]NonceFilterFactory{
+		"exact": NewExactNonceFilter,
+		"bloom": NewBloomNonceFilter(1000, 0.001),
+	} {
+		f := newFilter()
+		for i := 0; i < 1000; i++ {
+			f.Add(1, strconv.Itoa(i))
+		}
+		for i := 0; i < 1000; i++ {
+			if !f.Contains(1, strconv.Itoa(i)) {
+				t.Fatalf("%s: added nonce %d not found", name, i)
+			}
+		}
+		fp := 0
+		for i := 1000; i < 11000; i++ {
+			if f.Contains(1, strconv.Itoa(i)) {
+				fp++
+			}
+		}
+		// 误判率按 0.1% 设计，留足余量
+		if fp > 50 {
+			t.Fatalf("%s: too many false positives: %d", name, fp)
+		}
+		if f.Contains(2, "0") {
+			t.Fatalf("%s: nonce is scoped by job", name)
+		}
+		f.Add(2, "x")
+		f.EvictBefore(2)
+		if f.Jobs() != 1 || f.Contains(1, "0") || !f.Contains(2, "x") {
+			t.Fatalf("%s: evict mismatch", name)
+		}
+	}
+}
+
+// TestHistoryBoundedOverRotations 数千次轮换后任务历史与会话 nonce 集合保持有界
+func TestHistoryBoundedOverRotations(t *testing.T) {
+	interval := 100 * time.Millisecond
+	window := time.Second
+	coord := NewCoordinator(&memPusher{}, &fakeStore{}, nil, &fakeMQ{}, interval, 0, window)
+	coord.SetNonceFilter(NewBloomNonceFilter(16, 0.01))
+	coord.RegisterSession("c1", "u1")
+	coord.RegisterSession("c2", "u2")
+	exact := NewExactNonceFilter()
+	coord.sessions["c2"].UsedNonces = exact
+
+	maxJobs := int(window/interval) + 1
+	for i := 0; i < 5000; i++ {
+		coord.rotateJob()
+		for _, s := range coord.sessions {
+			s.UsedNonces.Add(coord.jobID, "n"+strconv.Itoa(i))
+		}
+		if len(coord.history) > maxJobs {
+			t.Fatalf("rotation %d: history size %d exceeds %d", i, len(coord.history), maxJobs)
+		}
+	}
+	for id, s := range coord.sessions {
+		if n := s.UsedNonces.Jobs(); n > maxJobs {
+			t.Fatalf("session %s keeps %d jobs", id, n)
+		}
+	}
+	if _, ok := coord.job(coord.jobID); !ok {
+		t.Fatal("current job must be kept")
+	}
+	if _, ok := coord.job(1); ok {
+		t.Fatal("oldest job should be pruned")
+	}
+}
+
+func TestHistoryPrunedByAge(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	coord := NewCoordinator(&memPusher{}, &fakeStore{}, nil, &fakeMQ{}, time.Hour, 2*time.Minute, time.Minute)
+	coord.SetClock(clk)
+	coord.RegisterSession("c1", "u1")
+	coord.rotateJob()
+	coord.sessions["c1"].UsedNonces.Add(1, "a")
+	coord.rotateJob()
+
+	// 保留时长取 historyWindow 与 expireAfter 中较大者
+	coord.pruneHistory(clk.Now().Add(90 * time.Second))
+	if len(coord.history) != 2 {
+		t.Fatalf("jobs within expireAfter must be kept, got %d", len(coord.history))
+	}
+	coord.pruneHistory(clk.Now().Add(3 * time.Minute))
+	if len(coord.history) != 1 || coord.sessions["c1"].UsedNonces.Jobs() != 0 {
+		t.Fatal("expired job and its nonces should be evicted")
+	}
+}
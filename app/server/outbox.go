@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/events"
+	"github.com/JellyTony/kupool/logger"
+)
+
+const (
+	DefaultOutboxInterval = 200 * time.Millisecond
+	DefaultOutboxBatch    = 100
+	// DefaultOutboxRetention 已发送消息与已处理事件记录的保留时长，超过后由 relay 清理
+	DefaultOutboxRetention = 24 * time.Hour
+	// DefaultOutboxSweepInterval relay 清理已发送消息的间隔
+	DefaultOutboxSweepInterval = 10 * time.Minute
+)
+
+// outbox 消息主题：submit 走统计队列 Publish，其余按事件流 PublishEvent
+const outboxTopicSubmit = "submit"
+
+// ErrDuplicateSubmission 持久化层发现 client_nonce 已被使用
+var ErrDuplicateSubmission = errors.New("Duplicate submission")
+
+// SubmitRecord 一次通过校验的提交需要持久化的状态
+type SubmitRecord struct {
+	Username          string
+	JobID             int
+	ClientNonce       string
+	LatestJobID       int
+	LatestServerNonce string
+	SubmitAt          time.Time
+}
+
+// OutboxMessage 待发布到 MQ 的消息
+type OutboxMessage struct {
+	ID      int64
+	Topic   string
+	Payload []byte
+}
+
+// OutboxStore 由支持事务的 StateStore 实现（transactional outbox）：
+// RecordSubmit 在同一事务内写入已用 nonce、用户状态与 outbox 消息，nonce 已存在时返回 ErrDuplicateSubmission；
+// RelayOutbox 认领最多 limit 条未发送消息，不持有锁地逐条交给 publish，每条成功后立即标记为已发送，
+// 遇到失败即停止并返回已发送条数，其余消息留待下次；SweepOutbox 删除 before 之前已发送的消息
+type OutboxStore interface {
+	RecordSubmit(rec SubmitRecord, msgs []OutboxMessage) error
+	RelayOutbox(limit int, publish func(OutboxMessage) error) (int, error)
+	SweepOutbox(before time.Time) (int, error)
+}
+
+// submitOutboxMessages 构造一次提交对应的 outbox 消息
+func submitOutboxMessages(evt events.SubmitEvent, accepted events.Envelope) []OutboxMessage {
+	sub, _ := json.Marshal(evt)
+	env, _ := json.Marshal(accepted)
+	return []OutboxMessage{
+		{Topic: outboxTopicSubmit, Payload: sub},
+		{Topic: string(accepted.Kind), Payload: env},
+	}
+}
+
+// outboxRelay 周期性地把 outbox 中未发送的消息发布到 MQ，并按保留期清理已发送的消息
+type outboxRelay struct {
+	store      OutboxStore
+	mq         MessageQueue
+	interval   time.Duration
+	batch      int
+	retention  time.Duration
+	sweepEvery time.Duration
+	lastSweep  time.Time
+	clk        clock.Clock
+	stop       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+func newOutboxRelay(store OutboxStore, mq MessageQueue) *outboxRelay {
+	return &outboxRelay{
+		store:      store,
+		mq:         mq,
+		interval:   DefaultOutboxInterval,
+		batch:      DefaultOutboxBatch,
+		retention:  DefaultOutboxRetention,
+		sweepEvery: DefaultOutboxSweepInterval,
+		clk:        clock.Real(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (r *outboxRelay) start() {
+	go func() {
+		defer close(r.done)
+		ticker := r.clk.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				// 退出前尽量把剩余消息发出去
+				r.drain()
+				return
+			case now := <-ticker.C():
+				r.drain()
+				r.sweep(now)
+			}
+		}
+	}()
+}
+
+// drain 连续发布直到 outbox 为空或出错
+func (r *outboxRelay) drain() {
+	for {
+		n, err := r.store.RelayOutbox(r.batch, r.publish)
+		if err != nil {
+			logger.WithFields(logger.Fields{"module": "app.outbox"}).Warnf("relay outbox failed: %v", err)
+			return
+		}
+		if n < r.batch {
+			return
+		}
+	}
+}
+
+// sweep 每 sweepEvery 删除一次超过保留期的已发送消息
+func (r *outboxRelay) sweep(now time.Time) {
+	if !r.lastSweep.IsZero() && now.Sub(r.lastSweep) < r.sweepEvery {
+		return
+	}
+	r.lastSweep = now
+	n, err := r.store.SweepOutbox(now.Add(-r.retention))
+	if err != nil {
+		logger.WithFields(logger.Fields{"module": "app.outbox"}).Warnf("sweep outbox failed: %v", err)
+		return
+	}
+	if n > 0 {
+		logger.WithFields(logger.Fields{"module": "app.outbox", "rows": n}).Debug("outbox swept")
+	}
+}
+
+// publish 发布一条 outbox 消息，事件 ID 取 outbox 行号供订阅者去重；无法解析的消息丢弃并视为已发送
+func (r *outboxRelay) publish(m OutboxMessage) error {
+	id := strconv.FormatInt(m.ID, 10)
+	if m.Topic == outboxTopicSubmit {
+		var evt events.SubmitEvent
+		if err := json.Unmarshal(m.Payload, &evt); err != nil {
+			logger.WithFields(logger.Fields{"module": "app.outbox", "id": m.ID}).Warnf("drop malformed outbox message: %v", err)
+			return nil
+		}
+		evt.ID = id
+		return r.mq.Publish(evt)
+	}
+	var env events.Envelope
+	if err := json.Unmarshal(m.Payload, &env); err != nil {
+		logger.WithFields(logger.Fields{"module": "app.outbox", "id": m.ID}).Warnf("drop malformed outbox message: %v", err)
+		return nil
+	}
+	env.ID = id
+	return r.mq.PublishEvent(env)
+}
+
+// close 停止 relay 并等待最后一次发布完成
+func (r *outboxRelay) close() {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/events"
+	"github.com/JellyTony/kupool/mq"
+	"github.com/JellyTony/kupool/protocol"
+)
+
+// outboxMemStore 在 memStore 之上模拟 PG 的事务性 outbox
+type outboxMemStore struct {
+	*memStore
+	mu     sync.Mutex
+	nextID int64
+	used   map[string]struct{}
+	rows   []OutboxMessage
+	sent   map[int64]time.Time
+	failN  int
+}
+
+func newOutboxMemStore() *outboxMemStore {
+	return &outboxMemStore{memStore: newMemStore(), used: make(map[string]struct{}), sent: make(map[int64]time.Time)}
+}
+
+func (o *outboxMemStore) RecordSubmit(rec SubmitRecord, msgs []OutboxMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := rec.Username + "/" + rec.ClientNonce
+	if _, ok := o.used[key]; ok {
+		return ErrDuplicateSubmission
+	}
+	o.used[key] = struct{}{}
+	for _, m := range msgs {
+		o.nextID++
+		m.ID = o.nextID
+		o.rows = append(o.rows, m)
+	}
+	return nil
+}
+
+func (o *outboxMemStore) RelayOutbox(limit int, publish func(OutboxMessage) error) (int, error) {
+	o.mu.Lock()
+	var pending []OutboxMessage
+	for _, m := range o.rows {
+		if _, ok := o.sent[m.ID]; !ok && len(pending) < limit {
+			pending = append(pending, m)
+		}
+	}
+	o.mu.Unlock()
+	for i, m := range pending {
+		o.mu.Lock()
+		fail := o.failN > 0
+		if fail {
+			o.failN--
+		}
+		o.mu.Unlock()
+		if fail {
+			return i, errors.New("publish failed")
+		}
+		if err := publish(m); err != nil {
+			return i, err
+		}
+		o.mu.Lock()
+		o.sent[m.ID] = time.Now()
+		o.mu.Unlock()
+	}
+	return len(pending), nil
+}
+
+func (o *outboxMemStore) SweepOutbox(before time.Time) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	kept := o.rows[:0]
+	n := 0
+	for _, m := range o.rows {
+		if at, ok := o.sent[m.ID]; ok && at.Before(before) {
+			delete(o.sent, m.ID)
+			n++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	o.rows = kept
+	return n, nil
+}
+
+func (o *outboxMemStore) unsent() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, m := range o.rows {
+		if _, ok := o.sent[m.ID]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// flakyQueue 第 failAt 次发布失败，记录成功发布的次数
+type flakyQueue struct {
+	MessageQueue
+	calls  int
+	failAt int
+	ok     int
+}
+
+func (q *flakyQueue) try() error {
+	q.calls++
+	if q.calls == q.failAt {
+		return errors.New("mq unavailable")
+	}
+	q.ok++
+	return nil
+}
+
+func (q *flakyQueue) Publish(evt events.SubmitEvent) error {
+	if err := q.try(); err != nil {
+		return err
+	}
+	return q.MessageQueue.Publish(evt)
+}
+
+func (q *flakyQueue) PublishEvent(evt events.Envelope) error {
+	if err := q.try(); err != nil {
+		return err
+	}
+	return q.MessageQueue.PublishEvent(evt)
+}
+
+func TestOutboxRelayPublishesAndMarksSent(t *testing.T) {
+	store := newOutboxMemStore()
+	queue := mq.NewMemoryQueue(16)
+	accepted, _ := queue.SubscribeEvents("share.accepted")
+	now := time.Now()
+	msgs := submitOutboxMessages(events.SubmitEvent{Username: "u", Time: now}, events.NewShareAccepted(now, events.ShareAccepted{Username: "u", JobID: 1}))
+	if err := store.RecordSubmit(SubmitRecord{Username: "u", JobID: 1, ClientNonce: "n", SubmitAt: now}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RecordSubmit(SubmitRecord{Username: "u", JobID: 1, ClientNonce: "n", SubmitAt: now}, msgs); !errors.Is(err, ErrDuplicateSubmission) {
+		t.Fatal("expect duplicate")
+	}
+	r := newOutboxRelay(store, queue)
+	r.drain()
+	if store.unsent() != 0 {
+		t.Fatal("outbox not drained")
+	}
+	evt := <-queue.Subscribe()
+	if evt.Username != "u" || evt.ID == "" {
+		t.Fatalf("unexpected submit event %+v", evt)
+	}
+	if e := <-accepted; e.ShareAccepted == nil || e.ShareAccepted.JobID != 1 || e.ID == "" {
+		t.Fatal("share accepted not relayed")
+	}
+}
+
+// TestOutboxRelayPartialFailure 一批中途发布失败时，已发布的消息不会随重试再次发布
+func TestOutboxRelayPartialFailure(t *testing.T) {
+	store := newOutboxMemStore()
+	queue := &flakyQueue{MessageQueue: mq.NewMemoryQueue(16), failAt: 2}
+	now := time.Now()
+	for _, nonce := range []string{"a", "b"} {
+		msgs := submitOutboxMessages(events.SubmitEvent{Username: "u", Time: now}, events.NewShareAccepted(now, events.ShareAccepted{Username: "u", JobID: 1}))
+		if err := store.RecordSubmit(SubmitRecord{Username: "u", JobID: 1, ClientNonce: nonce, SubmitAt: now}, msgs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newOutboxRelay(store, queue)
+	r.drain()
+	if store.unsent() != 3 || queue.ok != 1 {
+		t.Fatalf("expect 1 published and 3 unsent, got %d published and %d unsent", queue.ok, store.unsent())
+	}
+	r.drain()
+	if store.unsent() != 0 || queue.ok != 4 {
+		t.Fatalf("expect each message published once, got %d publishes and %d unsent", queue.ok, store.unsent())
+	}
+}
+
+// TestOutboxRelaySweepsSent 超过保留期的已发送消息被清理，未发送的保留
+func TestOutboxRelaySweepsSent(t *testing.T) {
+	store := newOutboxMemStore()
+	now := time.Now()
+	msgs := submitOutboxMessages(events.SubmitEvent{Username: "u", Time: now}, events.NewShareAccepted(now, events.ShareAccepted{Username: "u", JobID: 1}))
+	if err := store.RecordSubmit(SubmitRecord{Username: "u", JobID: 1, ClientNonce: "a", SubmitAt: now}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	r := newOutboxRelay(store, mq.NewMemoryQueue(16))
+	r.drain()
+	if err := store.RecordSubmit(SubmitRecord{Username: "u", JobID: 1, ClientNonce: "b", SubmitAt: now}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	r.sweep(time.Now().Add(r.retention + time.Second))
+	if len(store.rows) != 2 || store.unsent() != 2 {
+		t.Fatalf("expect only the 2 unsent rows kept, got %d rows", len(store.rows))
+	}
+	// 间隔内不会再次清理
+	r.drain()
+	r.sweep(time.Now().Add(r.retention + 2*time.Second))
+	if len(store.rows) != 2 {
+		t.Fatalf("expect no sweep within interval, got %d rows", len(store.rows))
+	}
+}
+
+func TestStatsConsumerSkipsRelayedDuplicates(t *testing.T) {
+	store := &batchStore{}
+	c := newStatsConsumer(store, ConsumerOptions{Workers: 1, BatchSize: 100, BatchWindow: time.Hour})
+	ch := make(chan events.SubmitEvent, 4)
+	ch <- events.SubmitEvent{ID: "1", Username: "u", Time: time.Now()}
+	ch <- events.SubmitEvent{ID: "1", Username: "u", Time: time.Now()}
+	ch <- events.SubmitEvent{ID: "2", Username: "u", Time: time.Now()}
+	close(ch)
+	c.start(ch, make(chan struct{}))
+	c.wait()
+	if store.counts["u"] != 2 {
+		t.Fatalf("expect 2, got %d", store.counts["u"])
+	}
+}
+
+// onceStore 模拟在事务内登记事件 ID 的统计存储，seen 在消费者之间共享（相当于持久化）
+type onceStore struct {
+	batchStore
+	seen map[string]bool
+}
+
+func (o *onceStore) IncrementOnce(evts []events.SubmitEvent) error {
+	var deltas []StatDelta
+	for _, e := range evts {
+		if e.ID != "" {
+			if o.seen[e.ID] {
+				continue
+			}
+			o.seen[e.ID] = true
+		}
+		deltas = append(deltas, StatDelta{Username: e.Username, Minute: e.Time, Count: 1})
+	}
+	return o.BatchIncrement(deltas)
+}
+
+// TestStatsConsumerDedupAcrossRestart 消费者重启后再次收到同一 outbox 事件不重复计数
+func TestStatsConsumerDedupAcrossRestart(t *testing.T) {
+	store := &onceStore{seen: make(map[string]bool)}
+	for i := 0; i < 2; i++ {
+		c := newStatsConsumer(store, ConsumerOptions{Workers: 1, BatchSize: 100, BatchWindow: time.Hour})
+		ch := make(chan events.SubmitEvent, 4)
+		ch <- events.SubmitEvent{ID: "1", Username: "u", Time: time.Now()}
+		ch <- events.SubmitEvent{ID: "1", Username: "u", Time: time.Now()}
+		ch <- events.SubmitEvent{Username: "u", Time: time.Now()}
+		close(ch)
+		c.start(ch, make(chan struct{}))
+		c.wait()
+	}
+	if store.counts["u"] != 3 {
+		t.Fatalf("expect 3, got %d", store.counts["u"])
+	}
+}
+
+func TestSubmitGoesThroughOutbox(t *testing.T) {
+	store := newOutboxMemStore()
+	store.failN = 1
+	app := startTestApp(t, "127.0.0.1:9098", store, store, mq.NewMemoryQueue(16), 0, func(a *AppServer) {
+		a.SetConsumerOptions(ConsumerOptions{BatchWindow: 10 * time.Millisecond})
+	})
+	conn := app.authorize(t, "ob")
+	app.rotate()
+	job := readJob(t, conn)
+	resp := sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "n1", Result: clientResult(job.ServerNonce, "n1")})
+	if !resp.Result {
+		t.Fatal("expect success")
+	}
+	// 第一次发布失败，下一个 relay 周期重试
+	waitFor(t, "relay retry", func() bool {
+		app.clk.Advance(DefaultOutboxInterval)
+		return store.unsent() == 0
+	})
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// RateLimiter 按 key 限制提交速率；now 由调用方传入，便于用假时钟测试
+type RateLimiter interface {
+	// Allow 尝试在 now 消耗一次配额，不允许时返回距离下次可用的等待时长
+	Allow(key string, now time.Time) (ok bool, wait time.Duration)
+	// Forget 释放 key 的状态
+	Forget(key string)
+}
+
+// sweepEvery 每处理多少次 Allow 清理一次空闲 key，避免按账号/IP 限速时 key 无限增长
+const sweepEvery = 1024
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBucket 令牌桶：每 per 补充 limit 个令牌，最多积累 burst 个
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64 // 每纳秒补充的令牌数
+	burst   float64
+	buckets map[string]*bucket
+	calls   int
+}
+
+// NewTokenBucket 每 per 允许 limit 次，允许 burst 次突发（burst<=0 时等于 limit）
+func NewTokenBucket(limit int, per time.Duration, burst int) RateLimiter {
+	if burst <= 0 {
+		burst = limit
+	}
+	return &tokenBucket{rate: float64(limit) / float64(per), burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+func (b *tokenBucket) refill(bk *bucket, now time.Time) {
+	if elapsed := now.Sub(bk.last); elapsed > 0 {
+		bk.tokens = math.Min(b.burst, bk.tokens+float64(elapsed)*b.rate)
+		bk.last = now
+	}
+}
+
+func (b *tokenBucket) Allow(key string, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sweep(now)
+	bk, ok := b.buckets[key]
+	if !ok {
+		bk = &bucket{tokens: b.burst, last: now}
+		b.buckets[key] = bk
+	}
+	b.refill(bk, now)
+	if bk.tokens >= 1 {
+		bk.tokens--
+		return true, 0
+	}
+	return false, time.Duration(math.Ceil((1 - bk.tokens) / b.rate))
+}
+
+func (b *tokenBucket) Forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.buckets, key)
+}
+
+// sweep 删除已补满的桶，它们与新建的桶等价
+func (b *tokenBucket) sweep(now time.Time) {
+	if b.calls++; b.calls%sweepEvery != 0 {
+		return
+	}
+	for k, bk := range b.buckets {
+		b.refill(bk, now)
+		if bk.tokens >= b.burst {
+			delete(b.buckets, k)
+		}
+	}
+}
+
+// slidingWindow 滑动窗口：任意长度为 window 的区间内最多 limit 次
+type slidingWindow struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+	calls  int
+}
+
+// NewSlidingWindow 任意 window 时长内最多允许 limit 次，每个 key 至多保存 limit 个时间戳
+func NewSlidingWindow(limit int, window time.Duration) RateLimiter {
+	return &slidingWindow{limit: limit, window: window, hits: make(map[string][]time.Time)}
+}
+
+func (w *slidingWindow) trim(ts []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-w.window)
+	i := 0
+	for i < len(ts) && !ts[i].After(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
+
+func (w *slidingWindow) Allow(key string, now time.Time) (bool, time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sweep(now)
+	ts := w.trim(w.hits[key], now)
+	if len(ts) < w.limit {
+		w.hits[key] = append(ts, now)
+		return true, 0
+	}
+	w.hits[key] = ts
+	return false, ts[0].Add(w.window).Sub(now)
+}
+
+func (w *slidingWindow) Forget(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.hits, key)
+}
+
+func (w *slidingWindow) sweep(now time.Time) {
+	if w.calls++; w.calls%sweepEvery != 0 {
+		return
+	}
+	for k, ts := range w.hits {
+		if len(w.trim(ts, now)) == 0 {
+			delete(w.hits, k)
+		}
+	}
+}
+
+// RateAlgorithm 限速算法
+type RateAlgorithm string
+
+const (
+	RateTokenBucket   RateAlgorithm = "token_bucket"
+	RateSlidingWindow RateAlgorithm = "sliding_window"
+)
+
+// RateLimitKey 限速维度
+type RateLimitKey string
+
+const (
+	RateKeySession RateLimitKey = "session"
+	RateKeyAccount RateLimitKey = "account"
+	RateKeyIP      RateLimitKey = "ip"
+)
+
+// OverLimitAction 超限时的处理方式
+type OverLimitAction string
+
+const (
+	// ActionReject 返回 Submission too frequent
+	ActionReject OverLimitAction = "reject"
+	// ActionDelay 预占下一个配额并推迟响应到配额可用时，等待超过 MaxDelay 时拒绝
+	ActionDelay OverLimitAction = "delay"
+	// ActionDisconnect 拒绝，连续超限 MaxViolations 次后断开连接
+	ActionDisconnect OverLimitAction = "disconnect"
+)
+
+const (
+	DefaultMaxViolations = 5
+	// disconnectDelay 断开前给拒绝响应留出的写出时间
+	disconnectDelay = 200 * time.Millisecond
+)
+
+var (
+	ErrSubmitTooFrequent = errors.New("Submission too frequent")
+	// errRateDisconnect 超限次数达到阈值，Receive 在返回错误后断开连接
+	errRateDisconnect = fmt.Errorf("%w, disconnecting", ErrSubmitTooFrequent)
+)
+
+// RatePolicy 一个限速档位
+type RatePolicy struct {
+	Algorithm     RateAlgorithm
+	Limit         int
+	Per           time.Duration
+	Burst         int
+	Key           RateLimitKey
+	Action        OverLimitAction
+	MaxDelay      time.Duration
+	MaxViolations int
+}
+
+// DefaultRatePolicy 每会话每秒 1 次，超限拒绝
+func DefaultRatePolicy() RatePolicy {
+	return RatePolicy{Algorithm: RateTokenBucket, Limit: 1, Per: time.Second, Burst: 1, Key: RateKeySession, Action: ActionReject}
+}
+
+// normalize 补全默认值并校验
+func (p RatePolicy) normalize() (RatePolicy, error) {
+	if p.Algorithm == "" {
+		p.Algorithm = RateTokenBucket
+	}
+	if p.Key == "" {
+		p.Key = RateKeySession
+	}
+	if p.Action == "" {
+		p.Action = ActionReject
+	}
+	if p.Limit <= 0 || p.Per <= 0 {
+		return p, errors.New("rate limit and period must be positive")
+	}
+	if p.Burst <= 0 {
+		p.Burst = p.Limit
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = p.Per
+	}
+	if p.MaxViolations <= 0 {
+		p.MaxViolations = DefaultMaxViolations
+	}
+	switch p.Algorithm {
+	case RateTokenBucket, RateSlidingWindow:
+	default:
+		return p, fmt.Errorf("unknown rate algorithm %q", p.Algorithm)
+	}
+	switch p.Key {
+	case RateKeySession, RateKeyAccount, RateKeyIP:
+	default:
+		return p, fmt.Errorf("unknown rate key %q", p.Key)
+	}
+	switch p.Action {
+	case ActionReject, ActionDelay, ActionDisconnect:
+	default:
+		return p, fmt.Errorf("unknown over-limit action %q", p.Action)
+	}
+	return p, nil
+}
+
+func (p RatePolicy) newLimiter() RateLimiter {
+	if p.Algorithm == RateSlidingWindow {
+		return NewSlidingWindow(p.Limit, p.Per)
+	}
+	return NewTokenBucket(p.Limit, p.Per, p.Burst)
+}
+
+type ratePolicyJSON struct {
+	Algorithm     RateAlgorithm   `json:"algorithm"`
+	Limit         int             `json:"limit"`
+	Per           string          `json:"per"`
+	Burst         int             `json:"burst"`
+	Key           RateLimitKey    `json:"key"`
+	Action        OverLimitAction `json:"action"`
+	MaxDelay      string          `json:"max_delay"`
+	MaxViolations int             `json:"max_violations"`
+}
+
+// UnmarshalJSON 时长字段使用 "1s"、"500ms" 形式
+func (p *RatePolicy) UnmarshalJSON(data []byte) error {
+	var raw ratePolicyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*p = RatePolicy{Algorithm: raw.Algorithm, Limit: raw.Limit, Burst: raw.Burst, Key: raw.Key, Action: raw.Action, MaxViolations: raw.MaxViolations}
+	var err error
+	if raw.Per != "" {
+		if p.Per, err = time.ParseDuration(raw.Per); err != nil {
+			return err
+		}
+	}
+	if raw.MaxDelay != "" {
+		if p.MaxDelay, err = time.ParseDuration(raw.MaxDelay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RateLimitConfig 提交限速配置：Accounts 把用户名映射到 Tiers 中的档位，未映射的用户使用 Default
+type RateLimitConfig struct {
+	Default  RatePolicy            `json:"default"`
+	Tiers    map[string]RatePolicy `json:"tiers"`
+	Accounts map[string]string     `json:"accounts"`
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{Default: DefaultRatePolicy()}
+}
+
+// LoadRateLimitConfig 从 JSON 文件读取限速配置
+func LoadRateLimitConfig(path string) (RateLimitConfig, error) {
+	cfg := DefaultRateLimitConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse rate limit config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// submitLimiter 按账号档位选择策略，每个档位一个 RateLimiter，并记录各会话连续超限次数
+type submitLimiter struct {
+	tiers      map[string]RatePolicy
+	accounts   map[string]string
+	limiters   map[string]RateLimiter
+	mu         sync.Mutex
+	violations map[string]int
+}
+
+func newSubmitLimiter(cfg RateLimitConfig) (*submitLimiter, error) {
+	l := &submitLimiter{tiers: make(map[string]RatePolicy), accounts: cfg.Accounts, limiters: make(map[string]RateLimiter), violations: make(map[string]int)}
+	add := func(tier string, p RatePolicy) error {
+		p, err := p.normalize()
+		if err != nil {
+			return fmt.Errorf("rate tier %q: %w", tier, err)
+		}
+		l.tiers[tier] = p
+		l.limiters[tier] = p.newLimiter()
+		return nil
+	}
+	if err := add("", cfg.Default); err != nil {
+		return nil, err
+	}
+	for name, p := range cfg.Tiers {
+		if err := add(name, p); err != nil {
+			return nil, err
+		}
+	}
+	for user, tier := range cfg.Accounts {
+		if _, ok := l.tiers[tier]; !ok {
+			return nil, fmt.Errorf("account %q refers to unknown rate tier %q", user, tier)
+		}
+	}
+	return l, nil
+}
+
+func (l *submitLimiter) tier(username string) string {
+	return l.accounts[username]
+}
+
+func limitKey(p RatePolicy, s *Session) string {
+	switch p.Key {
+	case RateKeyAccount:
+		return "account:" + s.Username
+	case RateKeyIP:
+		if s.RemoteIP != "" {
+			return "ip:" + s.RemoteIP
+		}
+	}
+	return "session:" + s.ChannelID
+}
+
+// check 在 now 为会话的一次提交申请配额。返回 nil 表示放行，delay 大于 0 时已预占 now+delay 的配额，
+// 调用方应把响应推迟 delay 再发出，而不是阻塞等待；超限时按策略拒绝或在连续超限达到阈值时返回 errRateDisconnect
+func (l *submitLimiter) check(s *Session, now time.Time) (delay time.Duration, err error) {
+	tier := l.tier(s.Username)
+	p, lim := l.tiers[tier], l.limiters[tier]
+	key := limitKey(p, s)
+	ok, wait := lim.Allow(key, now)
+	if !ok && p.Action == ActionDelay && wait <= p.MaxDelay {
+		if ok, _ = lim.Allow(key, now.Add(wait)); ok {
+			delay = wait
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ok {
+		delete(l.violations, s.ChannelID)
+		return delay, nil
+	}
+	l.violations[s.ChannelID]++
+	if p.Action == ActionDisconnect && l.violations[s.ChannelID] >= p.MaxViolations {
+		return 0, errRateDisconnect
+	}
+	return 0, ErrSubmitTooFrequent
+}
+
+// forget 会话断开时释放其状态；按账号/IP 的 key 可能被其他会话共享，由 limiter 自行清理
+func (l *submitLimiter) forget(s *Session) {
+	l.mu.Lock()
+	delete(l.violations, s.ChannelID)
+	l.mu.Unlock()
+	p := l.tiers[l.tier(s.Username)]
+	if p.Key == RateKeySession {
+		l.limiters[l.tier(s.Username)].Forget(limitKey(p, s))
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/protocol"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	tb := NewTokenBucket(2, time.Second, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := tb.Allow("k", clk.Now()); !ok {
+			t.Fatalf("burst submit %d denied", i)
+		}
+	}
+	ok, wait := tb.Allow("k", clk.Now())
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expect deny with 500ms wait, got %v %v", ok, wait)
+	}
+	if ok, _ := tb.Allow("other", clk.Now()); !ok {
+		t.Fatal("keys are independent")
+	}
+	clk.Advance(wait)
+	if ok, _ := tb.Allow("k", clk.Now()); !ok {
+		t.Fatal("token should be refilled")
+	}
+	tb.Forget("k")
+	if ok, _ := tb.Allow("k", clk.Now()); !ok {
+		t.Fatal("forgotten key starts with a full bucket")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	sw := NewSlidingWindow(3, time.Second)
+	start := clk.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := sw.Allow("k", clk.Now()); !ok {
+			t.Fatalf("submit %d denied", i)
+		}
+		clk.Advance(100 * time.Millisecond)
+	}
+	ok, wait := sw.Allow("k", clk.Now())
+	if ok || wait != 700*time.Millisecond {
+		t.Fatalf("expect deny with 700ms wait, got %v %v", ok, wait)
+	}
+	clk.Set(start.Add(time.Second))
+	if ok, _ := sw.Allow("k", clk.Now()); !ok {
+		t.Fatal("oldest hit should have left the window")
+	}
+	if ok, _ := sw.Allow("k", clk.Now()); ok {
+		t.Fatal("window still holds 3 hits")
+	}
+}
+
+func TestSubmitLimiterTiersAndKeys(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	l, err := newSubmitLimiter(RateLimitConfig{
+		Default: DefaultRatePolicy(),
+		Tiers: map[string]RatePolicy{
+			"vip":  {Algorithm: RateSlidingWindow, Limit: 10, Per: time.Second, Key: RateKeyAccount},
+			"farm": {Limit: 2, Per: time.Second, Key: RateKeyIP},
+		},
+		Accounts: map[string]string{"vip": "vip", "farm1": "farm", "farm2": "farm"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 默认档位：每会话每秒 1 次
+	basic := &Session{ChannelID: "c0", Username: "basic"}
+	if checkErr(l, basic, clk.Now()) != nil || !errors.Is(checkErr(l, basic, clk.Now()), ErrSubmitTooFrequent) {
+		t.Fatal("default tier should allow 1 per second")
+	}
+	// vip 按账号限速，两个会话共享 10 次配额
+	v1, v2 := &Session{ChannelID: "c1", Username: "vip"}, &Session{ChannelID: "c2", Username: "vip"}
+	for i := 0; i < 10; i++ {
+		s := v1
+		if i%2 == 1 {
+			s = v2
+		}
+		if err := checkErr(l, s, clk.Now()); err != nil {
+			t.Fatalf("vip submit %d: %v", i, err)
+		}
+	}
+	if checkErr(l, v2, clk.Now()) == nil {
+		t.Fatal("account quota should be shared across sessions")
+	}
+	// farm 按来源 IP 限速，不同账号同一 IP 共享配额
+	f1 := &Session{ChannelID: "c3", Username: "farm1", RemoteIP: "10.0.0.1"}
+	f2 := &Session{ChannelID: "c4", Username: "farm2", RemoteIP: "10.0.0.1"}
+	f3 := &Session{ChannelID: "c5", Username: "farm2", RemoteIP: "10.0.0.2"}
+	if checkErr(l, f1, clk.Now()) != nil || checkErr(l, f2, clk.Now()) != nil {
+		t.Fatal("ip quota of 2")
+	}
+	if checkErr(l, f2, clk.Now()) == nil {
+		t.Fatal("ip quota exhausted")
+	}
+	if checkErr(l, f3, clk.Now()) != nil {
+		t.Fatal("other ip has its own quota")
+	}
+}
+
+func TestSubmitLimiterActions(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	l, err := newSubmitLimiter(RateLimitConfig{
+		Default: RatePolicy{Limit: 1, Per: time.Second, Action: ActionDelay, MaxDelay: 500 * time.Millisecond},
+		Tiers:   map[string]RatePolicy{"strict": {Limit: 1, Per: time.Second, Action: ActionDisconnect, MaxViolations: 3}},
+		Accounts: map[string]string{
+			"bad": "strict",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delay：等待不超过 MaxDelay 时预占配额并返回需要推迟的时长，不阻塞；否则拒绝
+	s := &Session{ChannelID: "c1", Username: "u"}
+	_ = checkErr(l, s, clk.Now())
+	clk.Advance(600 * time.Millisecond)
+	delay, err := l.check(s, clk.Now())
+	if err != nil || delay != 400*time.Millisecond {
+		t.Fatalf("expect delayed accept after 400ms, got %v %v", delay, err)
+	}
+	// 预占的配额已用掉，下一次需要再等一整个周期
+	if err := checkErr(l, s, clk.Now()); !errors.Is(err, ErrSubmitTooFrequent) {
+		t.Fatalf("wait longer than max delay should be rejected, got %v", err)
+	}
+
+	// disconnect：连续超限 3 次后要求断开，中途放行会清零
+	b := &Session{ChannelID: "c2", Username: "bad"}
+	_ = checkErr(l, b, clk.Now())
+	_ = checkErr(l, b, clk.Now())
+	_ = checkErr(l, b, clk.Now())
+	clk.Advance(time.Second)
+	if checkErr(l, b, clk.Now()) != nil {
+		t.Fatal("allowed after refill")
+	}
+	for i := 1; i <= 3; i++ {
+		err := checkErr(l, b, clk.Now())
+		if i < 3 && err != ErrSubmitTooFrequent {
+			t.Fatalf("violation %d: expect reject, got %v", i, err)
+		}
+		if i == 3 && !errors.Is(err, errRateDisconnect) {
+			t.Fatalf("expect disconnect after 3 violations, got %v", err)
+		}
+	}
+}
+
+// recordAgent 记录推送给客户端的响应
+type recordAgent struct {
+	mu    sync.Mutex
+	resps []protocol.Response
+}
+
+func (a *recordAgent) ID() string { return "c1" }
+
+func (a *recordAgent) Push(data []byte) error {
+	var resp protocol.Response
+	_ = protocol.Decode(data, &resp)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.resps = append(a.resps, resp)
+	return nil
+}
+
+func (a *recordAgent) responses() []protocol.Response {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]protocol.Response(nil), a.resps...)
+}
+
+func submitPayload(id int, p protocol.SubmitParams) []byte {
+	raw, _ := protocol.Encode(p)
+	data, _ := protocol.Encode(protocol.Request{ID: &id, Method: "submit", Params: raw})
+	return data
+}
+
+// TestRateLimitBeforeValidation 无效与重复的提交同样受限速约束
+func TestRateLimitBeforeValidation(t *testing.T) {
+	coord := NewCoordinator(nopPusher{}, &fakeStore{}, nil, &fakeMQ{}, time.Second, 0, time.Minute)
+	coord.SetClock(clock.NewFake(time.Time{}))
+	_ = coord.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 2, Per: time.Second}})
+	coord.RegisterSession("c1", "u1")
+	coord.run()
+	lst := NewListener(coord)
+	valid := protocol.SubmitParams{JobID: coord.jobID, ClientNonce: "n1", Result: clientResult(coord.serverNonce, "n1")}
+	if _, err := lst.handleSubmit("c1", protocol.SubmitParams{JobID: coord.jobID, ClientNonce: "bad", Result: "deadbeef"}); !errors.Is(err, errInvalidResult) {
+		t.Fatalf("expect invalid result, got %v", err)
+	}
+	if _, err := lst.handleSubmit("c1", valid); err != nil {
+		t.Fatalf("expect accepted, got %v", err)
+	}
+	if _, err := lst.handleSubmit("c1", valid); !errors.Is(err, ErrSubmitTooFrequent) {
+		t.Fatalf("duplicate over the limit should be rate limited before the nonce check, got %v", err)
+	}
+}
+
+// TestDelayDefersResponse delay 动作不阻塞处理，成功响应在预占的配额到期后才发出
+func TestDelayDefersResponse(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	coord := NewCoordinator(nopPusher{}, &fakeStore{}, nil, &fakeMQ{}, time.Second, 0, time.Minute)
+	coord.SetClock(clk)
+	_ = coord.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 1, Per: time.Second, Action: ActionDelay, MaxDelay: 500 * time.Millisecond}})
+	coord.RegisterSession("c1", "u1")
+	coord.run()
+	lst := NewListener(coord)
+	ag := &recordAgent{}
+	submit := func(id int, nonce string) {
+		lst.Receive(ag, submitPayload(id, protocol.SubmitParams{JobID: coord.jobID, ClientNonce: nonce, Result: clientResult(coord.serverNonce, nonce)}))
+	}
+	submit(1, "a")
+	clk.Advance(600 * time.Millisecond)
+	submit(2, "b")
+	if n := len(ag.responses()); n != 1 {
+		t.Fatalf("second response should be deferred, got %d responses", n)
+	}
+	clk.Advance(400 * time.Millisecond)
+	resps := ag.responses()
+	if len(resps) != 2 || resps[1].ID != 2 || !resps[1].Result {
+		t.Fatalf("expect deferred success for request 2, got %+v", resps)
+	}
+}
+
+// checkErr 只关心 check 的错误
+func checkErr(l *submitLimiter, s *Session, now time.Time) error {
+	_, err := l.check(s, now)
+	return err
+}
+
+func TestLoadRateLimitConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate.json")
+	data := `{
+  "default": {"limit": 1, "per": "1s"},
+  "tiers": {"pro": {"algorithm": "sliding_window", "limit": 30, "per": "10s", "key": "account", "action": "delay", "max_delay": "250ms"}},
+  "accounts": {"alice": "pro"}
+}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadRateLimitConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pro := cfg.Tiers["pro"]
+	if pro.Per != 10*time.Second || pro.MaxDelay != 250*time.Millisecond || pro.Action != ActionDelay || cfg.Accounts["alice"] != "pro" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if _, err = newSubmitLimiter(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Accounts["bob"] = "missing"
+	if _, err = newSubmitLimiter(cfg); err == nil {
+		t.Fatal("expect error for unknown tier")
+	}
+	if _, err = newSubmitLimiter(RateLimitConfig{Default: RatePolicy{Limit: 1, Per: time.Second, Key: "port"}}); err == nil {
+		t.Fatal("expect error for unknown key")
+	}
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"net"
 	"sync"
 	"time"
 
 	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
 	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/proxyproto"
+	"github.com/JellyTony/kupool/recorder"
 	"github.com/JellyTony/kupool/tcp"
 )
 
@@ -18,6 +22,8 @@ type ShutdownStatus struct {
 	MQErrors     int
 	StoreClosed  bool
 	ServerClosed bool
+	Notified     int // 收到 client.reconnect 通知的会话数
+	ForcedClose  int // 宽限期结束时仍未断开、被强制关闭的会话数
 	Duration     time.Duration
 }
 
@@ -25,91 +31,250 @@ type AppServer struct {
 	srv         kupool.Server
 	coord       *Coordinator
 	stopConsume chan struct{}
-	mqWG        sync.WaitGroup
+	consumer    *statsConsumer
+	relay       *outboxRelay
+	rollupEvery time.Duration
+	drainOpts   DrainOptions
 	status      ShutdownStatus
+	closeOnce   sync.Once
 }
 
 func NewAppServer(addr string, store StatsStore, state StateStore, mq MessageQueue, interval time.Duration, expire time.Duration, historyWindow time.Duration) *AppServer {
-    s := tcp.NewServer(addr)
-    coord := NewCoordinator(s, store, state, mq, interval, expire, historyWindow)
-    acc := NewAcceptor(coord)
-    lst := NewListener(coord)
-    st := NewState(coord)
-    s.SetAcceptor(acc)
-    s.SetMessageListener(lst)
-    s.SetStateListener(st)
-    return &AppServer{srv: s, coord: coord, stopConsume: make(chan struct{})}
+	s := tcp.NewServer(addr)
+	coord := NewCoordinator(s, store, state, mq, interval, expire, historyWindow)
+	a := &AppServer{coord: coord, stopConsume: make(chan struct{}), consumer: newStatsConsumer(store, ConsumerOptions{}), rollupEvery: DefaultRollupInterval, drainOpts: DefaultDrainOptions()}
+	a.SetServer(s)
+	return a
+}
+
+// SetServer 替换底层传输（默认 tcp.Server，可换为 epoll.Server 等），并挂上握手、消息与状态监听；
+// 需在 Start 以及其他设置底层 Server 的方法之前调用
+func (a *AppServer) SetServer(s kupool.Server) {
+	s.SetAcceptor(NewAcceptor(a.coord))
+	s.SetMessageListener(NewListener(a.coord))
+	s.SetStateListener(NewState(a.coord))
+	a.coord.srv = s
+	a.srv = s
+}
+
+// SetRollupInterval 设置统计汇总与过期清理的间隔（仅当 StatsStore 实现 StatsRollup 时生效），需在 Start 之前调用
+func (a *AppServer) SetRollupInterval(d time.Duration) {
+	if d > 0 {
+		a.rollupEvery = d
+	}
+}
+
+// SetDrainOptions 设置关闭时排空连接的宽限期与重连通知，需在 Shutdown 之前调用
+func (a *AppServer) SetDrainOptions(opts DrainOptions) {
+	a.drainOpts = opts
+}
+
+// SetClock 设置任务轮换、限速、封禁、统计批次与汇总使用的时钟（默认真实时钟），需在 Start 之前调用；
+// 测试中传入 clock.Fake 后通过 Advance 驱动
+func (a *AppServer) SetClock(clk clock.Clock) {
+	a.coord.SetClock(clk)
+	a.consumer.clk = a.coord.clk
+}
+
+// SetRateLimit 设置提交限速策略（默认每会话每秒 1 次），需在 Start 之前调用
+func (a *AppServer) SetRateLimit(cfg RateLimitConfig) error {
+	return a.coord.SetRateLimit(cfg)
+}
+
+// SetNonceFilter 设置会话的重复 nonce 过滤器（默认精确集合），需在 Start 之前调用
+func (a *AppServer) SetNonceFilter(f NonceFilterFactory) {
+	a.coord.SetNonceFilter(f)
+}
+
+// SetBanPolicy 设置自动封禁策略，需在 Start 之前调用
+func (a *AppServer) SetBanPolicy(p BanPolicy) {
+	a.coord.SetBanPolicy(p)
+}
+
+// Bans 返回封禁管理器，供管理接口使用
+func (a *AppServer) Bans() *BanManager { return a.coord.Bans() }
+
+// SetConsumerOptions 设置统计消费者的并发数与批量参数，需在 Start 之前调用
+func (a *AppServer) SetConsumerOptions(opts ConsumerOptions) {
+	a.consumer = newStatsConsumer(a.coord.store, opts)
+	a.consumer.clk = a.coord.clk
+}
+
+// SetRecorder 把连接上的帧记录到 trace（见 recorder 包），底层 Server 不支持时返回 false；需在 Start 之前调用
+func (a *AppServer) SetRecorder(r *recorder.Recorder) bool {
+	s, ok := a.srv.(interface{ SetRecorder(*recorder.Recorder) })
+	if ok {
+		s.SetRecorder(r)
+	}
+	return ok
+}
+
+// SetListeners 使用已有的监听 socket（如热重启时继承的 socket），底层 Server 不支持时返回 false；需在 Start 之前调用
+func (a *AppServer) SetListeners(lsts ...net.Listener) bool {
+	s, ok := a.srv.(interface{ SetListeners(...net.Listener) })
+	if ok {
+		s.SetListeners(lsts...)
+	}
+	return ok
+}
+
+// SetProxyPolicy 对来自可信网段（负载均衡器）的连接解析 PROXY protocol 头部，按真实客户端地址封禁、限速与记录日志；
+// 底层 Server 不支持时返回 false，需在 Start 之前调用
+func (a *AppServer) SetProxyPolicy(p proxyproto.Policy) bool {
+	s, ok := a.srv.(interface{ SetProxyPolicy(proxyproto.Policy) })
+	if ok {
+		s.SetProxyPolicy(p)
+	}
+	return ok
+}
+
+// SetAdmission 设置连接准入限制（全局、每来源、握手中连接数与接受速率），底层 Server 不支持时返回 false；需在 Start 之前调用
+func (a *AppServer) SetAdmission(adm *kupool.Admission) bool {
+	s, ok := a.srv.(interface{ SetAdmission(*kupool.Admission) })
+	if ok {
+		s.SetAdmission(adm)
+	}
+	return ok
+}
+
+// SetHeartbeat 开启服务端心跳：空闲连接由服务端发送 ping 并记录往返时长，关闭连续不回 pong
+// 或长时间没有提交的连接；底层 Server 不支持时返回 false，需在 Start 之前调用。
+// opts.Clock 为空时使用 SetClock 设置的时钟
+func (a *AppServer) SetHeartbeat(opts kupool.HeartbeatOptions) bool {
+	if opts.Clock == nil {
+		opts.Clock = a.coord.clk
+	}
+	s, ok := a.srv.(interface{ SetHeartbeat(kupool.HeartbeatOptions) })
+	if ok {
+		s.SetHeartbeat(opts)
+	}
+	return ok
+}
+
+// SetAcceptLoops 设置 accept 循环数（多于一个时以 SO_REUSEPORT 分别监听），底层 Server 不支持时返回 false；需在 Start 之前调用
+func (a *AppServer) SetAcceptLoops(n int) bool {
+	s, ok := a.srv.(interface{ SetAcceptLoops(int) })
+	if ok {
+		s.SetAcceptLoops(n)
+	}
+	return ok
+}
+
+// CurrentJob 返回当前任务号与 server_nonce，广播循环生成首个任务前 jobID 为 0
+func (a *AppServer) CurrentJob() (jobID int, serverNonce string) { return a.coord.CurrentJob() }
+
+// Addr 返回服务端实际监听地址，尚未开始监听时返回 nil
+func (a *AppServer) Addr() net.Addr {
+	if s, ok := a.srv.(interface{ Addr() net.Addr }); ok {
+		return s.Addr()
+	}
+	return nil
 }
 
 func (a *AppServer) Start(ctx context.Context) error {
+	stop := make(chan struct{})
 	go func() {
-		ch := a.coord.mq.Subscribe()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-a.stopConsume:
-				return
-			case evt, ok := <-ch:
-				if !ok {
-					return
-				}
-				a.mqWG.Add(1)
-				if err := a.coord.store.Increment(evt.Username, evt.Time); err != nil {
-					logger.WithFields(logger.Fields{"module": "server", "username": evt.Username, "time": evt.Time}).Errorf("store increment failed: %v", err)
-					a.status.MQErrors++
-				}
-				a.mqWG.Done()
-			}
+		select {
+		case <-ctx.Done():
+		case <-a.stopConsume:
 		}
+		close(stop)
 	}()
+	a.consumer.start(a.coord.mq.Subscribe(), stop)
+	if r, ok := a.coord.store.(StatsRollup); ok {
+		go a.rollupLoop(r, stop)
+	}
+	if ob, ok := a.coord.state.(OutboxStore); ok {
+		a.relay = newOutboxRelay(ob, a.coord.mq)
+		a.relay.clk = a.coord.clk
+		a.relay.start()
+	}
+	if err := a.coord.bans.Restore(); err != nil {
+		logger.WithFields(logger.Fields{"module": "app.server", "error": err}).Warn("restore bans failed")
+	}
 	a.coord.StartBroadcast()
 	return a.srv.Start()
 }
 
+// Shutdown 先排空连接（见 drain），写完发送队列后关闭连接并等待在途提交处理完，
+// 再停止 outbox、统计消费者与存储，保证宽限期内接受的提交计入统计。可重复调用。
+// 等待统计消费者与关闭 mq/存储的重试间隔使用 SetClock 设置的时钟
 func (a *AppServer) Shutdown(ctx context.Context) error {
-	a.status.StartAt = time.Now()
+	a.closeOnce.Do(func() { a.shutdown(ctx) })
+	return nil
+}
+
+func (a *AppServer) shutdown(ctx context.Context) {
+	a.status.StartAt = a.coord.clk.Now()
+	wait := 10 * time.Second
+	timeout := 30 * time.Second
+	a.drain(ctx)
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := a.srv.Shutdown(cctx); err != nil {
+		logger.WithError(err).Error("server shutdown failed")
+	} else {
+		a.status.ServerClosed = true
+	}
+	if !a.waitIdle(cctx, wait, func() bool { return a.coord.inflight.Load() == 0 }) {
+		logger.WithFields(logger.Fields{"module": "server", "inflight": a.coord.inflight.Load()}).Warn("in-flight messages not finished")
+	}
+	if a.relay != nil {
+		// 先停 relay，保证 outbox 中剩余消息在消费者退出前发出
+		a.relay.close()
+	}
 	close(a.stopConsume)
 	a.status.MQStopped = true
 	done := make(chan struct{})
-	go func() { a.mqWG.Wait(); close(done) }()
-	wait := 10 * time.Second
-	timeout := 30 * time.Second
+	go func() { a.consumer.wait(); close(done) }()
 	select {
 	case <-done:
-	case <-time.After(wait):
+	case <-a.coord.clk.After(wait):
 	}
-	a.coord.Stop()
-	if err := retry(3, 2*time.Second, func() error { return a.coord.mq.Close() }); err != nil {
+	if err := retry(a.coord.clk, 3, 2*time.Second, func() error { return a.coord.mq.Close() }); err != nil {
 		logger.WithError(err).Error("mq close failed")
 	}
-	if err := retry(3, 2*time.Second, func() error { return a.coord.store.Close() }); err != nil {
+	if err := retry(a.coord.clk, 3, 2*time.Second, func() error { return a.coord.store.Close() }); err != nil {
 		logger.WithError(err).Error("store close failed")
 	} else {
 		a.status.StoreClosed = true
 	}
-	cctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	if err := a.srv.Shutdown(cctx); err != nil {
-		logger.WithError(err).Error("server shutdown failed")
-	} else {
-		a.status.ServerClosed = true
-	}
-	a.status.EndAt = time.Now()
+	a.status.EndAt = a.coord.clk.Now()
 	a.status.Duration = a.status.EndAt.Sub(a.status.StartAt)
-	logger.WithFields(logger.Fields{"module": "server", "duration": a.status.Duration}).Info("shutdown done")
-	return nil
+	logger.WithFields(logger.Fields{"module": "server", "duration": a.status.Duration, "notified": a.status.Notified, "forced_close": a.status.ForcedClose}).Info("shutdown done")
 }
 
-func retry(n int, backoff time.Duration, f func() error) error {
+func (a *AppServer) rollupLoop(r StatsRollup, stop <-chan struct{}) {
+	ticker := a.coord.clk.NewTicker(a.rollupEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C():
+			if err := r.Rollup(now); err != nil {
+				logger.WithFields(logger.Fields{"module": "server"}).Warnf("stats rollup failed: %v", err)
+			}
+		}
+	}
+}
+
+// retry 最多调用 f n 次，两次之间按 clk 等待 backoff
+func retry(clk clock.Clock, n int, backoff time.Duration, f func() error) error {
 	var err error
 	for i := 0; i < n; i++ {
 		if err = f(); err == nil {
 			return nil
 		}
-		time.Sleep(backoff)
+		if i < n-1 {
+			clk.Sleep(backoff)
+		}
 	}
 	return err
 }
 
-func (a *AppServer) Status() ShutdownStatus { return a.status }
+func (a *AppServer) Status() ShutdownStatus {
+	st := a.status
+	st.MQErrors = a.consumer.errorCount()
+	return st
+}
@@ -5,16 +5,20 @@ import (
     "crypto/sha256"
     "encoding/hex"
     "net"
+    "sync"
     "testing"
     "time"
 
     kupool "github.com/JellyTony/kupool"
+    "github.com/JellyTony/kupool/clock"
+    "github.com/JellyTony/kupool/events"
     "github.com/JellyTony/kupool/mq"
     "github.com/JellyTony/kupool/protocol"
     "github.com/JellyTony/kupool/tcp"
 )
 
 type memStore struct{
+    mu sync.Mutex
     data map[string]map[time.Time]int
     latestID int
     latestNonce string
@@ -31,6 +35,14 @@ func (m *memStore) Increment(username string, minute time.Time) error {
     u[mm] = u[mm] + 1
     return nil
 }
+func (m *memStore) IncrementBy(username string, minute time.Time, n int) error {
+    for i := 0; i < n; i++ { _ = m.Increment(username, minute) }
+    return nil
+}
+func (m *memStore) BatchIncrement(deltas []StatDelta) error {
+    for _, d := range deltas { _ = m.IncrementBy(d.Username, d.Minute, d.Count) }
+    return nil
+}
 func (m *memStore) Get(username string, minute time.Time) (int, error) {
     mm := minute.Truncate(time.Minute)
     u := m.data[username]
@@ -41,20 +53,85 @@ func (m *memStore) Close() error { return nil }
 
 // StateStore
 func (m *memStore) SaveJob(jobID int, nonce string, createdAt time.Time) error {
+    m.mu.Lock(); defer m.mu.Unlock()
     m.latestID = jobID; m.latestNonce = nonce; m.hist[jobID] = JobRecord{Nonce: nonce, CreatedAt: createdAt}; return nil
 }
 func (m *memStore) LoadLatestJob() (int, string, time.Time, error) {
+    m.mu.Lock(); defer m.mu.Unlock()
     rec := m.hist[m.latestID]; return m.latestID, rec.Nonce, rec.CreatedAt, nil
 }
-func (m *memStore) LoadJobHistory(since time.Duration) (map[int]JobRecord, error) { return m.hist, nil }
+func (m *memStore) LoadJobHistory(since time.Duration) (map[int]JobRecord, error) {
+    m.mu.Lock(); defer m.mu.Unlock()
+    out := make(map[int]JobRecord, len(m.hist))
+    for id, rec := range m.hist { out[id] = rec }
+    return out, nil
+}
+func (m *memStore) LoadJob(jobID int) (JobRecord, bool, error) {
+    m.mu.Lock(); defer m.mu.Unlock()
+    rec, ok := m.hist[jobID]; return rec, ok, nil
+}
 func (m *memStore) LoadUserState(username string) (int, string, time.Time, error) { return 0, "", time.Time{}, nil }
 func (m *memStore) SaveUserState(username string, latestJobID int, latestServerNonce string, lastSubmitAt time.Time) error { return nil }
 func (m *memStore) SaveUsedNonce(username string, jobID int, clientNonce string) error { return nil }
 func (m *memStore) HasUsedNonce(username string, jobID int, clientNonce string) (bool, error) { return false, nil }
 
+// testInterval 测试中的任务轮换间隔；时钟为 clock.Fake，只有 rotate 推进时间时才轮换
+const testInterval = time.Minute
+
+// testApp 由 clock.Fake 驱动的 AppServer，任务轮换、过期与限速都不依赖真实等待
+type testApp struct {
+    *AppServer
+    clk  *clock.Fake
+    addr string
+}
+
+func startTestApp(t *testing.T, addr string, store StatsStore, state StateStore, queue MessageQueue, expire time.Duration, setup ...func(*AppServer)) *testApp {
+    t.Helper()
+    app := NewAppServer(addr, store, state, queue, testInterval, expire, time.Hour)
+    clk := clock.NewFake(time.Time{})
+    app.SetClock(clk)
+    for _, f := range setup { f(app) }
+    rootCtx, cancel := context.WithCancel(context.Background())
+    go func(){ _ = app.Start(rootCtx) }()
+    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
+    waitFor(t, "listening", func() bool {
+        c, err := net.Dial("tcp", addr)
+        if err == nil { _ = c.Close() }
+        return err == nil
+    })
+    // 首个任务在轮换 ticker 创建之后生成，此后 rotate 推进时间一定会触发轮换
+    waitFor(t, "first job", func() bool {
+        app.coord.mu.RLock(); defer app.coord.mu.RUnlock()
+        return app.coord.jobID > 0
+    })
+    return &testApp{AppServer: app, clk: clk, addr: addr}
+}
+
+// waitFor 等待后台协程达到某个状态（监听就绪、会话注册等），只轮询不推进时钟
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(3 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) { t.Fatalf("timeout waiting for %s", what) }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// rotate 推进一个轮换间隔，触发一次任务轮换与广播
+func (a *testApp) rotate() { a.clk.Advance(testInterval) }
+
+// authorize 连接并完成认证，返回时会话已注册
+func (a *testApp) authorize(t *testing.T, username string) net.Conn {
+    t.Helper()
+    conn := dialAuthorize(t, a.addr, username)
+    if resp := readResponse(t, conn, 1); !resp.Result { t.Fatalf("authorize %s failed", username) }
+    return conn
+}
+
 func dialAuthorize(t *testing.T, addr, username string) net.Conn {
     conn, err := net.DialTimeout("tcp", addr, time.Second*3)
     if err != nil { t.Fatal(err) }
+    t.Cleanup(func(){ _ = conn.Close() })
     id := 1
     req := protocol.Request{ID: &id, Method: "authorize"}
     p, _ := protocol.Encode(protocol.AuthorizeParams{Username: username})
@@ -66,6 +143,7 @@ func dialAuthorize(t *testing.T, addr, username string) net.Conn {
 
 func readJob(t *testing.T, conn net.Conn) protocol.JobParams {
     c := tcp.NewConn(conn)
+    _ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
     for {
         f, err := c.ReadFrame()
         if err != nil { t.Fatal(err) }
@@ -80,100 +158,110 @@ func readJob(t *testing.T, conn net.Conn) protocol.JobParams {
     }
 }
 
+// readResponse 读取 id 对应的响应，跳过期间收到的任务广播
+func readResponse(t *testing.T, conn net.Conn, id int) protocol.Response {
+    c := tcp.NewConn(conn)
+    _ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+    for {
+        f, err := c.ReadFrame()
+        if err != nil { t.Fatal(err) }
+        if f.GetOpCode() != kupool.OpBinary { continue }
+        var resp protocol.Response
+        if protocol.Decode(f.GetPayload(), &resp) == nil && resp.ID == id { return resp }
+    }
+}
+
 func sendSubmit(t *testing.T, conn net.Conn, id int, p protocol.SubmitParams) protocol.Response {
     req := protocol.Request{ID: &id, Method: "submit"}
     raw, _ := protocol.Encode(p)
     req.Params = raw
     data, _ := protocol.Encode(req)
-    c := tcp.NewConn(conn)
-    _ = c.WriteFrame(kupool.OpBinary, data)
-    f, err := c.ReadFrame()
-    if err != nil { t.Fatal(err) }
-    var resp protocol.Response
-    _ = protocol.Decode(f.GetPayload(), &resp)
-    return resp
+    _ = tcp.NewConn(conn).WriteFrame(kupool.OpBinary, data)
+    return readResponse(t, conn, id)
+}
+
+func respError(r protocol.Response) string {
+    if r.Error == nil { return "" }
+    return *r.Error
 }
 
 func TestSuccessFlow(t *testing.T) {
     store := newMemStore()
-    queue := mq.NewMemoryQueue(16)
-    state := StateStore(store)
-    app := NewAppServer("127.0.0.1:9091", store, state, queue, time.Millisecond*200, 0, time.Hour)
-    rootCtx, cancel := context.WithCancel(context.Background())
-    go func(){ _ = app.Start(rootCtx) }()
-    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
-    time.Sleep(time.Millisecond*100)
-    conn := dialAuthorize(t, "127.0.0.1:9091", "u1")
+    app := startTestApp(t, "127.0.0.1:9091", store, store, mq.NewMemoryQueue(16), 0)
+    conn := app.authorize(t, "u1")
+    app.rotate()
     job := readJob(t, conn)
     res := clientResult(job.ServerNonce, "abc")
     resp := sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "abc", Result: res})
-    if !resp.Result { t.Fatal("expect success") }
+    if !resp.Result { t.Fatalf("expect success, got %s", respError(resp)) }
 }
 
 func TestInvalidResult(t *testing.T) {
     store := newMemStore()
-    queue := mq.NewMemoryQueue(16)
-    state := StateStore(store)
-    app := NewAppServer("127.0.0.1:9092", store, state, queue, time.Millisecond*200, 0, time.Hour)
-    rootCtx, cancel := context.WithCancel(context.Background())
-    go func(){ _ = app.Start(rootCtx) }()
-    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
-    time.Sleep(time.Millisecond*100)
-    conn := dialAuthorize(t, "127.0.0.1:9092", "u2")
+    app := startTestApp(t, "127.0.0.1:9092", store, store, mq.NewMemoryQueue(16), 0)
+    conn := app.authorize(t, "u2")
+    app.rotate()
     job := readJob(t, conn)
     resp := sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "abc", Result: "deadbeef"})
-    if resp.Result { t.Fatal("expect failure") }
+    if resp.Result || respError(resp) != "Invalid result" { t.Fatalf("expect Invalid result, got %+v", resp) }
 }
 
+// TestRateLimit 时钟不动时第二次提交被限速，推进 1 秒后恢复
 func TestRateLimit(t *testing.T) {
     store := newMemStore()
-    queue := mq.NewMemoryQueue(16)
-    state := StateStore(store)
-    app := NewAppServer("127.0.0.1:9093", store, state, queue, time.Millisecond*200, 0, time.Hour)
-    rootCtx, cancel := context.WithCancel(context.Background())
-    go func(){ _ = app.Start(rootCtx) }()
-    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
-    time.Sleep(time.Millisecond*100)
-    conn := dialAuthorize(t, "127.0.0.1:9093", "u3")
+    app := startTestApp(t, "127.0.0.1:9093", store, store, mq.NewMemoryQueue(16), 0)
+    conn := app.authorize(t, "u3")
+    app.rotate()
     job := readJob(t, conn)
-    res := clientResult(job.ServerNonce, "x1")
-    _ = sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "x1", Result: res})
-    res2 := clientResult(job.ServerNonce, "x2")
-    resp2 := sendSubmit(t, conn, 3, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "x2", Result: res2})
-    if resp2.Result { t.Fatal("expect rate limit failure") }
+    submit := func(id int, nonce string) protocol.Response {
+        return sendSubmit(t, conn, id, protocol.SubmitParams{JobID: job.JobID, ClientNonce: nonce, Result: clientResult(job.ServerNonce, nonce)})
+    }
+    if r := submit(2, "x1"); !r.Result { t.Fatalf("first submit: %s", respError(r)) }
+    if r := submit(3, "x2"); r.Result || respError(r) != ErrSubmitTooFrequent.Error() { t.Fatalf("expect rate limit failure, got %+v", r) }
+    app.clk.Advance(time.Second)
+    if r := submit(4, "x3"); !r.Result { t.Fatalf("submit after 1s: %s", respError(r)) }
 }
 
 func TestDuplicate(t *testing.T) {
     store := newMemStore()
-    queue := mq.NewMemoryQueue(16)
-    state := StateStore(store)
-    app := NewAppServer("127.0.0.1:9094", store, state, queue, time.Millisecond*200, 0, time.Hour)
-    rootCtx, cancel := context.WithCancel(context.Background())
-    go func(){ _ = app.Start(rootCtx) }()
-    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
-    time.Sleep(time.Millisecond*100)
-    conn := dialAuthorize(t, "127.0.0.1:9094", "u4")
+    app := startTestApp(t, "127.0.0.1:9094", store, store, mq.NewMemoryQueue(16), 0)
+    conn := app.authorize(t, "u4")
+    app.rotate()
     job := readJob(t, conn)
     res := clientResult(job.ServerNonce, "dup")
     _ = sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "dup", Result: res})
+    app.clk.Advance(time.Second)
     resp2 := sendSubmit(t, conn, 3, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "dup", Result: res})
-    if resp2.Result { t.Fatal("expect duplicate failure") }
+    if resp2.Result || respError(resp2) != ErrDuplicateSubmission.Error() { t.Fatalf("expect duplicate failure, got %+v", resp2) }
 }
 
 func TestTaskNotExist(t *testing.T) {
     store := newMemStore()
-    queue := mq.NewMemoryQueue(16)
-    state := StateStore(store)
-    app := NewAppServer("127.0.0.1:9095", store, state, queue, time.Millisecond*200, 0, time.Hour)
-    rootCtx, cancel := context.WithCancel(context.Background())
-    go func(){ _ = app.Start(rootCtx) }()
-    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
-    time.Sleep(time.Millisecond*100)
-    conn := dialAuthorize(t, "127.0.0.1:9095", "u5")
+    app := startTestApp(t, "127.0.0.1:9095", store, store, mq.NewMemoryQueue(16), 0)
+    conn := app.authorize(t, "u5")
+    app.rotate()
     job := readJob(t, conn)
     res := clientResult(job.ServerNonce, "z")
     resp := sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID+100, ClientNonce: "z", Result: res})
-    if resp.Result { t.Fatal("expect task not exist failure") }
+    if resp.Result || respError(resp) != "Task does not exist" { t.Fatalf("expect task not exist failure, got %+v", resp) }
+}
+
+// TestTaskExpired 旧任务在 expireAfter 内仍可提交，时钟越过 expireAfter 后被拒绝
+func TestTaskExpired(t *testing.T) {
+    store := newMemStore()
+    app := startTestApp(t, "127.0.0.1:9099", store, store, mq.NewMemoryQueue(16), 90*time.Second)
+    conn := app.authorize(t, "u6")
+    app.rotate()
+    old := readJob(t, conn)
+    app.rotate()
+    if cur := readJob(t, conn); cur.JobID == old.JobID { t.Fatal("expect a new job") }
+    submit := func(id int, nonce string) protocol.Response {
+        return sendSubmit(t, conn, id, protocol.SubmitParams{JobID: old.JobID, ClientNonce: nonce, Result: clientResult(old.ServerNonce, nonce)})
+    }
+    if r := submit(2, "a"); !r.Result { t.Fatalf("job within expireAfter: %s", respError(r)) }
+    app.rotate()
+    _ = readJob(t, conn)
+    if r := submit(3, "b"); r.Result || respError(r) != "Task expired" { t.Fatalf("expect Task expired, got %+v", r) }
 }
 
 func clientResult(serverNonce, clientNonce string) string {
@@ -183,24 +271,54 @@ func clientResult(serverNonce, clientNonce string) string {
 
 func TestConcurrentClients(t *testing.T) {
     store := newMemStore()
-    queue := mq.NewMemoryQueue(64)
-    state := StateStore(store)
-    app := NewAppServer("127.0.0.1:9096", store, state, queue, time.Millisecond*200, 0, time.Hour)
-    rootCtx, cancel := context.WithCancel(context.Background())
-    go func(){ _ = app.Start(rootCtx) }()
-    t.Cleanup(func(){ cancel(); _ = app.Shutdown(rootCtx) })
-    time.Sleep(time.Millisecond*100)
+    app := startTestApp(t, "127.0.0.1:9096", store, store, mq.NewMemoryQueue(64), 0)
     n := 5
-    done := make(chan struct{}, n)
-    for i := 0; i < n; i++ {
-        go func(idx int){
-            conn := dialAuthorize(t, "127.0.0.1:9096", "u"+string(rune('a'+idx)))
+    conns := make([]net.Conn, n)
+    for i := range conns {
+        conns[i] = app.authorize(t, "u"+string(rune('a'+i)))
+    }
+    app.rotate()
+    done := make(chan bool, n)
+    for _, conn := range conns {
+        go func(conn net.Conn){
             job := readJob(t, conn)
             res := clientResult(job.ServerNonce, "c")
             resp := sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "c", Result: res})
-            if !resp.Result { t.Fatal("expect success") }
-            done <- struct{}{}
-        }(i)
+            done <- resp.Result
+        }(conn)
+    }
+    for i := 0; i < n; i++ {
+        if !<-done { t.Fatal("expect success") }
+    }
+}
+
+func TestEventStream(t *testing.T) {
+    store := newMemStore()
+    queue := mq.NewMemoryQueue(64)
+    evts, _ := queue.SubscribeEvents("share.*", "session.*")
+    // 无效提交同样消耗配额，放宽限速以便紧接着提交一次有效结果
+    app := startTestApp(t, "127.0.0.1:9097", store, store, queue, 0, func(a *AppServer) {
+        _ = a.SetRateLimit(RateLimitConfig{Default: RatePolicy{Limit: 10, Per: time.Second}})
+    })
+    opened := app.clk.Now()
+    conn := app.authorize(t, "ev")
+    app.rotate()
+    job := readJob(t, conn)
+    _ = sendSubmit(t, conn, 2, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "bad", Result: "deadbeef"})
+    _ = sendSubmit(t, conn, 3, protocol.SubmitParams{JobID: job.JobID, ClientNonce: "ok", Result: clientResult(job.ServerNonce, "ok")})
+    _ = conn.Close()
+    want := []events.Kind{events.KindSessionOpened, events.KindShareRejected, events.KindShareAccepted, events.KindSessionClosed}
+    for _, k := range want {
+        select {
+        case e := <-evts:
+            if e.Kind != k { t.Fatalf("expect %s, got %s", k, e.Kind) }
+            at := app.clk.Now()
+            if k == events.KindSessionOpened { at = opened }
+            if !e.Time.Equal(at) { t.Fatalf("%s: event time should come from the clock", k) }
+            if k == events.KindShareRejected && e.ShareRejected.Reason != "Invalid result" { t.Fatal("reject reason") }
+            if k == events.KindShareAccepted && e.ShareAccepted.Username != "ev" { t.Fatal("accepted username") }
+        case <-time.After(2 * time.Second):
+            t.Fatalf("timeout waiting for %s", k)
+        }
     }
-    for i := 0; i < n; i++ { <-done }
 }
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/mq"
+)
+
+// failingCloseStore Close 总是失败
+type failingCloseStore struct {
+	*memStore
+	closes atomic.Int32
+}
+
+func (s *failingCloseStore) Close() error {
+	s.closes.Add(1)
+	return errors.New("close failed")
+}
+
+// TestShutdownRetriesOnInjectedClock 关闭存储失败时的重试间隔由注入的时钟推进，不做真实等待
+func TestShutdownRetriesOnInjectedClock(t *testing.T) {
+	store := &failingCloseStore{memStore: newMemStore()}
+	app := NewAppServer("127.0.0.1:0", store, store, mq.NewMemoryQueue(16), testInterval, 0, time.Hour)
+	clk := clock.NewFake(time.Time{})
+	app.SetClock(clk)
+	app.SetDrainOptions(DrainOptions{})
+
+	done := make(chan struct{})
+	go func() {
+		_ = app.Shutdown(context.Background())
+		close(done)
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		select {
+		case <-done:
+			if n := store.closes.Load(); n != 3 {
+				t.Fatalf("expect 3 close attempts, got %d", n)
+			}
+			if app.Status().StoreClosed {
+				t.Fatal("store close failed, status must not report it closed")
+			}
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown retries should follow the fake clock instead of sleeping")
+		}
+		clk.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import "time"
+
+// Granularity 统计聚合粒度
+type Granularity string
+
+const (
+	GranularityMinute Granularity = "minute"
+	GranularityHour   Granularity = "hour"
+	GranularityDay    Granularity = "day"
+)
+
+// granularities 由细到粗
+var granularities = []Granularity{GranularityMinute, GranularityHour, GranularityDay}
+
+const (
+	DefaultMinuteRetention = 48 * time.Hour
+	DefaultHourRetention   = 90 * 24 * time.Hour
+	// DefaultMaxPoints 自动选择粒度时单次查询最多返回的桶数
+	DefaultMaxPoints = 1440
+)
+
+// Duration 返回粒度对应的桶长度
+func (g Granularity) Duration() time.Duration {
+	switch g {
+	case GranularityHour:
+		return time.Hour
+	case GranularityDay:
+		return 24 * time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+// Truncate 将时间对齐到桶起点（按 UTC 对齐）
+func (g Granularity) Truncate(t time.Time) time.Time {
+	return t.Truncate(g.Duration())
+}
+
+// Ceil 将时间向上对齐到桶起点。查询从 Ceil(start) 开始统计：start 所在的桶只有部分落在范围内，
+// 不计入，避免把 start 之前的提交算进来
+func (g Granularity) Ceil(t time.Time) time.Time {
+	if c := g.Truncate(t); c.Before(t) {
+		return c.Add(g.Duration())
+	}
+	return t
+}
+
+// Valid 是否为已知粒度
+func (g Granularity) Valid() bool {
+	for _, v := range granularities {
+		if g == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Retention 各粒度的保留时长，0 表示永久保留
+type Retention struct {
+	Minute time.Duration
+	Hour   time.Duration
+	Day    time.Duration
+}
+
+// DefaultRetention 分钟保留 48 小时，小时保留 90 天，天永久保留
+func DefaultRetention() Retention {
+	return Retention{Minute: DefaultMinuteRetention, Hour: DefaultHourRetention}
+}
+
+// Of 返回指定粒度的保留时长
+func (r Retention) Of(g Granularity) time.Duration {
+	switch g {
+	case GranularityHour:
+		return r.Hour
+	case GranularityDay:
+		return r.Day
+	default:
+		return r.Minute
+	}
+}
+
+// Pick 为 [start, end] 选择满足限制的最细粒度：由细到粗，跳过保留期已不包含 start、
+// 或桶数超过 DefaultMaxPoints 的粒度；都不满足时返回最粗的天粒度。
+// 不取“能覆盖范围的最粗粒度”：天粒度总能覆盖，那样任何范围都只会得到按天的结果
+func (r Retention) Pick(start, end, now time.Time) Granularity {
+	for _, g := range granularities {
+		if keep := r.Of(g); keep > 0 && start.Before(now.Add(-keep)) {
+			continue
+		}
+		if end.Sub(start)/g.Duration() > DefaultMaxPoints {
+			continue
+		}
+		return g
+	}
+	return GranularityDay
+}
+
+// DefaultRollupInterval 后台汇总与清理的默认间隔
+const DefaultRollupInterval = 5 * time.Minute
+
+// StatsRollup 由支持分级汇总的 StatsStore 实现：把分钟数据汇总为小时/天，并按各粒度的保留期清理过期数据
+type StatsRollup interface {
+	Rollup(now time.Time) error
+}
+
+// UserTotal 用户在某段时间内的提交总数
+type UserTotal struct {
+	Username string `json:"username"`
+	Total    int    `json:"total"`
+}
+
+// StatsQuery 统计分析查询，g 为空时由存储按保留期与范围大小自动选择粒度；
+// 统计起点为 g.Ceil(start)，即 start 所在的不完整桶不计入
+type StatsQuery interface {
+	// PickGranularity 返回自动模式下 [start, end] 会使用的粒度
+	PickGranularity(start, end time.Time) Granularity
+	GetUserSubmissionsByTimeRange(username string, start, end time.Time, g Granularity) (map[time.Time]int, error)
+	GetTopUsersBySubmissions(start, end time.Time, limit int, g Granularity) ([]UserTotal, error)
+	GetTotalSubmissions(start, end time.Time, g Granularity) (int, error)
+}
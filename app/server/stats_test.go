@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPick(t *testing.T) {
+	r := DefaultRetention()
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		start, end time.Time
+		want       Granularity
+	}{
+		{now.Add(-10 * time.Minute), now, GranularityMinute},
+		{now.Add(-23 * time.Hour), now, GranularityMinute},
+		// 整天的范围天粒度也能覆盖，仍取满足限制的最细粒度
+		{now.Truncate(24 * time.Hour).Add(-24 * time.Hour), now.Truncate(24 * time.Hour), GranularityMinute},
+		// 超过点数上限
+		{now.Add(-25 * time.Hour), now, GranularityHour},
+		// 分钟数据已过保留期
+		{now.Add(-72 * time.Hour), now.Add(-71 * time.Hour), GranularityHour},
+		{now.Add(-100 * 24 * time.Hour), now.Add(-99 * 24 * time.Hour), GranularityDay},
+	}
+	for i, c := range cases {
+		if got := r.Pick(c.start, c.end, now); got != c.want {
+			t.Errorf("case %d: got %s, want %s", i, got, c.want)
+		}
+	}
+}
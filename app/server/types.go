@@ -2,17 +2,46 @@ package server
 
 import (
     "sync"
+    "sync/atomic"
     "time"
+    "github.com/JellyTony/kupool/clock"
     "github.com/JellyTony/kupool/events"
 )
 
+// Session 单个连接的会话。ChannelID/Username/UsedNonces 创建后不变（UsedNonces 自带锁）；
+// LatestJobID/LatestServerNonce/LastSubmitAt 由 mu 保护，广播与提交都只短暂持有；
+// submitMu 串行化同一会话的提交，保证频率与重复校验到记录之间不会交错
 type Session struct {
     ChannelID        string
     Username         string
     LatestJobID      int
     LatestServerNonce string
     LastSubmitAt     time.Time
-    UsedNonces       map[int]map[string]struct{}
+    UsedNonces       NonceFilter
+    RemoteIP         string
+
+    mu       sync.Mutex
+    submitMu sync.Mutex
+}
+
+// Latest 返回会话最新的任务与上次提交时间
+func (s *Session) Latest() (jobID int, serverNonce string, lastSubmitAt time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.LatestJobID, s.LatestServerNonce, s.LastSubmitAt
+}
+
+func (s *Session) markSubmit(at time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.LastSubmitAt = at
+}
+
+func (s *Session) setLatestJob(jobID int, serverNonce string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.LatestJobID = jobID
+    s.LatestServerNonce = serverNonce
 }
 
 type Coordinator struct {
@@ -27,8 +56,19 @@ type Coordinator struct {
     state        StateStore
     mq           MessageQueue
     history      map[int]JobRecord
+    minJobID     int
+    maxJobID     int                // 已知的最大任务号：本地轮换、回源命中或存储中的最新任务
+    latestAt     time.Time          // 上次向存储刷新最新任务号的时间
+    jobMisses    map[int]time.Time  // 回源未命中的任务号，jobMissTTL 内不再回源
+    lookupMu     sync.Mutex         // 串行化回源查询，同一任务号并发未命中时只查询一次
+    nonceFilter  NonceFilterFactory
+    limiter      *submitLimiter
+    bans         *BanManager
     expireAfter  time.Duration
+    clk          clock.Clock
     stopCh       chan struct{}
+    stopOnce     sync.Once
+    inflight     atomic.Int64 // 正在处理的上行消息数，排空时等待归零
 }
 
 type ServerPusher interface {
@@ -37,14 +77,25 @@ type ServerPusher interface {
 
 type StatsStore interface {
     Increment(username string, minute time.Time) error
+    IncrementBy(username string, minute time.Time, n int) error
+    BatchIncrement(deltas []StatDelta) error
     Get(username string, minute time.Time) (int, error)
     Close() error
 }
 
+// StatDelta 单个 (username, minute) 的提交计数增量，用于批量写入
+type StatDelta struct {
+    Username string
+    Minute   time.Time
+    Count    int
+}
+
 type StateStore interface {
     SaveJob(jobID int, nonce string, createdAt time.Time) error
     LoadLatestJob() (jobID int, nonce string, createdAt time.Time, err error)
     LoadJobHistory(since time.Duration) (map[int]JobRecord, error)
+    // LoadJob 按 JobID 查询共享任务表，不存在时 ok 为 false
+    LoadJob(jobID int) (rec JobRecord, ok bool, err error)
     LoadUserState(username string) (latestJobID int, latestServerNonce string, lastSubmitAt time.Time, err error)
     SaveUserState(username string, latestJobID int, latestServerNonce string, lastSubmitAt time.Time) error
     SaveUsedNonce(username string, jobID int, clientNonce string) error
@@ -55,6 +106,10 @@ type StateStore interface {
 type MessageQueue interface {
     Publish(evt events.SubmitEvent) error
     Subscribe() <-chan events.SubmitEvent
+    // PublishEvent 按 evt.RoutingKey() 发布事件流
+    PublishEvent(evt events.Envelope) error
+    // SubscribeEvents 订阅 routing key 匹配 patterns（支持 `*`/`#`）的事件
+    SubscribeEvents(patterns ...string) (<-chan events.Envelope, error)
     Close() error
 }
 
@@ -1,11 +1,13 @@
 package kupool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/JellyTony/kupool/clock"
 	"github.com/JellyTony/kupool/logger"
 )
 
@@ -15,7 +17,12 @@ type ChannelImpl struct {
 	id string
 	Conn
 	writechan chan []byte
+	ctrlchan  chan OpCode // 控制帧（ping/pong）同样由 writeloop 写出，避免与业务消息交错
+	flushreq  chan chan struct{}
 	once      sync.Once
+	hbOnce    sync.Once
+	heartbeat Heartbeat
+	clk       clock.Clock // 心跳计时，由 SetHeartbeat 设置
 	writeWait time.Duration
 	readwait  time.Duration
 	closed    *Event
@@ -31,10 +38,14 @@ func NewChannel(id string, conn Conn) Channel {
 		id:        id,
 		Conn:      conn,
 		writechan: make(chan []byte, 5),
+		ctrlchan:  make(chan OpCode, 2),
+		flushreq:  make(chan chan struct{}),
 		closed:    NewEvent(),
 		writeWait: DefaultWriteWait, //default value
 		readwait:  DefaultReadWait,
+		clk:       clock.Real(),
 	}
+	ch.heartbeat.Start(ch.clk.Now())
 	go func() {
 		err := ch.writeloop()
 		if err != nil {
@@ -64,6 +75,26 @@ func (ch *ChannelImpl) writeloop() error {
 			if err != nil {
 				return err
 			}
+		case op := <-ch.ctrlchan:
+			if err := ch.WriteFrame(op, nil); err != nil {
+				return err
+			}
+			if err := ch.Conn.Flush(); err != nil {
+				return err
+			}
+		case done := <-ch.flushreq:
+			// 写完队列中剩余的消息后通知 Drain
+			for i := len(ch.writechan); i > 0; i-- {
+				if err := ch.WriteFrame(OpBinary, <-ch.writechan); err != nil {
+					close(done)
+					return err
+				}
+			}
+			err := ch.Conn.Flush()
+			close(done)
+			if err != nil {
+				return err
+			}
 		case <-ch.closed.Done():
 			return nil
 		}
@@ -78,9 +109,13 @@ func (ch *ChannelImpl) Push(payload []byte) error {
 	if ch.closed.HasFired() {
 		return fmt.Errorf("channel %s has closed", ch.id)
 	}
-	// 异步写
-	ch.writechan <- payload
-	return nil
+	// 异步写；writechan 不关闭，关闭后由 closed 事件解除阻塞，避免向已关闭的 chan 发送
+	select {
+	case ch.writechan <- payload:
+		return nil
+	case <-ch.closed.Done():
+		return fmt.Errorf("channel %s has closed", ch.id)
+	}
 }
 
 // overwrite Conn
@@ -92,12 +127,27 @@ func (ch *ChannelImpl) WriteFrame(code OpCode, payload []byte) error {
 // Close 关闭连接
 func (ch *ChannelImpl) Close() error {
 	ch.once.Do(func() {
-		close(ch.writechan)
 		ch.closed.Fire()
+		_ = ch.Conn.Close()
 	})
 	return nil
 }
 
+// Drain 等待发送队列中的消息写完后关闭连接；ctx 结束时不再等待，直接关闭
+func (ch *ChannelImpl) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case ch.flushreq <- done:
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-ch.closed.Done():
+	case <-ctx.Done():
+	}
+	return ch.Close()
+}
+
 // SetWriteWait 设置写超时
 func (ch *ChannelImpl) SetWriteWait(writeWait time.Duration) {
 	if writeWait == 0 {
@@ -113,6 +163,56 @@ func (ch *ChannelImpl) SetReadWait(readwait time.Duration) {
 	ch.readwait = readwait
 }
 
+// SetHeartbeat 开启服务端心跳与空闲检测并设置计时使用的时钟，只在第一次调用时生效，需在 Readloop 之前调用
+func (ch *ChannelImpl) SetHeartbeat(opts HeartbeatOptions) {
+	if !opts.Enabled() && opts.Clock == nil {
+		return
+	}
+	ch.hbOnce.Do(func() {
+		if opts.Clock != nil {
+			ch.clk = opts.Clock
+			ch.heartbeat.Start(ch.clk.Now())
+		}
+		if opts.Enabled() {
+			go ch.heartbeatloop(opts)
+		}
+	})
+}
+
+// Liveness 最近的读活动与 ping/pong 往返时长
+func (ch *ChannelImpl) Liveness() Liveness {
+	return ch.heartbeat.Liveness()
+}
+
+func (ch *ChannelImpl) heartbeatloop(opts HeartbeatOptions) {
+	tick := ch.clk.NewTicker(opts.CheckEvery())
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C():
+			ping, err := ch.heartbeat.Check(now, opts)
+			if err != nil {
+				logger.WithFields(logger.Fields{"module": "channel", "id": ch.id}).Infof("%v, closing", err)
+				_ = ch.Close()
+				return
+			}
+			if ping {
+				ch.control(OpPing)
+			}
+		case <-ch.closed.Done():
+			return
+		}
+	}
+}
+
+// control 把控制帧交给 writeloop
+func (ch *ChannelImpl) control(op OpCode) {
+	select {
+	case ch.ctrlchan <- op:
+	case <-ch.closed.Done():
+	}
+}
+
 func (ch *ChannelImpl) Readloop(lst MessageListener) error {
 	ch.Lock()
 	defer ch.Unlock()
@@ -129,18 +229,25 @@ func (ch *ChannelImpl) Readloop(lst MessageListener) error {
 		if err != nil {
 			return err
 		}
+		now := ch.clk.Now()
+		ch.heartbeat.OnRead(now)
 		if frame.GetOpCode() == OpClose {
 			return errors.New("remote side close the channel")
 		}
 		if frame.GetOpCode() == OpPing {
 			log.Debug("recv a ping; resp with a pong")
-			_ = ch.WriteFrame(OpPong, nil)
+			ch.control(OpPong)
+			continue
+		}
+		if frame.GetOpCode() == OpPong {
+			ch.heartbeat.OnPong(now)
 			continue
 		}
 		payload := frame.GetPayload()
 		if len(payload) == 0 {
 			continue
 		}
+		ch.heartbeat.OnMessage(now)
 		// TODO: Optimization point
 		go lst.Receive(ch, payload)
 	}
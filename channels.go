@@ -2,10 +2,14 @@ package kupool
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/JellyTony/kupool/logger"
 )
 
+// DefaultChannelShards NewChannels 的 num 不大于 0 时使用的分片数
+const DefaultChannelShards = 32
+
 // ChannelMap ChannelMap
 type ChannelMap interface {
 	Add(channel Channel)
@@ -14,17 +18,38 @@ type ChannelMap interface {
 	All() []Channel
 }
 
-// ChannelsImpl ChannelMap
+// ChannelsImpl 按 channel id 哈希分片的 ChannelMap，每个分片独立加锁；
+// 除 ChannelMap 外还提供 O(1) 的 Len 与逐分片遍历的 Range，供调用方按需断言使用
 type ChannelsImpl struct {
-	// TODO: Optimization point
-	channels *sync.Map
+	shards []*channelShard
+	count  atomic.Int64
+}
+
+type channelShard struct {
+	sync.RWMutex
+	channels map[string]Channel
 }
 
-// NewChannels NewChannels
+// NewChannels 创建 num 个分片的 ChannelMap
 func NewChannels(num int) ChannelMap {
-	return &ChannelsImpl{
-		channels: new(sync.Map),
+	if num <= 0 {
+		num = DefaultChannelShards
+	}
+	ch := &ChannelsImpl{shards: make([]*channelShard, num)}
+	for i := range ch.shards {
+		ch.shards[i] = &channelShard{channels: make(map[string]Channel)}
+	}
+	return ch
+}
+
+// shard FNV-1a 哈希选择分片
+func (ch *ChannelsImpl) shard(id string) *channelShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
 	}
+	return ch.shards[h%uint32(len(ch.shards))]
 }
 
 // Add addChannel
@@ -35,12 +60,24 @@ func (ch *ChannelsImpl) Add(channel Channel) {
 		}).Error("channel id is required")
 	}
 
-	ch.channels.Store(channel.ID(), channel)
+	s := ch.shard(channel.ID())
+	s.Lock()
+	if _, ok := s.channels[channel.ID()]; !ok {
+		ch.count.Add(1)
+	}
+	s.channels[channel.ID()] = channel
+	s.Unlock()
 }
 
 // Remove addChannel
 func (ch *ChannelsImpl) Remove(id string) {
-	ch.channels.Delete(id)
+	s := ch.shard(id)
+	s.Lock()
+	if _, ok := s.channels[id]; ok {
+		delete(s.channels, id)
+		ch.count.Add(-1)
+	}
+	s.Unlock()
 }
 
 // Get Get
@@ -51,18 +88,42 @@ func (ch *ChannelsImpl) Get(id string) (Channel, bool) {
 		}).Error("channel id is required")
 	}
 
-	val, ok := ch.channels.Load(id)
-	if !ok {
-		return nil, false
+	s := ch.shard(id)
+	s.RLock()
+	channel, ok := s.channels[id]
+	s.RUnlock()
+	return channel, ok
+}
+
+// Len 当前 channel 数
+func (ch *ChannelsImpl) Len() int {
+	return int(ch.count.Load())
+}
+
+// Range 逐个分片遍历，fn 返回 false 时停止。每个分片先复制再释放锁后回调，
+// fn 中可以 Add/Remove；遍历期间的增删不保证可见
+func (ch *ChannelsImpl) Range(fn func(Channel) bool) {
+	var buf []Channel
+	for _, s := range ch.shards {
+		s.RLock()
+		buf = buf[:0]
+		for _, c := range s.channels {
+			buf = append(buf, c)
+		}
+		s.RUnlock()
+		for _, c := range buf {
+			if !fn(c) {
+				return
+			}
+		}
 	}
-	return val.(Channel), true
 }
 
 // All return channels
 func (ch *ChannelsImpl) All() []Channel {
-	arr := make([]Channel, 0)
-	ch.channels.Range(func(key, val interface{}) bool {
-		arr = append(arr, val.(Channel))
+	arr := make([]Channel, 0, ch.Len())
+	ch.Range(func(c Channel) bool {
+		arr = append(arr, c)
 		return true
 	})
 	return arr
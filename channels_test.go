@@ -0,0 +1,202 @@
+package kupool
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testChannel 只实现 ID，ChannelMap 不调用其余方法
+type testChannel struct {
+	Channel
+	id string
+}
+
+func (c *testChannel) ID() string { return c.id }
+
+func TestChannelsLenAndRange(t *testing.T) {
+	m := NewChannels(8).(*ChannelsImpl)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				m.Add(&testChannel{id: strconv.Itoa(w*1000 + i)})
+			}
+		}(w)
+	}
+	wg.Wait()
+	if m.Len() != 8000 {
+		t.Fatalf("expect 8000 channels, got %d", m.Len())
+	}
+	// 重复添加替换旧值，移除不存在的 id 不影响计数
+	m.Add(&testChannel{id: "0"})
+	m.Remove("missing")
+	if m.Len() != 8000 {
+		t.Fatalf("expect 8000 channels, got %d", m.Len())
+	}
+
+	// Range 回调中可以移除
+	seen := make(map[string]bool)
+	m.Range(func(c Channel) bool {
+		seen[c.ID()] = true
+		m.Remove(c.ID())
+		return true
+	})
+	if len(seen) != 8000 || m.Len() != 0 || len(m.All()) != 0 {
+		t.Fatalf("expect to visit and remove 8000 channels, visited %d, %d left", len(seen), m.Len())
+	}
+
+	m.Add(&testChannel{id: "a"})
+	m.Add(&testChannel{id: "b"})
+	n := 0
+	m.Range(func(Channel) bool { n++; return false })
+	if n != 1 {
+		t.Fatalf("range should stop when fn returns false, visited %d", n)
+	}
+	if c, ok := m.Get("a"); !ok || c.ID() != "a" {
+		t.Fatal("get a")
+	}
+}
+
+const benchChannels = 100000
+
+// syncMapChannels 分片前基于单个 sync.Map 的实现，作为基准对照
+type syncMapChannels struct {
+	m sync.Map
+}
+
+func (s *syncMapChannels) Add(c Channel)    { s.m.Store(c.ID(), c) }
+func (s *syncMapChannels) Remove(id string) { s.m.Delete(id) }
+func (s *syncMapChannels) Get(id string) (Channel, bool) {
+	v, ok := s.m.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(Channel), true
+}
+func (s *syncMapChannels) All() []Channel {
+	var arr []Channel
+	s.m.Range(func(_, v any) bool {
+		arr = append(arr, v.(Channel))
+		return true
+	})
+	return arr
+}
+
+func benchMaps() []struct {
+	name string
+	new  func() ChannelMap
+} {
+	return []struct {
+		name string
+		new  func() ChannelMap
+	}{
+		{"sharded", func() ChannelMap { return NewChannels(DefaultChannelShards) }},
+		{"syncmap", func() ChannelMap { return new(syncMapChannels) }},
+	}
+}
+
+func fill(m ChannelMap) []string {
+	ids := make([]string, benchChannels)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		m.Add(&testChannel{id: ids[i]})
+	}
+	return ids
+}
+
+// BenchmarkChannelsGet 10 万连接下并发查找（推送）
+func BenchmarkChannelsGet(b *testing.B) {
+	for _, bm := range benchMaps() {
+		b.Run(bm.name, func(b *testing.B) {
+			m := bm.new()
+			ids := fill(m)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					m.Get(ids[i%benchChannels])
+					i += 7919
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkChannelsChurn 10 万连接下并发上下线
+func BenchmarkChannelsChurn(b *testing.B) {
+	for _, bm := range benchMaps() {
+		b.Run(bm.name, func(b *testing.B) {
+			m := bm.new()
+			ids := fill(m)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					id := ids[i%benchChannels]
+					m.Remove(id)
+					m.Add(&testChannel{id: id})
+					i += 7919
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkChannelsLen 10 万连接下取连接数
+func BenchmarkChannelsLen(b *testing.B) {
+	for _, bm := range benchMaps() {
+		b.Run(bm.name, func(b *testing.B) {
+			m := bm.new()
+			fill(m)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if l, ok := m.(interface{ Len() int }); ok {
+					_ = l.Len()
+				} else {
+					_ = len(m.All())
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkChannelsBroadcast 10 万连接下遍历全部连接（广播），同时有连接上下线
+func BenchmarkChannelsBroadcast(b *testing.B) {
+	for _, bm := range benchMaps() {
+		b.Run(bm.name, func(b *testing.B) {
+			m := bm.new()
+			ids := fill(m)
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i += 7919 {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					id := ids[i%benchChannels]
+					m.Remove(id)
+					m.Add(&testChannel{id: id})
+				}
+			}()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := 0
+				if r, ok := m.(interface{ Range(func(Channel) bool) }); ok {
+					r.Range(func(Channel) bool { n++; return true })
+				} else {
+					n = len(m.All())
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake 手动推进的 Clock：Advance 按到期顺序触发定时器、ticker、AfterFunc 与 Sleep。
+// AfterFunc 的回调在 Advance 所在协程中同步执行，便于测试断言
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	seq     int
+	waiters []*waiter
+}
+
+type waiter struct {
+	seq    int
+	at     time.Time
+	period time.Duration // ticker 周期，0 表示一次性
+	ch     chan time.Time
+	fn     func()
+}
+
+// NewFake 从 start 开始计时；start 为零值时使用固定的 2024-01-01 UTC
+func NewFake(start time.Time) *Fake {
+	if start.IsZero() {
+		start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	f := &Fake{now: start}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration { return f.Now().Sub(t) }
+
+// Sleep 阻塞到其他协程把时间推进 d
+func (f *Fake) Sleep(d time.Duration) { <-f.After(d) }
+
+func (f *Fake) After(d time.Duration) <-chan time.Time { return f.NewTimer(d).C() }
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return &fakeTimer{f: f, w: f.add(d, 0, nil, fn)}
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return &fakeTimer{f: f, w: f.add(d, 0, make(chan time.Time, 1), nil)}
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return &fakeTicker{f: f, w: f.add(d, d, make(chan time.Time, 1), nil)}
+}
+
+func (f *Fake) add(d, period time.Duration, ch chan time.Time, fn func()) *waiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	w := &waiter{seq: f.seq, at: f.now.Add(d), period: period, ch: ch, fn: fn}
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+	return w
+}
+
+// remove 移除 w，返回移除前是否处于等待中
+func (f *Fake) remove(w *waiter) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.removeLocked(w)
+}
+
+func (f *Fake) removeLocked(w *waiter) bool {
+	for i, x := range f.waiters {
+		if x == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance 把时间推进 d，期间到期的定时器按到期时间依次触发
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	target := f.now.Add(d)
+	f.mu.Unlock()
+	f.advanceTo(target)
+}
+
+// Set 把时间设置为 t，早于当前时间时只修改读数，不触发定时器
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	if !t.After(f.now) {
+		f.now = t
+		f.mu.Unlock()
+		return
+	}
+	f.mu.Unlock()
+	f.advanceTo(t)
+}
+
+func (f *Fake) advanceTo(target time.Time) {
+	for {
+		f.mu.Lock()
+		sort.Slice(f.waiters, func(i, j int) bool {
+			if f.waiters[i].at.Equal(f.waiters[j].at) {
+				return f.waiters[i].seq < f.waiters[j].seq
+			}
+			return f.waiters[i].at.Before(f.waiters[j].at)
+		})
+		if len(f.waiters) == 0 || f.waiters[0].at.After(target) {
+			f.now = target
+			f.mu.Unlock()
+			return
+		}
+		w := f.waiters[0]
+		if w.at.After(f.now) {
+			f.now = w.at
+		}
+		now := f.now
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.removeLocked(w)
+		}
+		f.mu.Unlock()
+		if w.fn != nil {
+			w.fn()
+			continue
+		}
+		// 与标准库一致：接收方未取走上一次的值时丢弃本次
+		select {
+		case w.ch <- now:
+		default:
+		}
+	}
+}
+
+// Waiters 当前等待中的定时器、ticker 与 Sleep 数量
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil 阻塞到等待者数量不少于 n，用于等后台协程创建好 ticker 再推进时间
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	f *Fake
+	w *waiter
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.w.ch }
+func (t *fakeTimer) Stop() bool          { return t.f.remove(t.w) }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	active := t.f.removeLocked(t.w)
+	t.w.at = t.f.now.Add(d)
+	t.f.waiters = append(t.f.waiters, t.w)
+	t.f.cond.Broadcast()
+	return active
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *waiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.ch }
+func (t *fakeTicker) Stop()               { t.f.remove(t.w) }
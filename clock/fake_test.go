@@ -0,0 +1,76 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTimersFireInOrder(t *testing.T) {
+	f := NewFake(time.Time{})
+	start := f.Now()
+	var fired []string
+	f.AfterFunc(3*time.Second, func() { fired = append(fired, "c") })
+	f.AfterFunc(time.Second, func() { fired = append(fired, "a") })
+	stopped := f.AfterFunc(2*time.Second, func() { fired = append(fired, "x") })
+	f.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	if !stopped.Stop() {
+		t.Fatal("pending timer should report active on Stop")
+	}
+	f.Advance(2 * time.Second)
+	if len(fired) != 2 || fired[0] != "a" || fired[1] != "b" {
+		t.Fatalf("unexpected order %v", fired)
+	}
+	f.Advance(time.Second)
+	if len(fired) != 3 || f.Since(start) != 3*time.Second {
+		t.Fatalf("unexpected %v at %v", fired, f.Since(start))
+	}
+}
+
+func TestFakeTickerAndTimer(t *testing.T) {
+	f := NewFake(time.Time{})
+	tk := f.NewTicker(time.Second)
+	defer tk.Stop()
+	f.Advance(time.Second)
+	first := <-tk.C()
+	// 未取走的 tick 被丢弃，与标准库一致
+	f.Advance(3 * time.Second)
+	if got := <-tk.C(); !got.Equal(first.Add(time.Second)) {
+		t.Fatalf("expect the first pending tick to be kept, got %v", got.Sub(first))
+	}
+	select {
+	case <-tk.C():
+		t.Fatal("extra ticks should be dropped")
+	default:
+	}
+
+	tm := f.NewTimer(time.Second)
+	f.Advance(500 * time.Millisecond)
+	if !tm.Reset(time.Second) {
+		t.Fatal("reset of pending timer reports active")
+	}
+	f.Advance(500 * time.Millisecond)
+	select {
+	case <-tm.C():
+		t.Fatal("timer was reset")
+	default:
+	}
+	f.Advance(500 * time.Millisecond)
+	<-tm.C()
+}
+
+func TestFakeSleepAndBlockUntil(t *testing.T) {
+	f := NewFake(time.Time{})
+	done := make(chan time.Time)
+	go func() {
+		f.Sleep(time.Minute)
+		done <- f.Now()
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+	if got := <-done; f.Since(got) != 0 {
+		t.Fatal("sleeper should wake at the advanced time")
+	}
+	if f.Waiters() != 0 {
+		t.Fatal("sleep waiter should be removed")
+	}
+}
@@ -7,19 +7,42 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	clientapp "github.com/JellyTony/kupool/app/client"
 	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/sdk"
 )
 
 func main() {
-	addr := flag.String("addr", "localhost:8080", "server addr")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	addr := flag.String("addr", "localhost:8080", "pool addresses in priority order, comma separated; addr=priority overrides the order")
 	username := flag.String("username", "admin", "username")
+	transport := flag.String("transport", "tcp", "pool transport: tcp|ws")
+	submitInterval := flag.Duration("submit_interval", clientapp.DefaultSubmitInterval, "min interval between submits, match the server rate limit")
+	def := sdk.DefaultReconnectOptions()
+	backoffMin := flag.Duration("backoff_min", def.MinBackoff, "first retry delay when no pool is reachable")
+	backoffMax := flag.Duration("backoff_max", def.MaxBackoff, "max retry delay (exponential backoff with jitter)")
+	probeInterval := flag.Duration("probe_interval", def.ProbeInterval, "how often to probe higher priority pools while on a backup pool")
 	flag.Parse()
+	if v := os.Getenv("KUP_SUBMIT_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			*submitInterval = d
+		}
+	}
+	if v := os.Getenv("KUP_TRANSPORT"); v != "" {
+		*transport = v
+	}
 	_ = logger.Init(logger.Settings{Format: "json"})
-	c := clientapp.NewClient(*username)
-	if err := c.Connect(*addr); err != nil {
-		logger.WithError(err).Fatal("connect failed")
+	pools, err := sdk.ParsePools(*addr)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid -addr")
+	}
+	tr, err := sdk.ParseTransport(*transport)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid -transport")
 	}
 
 	ctx, cancel := context.WithCancelCause(context.Background())
@@ -29,7 +52,13 @@ func main() {
 	go func() {
 		<-sigCh
 		cancel(fmt.Errorf("signal done"))
-		c.Close()
 	}()
-	_ = c.Run(ctx)
+
+	// 断线、服务端重启或通知 client.reconnect 时自动重连，主矿池不可用时切到备用矿池
+	c := clientapp.NewClient(*username)
+	c.SetSubmitInterval(*submitInterval)
+	c.SetTransport(tr)
+	c.SetPools(pools...)
+	c.SetReconnect(sdk.ReconnectOptions{MinBackoff: *backoffMin, MaxBackoff: *backoffMax, Jitter: def.Jitter, ProbeInterval: *probeInterval})
+	_ = c.Mine(ctx)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/JellyTony/kupool/app/replay"
+	"github.com/JellyTony/kupool/recorder"
+)
+
+const replayUsage = `usage: kupool-client replay [-addr ADDR] [-speed N] [-timeout D] [-session ID] <trace.jsonl>
+
+Replays a trace recorded by kupool-server -record against ADDR and prints
+every response that differs from the recording. Exits 1 on any difference.
+`
+
+// runReplay 处理 `kupool-client replay` 子命令，返回进程退出码
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), replayUsage) }
+	addr := fs.String("addr", "localhost:8080", "server addr")
+	speed := fs.Float64("speed", 1, "replay speed relative to the recording (0=as fast as possible)")
+	timeout := fs.Duration("timeout", replay.DefaultTimeout, "max wait for each expected frame")
+	session := fs.String("session", "", "only replay this conn number or channel id")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	recs, err := recorder.LoadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	if *session != "" {
+		recs = filterSession(recs, *session)
+		if len(recs) == 0 {
+			fmt.Fprintln(os.Stderr, "replay: no records for session", *session)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	report, err := replay.Run(ctx, *addr, recs, replay.Options{Speed: *speed, Timeout: *timeout})
+	for _, m := range report.Mismatches {
+		fmt.Println(m)
+	}
+	fmt.Printf("sessions=%d sent=%d matched=%d mismatched=%d\n", report.Sessions, report.Sent, report.Matched, len(report.Mismatches))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// filterSession 保留指定连接的记录；session 可以是连接序号或 channel id
+func filterSession(recs []recorder.Record, session string) []recorder.Record {
+	var conn uint64
+	if n, err := strconv.ParseUint(session, 10, 64); err == nil {
+		conn = n
+	} else {
+		for _, s := range recorder.Sessions(recs) {
+			if s.Channel == session {
+				conn = s.Conn
+				break
+			}
+		}
+	}
+	var out []recorder.Record
+	for _, r := range recs {
+		if r.Conn == conn {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/JellyTony/kupool/stats"
+)
+
+const migrateUsage = `usage: kupool-server migrate [-pg_dsn DSN] <command>
+
+commands:
+  up        apply all pending migrations
+  down [N]  revert the last N migrations (default 1)
+  to N      migrate up or down to version N
+  version   print current and latest schema version
+`
+
+// runMigrate 处理 `kupool-server migrate` 子命令，返回进程退出码
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), migrateUsage) }
+	pgDsn := fs.String("pg_dsn", os.Getenv("KUP_PG_DSN"), "postgres dsn")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || *pgDsn == "" {
+		fs.Usage()
+		return 2
+	}
+	mg, closeFn, err := stats.OpenMigrator(*pgDsn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	defer closeFn()
+
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	n := 0
+	switch cmd {
+	case "up":
+		n, err = mg.Up()
+	case "down":
+		steps := 1
+		if len(rest) > 0 {
+			if steps, err = strconv.Atoi(rest[0]); err != nil || steps <= 0 {
+				fmt.Fprintln(os.Stderr, "migrate: down expects a positive step count")
+				return 2
+			}
+		}
+		n, err = mg.Down(steps)
+	case "to":
+		if len(rest) == 0 {
+			fs.Usage()
+			return 2
+		}
+		target, perr := strconv.Atoi(rest[0])
+		if perr != nil {
+			fmt.Fprintln(os.Stderr, "migrate: invalid version", rest[0])
+			return 2
+		}
+		n, err = mg.To(target)
+	case "version":
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	v, err := mg.Version()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	if cmd != "version" {
+		fmt.Printf("applied %d migration(s)\n", n)
+	}
+	fmt.Printf("schema version %d (latest %d)\n", v, mg.Latest())
+	return 0
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+// TestHotRestartUnderLoad 在持续提交的负载下发送 SIGHUP：新进程接管监听 socket，
+// 旧进程通知重连并排空后退出。期间不应有连接失败或丢失的响应，任务号经 bolt 状态延续，
+// 两个进程接受的提交都计入统计
+func TestHotRestartUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the server binary")
+	}
+	bin := buildServer(t)
+	dir := t.TempDir()
+	addr, httpAddr := freeAddr(t), freeAddr(t)
+	logPath := filepath.Join(dir, "server.log")
+	logf, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logf.Close()
+	t.Cleanup(func() {
+		killAll(bin)
+		if t.Failed() {
+			out, _ := os.ReadFile(logPath)
+			t.Logf("server log:\n%s", out)
+		}
+	})
+
+	cmd := exec.Command(bin,
+		"-addr", addr, "-http_addr", httpAddr,
+		"-store", "bolt", "-store_path", filepath.Join(dir, "kupool.db"),
+		"-interval", "300ms", "-rate_limit", "1000", "-ban_enabled=false",
+		"-drain_grace", "5s", "-stats_batch_window", "50ms",
+	)
+	cmd.Env = append(os.Environ(), "KUP_LOG_LEVEL=warn")
+	// 子进程继承标准输出，必须是文件，否则 Wait 会等到子进程也退出
+	cmd.Stdout, cmd.Stderr = logf, logf
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitDial(t, addr)
+
+	start := time.Now()
+	stop := make(chan struct{})
+	miners := make([]*loadMiner, 4)
+	var wg sync.WaitGroup
+	for i := range miners {
+		miners[i] = &loadMiner{name: fmt.Sprintf("m%d", i), addr: addr}
+		wg.Add(1)
+		go func(m *loadMiner) {
+			defer wg.Done()
+			m.run(stop)
+		}(miners[i])
+	}
+
+	time.Sleep(time.Second)
+	if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("old process should exit cleanly: %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("old process did not exit after handing off")
+	}
+	// 负载继续打在新进程上
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	total := 0
+	for _, m := range miners {
+		if m.err != nil {
+			t.Fatalf("%s: %v", m.name, m.err)
+		}
+		if m.dialErrs != 0 || m.lost != 0 {
+			t.Fatalf("%s: %d failed dials, %d lost responses", m.name, m.dialErrs, m.lost)
+		}
+		if m.reconnects != 1 || m.acceptedAfter == 0 {
+			t.Fatalf("%s: expect to reconnect once and keep mining, got %d reconnects, %d accepted after", m.name, m.reconnects, m.acceptedAfter)
+		}
+		if m.firstJobAfter <= m.lastJobBefore {
+			t.Fatalf("%s: job ids should continue across the restart: %d -> %d", m.name, m.lastJobBefore, m.firstJobAfter)
+		}
+		total += m.accepted
+	}
+
+	// 新进程从 bolt 读到旧进程落库的计数（bolt 不支持范围查询，逐分钟累加）
+	got := -1
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got = statsSum(httpAddr, miners, start, time.Now()); got == total {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expect %d submissions in stats, got %d", total, got)
+}
+
+// loadMiner 持续提交的矿工：收到 client.reconnect 后停止提交，等在途响应都到齐再重连
+type loadMiner struct {
+	name string
+	addr string
+
+	err           error
+	dialErrs      int
+	lost          int
+	reconnects    int
+	accepted      int
+	acceptedAfter int
+	lastJobBefore int
+	firstJobAfter int
+}
+
+func (m *loadMiner) run(stop <-chan struct{}) {
+	for session := 0; ; session++ {
+		raw, err := net.DialTimeout("tcp", m.addr, 2*time.Second)
+		if err != nil {
+			m.dialErrs++
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				continue
+			}
+		}
+		stopped := m.session(tcp.NewConn(raw), session, stop)
+		raw.Close()
+		if stopped || m.err != nil {
+			return
+		}
+		m.reconnects++
+	}
+}
+
+// session 返回 true 表示因 stop 结束
+func (m *loadMiner) session(conn *tcp.TcpConn, session int, stop <-chan struct{}) bool {
+	frames := make(chan kupool.Frame, 64)
+	go func() {
+		defer close(frames)
+		for {
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			frames <- f
+		}
+	}()
+	if err := m.send(conn, 1, "authorize", protocol.AuthorizeParams{Username: m.name}); err != nil {
+		m.err = err
+		return false
+	}
+	pending := map[int]bool{1: true}
+	nextID := 2
+	var job protocol.JobParams
+	leaving, stopping := false, false
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if (leaving || stopping) && len(pending) == 0 {
+			return stopping
+		}
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				m.lost += len(pending)
+				return stopping
+			}
+			if f.GetOpCode() != kupool.OpBinary {
+				continue
+			}
+			var req protocol.Request
+			if protocol.Decode(f.GetPayload(), &req) == nil && req.Method != "" {
+				switch req.Method {
+				case "job":
+					_ = protocol.Decode(req.Params, &job)
+					if session == 0 {
+						m.lastJobBefore = job.JobID
+					} else if m.firstJobAfter == 0 {
+						m.firstJobAfter = job.JobID
+					}
+				case "client.reconnect":
+					leaving = true
+				}
+				continue
+			}
+			var resp protocol.Response
+			if protocol.Decode(f.GetPayload(), &resp) != nil {
+				continue
+			}
+			delete(pending, resp.ID)
+			if resp.ID == 1 {
+				if !resp.Result {
+					m.err = fmt.Errorf("authorize rejected: %v", resp.Error)
+					return false
+				}
+				continue
+			}
+			if resp.Result {
+				m.accepted++
+				if session > 0 {
+					m.acceptedAfter++
+				}
+			}
+		case <-tick.C:
+			if leaving || stopping || job.JobID == 0 {
+				continue
+			}
+			nonce := fmt.Sprintf("%s-%d-%d", m.name, session, nextID)
+			p := protocol.SubmitParams{JobID: job.JobID, ClientNonce: nonce, Result: sha256Hex(job.ServerNonce + nonce)}
+			if err := m.send(conn, nextID, "submit", p); err != nil {
+				m.lost += len(pending)
+				return false
+			}
+			pending[nextID] = true
+			nextID++
+		case <-stop:
+			stopping = true
+			stop = nil
+		}
+	}
+}
+
+func (m *loadMiner) send(conn *tcp.TcpConn, id int, method string, params any) error {
+	raw, _ := protocol.Encode(params)
+	data, _ := protocol.Encode(protocol.Request{ID: &id, Method: method, Params: raw})
+	return conn.WriteFrame(kupool.OpBinary, data)
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func buildServer(t *testing.T) string {
+	t.Helper()
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+	bin := filepath.Join(t.TempDir(), "kupool-server")
+	if out, err := exec.Command(goBin, "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build server: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitDial(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// statsSum 经 /stats 累加各矿工在 [start, end] 内每分钟的提交数，请求失败时返回 -1
+func statsSum(httpAddr string, miners []*loadMiner, start, end time.Time) int {
+	sum := 0
+	for _, m := range miners {
+		for minute := start.Truncate(time.Minute); !minute.After(end); minute = minute.Add(time.Minute) {
+			q := url.Values{"username": {m.name}, "minute": {minute.UTC().Format(time.RFC3339)}}
+			resp, err := http.Get("http://" + httpAddr + "/stats?" + q.Encode())
+			if err != nil {
+				return -1
+			}
+			var body struct {
+				Count int `json:"submission_count"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || err != nil {
+				return -1
+			}
+			sum += body.Count
+		}
+	}
+	return sum
+}
+
+// killAll 结束所有运行 bin 的进程，包括热重启产生的子进程
+func killAll(bin string) {
+	procs, _ := filepath.Glob("/proc/[0-9]*/exe")
+	for _, p := range procs {
+		if exe, err := os.Readlink(p); err == nil && exe == bin {
+			var pid int
+			if _, err := fmt.Sscanf(p, "/proc/%d/exe", &pid); err == nil {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+}
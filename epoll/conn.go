@@ -0,0 +1,291 @@
+package epoll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/tcp"
+	"github.com/JellyTony/kupool/wire/endian"
+)
+
+const (
+	// MaxFrameSize 单帧 payload 上限，超过时关闭连接
+	MaxFrameSize = 1 << 20
+	// MaxPending 单个连接待写出的帧数上限，超过时 Push 返回错误而不是阻塞调用方
+	MaxPending = 256
+
+	frameHeader = 5 // opcode(1) + 长度(4, 小端)
+	readBufSize = 4096
+)
+
+var errDrivenByPoller = errors.New("epoll: channel is driven by the poller")
+
+// readBufs 读缓冲只在连接可读时从池中借出，空闲连接不持有缓冲
+var readBufs = sync.Pool{New: func() any {
+	b := make([]byte, readBufSize)
+	return &b
+}}
+
+type outFrame struct {
+	op      kupool.OpCode
+	payload []byte
+}
+
+// conn 由 poller 驱动的 Channel：没有常驻的读写 goroutine，可读时由读协程池解析帧，
+// Push 排队后由写协程池写出
+type conn struct {
+	*tcp.TcpConn
+	id     string
+	srv    *Server
+	raw    syscall.RawConn
+	fd     int
+	ticket *kupool.Ticket
+
+	reading   atomic.Bool      // 同一时刻只有一个读协程处理该连接
+	heartbeat kupool.Heartbeat // 读活动与 ping/pong 往返，空闲超时与心跳由 Server 统一巡检
+	pending   []byte           // 未凑满一帧的数据，仅由持有 reading 的读协程访问
+
+	mu        sync.Mutex // 保护 out/writing/drained，并与 rearm 互斥以免关闭后重新注册
+	out       []outFrame
+	writing   bool
+	drained   chan struct{}
+	writeWait time.Duration
+	readWait  time.Duration
+	hb        kupool.HeartbeatOptions
+	clk       clock.Clock
+	closed    *kupool.Event
+}
+
+func newConn(s *Server, id string, rawconn net.Conn) (*conn, error) {
+	sc, ok := rawconn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("epoll: %T does not expose a file descriptor", rawconn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		TcpConn:   tcp.NewConn(rawconn),
+		id:        id,
+		srv:       s,
+		raw:       raw,
+		writeWait: s.options.writewait,
+		readWait:  s.options.readwait,
+		hb:        s.options.heartbeat,
+		clk:       clock.OrReal(s.options.heartbeat.Clock),
+		closed:    kupool.NewEvent(),
+	}
+	if err := raw.Control(func(fd uintptr) { c.fd = int(fd) }); err != nil {
+		return nil, err
+	}
+	c.heartbeat.Start(c.clk.Now())
+	return c, nil
+}
+
+// ID id
+func (c *conn) ID() string { return c.id }
+
+// Push 异步写数据
+func (c *conn) Push(payload []byte) error {
+	return c.enqueue(kupool.OpBinary, payload)
+}
+
+func (c *conn) enqueue(op kupool.OpCode, payload []byte) error {
+	c.mu.Lock()
+	if c.closed.HasFired() {
+		c.mu.Unlock()
+		return fmt.Errorf("channel %s has closed", c.id)
+	}
+	if len(c.out) >= MaxPending {
+		c.mu.Unlock()
+		return fmt.Errorf("channel %s send queue is full", c.id)
+	}
+	c.out = append(c.out, outFrame{op: op, payload: payload})
+	schedule := !c.writing
+	c.writing = true
+	c.mu.Unlock()
+	if schedule {
+		c.srv.schedule(c)
+	}
+	return nil
+}
+
+// flush 由写协程调用，把队列中的帧合并成一次写出，直到队列为空
+func (c *conn) flush(buf []byte) []byte {
+	for {
+		c.mu.Lock()
+		out := c.out
+		c.out = nil
+		if len(out) == 0 || c.closed.HasFired() {
+			c.writing = false
+			if c.drained != nil {
+				close(c.drained)
+				c.drained = nil
+			}
+			c.mu.Unlock()
+			return buf
+		}
+		c.mu.Unlock()
+
+		buf = buf[:0]
+		for _, f := range out {
+			buf = append(buf, byte(f.op))
+			buf = endian.Default.AppendUint32(buf, uint32(len(f.payload)))
+			buf = append(buf, f.payload...)
+		}
+		_ = c.SetWriteDeadline(time.Now().Add(c.writeWait))
+		if _, err := c.TcpConn.Write(buf); err != nil {
+			_ = c.Close()
+		}
+	}
+}
+
+// onReadable 由读协程调用：读出当前可读的数据，按帧分发给 MessageListener，返回 false 表示连接已关闭
+func (c *conn) onReadable(lst kupool.MessageListener) bool {
+	bp := readBufs.Get().(*[]byte)
+	defer readBufs.Put(bp)
+	n, err := rawRead(c.raw, *bp)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+		return true
+	}
+	if err != nil || n == 0 {
+		_ = c.Close()
+		return false
+	}
+	now := c.clk.Now()
+	c.heartbeat.OnRead(now)
+
+	data := (*bp)[:n]
+	if len(c.pending) > 0 {
+		c.pending = append(c.pending, data...)
+		data = c.pending
+	}
+	for len(data) >= frameHeader {
+		size := int(endian.Default.Uint32(data[1:frameHeader]))
+		if size > MaxFrameSize {
+			_ = c.Close()
+			return false
+		}
+		if len(data) < frameHeader+size {
+			break
+		}
+		op := kupool.OpCode(data[0])
+		// 读缓冲会被复用，payload 必须复制
+		payload := append([]byte(nil), data[frameHeader:frameHeader+size]...)
+		data = data[frameHeader+size:]
+		switch op {
+		case kupool.OpClose:
+			_ = c.Close()
+			return false
+		case kupool.OpPing:
+			_ = c.enqueue(kupool.OpPong, nil)
+			continue
+		case kupool.OpPong:
+			c.heartbeat.OnPong(now)
+			continue
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		c.heartbeat.OnMessage(now)
+		// 同步回调：同一连接的消息按到达顺序处理，不为每帧创建 goroutine
+		lst.Receive(c, payload)
+		if c.closed.HasFired() {
+			return false
+		}
+	}
+	if len(data) == 0 {
+		c.pending = nil
+	} else {
+		c.pending = append(c.pending[:0:0], data...)
+	}
+	return true
+}
+
+// Close 关闭连接，从 poller 与 ChannelMap 中移除并通知 StateListener
+func (c *conn) Close() error {
+	if !c.closed.Fire() {
+		return nil
+	}
+	c.mu.Lock()
+	_ = c.srv.poller.remove(c)
+	c.mu.Unlock()
+	err := c.TcpConn.Close()
+	c.ticket.Release()
+	c.srv.Remove(c.id)
+	_ = c.srv.Disconnect(c.id)
+	return err
+}
+
+// Drain 等待发送队列写完后关闭连接；ctx 结束时不再等待，直接关闭
+func (c *conn) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.writing {
+		c.mu.Unlock()
+		return c.Close()
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	done := c.drained
+	c.mu.Unlock()
+	select {
+	case <-done:
+	case <-c.closed.Done():
+	case <-ctx.Done():
+	}
+	return c.Close()
+}
+
+// Readloop 读取由 poller 驱动，不支持阻塞读循环
+func (c *conn) Readloop(kupool.MessageListener) error { return errDrivenByPoller }
+
+// SetWriteWait 设置写超时
+func (c *conn) SetWriteWait(d time.Duration) {
+	if d == 0 {
+		return
+	}
+	c.writeWait = d
+}
+
+// SetReadWait 设置空闲超时，超过该时长没有收到数据时关闭连接
+func (c *conn) SetReadWait(d time.Duration) {
+	if d == 0 {
+		return
+	}
+	c.readWait = d
+}
+
+// SetHeartbeat 设置服务端心跳与空闲检测，由 Server 巡检时执行
+func (c *conn) SetHeartbeat(opts kupool.HeartbeatOptions) {
+	c.hb = opts
+}
+
+// Liveness 最近的读活动与 ping/pong 往返时长
+func (c *conn) Liveness() kupool.Liveness {
+	return c.heartbeat.Liveness()
+}
+
+// check 巡检：超过读超时没有收到任何数据，或心跳检查失败时返回原因；连接空闲时发送 ping
+func (c *conn) check(now time.Time) error {
+	if idle := now.Sub(c.heartbeat.Liveness().LastRead); idle > c.readWait {
+		return errors.New("read timeout")
+	}
+	if !c.hb.Enabled() {
+		return nil
+	}
+	ping, err := c.heartbeat.Check(now, c.hb)
+	if ping {
+		_ = c.enqueue(kupool.OpPing, nil)
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package epoll_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/app/harness"
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/epoll"
+	"github.com/JellyTony/kupool/events"
+)
+
+// TestAppServerOnEpoll AppServer 换用 epoll 传输后握手、广播、提交、统计与排空的行为与 tcp 一致
+func TestAppServerOnEpoll(t *testing.T) {
+	h := harness.Start(t, harness.Options{Setup: func(app *server.AppServer) {
+		app.SetServer(epoll.NewServer("127.0.0.1:0"))
+		app.SetDrainOptions(server.DrainOptions{Grace: harness.DefaultTimeout})
+	}})
+	start := h.Clock.Now()
+	a, b := h.Connect("alice"), h.Connect("bob")
+	h.Rotate()
+	job := a.NextJob()
+	if next := b.NextJob(); next.JobID != job.JobID {
+		t.Fatalf("both sessions should receive job %d, got %d", job.JobID, next.JobID)
+	}
+	if r := a.Submit(job, "n1"); !r.Result {
+		t.Fatalf("valid share rejected: %s", harness.ErrorOf(r))
+	}
+	if r := a.Submit(job, "n2"); harness.ErrorOf(r) != server.ErrSubmitTooFrequent.Error() {
+		t.Fatalf("expect rate limit, got %+v", r)
+	}
+	if r := b.SubmitResult(job.JobID, "n1", "00"); harness.ErrorOf(r) != "Invalid result" {
+		t.Fatalf("expect Invalid result, got %+v", r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = h.App.Shutdown(context.Background())
+		close(done)
+	}()
+	a.NextNotification("client.reconnect")
+	b.NextNotification("client.reconnect")
+	h.Advance(time.Second)
+	if r := b.Submit(job, "late"); !r.Result {
+		t.Fatalf("submit within the grace period rejected: %s", harness.ErrorOf(r))
+	}
+	a.Close()
+	b.Close()
+	select {
+	case <-done:
+	case <-time.After(harness.DefaultTimeout):
+		t.Fatal("shutdown should finish once every client has left")
+	}
+	if got := len(h.WaitEvents(events.KindSessionClosed, 2)); got != 2 {
+		t.Fatalf("expect 2 session.closed, got %d", got)
+	}
+	h.ExpectTotal(start, h.Clock.Now(), 2)
+}
@@ -0,0 +1,105 @@
+package epoll
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+
+	kupool "github.com/JellyTony/kupool"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitTimeout epoll_wait 的超时（毫秒），用于发现 Shutdown
+const waitTimeout = 200
+
+// poller 单个 epoll 实例。连接以 EPOLLONESHOT 注册：每次可读只通知一次，读协程处理完再 rearm，
+// 因此同一连接不会被多个读协程同时读取
+type poller struct {
+	fd    int
+	mu    sync.RWMutex
+	conns map[int]*conn
+}
+
+func newPoller() (*poller, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{fd: fd, conns: make(map[int]*conn)}, nil
+}
+
+const readEvents = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+
+func (p *poller) add(c *conn) error {
+	p.mu.Lock()
+	p.conns[c.fd] = c
+	p.mu.Unlock()
+	err := unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, c.fd, &unix.EpollEvent{Events: readEvents, Fd: int32(c.fd)})
+	if err != nil {
+		p.mu.Lock()
+		delete(p.conns, c.fd)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+func (p *poller) rearm(c *conn) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, c.fd, &unix.EpollEvent{Events: readEvents, Fd: int32(c.fd)})
+}
+
+// remove 需在关闭 socket 之前调用，否则 fd 可能已被新连接复用
+func (p *poller) remove(c *conn) error {
+	p.mu.Lock()
+	if p.conns[c.fd] == c {
+		delete(p.conns, c.fd)
+	}
+	p.mu.Unlock()
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, c.fd, nil)
+}
+
+func (p *poller) close() error {
+	return unix.Close(p.fd)
+}
+
+// wait 循环等待就绪事件并回调 fn，quit 触发后关闭 epoll 实例并返回
+func (p *poller) wait(quit *kupool.Event, fn func(*conn)) {
+	events := make([]unix.EpollEvent, 256)
+	for !quit.HasFired() {
+		n, err := unix.EpollWait(p.fd, events, waitTimeout)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			break
+		}
+		for i := 0; i < n; i++ {
+			p.mu.RLock()
+			c := p.conns[int(events[i].Fd)]
+			p.mu.RUnlock()
+			if c != nil {
+				fn(c)
+			}
+		}
+	}
+	_ = p.close()
+}
+
+// rawRead 对非阻塞 socket 直接 read 一次，不经 Go 的 netpoller 等待；无数据时返回 EAGAIN
+func rawRead(rc syscall.RawConn, buf []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	cerr := rc.Read(func(fd uintptr) bool {
+		n, err = unix.Read(int(fd), buf)
+		return true
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package epoll
+
+import (
+	"syscall"
+
+	kupool "github.com/JellyTony/kupool"
+)
+
+type poller struct{}
+
+func newPoller() (*poller, error) { return nil, ErrNotSupported }
+
+func (p *poller) add(*conn) error                  { return ErrNotSupported }
+func (p *poller) rearm(*conn) error                { return ErrNotSupported }
+func (p *poller) remove(*conn) error               { return ErrNotSupported }
+func (p *poller) close() error                     { return nil }
+func (p *poller) wait(*kupool.Event, func(*conn))  {}
+func rawRead(syscall.RawConn, []byte) (int, error) { return 0, ErrNotSupported }
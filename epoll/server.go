@@ -0,0 +1,487 @@
+// Package epoll 基于 Linux epoll 就绪通知的 kupool.Server 实现，用于承载大量空闲矿工。
+//
+// tcp.Server 的每个连接常驻 Readloop 与 writeloop 两个 goroutine，并为每条消息创建一个 goroutine；
+// 这里连接注册到 epoll 后不再占用 goroutine：可读时由固定大小的读协程池借出读缓冲解析帧并同步回调
+// MessageListener，Push 排队后由写协程池写出，空闲超时由一个巡检协程统一处理。
+// 握手仍按 Acceptor 约定在独立 goroutine 中阻塞完成。非 Linux 平台 Start 返回 ErrNotSupported
+package epoll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/proxyproto"
+	"github.com/JellyTony/kupool/tcp"
+
+	"github.com/segmentio/ksuid"
+)
+
+var (
+	// ErrNotSupported 当前平台不支持 epoll
+	ErrNotSupported = errors.New("epoll: only supported on linux")
+	// ErrServerClosed StopAccept 或 Shutdown 之后 Start 返回的错误
+	ErrServerClosed = tcp.ErrServerClosed
+)
+
+// ServerOptions ServerOptions
+type ServerOptions struct {
+	loginwait time.Duration           //登陆超时
+	readwait  time.Duration           //读超时（空闲超时）
+	writewait time.Duration           //写超时
+	readers   int                     //读协程数
+	writers   int                     //写协程数
+	heartbeat kupool.HeartbeatOptions //服务端心跳
+}
+
+// Server 基于 epoll 的 kupool.Server
+type Server struct {
+	listen string
+	kupool.ChannelMap
+	kupool.Acceptor
+	kupool.MessageListener
+	kupool.StateListener
+	once    sync.Once
+	options ServerOptions
+	quit    *kupool.Event // 停止 accept
+	done    *kupool.Event // Shutdown 结束，poller 与读写协程退出
+	mu      sync.Mutex
+	lsts    []net.Listener
+	poller  *poller
+	proxy   *proxyproto.Policy
+	admit   *kupool.Admission
+	readq   chan *conn
+	writeq  chan *conn
+}
+
+// NewServer NewServer
+func NewServer(listen string) kupool.Server {
+	workers := 4 * runtime.GOMAXPROCS(0)
+	return &Server{
+		listen:     listen,
+		ChannelMap: kupool.NewChannels(kupool.DefaultChannelShards),
+		quit:       kupool.NewEvent(),
+		done:       kupool.NewEvent(),
+		options: ServerOptions{
+			loginwait: kupool.DefaultLoginWait,
+			readwait:  kupool.DefaultReadWait,
+			writewait: kupool.DefaultWriteWait,
+			readers:   workers,
+			writers:   workers,
+		},
+	}
+}
+
+// Start server
+func (s *Server) Start() error {
+	log := logger.WithFields(logger.Fields{
+		"module": "epoll.server",
+		"listen": s.listen,
+	})
+
+	if s.StateListener == nil {
+		return fmt.Errorf("StateListener is nil")
+	}
+	if s.MessageListener == nil {
+		return fmt.Errorf("MessageListener is nil")
+	}
+	if s.Acceptor == nil {
+		s.Acceptor = new(defaultAcceptor)
+	}
+
+	p, err := newPoller()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	lsts := s.lsts
+	s.mu.Unlock()
+	if len(lsts) == 0 {
+		lst, err := net.Listen("tcp", s.listen)
+		if err != nil {
+			_ = p.close()
+			return err
+		}
+		lsts = []net.Listener{lst}
+	}
+	s.mu.Lock()
+	s.lsts = lsts
+	s.poller = p
+	stopped := s.quit.HasFired()
+	s.mu.Unlock()
+	if stopped {
+		// Start 之前已经调用了 StopAccept
+		for _, lst := range lsts {
+			_ = lst.Close()
+		}
+		_ = p.close()
+		return ErrServerClosed
+	}
+
+	s.readq = make(chan *conn, 1024)
+	s.writeq = make(chan *conn, 1024)
+	for i := 0; i < s.options.readers; i++ {
+		go s.readLoop()
+	}
+	for i := 0; i < s.options.writers; i++ {
+		go s.writeLoop()
+	}
+	go p.wait(s.done, func(c *conn) {
+		// 同一连接同时只交给一个读协程；正在处理时忽略，处理完重新注册后会再次通知
+		if c.reading.CompareAndSwap(false, true) {
+			s.readq <- c
+		}
+	})
+	go s.sweep()
+
+	log.WithField("addr", lsts[0].Addr().String()).WithField("readers", s.options.readers).Info("started")
+	var wg sync.WaitGroup
+	for _, lst := range lsts {
+		wg.Add(1)
+		go func(lst net.Listener) {
+			defer wg.Done()
+			s.acceptLoop(lst)
+		}(lst)
+	}
+	wg.Wait()
+	log.Info("listener closed")
+	return ErrServerClosed
+}
+
+// acceptLoop 在 lst 上接受连接直到监听关闭
+func (s *Server) acceptLoop(lst net.Listener) {
+	log := logger.WithFields(logger.Fields{
+		"module": "epoll.server",
+		"listen": s.listen,
+	})
+	var backoff time.Duration
+	for {
+		rawconn, err := lst.Accept()
+		if err != nil {
+			if s.quit.HasFired() {
+				return
+			}
+			// 临时错误（如文件描述符耗尽）退避重试，避免空转
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Warnf("accept error: %v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go s.handshake(rawconn)
+	}
+}
+
+// handshake 按 Acceptor 约定阻塞完成握手，随后把连接交给 poller，本 goroutine 退出
+func (s *Server) handshake(rawconn net.Conn) {
+	log := logger.WithFields(logger.Fields{
+		"module": "epoll.server",
+	})
+	refuse := func(err error) {
+		log.Debugf("refuse %s: %v", rawconn.RemoteAddr(), err)
+		_ = rawconn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = tcp.WriteFrame(rawconn, kupool.OpClose, []byte(err.Error()))
+		_ = rawconn.Close()
+	}
+	// 读取 PROXY 头部前先占用全局与握手名额，按来源的限制等真实地址确定后再检查
+	var source net.Addr
+	if s.proxy == nil {
+		source = rawconn.RemoteAddr()
+	}
+	ticket, err := s.admit.Admit(source)
+	if err != nil {
+		refuse(err)
+		return
+	}
+	if s.proxy != nil {
+		pc, err := s.proxy.Wrap(rawconn)
+		if err != nil {
+			log.Warnf("proxy protocol from %s: %v", rawconn.RemoteAddr(), err)
+			_ = rawconn.Close()
+			ticket.Release()
+			return
+		}
+		rawconn = pc
+		if err := ticket.Bind(rawconn.RemoteAddr()); err != nil {
+			refuse(err)
+			ticket.Release()
+			return
+		}
+	}
+	tc := tcp.NewConn(rawconn)
+	id, err := s.Accept(tc, s.options.loginwait)
+	if err != nil {
+		_ = tc.WriteFrame(kupool.OpClose, []byte(err.Error()))
+		log.Debugf("close connection, %s", id)
+		_ = tc.Close()
+		ticket.Release()
+		return
+	}
+	if _, ok := s.Get(id); ok {
+		log.Warnf("channel %s existed", id)
+		_ = tc.WriteFrame(kupool.OpClose, []byte("channelId is repeated"))
+		_ = tc.Close()
+		ticket.Release()
+		return
+	}
+	c, err := newConn(s, id, rawconn)
+	if err != nil {
+		log.Errorf("register channel %s: %v", id, err)
+		_ = tc.Close()
+		ticket.Release()
+		_ = s.Disconnect(id)
+		return
+	}
+	// 名额随连接关闭归还
+	ticket.Established()
+	c.ticket = ticket
+	// Acceptor 设置的读超时对非阻塞读无意义，空闲超时改由 sweep 处理
+	_ = rawconn.SetReadDeadline(time.Time{})
+	s.Add(c)
+	if err := s.poller.add(c); err != nil {
+		log.Errorf("register channel %s: %v", id, err)
+		_ = c.Close()
+		return
+	}
+	if s.done.HasFired() {
+		// 握手期间 Shutdown 已结束
+		_ = c.Close()
+		return
+	}
+	log.Infof("accept channel: %s", id)
+}
+
+func (s *Server) readLoop() {
+	for {
+		select {
+		case c := <-s.readq:
+			alive := c.onReadable(s.MessageListener)
+			c.reading.Store(false)
+			if alive {
+				c.mu.Lock()
+				if !c.closed.HasFired() {
+					_ = s.poller.rearm(c)
+				}
+				c.mu.Unlock()
+			}
+		case <-s.done.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) writeLoop() {
+	var buf []byte
+	for {
+		select {
+		case c := <-s.writeq:
+			buf = c.flush(buf)
+			if cap(buf) > 64*readBufSize {
+				buf = nil
+			}
+		case <-s.done.Done():
+			return
+		}
+	}
+}
+
+// schedule 把有待写数据的连接交给写协程
+func (s *Server) schedule(c *conn) {
+	select {
+	case s.writeq <- c:
+	case <-s.done.Done():
+		// 写协程已退出，直接在调用方写出
+		c.flush(nil)
+	}
+}
+
+// sweep 按读超时的四分之一（开启心跳时取更短的心跳巡检间隔）巡检，关闭超过读超时没有数据
+// 或心跳检查失败的连接，并向空闲连接发送 ping
+func (s *Server) sweep() {
+	every := s.options.readwait / 4
+	if every < time.Second {
+		every = time.Second
+	}
+	if hb := s.options.heartbeat; hb.Enabled() && hb.CheckEvery() < every {
+		every = hb.CheckEvery()
+	}
+	tick := clock.OrReal(s.options.heartbeat.Clock).NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C():
+			s.rangeChannels(func(ch kupool.Channel) {
+				c, ok := ch.(*conn)
+				if !ok {
+					return
+				}
+				if err := c.check(now); err != nil {
+					logger.WithFields(logger.Fields{"module": "epoll.server", "id": c.id}).Infof("%v, closing", err)
+					_ = c.Close()
+				}
+			})
+		case <-s.done.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) rangeChannels(fn func(kupool.Channel)) {
+	if r, ok := s.ChannelMap.(interface {
+		Range(func(kupool.Channel) bool)
+	}); ok {
+		r.Range(func(ch kupool.Channel) bool {
+			fn(ch)
+			return true
+		})
+		return
+	}
+	for _, ch := range s.ChannelMap.All() {
+		fn(ch)
+	}
+}
+
+// StopAccept 关闭监听，accept 循环随即退出；已建立的连接照常收发
+func (s *Server) StopAccept() error {
+	if !s.quit.Fire() {
+		return nil
+	}
+	s.mu.Lock()
+	lsts := s.lsts
+	s.mu.Unlock()
+	var errs []error
+	for _, lst := range lsts {
+		if err := lst.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetListeners 使用已有的监听 socket（如热重启时从父进程继承），每个 socket 一个 accept 循环；需在 Start 之前调用
+func (s *Server) SetListeners(lsts ...net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lsts = lsts
+}
+
+// Addr 返回实际监听地址，Start 之前且未 SetListeners 时返回 nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.lsts) == 0 {
+		return nil
+	}
+	return s.lsts[0].Addr()
+}
+
+// Shutdown 停止接受新连接，写完每个连接发送队列中的消息后关闭；ctx 结束时直接关闭剩余连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	log := logger.WithFields(logger.Fields{
+		"module": "epoll.server",
+	})
+	var err error
+	s.once.Do(func() {
+		defer func() {
+			log.Infoln("shutdown")
+		}()
+		err = s.StopAccept()
+		var wg sync.WaitGroup
+		for _, ch := range s.ChannelMap.All() {
+			wg.Add(1)
+			go func(ch kupool.Channel) {
+				defer wg.Done()
+				if d, ok := ch.(interface{ Drain(context.Context) error }); ok {
+					_ = d.Drain(ctx)
+					return
+				}
+				_ = ch.Close()
+			}(ch)
+		}
+		wg.Wait()
+		s.done.Fire()
+	})
+	return err
+}
+
+// string channelID
+// []byte data
+func (s *Server) Push(id string, data []byte) error {
+	ch, ok := s.ChannelMap.Get(id)
+	if !ok {
+		return errors.New("channel no found")
+	}
+	return ch.Push(data)
+}
+
+// SetAcceptor SetAcceptor
+func (s *Server) SetAcceptor(acceptor kupool.Acceptor) {
+	s.Acceptor = acceptor
+}
+
+// SetMessageListener SetMessageListener
+func (s *Server) SetMessageListener(listener kupool.MessageListener) {
+	s.MessageListener = listener
+}
+
+// SetStateListener SetStateListener
+func (s *Server) SetStateListener(listener kupool.StateListener) {
+	s.StateListener = listener
+}
+
+// SetReadWait 设置空闲超时
+func (s *Server) SetReadWait(readwait time.Duration) {
+	s.options.readwait = readwait
+}
+
+// SetHeartbeat 之后建立的连接空闲时由服务端发送 ping，并关闭不回 pong 或长时间没有业务消息的连接
+func (s *Server) SetHeartbeat(opts kupool.HeartbeatOptions) {
+	s.options.heartbeat = opts
+}
+
+// SetChannelMap SetChannelMap
+func (s *Server) SetChannelMap(channels kupool.ChannelMap) {
+	s.ChannelMap = channels
+}
+
+// SetProxyPolicy 对来自可信网段的连接先解析 PROXY protocol 头部，Acceptor 与之后的 RemoteAddr 为真实客户端地址；
+// 需在 Start 之前调用
+func (s *Server) SetProxyPolicy(p proxyproto.Policy) {
+	s.proxy = &p
+}
+
+// SetAdmission 在 Acceptor 之前按全局、来源、握手数与速率限制新连接，被拒绝的连接收到带原因的 OpClose；
+// 需在 Start 之前调用
+func (s *Server) SetAdmission(a *kupool.Admission) {
+	s.admit = a
+}
+
+// SetWorkers 设置读、写协程数（默认各为 4*GOMAXPROCS）。MessageListener 在读协程中同步执行，
+// 回调阻塞（如限速的 delay 动作）会占用读协程；需在 Start 之前调用
+func (s *Server) SetWorkers(readers, writers int) {
+	if readers > 0 {
+		s.options.readers = readers
+	}
+	if writers > 0 {
+		s.options.writers = writers
+	}
+}
+
+type defaultAcceptor struct {
+}
+
+// Accept defaultAcceptor
+func (a *defaultAcceptor) Accept(conn kupool.Conn, timeout time.Duration) (string, error) {
+	return ksuid.New().String(), nil
+}
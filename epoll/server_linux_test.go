@@ -0,0 +1,380 @@
+package epoll
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/proxyproto"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+// echoListener 原样回写收到的消息，并记录断开的连接
+type echoListener struct {
+	mu     sync.Mutex
+	closed []string
+}
+
+func (l *echoListener) Receive(ag kupool.Agent, payload []byte) { _ = ag.Push(payload) }
+func (l *echoListener) Disconnect(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = append(l.closed, id)
+	return nil
+}
+
+func (l *echoListener) disconnected() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.closed)
+}
+
+func waitUntil(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startServer 启动 s 并返回监听地址
+func startServer(t testing.TB, s kupool.Server, lst *echoListener) string {
+	t.Helper()
+	s.SetMessageListener(lst)
+	s.SetStateListener(lst)
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	addr := s.(interface{ Addr() net.Addr })
+	waitUntil(t, "listen", func() bool { return addr.Addr() != nil })
+	return addr.Addr().String()
+}
+
+func dial(t testing.TB, addr string) *tcp.TcpConn {
+	t.Helper()
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+	return tcp.NewConn(raw)
+}
+
+func expectFrame(t *testing.T, c *tcp.TcpConn, op kupool.OpCode, payload string) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	f, err := c.ReadFrame()
+	if err != nil {
+		t.Fatalf("read %q: %v", payload, err)
+	}
+	if f.GetOpCode() != op || string(f.GetPayload()) != payload {
+		t.Fatalf("expect op=%d %q, got op=%d %q", op, payload, f.GetOpCode(), f.GetPayload())
+	}
+}
+
+// TestFramesAcrossReads 帧被拆成单字节发送、多帧合并发送时都能按顺序解析，ping 回 pong
+func TestFramesAcrossReads(t *testing.T) {
+	lst := &echoListener{}
+	addr := startServer(t, NewServer("127.0.0.1:0"), lst)
+	c := dial(t, addr)
+
+	var one []byte
+	for _, p := range []string{"first", "second"} {
+		one = append(one, frameBytes(kupool.OpBinary, p)...)
+	}
+	for _, b := range one {
+		if _, err := c.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expectFrame(t, c, kupool.OpBinary, "first")
+	expectFrame(t, c, kupool.OpBinary, "second")
+
+	var many []byte
+	many = append(many, frameBytes(kupool.OpPing, "")...)
+	for i := 0; i < 100; i++ {
+		many = append(many, frameBytes(kupool.OpBinary, strconv.Itoa(i))...)
+	}
+	if _, err := c.Write(many); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, c, kupool.OpPong, "")
+	for i := 0; i < 100; i++ {
+		expectFrame(t, c, kupool.OpBinary, strconv.Itoa(i))
+	}
+}
+
+// TestCloseAndIdleTimeout 客户端关闭、发送关闭帧与空闲超时都会移除连接并回调 Disconnect
+func TestCloseAndIdleTimeout(t *testing.T) {
+	lst := &echoListener{}
+	s := NewServer("127.0.0.1:0")
+	s.SetReadWait(300 * time.Millisecond)
+	addr := startServer(t, s, lst)
+	channels := s.(*Server).ChannelMap.(*kupool.ChannelsImpl)
+
+	a, b, idle := dial(t, addr), dial(t, addr), dial(t, addr)
+	waitUntil(t, "channels", func() bool { return channels.Len() == 3 })
+
+	a.Close()
+	if err := b.WriteFrame(kupool.OpClose, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "two disconnects", func() bool { return lst.disconnected() == 2 && channels.Len() == 1 })
+
+	_ = idle.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := idle.ReadFrame(); err == nil {
+		t.Fatal("idle connection should be closed after the read wait")
+	}
+	waitUntil(t, "idle disconnect", func() bool { return lst.disconnected() == 3 && channels.Len() == 0 })
+}
+
+// TestHeartbeat 回复 pong 的连接测得 RTT，直到没有业务消息超过空闲时长才被关闭；不回复的连接在连续丢失后先被关闭
+func TestHeartbeat(t *testing.T) {
+	lst := &echoListener{}
+	s := NewServer("127.0.0.1:0")
+	s.(*Server).SetHeartbeat(kupool.HeartbeatOptions{Interval: 50 * time.Millisecond, MaxMissed: 2, IdleTimeout: 600 * time.Millisecond})
+	addr := startServer(t, s, lst)
+	channels := s.(*Server).ChannelMap.(*kupool.ChannelsImpl)
+
+	alive := dial(t, addr)
+	dial(t, addr) // 不回复 ping
+	waitUntil(t, "channels", func() bool { return channels.Len() == 2 })
+	var ch kupool.Channel
+	channels.Range(func(c kupool.Channel) bool {
+		if c.RemoteAddr().String() == alive.LocalAddr().String() {
+			ch = c
+		}
+		return ch == nil
+	})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			f, err := alive.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.GetOpCode() == kupool.OpPing {
+				_ = alive.WriteFrame(kupool.OpPong, nil)
+			}
+		}
+	}()
+
+	waitUntil(t, "silent disconnect", func() bool { return lst.disconnected() == 1 && channels.Len() == 1 })
+	if _, ok := channels.Get(ch.ID()); !ok {
+		t.Fatal("channel answering pings should stay open")
+	}
+	if lv := ch.(kupool.Heartbeater).Liveness(); lv.RTT <= 0 {
+		t.Fatalf("expect rtt to be measured, got %+v", lv)
+	}
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("channel without messages should be closed after the idle timeout")
+	}
+	waitUntil(t, "idle disconnect", func() bool { return lst.disconnected() == 2 && channels.Len() == 0 })
+}
+
+// TestHeartbeatClock 活动时间与巡检使用 HeartbeatOptions.Clock
+func TestHeartbeatClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := clock.NewFake(start)
+	lst := &echoListener{}
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetHeartbeat(kupool.HeartbeatOptions{IdleTimeout: time.Minute, Clock: clk})
+	addr := startServer(t, s, lst)
+	dial(t, addr)
+	waitUntil(t, "channel", func() bool { return len(s.All()) == 1 })
+	if lv := s.All()[0].(kupool.Heartbeater).Liveness(); !lv.LastRead.Equal(start) {
+		t.Fatalf("expect activity stamped by the fake clock, got %+v", lv)
+	}
+	clk.BlockUntil(1)
+	waitUntil(t, "idle close", func() bool {
+		clk.Advance(30 * time.Second)
+		return lst.disconnected() == 1 && len(s.All()) == 0
+	})
+}
+
+// TestShutdownDrains StopAccept 后已建立的连接照常收发，Shutdown 写完队列后关闭
+func TestShutdownDrains(t *testing.T) {
+	lst := &echoListener{}
+	s := NewServer("127.0.0.1:0").(*Server)
+	addr := startServer(t, s, lst)
+	c := dial(t, addr)
+	waitUntil(t, "channel", func() bool { return len(s.All()) == 1 })
+
+	if err := s.StopAccept(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteFrame(kupool.OpBinary, []byte("after stop")); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, c, kupool.OpBinary, "after stop")
+
+	id := s.All()[0].ID()
+	for i := 0; i < 10; i++ {
+		if err := s.Push(id, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		expectFrame(t, c, kupool.OpBinary, strconv.Itoa(i))
+	}
+	if _, err := c.ReadFrame(); err == nil {
+		t.Fatal("connection should be closed after the queue is flushed")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("listener should be closed")
+	}
+}
+
+// TestOversizedFrame 超过 MaxFrameSize 的帧直接断开，不分配缓冲
+func TestOversizedFrame(t *testing.T) {
+	lst := &echoListener{}
+	addr := startServer(t, NewServer("127.0.0.1:0"), lst)
+	c := dial(t, addr)
+	hdr := []byte{byte(kupool.OpBinary), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(hdr[1:], MaxFrameSize+1)
+	if _, err := c.Write(hdr); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.ReadFrame(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect connection closed, got %v", err)
+	}
+}
+
+// TestProxyProtocol 头部与首帧在同一次写入中到达时，头部之后的数据仍由 poller 读到
+func TestProxyProtocol(t *testing.T) {
+	lst := &echoListener{}
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetProxyPolicy(proxyproto.Policy{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}})
+	addr := startServer(t, s, lst)
+	c := dial(t, addr)
+	data := append([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 8080\r\n"), frameBytes(kupool.OpBinary, "hello")...)
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, c, kupool.OpBinary, "hello")
+	if got := s.All()[0].RemoteAddr().String(); got != "203.0.113.7:4000" {
+		t.Fatalf("expect the client address from the header, got %s", got)
+	}
+}
+
+func frameBytes(op kupool.OpCode, payload string) []byte {
+	b := []byte{byte(op), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+const benchConns = 5000
+
+func transports() []struct {
+	name string
+	new  func() kupool.Server
+} {
+	return []struct {
+		name string
+		new  func() kupool.Server
+	}{
+		{"tcp", func() kupool.Server { return tcp.NewServer("127.0.0.1:0") }},
+		{"epoll", func() kupool.Server { return NewServer("127.0.0.1:0") }},
+	}
+}
+
+// BenchmarkIdleConns 保持 5000 个空闲连接，报告每个连接占用的 goroutine 与内存，
+// 并测量此时单个连接一次请求/响应的延迟
+func BenchmarkIdleConns(b *testing.B) {
+	for _, tr := range transports() {
+		b.Run(tr.name, func(b *testing.B) {
+			runtime.GC()
+			var before runtime.MemStats
+			runtime.ReadMemStats(&before)
+			g0 := runtime.NumGoroutine()
+
+			lst := &echoListener{}
+			addr := startServer(b, tr.new(), lst)
+			conns := make([]*tcp.TcpConn, benchConns)
+			for i := range conns {
+				conns[i] = dial(b, addr)
+			}
+			// 每个连接完成一次往返，确认已被服务端接受
+			for _, c := range conns {
+				if err := c.WriteFrame(kupool.OpBinary, []byte("hi")); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := c.ReadFrame(); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			runtime.GC()
+			var after runtime.MemStats
+			runtime.ReadMemStats(&after)
+			goroutines := runtime.NumGoroutine() - g0
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c := conns[i%benchConns]
+				if err := c.WriteFrame(kupool.OpBinary, []byte("ping")); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := c.ReadFrame(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// 客户端每个连接没有 goroutine，差值即服务端的开销；内存含 goroutine 栈与客户端连接
+			b.ReportMetric(float64(goroutines)/benchConns, "goroutines/conn")
+			b.ReportMetric(float64(after.HeapInuse+after.StackInuse-before.HeapInuse-before.StackInuse)/benchConns, "memB/conn")
+		})
+	}
+}
+
+// BenchmarkRoundTrip 64 个活跃连接并发请求/响应的吞吐
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, tr := range transports() {
+		b.Run(tr.name, func(b *testing.B) {
+			addr := startServer(b, tr.new(), &echoListener{})
+			var next atomic.Int64
+			conns := make([]*tcp.TcpConn, 64)
+			for i := range conns {
+				conns[i] = dial(b, addr)
+			}
+			b.SetParallelism(64 / runtime.GOMAXPROCS(0))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				c := conns[int(next.Add(1)-1)%len(conns)]
+				payload := []byte(fmt.Sprintf("%64d", 0))
+				for pb.Next() {
+					if err := c.WriteFrame(kupool.OpBinary, payload); err != nil {
+						b.Error(err)
+						return
+					}
+					if _, err := c.ReadFrame(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,9 +1,123 @@
 package events
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type SubmitEvent struct {
-    Username string
-    Time     time.Time
+	// ID 由 outbox relay 填充（outbox 行号），为空表示未经过 outbox；消费者据此去重
+	ID       string `json:",omitempty"`
+	Username string
+	Time     time.Time
 }
 
+// Kind 事件类型，同时作为 MQ 的 routing key
+type Kind string
+
+const (
+	KindShareAccepted Kind = "share.accepted"
+	KindShareRejected Kind = "share.rejected"
+	KindSessionOpened Kind = "session.opened"
+	KindSessionClosed Kind = "session.closed"
+	KindJobRotated    Kind = "job.rotated"
+)
+
+// Envelope 统一的事件信封，Kind 决定哪个负载字段有值
+type Envelope struct {
+	// ID 由 outbox relay 填充（outbox 行号），为空表示未经过 outbox；订阅者据此去重
+	ID            string         `json:"id,omitempty"`
+	Kind          Kind           `json:"kind"`
+	Time          time.Time      `json:"time"`
+	ShareAccepted *ShareAccepted `json:"share_accepted,omitempty"`
+	ShareRejected *ShareRejected `json:"share_rejected,omitempty"`
+	SessionOpened *SessionOpened `json:"session_opened,omitempty"`
+	SessionClosed *SessionClosed `json:"session_closed,omitempty"`
+	JobRotated    *JobRotated    `json:"job_rotated,omitempty"`
+}
+
+type ShareAccepted struct {
+	Username    string `json:"username"`
+	ChannelID   string `json:"channel_id"`
+	JobID       int    `json:"job_id"`
+	ClientNonce string `json:"client_nonce"`
+}
+
+type ShareRejected struct {
+	Username    string `json:"username"`
+	ChannelID   string `json:"channel_id"`
+	JobID       int    `json:"job_id"`
+	ClientNonce string `json:"client_nonce"`
+	Reason      string `json:"reason"`
+}
+
+type SessionOpened struct {
+	Username   string `json:"username"`
+	ChannelID  string `json:"channel_id"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+type SessionClosed struct {
+	Username  string `json:"username"`
+	ChannelID string `json:"channel_id"`
+}
+
+type JobRotated struct {
+	JobID       int    `json:"job_id"`
+	ServerNonce string `json:"server_nonce"`
+}
+
+// RoutingKey 返回事件的 routing key
+func (e Envelope) RoutingKey() string { return string(e.Kind) }
+
+func NewShareAccepted(t time.Time, p ShareAccepted) Envelope {
+	return Envelope{Kind: KindShareAccepted, Time: t, ShareAccepted: &p}
+}
+
+func NewShareRejected(t time.Time, p ShareRejected) Envelope {
+	return Envelope{Kind: KindShareRejected, Time: t, ShareRejected: &p}
+}
+
+func NewSessionOpened(t time.Time, p SessionOpened) Envelope {
+	return Envelope{Kind: KindSessionOpened, Time: t, SessionOpened: &p}
+}
+
+func NewSessionClosed(t time.Time, p SessionClosed) Envelope {
+	return Envelope{Kind: KindSessionClosed, Time: t, SessionClosed: &p}
+}
+
+func NewJobRotated(t time.Time, p JobRotated) Envelope {
+	return Envelope{Kind: KindJobRotated, Time: t, JobRotated: &p}
+}
+
+// Match 按 AMQP topic 规则匹配 routing key：`*` 匹配一个单词，`#` 匹配零个或多个单词
+func Match(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(p, k []string) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case "#":
+			if len(p) == 1 {
+				return true
+			}
+			for i := 0; i <= len(k); i++ {
+				if matchWords(p[1:], k[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(k) == 0 {
+				return false
+			}
+		default:
+			if len(k) == 0 || p[0] != k[0] {
+				return false
+			}
+		}
+		p, k = p[1:], k[1:]
+	}
+	return len(k) == 0
+}
@@ -0,0 +1,35 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"share.accepted", "share.accepted", true},
+		{"share.accepted", "share.rejected", false},
+		{"share.*", "share.rejected", true},
+		{"*.closed", "session.closed", true},
+		{"*", "share.accepted", false},
+		{"#", "share.accepted", true},
+		{"share.#", "share", true},
+		{"#.rotated", "job.rotated", true},
+		{"session.*.x", "session.opened", false},
+	}
+	for _, c := range cases {
+		if got := Match(c.pattern, c.key); got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.pattern, c.key, got, c.want)
+		}
+	}
+}
+
+func TestEnvelopeRoutingKey(t *testing.T) {
+	e := NewShareRejected(time.Now(), ShareRejected{Username: "u", Reason: "Invalid result"})
+	if e.RoutingKey() != "share.rejected" || e.ShareRejected == nil || e.ShareRejected.Reason != "Invalid result" {
+		t.Fatal("envelope mismatch")
+	}
+}
@@ -0,0 +1,124 @@
+package kupool
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+)
+
+// DefaultMaxMissedPongs 连续未收到 pong 的默认上限
+const DefaultMaxMissedPongs = 3
+
+// HeartbeatOptions 服务端心跳与空闲检测参数，字段为 0 时关闭对应检查
+type HeartbeatOptions struct {
+	Interval    time.Duration // 连接超过该时长没有收到任何帧时发送 OpPing，等待 pong 的时长也为该值
+	MaxMissed   int           // 连续未收到 pong 的次数达到该值时关闭连接，默认 DefaultMaxMissedPongs
+	IdleTimeout time.Duration // 超过该时长没有收到业务消息（如提交）时关闭连接
+	Clock       clock.Clock   // 活动时间、巡检与 ping 计时使用的时钟，nil 使用真实时钟
+}
+
+// Enabled 是否开启了任一检查
+func (o HeartbeatOptions) Enabled() bool {
+	return o.Interval > 0 || o.IdleTimeout > 0
+}
+
+// CheckEvery 巡检间隔：取开启的检查中较短时长的一半
+func (o HeartbeatOptions) CheckEvery() time.Duration {
+	every := o.Interval
+	if every <= 0 || (o.IdleTimeout > 0 && o.IdleTimeout < every) {
+		every = o.IdleTimeout
+	}
+	return every / 2
+}
+
+// Liveness 连接的活跃情况
+type Liveness struct {
+	LastRead    time.Time     `json:"last_read"`    // 最近收到任意帧（含 ping/pong）的时间
+	LastMessage time.Time     `json:"last_message"` // 最近收到业务消息的时间
+	RTT         time.Duration `json:"rtt_ns"`       // 最近一次服务端 ping 的往返时长，0 表示尚未测得
+	MissedPongs int           `json:"missed_pongs"` // 连续未收到 pong 的次数
+}
+
+// Heartbeater 支持服务端心跳的 Channel
+type Heartbeater interface {
+	SetHeartbeat(HeartbeatOptions)
+	Liveness() Liveness
+}
+
+// Heartbeat 记录单个连接的读活动与 ping/pong 往返，供各传输的 Channel 复用；方法可并发调用
+type Heartbeat struct {
+	lastRead    atomic.Int64 // UnixNano
+	lastMessage atomic.Int64
+	pingAt      atomic.Int64 // 尚未收到 pong 的 ping 的发出时间，0 表示没有
+	rtt         atomic.Int64
+	missed      atomic.Int32
+}
+
+// Start 以 now 作为初始活动时间
+func (h *Heartbeat) Start(now time.Time) {
+	h.lastRead.Store(now.UnixNano())
+	h.lastMessage.Store(now.UnixNano())
+}
+
+// OnRead 收到任意帧
+func (h *Heartbeat) OnRead(now time.Time) {
+	h.lastRead.Store(now.UnixNano())
+}
+
+// OnMessage 收到业务消息
+func (h *Heartbeat) OnMessage(now time.Time) {
+	h.lastMessage.Store(now.UnixNano())
+}
+
+// OnPong 收到 pong，结束等待并记录往返时长；没有等待中的 ping 时忽略
+func (h *Heartbeat) OnPong(now time.Time) {
+	if at := h.pingAt.Swap(0); at != 0 {
+		h.rtt.Store(now.UnixNano() - at)
+		h.missed.Store(0)
+	}
+}
+
+// Check 按 opts 检查连接：返回 error 表示应关闭连接；ping 为 true 表示连接空闲，
+// 调用方应立即发送 OpPing（发出时间已记为 now）
+func (h *Heartbeat) Check(now time.Time, opts HeartbeatOptions) (ping bool, err error) {
+	if opts.IdleTimeout > 0 {
+		if idle := now.Sub(time.Unix(0, h.lastMessage.Load())); idle >= opts.IdleTimeout {
+			return false, fmt.Errorf("no message for %v", idle.Truncate(time.Millisecond))
+		}
+	}
+	if opts.Interval <= 0 {
+		return false, nil
+	}
+	if at := h.pingAt.Load(); at != 0 {
+		if now.Sub(time.Unix(0, at)) < opts.Interval {
+			return false, nil
+		}
+		// 等待超时；CAS 失败说明 pong 恰好到达
+		if h.pingAt.CompareAndSwap(at, 0) {
+			maxMissed := opts.MaxMissed
+			if maxMissed <= 0 {
+				maxMissed = DefaultMaxMissedPongs
+			}
+			if n := int(h.missed.Add(1)); n >= maxMissed {
+				return false, fmt.Errorf("missed %d pongs", n)
+			}
+		}
+	}
+	if now.Sub(time.Unix(0, h.lastRead.Load())) < opts.Interval {
+		return false, nil
+	}
+	h.pingAt.Store(now.UnixNano())
+	return true, nil
+}
+
+// Liveness 当前活跃情况
+func (h *Heartbeat) Liveness() Liveness {
+	return Liveness{
+		LastRead:    time.Unix(0, h.lastRead.Load()),
+		LastMessage: time.Unix(0, h.lastMessage.Load()),
+		RTT:         time.Duration(h.rtt.Load()),
+		MissedPongs: int(h.missed.Load()),
+	}
+}
@@ -0,0 +1,67 @@
+package kupool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatCheck(t *testing.T) {
+	opts := HeartbeatOptions{Interval: 10 * time.Second, MaxMissed: 2}
+	start := time.Unix(1000, 0)
+	var h Heartbeat
+	h.Start(start)
+
+	if ping, err := h.Check(start.Add(5*time.Second), opts); ping || err != nil {
+		t.Fatalf("not idle yet: ping=%v err=%v", ping, err)
+	}
+	// 空闲满一个间隔，发送 ping
+	if ping, err := h.Check(start.Add(10*time.Second), opts); !ping || err != nil {
+		t.Fatalf("expect ping: ping=%v err=%v", ping, err)
+	}
+	// 等待 pong 期间不重复发送
+	if ping, err := h.Check(start.Add(15*time.Second), opts); ping || err != nil {
+		t.Fatalf("waiting for pong: ping=%v err=%v", ping, err)
+	}
+	h.OnRead(start.Add(10250 * time.Millisecond))
+	h.OnPong(start.Add(10250 * time.Millisecond))
+	if lv := h.Liveness(); lv.RTT != 250*time.Millisecond || lv.MissedPongs != 0 {
+		t.Fatalf("unexpected liveness %+v", lv)
+	}
+
+	// 连续两次未回 pong 时关闭
+	if ping, _ := h.Check(start.Add(21*time.Second), opts); !ping {
+		t.Fatal("expect second ping")
+	}
+	if ping, err := h.Check(start.Add(31*time.Second), opts); !ping || err != nil {
+		t.Fatalf("first miss should ping again: ping=%v err=%v", ping, err)
+	}
+	if lv := h.Liveness(); lv.MissedPongs != 1 {
+		t.Fatalf("expect 1 missed pong, got %+v", lv)
+	}
+	if _, err := h.Check(start.Add(41*time.Second), opts); err == nil {
+		t.Fatal("expect close after 2 missed pongs")
+	}
+}
+
+func TestHeartbeatIdleTimeout(t *testing.T) {
+	opts := HeartbeatOptions{IdleTimeout: time.Minute}
+	start := time.Unix(1000, 0)
+	var h Heartbeat
+	h.Start(start)
+	h.OnRead(start.Add(50 * time.Second))
+	if _, err := h.Check(start.Add(50*time.Second), opts); err != nil {
+		t.Fatal(err)
+	}
+	h.OnMessage(start.Add(50 * time.Second))
+	if _, err := h.Check(start.Add(100*time.Second), opts); err != nil {
+		t.Fatalf("message resets the idle timer: %v", err)
+	}
+	// 只有 ping/pong 等读活动不算业务消息
+	h.OnRead(start.Add(105 * time.Second))
+	if _, err := h.Check(start.Add(110*time.Second), opts); err == nil {
+		t.Fatal("expect idle timeout")
+	}
+	if every := (HeartbeatOptions{Interval: time.Minute, IdleTimeout: 10 * time.Second}).CheckEvery(); every != 5*time.Second {
+		t.Fatalf("unexpected check interval %v", every)
+	}
+}
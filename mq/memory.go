@@ -1,32 +1,106 @@
 package mq
 
 import (
-    "sync"
+	"sync"
+	"sync/atomic"
 
-    "github.com/JellyTony/kupool/events"
+	"github.com/JellyTony/kupool/events"
 )
 
 type MemoryQueue struct {
-    ch   chan events.SubmitEvent
-    once sync.Once
-    closed bool
+	ch     chan events.SubmitEvent
+	once   sync.Once
+	closed bool
+
+	mu      sync.RWMutex
+	subs    []*memorySub
+	dropped int64
+}
+
+type memorySub struct {
+	patterns []string
+	ch       chan events.Envelope
 }
 
 func NewMemoryQueue(size int) *MemoryQueue {
-    return &MemoryQueue{ch: make(chan events.SubmitEvent, size)}
+	return &MemoryQueue{ch: make(chan events.SubmitEvent, size)}
 }
 
 func (q *MemoryQueue) Publish(evt events.SubmitEvent) error {
-    if q.closed { return nil }
-    q.ch <- evt
-    return nil
+	if q.closed {
+		return nil
+	}
+	q.ch <- evt
+	return nil
 }
 
 func (q *MemoryQueue) Subscribe() <-chan events.SubmitEvent {
-    return q.ch
+	return q.ch
+}
+
+// PublishEvent 将事件投递给所有 pattern 匹配的订阅者；订阅者缓冲满时丢弃，避免阻塞提交路径
+func (q *MemoryQueue) PublishEvent(evt events.Envelope) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return nil
+	}
+	key := evt.RoutingKey()
+	for _, s := range q.subs {
+		if !s.match(key) {
+			continue
+		}
+		select {
+		case s.ch <- evt:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+		}
+	}
+	return nil
 }
 
+// SubscribeEvents 订阅 routing key 匹配任一 pattern 的事件，未指定 pattern 时订阅全部
+func (q *MemoryQueue) SubscribeEvents(patterns ...string) (<-chan events.Envelope, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"#"}
+	}
+	size := cap(q.ch)
+	if size == 0 {
+		size = 1
+	}
+	s := &memorySub{patterns: patterns, ch: make(chan events.Envelope, size)}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		close(s.ch)
+		return s.ch, nil
+	}
+	q.subs = append(q.subs, s)
+	return s.ch, nil
+}
+
+// Dropped 返回因订阅者缓冲已满而丢弃的事件数
+func (q *MemoryQueue) Dropped() int64 { return atomic.LoadInt64(&q.dropped) }
+
 func (q *MemoryQueue) Close() error {
-    q.once.Do(func(){ close(q.ch); q.closed = true })
-    return nil
+	q.once.Do(func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		close(q.ch)
+		q.closed = true
+		for _, s := range q.subs {
+			close(s.ch)
+		}
+		q.subs = nil
+	})
+	return nil
+}
+
+func (s *memorySub) match(key string) bool {
+	for _, p := range s.patterns {
+		if events.Match(p, key) {
+			return true
+		}
+	}
+	return false
 }
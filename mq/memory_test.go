@@ -2,6 +2,7 @@ package mq
 
 import (
     "testing"
+    "time"
     "github.com/JellyTony/kupool/events"
 )
 
@@ -16,3 +17,29 @@ func TestMemoryQueuePubSub(t *testing.T) {
     _ = q.Close()
 }
 
+
+func TestMemoryQueueEventRouting(t *testing.T) {
+    q := NewMemoryQueue(4)
+    shares, _ := q.SubscribeEvents("share.*")
+    rejects, _ := q.SubscribeEvents("share.rejected")
+    all, _ := q.SubscribeEvents()
+    now := time.Now()
+    _ = q.PublishEvent(events.NewShareAccepted(now, events.ShareAccepted{Username: "u"}))
+    _ = q.PublishEvent(events.NewShareRejected(now, events.ShareRejected{Username: "u", Reason: "Duplicate submission"}))
+    _ = q.PublishEvent(events.NewJobRotated(now, events.JobRotated{JobID: 1}))
+    if len(shares) != 2 { t.Fatalf("share.* expect 2, got %d", len(shares)) }
+    if len(rejects) != 1 { t.Fatalf("share.rejected expect 1, got %d", len(rejects)) }
+    if len(all) != 3 { t.Fatalf("all expect 3, got %d", len(all)) }
+    if e := <-rejects; e.ShareRejected == nil || e.ShareRejected.Reason != "Duplicate submission" { t.Fatal("reject payload") }
+    _ = q.Close()
+    if _, ok := <-all; !ok { t.Fatal("buffered event lost on close") }
+}
+
+func TestMemoryQueueEventDropWhenFull(t *testing.T) {
+    q := NewMemoryQueue(1)
+    _, _ = q.SubscribeEvents("job.rotated")
+    _ = q.PublishEvent(events.NewJobRotated(time.Now(), events.JobRotated{JobID: 1}))
+    _ = q.PublishEvent(events.NewJobRotated(time.Now(), events.JobRotated{JobID: 2}))
+    if q.Dropped() != 1 { t.Fatalf("expect 1 dropped, got %d", q.Dropped()) }
+    _ = q.Close()
+}
@@ -9,11 +9,15 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// DefaultEventExchange 事件流使用的 topic exchange，routing key 为 events.Kind
+const DefaultEventExchange = "kupool.events"
+
 type RabbitMQ struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
-	q    amqp.Queue
-	out  chan events.SubmitEvent
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	q        amqp.Queue
+	out      chan events.SubmitEvent
+	exchange string
 }
 
 func NewRabbitMQ(url, queue string) (*RabbitMQ, error) {
@@ -30,7 +34,10 @@ func NewRabbitMQ(url, queue string) (*RabbitMQ, error) {
 	if err != nil {
 		return nil, err
 	}
-	r := &RabbitMQ{conn: conn, ch: ch, q: q, out: make(chan events.SubmitEvent, 1024)}
+	if err = ch.ExchangeDeclare(DefaultEventExchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		return nil, err
+	}
+	r := &RabbitMQ{conn: conn, ch: ch, q: q, out: make(chan events.SubmitEvent, 1024), exchange: DefaultEventExchange}
 	go r.consume()
 	return r, nil
 }
@@ -45,6 +52,63 @@ func (r *RabbitMQ) Publish(evt events.SubmitEvent) error {
 	})
 }
 
+// PublishEvent 以事件类型作为 routing key 发布到 topic exchange
+func (r *RabbitMQ) PublishEvent(evt events.Envelope) error {
+	b, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	return r.ch.PublishWithContext(context.Background(), r.exchange, evt.RoutingKey(), false, false, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    evt.Time,
+		Type:         string(evt.Kind),
+		ContentType:  "application/json",
+		Body:         b,
+	})
+}
+
+// SubscribeEvents 声明一个独占的临时队列并按 patterns 绑定到 exchange；
+// 需要持久订阅的下游服务应自行声明具名队列并绑定相同的 routing key
+func (r *RabbitMQ) SubscribeEvents(patterns ...string) (<-chan events.Envelope, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"#"}
+	}
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	for _, p := range patterns {
+		if err = ch.QueueBind(q.Name, p, r.exchange, false, nil); err != nil {
+			_ = ch.Close()
+			return nil, err
+		}
+	}
+	msgs, err := ch.Consume(q.Name, "", false, true, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	out := make(chan events.Envelope, 1024)
+	go func() {
+		defer close(out)
+		for m := range msgs {
+			var evt events.Envelope
+			if json.Unmarshal(m.Body, &evt) == nil {
+				out <- evt
+				_ = m.Ack(false)
+			} else {
+				_ = m.Nack(false, false)
+			}
+		}
+	}()
+	return out, nil
+}
+
 func (r *RabbitMQ) consume() {
 	msgs, err := r.ch.Consume(r.q.Name, "", false, false, false, false, nil)
 	if err != nil {
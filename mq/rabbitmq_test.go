@@ -22,3 +22,20 @@ func TestRabbit(t *testing.T){
     }
 }
 
+
+func TestRabbitEvents(t *testing.T){
+    url := os.Getenv("KUP_MQ_URL")
+    if url == "" { t.Skip("MQ URL not provided") }
+    r, err := NewRabbitMQ(url, "kupool_test")
+    if err != nil { t.Fatal(err) }
+    defer r.Close()
+    ch, err := r.SubscribeEvents("share.rejected")
+    if err != nil { t.Fatal(err) }
+    _ = r.PublishEvent(events.NewShareAccepted(time.Now(), events.ShareAccepted{Username: "u"}))
+    _ = r.PublishEvent(events.NewShareRejected(time.Now(), events.ShareRejected{Username: "u", Reason: "Invalid result"}))
+    select{
+    case e := <-ch:
+        if e.Kind != events.KindShareRejected { t.Fatalf("unexpected kind %s", e.Kind) }
+    case <-time.After(3*time.Second): t.Fatal("timeout")
+    }
+}
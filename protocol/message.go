@@ -31,6 +31,17 @@ type SubmitParams struct {
     Result      string `json:"result"`
 }
 
+// ReconnectParams client.reconnect 通知：服务端即将下线，客户端等待 Wait 秒后重连 Host（为空时重连原地址）
+type ReconnectParams struct {
+    Host string `json:"host,omitempty"`
+    Wait int    `json:"wait"`
+}
+
+// DifficultyParams set_difficulty 通知：之后的提交按新难度计算
+type DifficultyParams struct {
+    Difficulty float64 `json:"difficulty"`
+}
+
 func Encode(v any) ([]byte, error) {
     return json.Marshal(v)
 }
@@ -0,0 +1,258 @@
+// Package proxyproto 解析负载均衡器在连接开头发送的 PROXY protocol v1/v2 头部，
+// 把连接的 RemoteAddr 换成真实客户端地址。
+//
+// 只有来自 Policy.Trusted 网段的连接才解析头部，且必须带有头部；其他来源的连接原样返回，
+// 避免客户端伪造地址。头部按字节精确读取、不预读，之后的数据仍留在 socket 中，
+// 因此包装后的连接可以直接交给基于 fd 的传输（如 epoll）
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout 读取头部的默认超时
+const DefaultTimeout = 5 * time.Second
+
+var (
+	// ErrNoHeader 可信来源的连接没有以 PROXY 头部开头
+	ErrNoHeader = errors.New("proxyproto: missing PROXY header")
+	// ErrInvalidHeader 头部格式错误
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	v1MaxLen = 107 // 含结尾的 \r\n
+	v2Header = 16
+)
+
+// Header 解析出的头部
+type Header struct {
+	Version     int
+	Local       bool     // v2 LOCAL 命令或 v1 UNKNOWN：负载均衡器自身的连接（如健康检查），使用真实的对端地址
+	Source      net.Addr // Local 为 true 时为 nil
+	Destination net.Addr
+}
+
+// Policy 哪些来源需要解析 PROXY 头部
+type Policy struct {
+	Trusted []netip.Prefix // 负载均衡器所在网段
+	Timeout time.Duration  // 读取头部的超时，默认 DefaultTimeout
+}
+
+// ParsePrefixes 解析逗号分隔的 CIDR 列表，单个 IP 视为 /32 或 /128
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			addr, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// Trusts addr 是否来自可信网段
+func (p Policy) Trusts(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(ta.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range p.Trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap 来自可信网段的连接读取并解析头部，返回以真实客户端地址为 RemoteAddr 的 *Conn；
+// 其他连接原样返回。出错时调用方负责关闭 conn
+func (p Policy) Wrap(conn net.Conn) (net.Conn, error) {
+	if !p.Trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	hdr, err := ReadHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return &Conn{Conn: conn, hdr: hdr}, nil
+}
+
+// Conn 解析过 PROXY 头部的连接
+type Conn struct {
+	net.Conn
+	hdr *Header
+}
+
+// Header 解析出的头部
+func (c *Conn) Header() *Header { return c.hdr }
+
+// ProxyAddr 负载均衡器的地址，即底层连接的对端
+func (c *Conn) ProxyAddr() net.Addr { return c.Conn.RemoteAddr() }
+
+// RemoteAddr 真实客户端地址；LOCAL 连接返回负载均衡器地址
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.hdr.Local || c.hdr.Source == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.hdr.Source
+}
+
+// LocalAddr 客户端连接的原始目的地址；LOCAL 连接返回本地地址
+func (c *Conn) LocalAddr() net.Addr {
+	if c.hdr.Local || c.hdr.Destination == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.hdr.Destination
+}
+
+// SyscallConn 透传底层连接的 fd，供基于 fd 的传输使用
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("proxyproto: %T does not expose a file descriptor", c.Conn)
+	}
+	return sc.SyscallConn()
+}
+
+// ReadHeader 从 r 读取一个 v1 或 v2 头部，恰好读到头部结尾为止
+func ReadHeader(r io.Reader) (*Header, error) {
+	// v1 最短为 "PROXY UNKNOWN\r\n"（15 字节），v2 固定部分 16 字节，先读 8 字节区分版本
+	buf := make([]byte, 8, v1MaxLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(buf, v1Prefix):
+		return readV1(r, buf)
+	case bytes.Equal(buf, v2Signature[:8]):
+		return readV2(r, buf)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r io.Reader, buf []byte) (*Header, error) {
+	// 逐字节读到 \r\n，不读取头部之后的数据
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= v1MaxLen {
+			return nil, fmt.Errorf("%w: v1 line too long", ErrInvalidHeader)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+	fields := strings.Split(string(buf[:len(buf)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1, Local: true}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, buf)
+	}
+	src, err := v1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := v1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func v1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != (proto == "TCP4") {
+		return nil, fmt.Errorf("%w: bad address %q", ErrInvalidHeader, ip)
+	}
+	// 端口不允许前导零与符号
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || strconv.FormatUint(p, 10) != port {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r io.Reader, buf []byte) (*Header, error) {
+	buf = buf[:v2Header]
+	if _, err := io.ReadFull(r, buf[8:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:12], v2Signature) || buf[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: bad v2 signature or version", ErrInvalidHeader)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(buf[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	hdr := &Header{Version: 2}
+	switch buf[12] & 0x0f {
+	case 0x0: // LOCAL，忽略地址
+		hdr.Local = true
+		return hdr, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown v2 command %#x", ErrInvalidHeader, buf[12]&0x0f)
+	}
+	// 只接受 TCP over IPv4/IPv6，其余（UDP、UNIX、UNSPEC）按 LOCAL 处理；地址之后的 TLV 忽略
+	var n int
+	switch buf[13] {
+	case 0x11:
+		n = 4
+	case 0x21:
+		n = 16
+	default:
+		hdr.Local = true
+		return hdr, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, fmt.Errorf("%w: v2 address block too short", ErrInvalidHeader)
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:n])
+	dstIP, _ := netip.AddrFromSlice(body[n : 2*n])
+	srcPort := binary.BigEndian.Uint16(body[2*n:])
+	dstPort := binary.BigEndian.Uint16(body[2*n+2:])
+	hdr.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	hdr.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	return hdr, nil
+}
@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// v2 按规范手工拼出 v2 头部：签名、版本与命令、地址族、长度、地址块与可选 TLV
+func v2(cmd, fam byte, addrs []byte, tlv []byte) []byte {
+	b := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)+len(tlv)))
+	b = append(b, addrs...)
+	return append(b, tlv...)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x0f, 0xa0, 0x1f, 0x90} // 203.0.113.7:4000 -> 10.0.0.1:8080
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x0f, 0xa0, 0x1f, 0x90)
+	cases := []struct {
+		name     string
+		in       []byte
+		version  int
+		local    bool
+		src, dst string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 8080\r\n"), 1, false, "203.0.113.7:4000", "10.0.0.1:8080"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 8080\r\n"), 1, false, "[2001:db8::1]:4000", "[2001:db8::2]:8080"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), 1, true, "", ""},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), 1, true, "", ""},
+		{"v2 tcp4", v2(1, 0x11, ipv4, nil), 2, false, "203.0.113.7:4000", "10.0.0.1:8080"},
+		{"v2 tcp6", v2(1, 0x21, ipv6, nil), 2, false, "[2001:db8::1]:4000", "[2001:db8::2]:8080"},
+		{"v2 tcp4 with tlv", v2(1, 0x11, ipv4, []byte{0x05, 0x00, 0x03, 'a', 'b', 'c'}), 2, false, "203.0.113.7:4000", "10.0.0.1:8080"},
+		{"v2 local", v2(0, 0x00, nil, nil), 2, true, "", ""},
+		{"v2 udp", v2(1, 0x12, ipv4, nil), 2, true, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// 头部之后的数据必须原样留在 reader 中
+			r := bytes.NewReader(append(append([]byte{}, c.in...), "rest"...))
+			hdr, err := ReadHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Version != c.version || hdr.Local != c.local {
+				t.Fatalf("unexpected header %+v", hdr)
+			}
+			if !c.local && (hdr.Source.String() != c.src || hdr.Destination.String() != c.dst) {
+				t.Fatalf("expect %s -> %s, got %s -> %s", c.src, c.dst, hdr.Source, hdr.Destination)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Fatalf("header parser consumed payload, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderRejects(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x0f, 0xa0, 0x1f, 0x90}
+	cases := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"no header", []byte("\x02\x00\x00\x00\x10{\"id\":1}"), ErrNoHeader},
+		{"v1 bad proto", []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n"), ErrInvalidHeader},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n"), ErrInvalidHeader},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 01 2\r\n"), ErrInvalidHeader},
+		{"v1 port overflow", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 65536 2\r\n"), ErrInvalidHeader},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), ErrInvalidHeader},
+		{"v2 bad version", append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x11, 0x11, 0, 12), ErrInvalidHeader},
+		{"v2 bad command", v2(2, 0x11, ipv4, nil), ErrInvalidHeader},
+		{"v2 short addresses", v2(1, 0x11, ipv4[:8], nil), ErrInvalidHeader},
+		{"v2 truncated", v2(1, 0x11, ipv4, nil)[:20], io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(c.in)); !errors.Is(err, c.want) {
+				t.Fatalf("expect %v, got %v", c.want, err)
+			}
+		})
+	}
+}
+
+func TestPolicyTrusts(t *testing.T) {
+	trusted, err := ParsePrefixes("10.0.0.0/8, 192.168.1.5,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Policy{Trusted: trusted}
+	for addr, want := range map[string]bool{
+		"10.1.2.3:1":          true,
+		"[::ffff:10.0.0.1]:1": true,
+		"192.168.1.5:1":       true,
+		"192.168.1.6:1":       false,
+		"[2001:db8::9]:1":     true,
+		"[2001:db9::9]:1":     false,
+	} {
+		ta := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))
+		if got := p.Trusts(ta); got != want {
+			t.Errorf("%s: expect trusted=%v", addr, want)
+		}
+	}
+	if _, err := ParsePrefixes("10.0.0.0/33"); err == nil {
+		t.Fatal("expect invalid prefix error")
+	}
+}
@@ -0,0 +1,148 @@
+// Package recorder 以 JSONL 记录连接上的每一帧（方向、opcode、时间与 channel ID），
+// 用于复现矿工反馈的问题，也可作为回归用例由 app/replay 回放
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/logger"
+)
+
+// Direction 帧的方向
+type Direction string
+
+const (
+	DirIn  Direction = "in"  // 客户端发往服务端
+	DirOut Direction = "out" // 服务端发往客户端
+)
+
+// Record trace 中的一行
+type Record struct {
+	Time    time.Time     `json:"ts"`
+	Conn    uint64        `json:"conn"`              // 录制内的连接序号，认证完成前尚无 channel ID，按它关联同一连接
+	Channel string        `json:"channel,omitempty"` // 认证成功后的 channel ID
+	Remote  string        `json:"remote,omitempty"`
+	Dir     Direction     `json:"dir"`
+	OpCode  kupool.OpCode `json:"op"`
+	Payload string        `json:"payload"`
+}
+
+// Recorder 把多个连接的帧按发生顺序写入同一个 trace，可并发使用
+type Recorder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	enc    *json.Encoder
+	clk    clock.Clock
+	seq    atomic.Uint64
+	failed bool
+}
+
+// New 写入 w；每条记录写完即 flush，进程异常退出时 trace 仍然完整
+func New(w io.Writer) *Recorder {
+	bw := bufio.NewWriter(w)
+	r := &Recorder{w: bw, enc: json.NewEncoder(bw), clk: clock.Real()}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	return r
+}
+
+// Open 以追加方式打开 path
+func Open(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return New(f), nil
+}
+
+// SetClock 设置记录时间戳使用的时钟（默认真实时钟），需在 Wrap 之前调用
+func (r *Recorder) SetClock(clk clock.Clock) { r.clk = clock.OrReal(clk) }
+
+// Wrap 包装一个连接，经过它读写的帧都会被记录
+func (r *Recorder) Wrap(conn kupool.Conn) *Conn {
+	c := &Conn{Conn: conn, r: r, id: r.seq.Add(1)}
+	if addr := conn.RemoteAddr(); addr != nil {
+		c.remote = addr.String()
+	}
+	return c
+}
+
+// Close flush 并关闭底层 writer
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.w.Flush()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// write 写入失败只告警一次，不影响连接本身
+func (r *Recorder) write(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.enc.Encode(rec)
+	if err == nil {
+		err = r.w.Flush()
+	}
+	if err != nil && !r.failed {
+		r.failed = true
+		logger.WithFields(logger.Fields{"module": "recorder", "error": err}).Warn("write trace failed")
+	}
+}
+
+// Conn 记录帧的连接包装
+type Conn struct {
+	kupool.Conn
+	r       *Recorder
+	id      uint64
+	remote  string
+	channel atomic.Value
+}
+
+// ID 录制内的连接序号
+func (c *Conn) ID() uint64 { return c.id }
+
+// SetChannelID 认证完成后设置 channel ID，之后的记录都带上它
+func (c *Conn) SetChannelID(id string) { c.channel.Store(id) }
+
+// ReadFrame 读到的帧记为 in
+func (c *Conn) ReadFrame() (kupool.Frame, error) {
+	f, err := c.Conn.ReadFrame()
+	if err == nil {
+		c.record(DirIn, f.GetOpCode(), f.GetPayload())
+	}
+	return f, err
+}
+
+// WriteFrame 写出的帧记为 out；在写之前记录，保证同一连接内响应先于客户端随后的请求出现在 trace 中
+func (c *Conn) WriteFrame(code kupool.OpCode, payload []byte) error {
+	c.record(DirOut, code, payload)
+	return c.Conn.WriteFrame(code, payload)
+}
+
+func (c *Conn) record(dir Direction, code kupool.OpCode, payload []byte) {
+	ch, _ := c.channel.Load().(string)
+	c.r.write(Record{
+		Time:    c.r.clk.Now(),
+		Conn:    c.id,
+		Channel: ch,
+		Remote:  c.remote,
+		Dir:     dir,
+		OpCode:  code,
+		Payload: string(payload),
+	})
+}
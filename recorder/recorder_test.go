@@ -0,0 +1,58 @@
+package recorder_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/recorder"
+	"github.com/JellyTony/kupool/tcp"
+)
+
+func TestRecorderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	rec := recorder.New(&buf)
+	clk := clock.NewFake(time.Time{})
+	rec.SetClock(clk)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := rec.Wrap(tcp.NewConn(server))
+	peer := tcp.NewConn(client)
+
+	go func() { _ = peer.WriteFrame(kupool.OpBinary, []byte(`{"id":1,"method":"authorize"}`)) }()
+	if _, err := conn.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetChannelID("ch1")
+	clk.Advance(time.Second)
+	go func() { _, _ = peer.ReadFrame() }()
+	if err := conn.WriteFrame(kupool.OpBinary, []byte(`{"id":1,"result":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	recs, err := recorder.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expect 2 records, got %d", len(recs))
+	}
+	in, out := recs[0], recs[1]
+	if in.Dir != recorder.DirIn || in.Channel != "" || in.Payload != `{"id":1,"method":"authorize"}` {
+		t.Fatalf("unexpected in record %+v", in)
+	}
+	if out.Dir != recorder.DirOut || out.Channel != "ch1" || out.OpCode != kupool.OpBinary || out.Conn != in.Conn {
+		t.Fatalf("unexpected out record %+v", out)
+	}
+	if out.Time.Sub(in.Time) != time.Second {
+		t.Fatalf("timestamps come from the clock, got %v", out.Time.Sub(in.Time))
+	}
+	if s := recorder.Sessions(recs); len(s) != 1 || s[0].Channel != "ch1" {
+		t.Fatalf("unexpected sessions %+v", s)
+	}
+}
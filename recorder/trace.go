@@ -0,0 +1,66 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Session 同一连接上的全部记录，按发生顺序
+type Session struct {
+	Conn    uint64
+	Channel string
+	Remote  string
+	Records []Record
+}
+
+// Load 读取 JSONL trace，空行被忽略
+func Load(r io.Reader) ([]Record, error) {
+	var out []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		out = append(out, rec)
+	}
+	return out, sc.Err()
+}
+
+// LoadFile 读取 path 中的 trace
+func LoadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Sessions 按连接分组，顺序为各连接首条记录出现的顺序
+func Sessions(recs []Record) []Session {
+	idx := make(map[uint64]int)
+	var out []Session
+	for _, rec := range recs {
+		i, ok := idx[rec.Conn]
+		if !ok {
+			i = len(out)
+			idx[rec.Conn] = i
+			out = append(out, Session{Conn: rec.Conn, Remote: rec.Remote})
+		}
+		if rec.Channel != "" {
+			out[i].Channel = rec.Channel
+		}
+		out[i].Records = append(out[i].Records, rec)
+	}
+	return out
+}
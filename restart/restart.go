@@ -0,0 +1,96 @@
+// Package restart 实现零停机重启：运行中的进程把监听 socket 交给新 exec 的子进程，
+// 子进程就绪后接管 accept，父进程排空已有连接后退出。仅支持 Linux，其他平台 Upgrade 返回 ErrNotSupported
+package restart
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrNotSupported 当前平台不支持热重启
+	ErrNotSupported = errors.New("restart: hot restart is only supported on linux")
+	// ErrUpgrading 已有一次重启在进行中
+	ErrUpgrading = errors.New("restart: upgrade already in progress")
+)
+
+const (
+	envListeners = "KUP_RESTART_LISTENERS" // 继承的监听 socket，形如 server=3,http=4
+	envReady     = "KUP_RESTART_READY"     // 子进程通知父进程就绪的管道 fd
+)
+
+// Upgrader 管理可在重启时交接的监听 socket
+type Upgrader struct {
+	mu        sync.Mutex
+	inherited map[string]net.Listener // 从父进程继承、尚未被 Listen 取走的 socket
+	listeners map[string]net.Listener // 正在使用、重启时交给子进程的 socket
+	names     []string
+	ready     *os.File // 由父进程启动时非 nil
+	upgrading bool
+}
+
+// New 创建 Upgrader；由父进程重启而来时接收继承的 socket
+func New() (*Upgrader, error) {
+	u := &Upgrader{inherited: make(map[string]net.Listener), listeners: make(map[string]net.Listener)}
+	if err := u.inherit(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// HasParent 是否由父进程热重启而来
+func (u *Upgrader) HasParent() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ready != nil
+}
+
+// Listen 返回名为 name 的监听 socket：优先使用从父进程继承的，否则新建。
+// 同一 name 在父子进程之间对应同一个 socket，地址变化时需换用新的 name
+func (u *Upgrader) Listen(name, network, addr string) (net.Listener, error) {
+	return u.ListenFunc(name, func() (net.Listener, error) { return net.Listen(network, addr) })
+}
+
+// ListenFunc 同 Listen，没有可继承的 socket 时调用 listen 新建（如需设置 SO_REUSEPORT 等选项）
+func (u *Upgrader) ListenFunc(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.listeners[name]; ok {
+		return nil, errors.New("restart: listener " + name + " already exists")
+	}
+	lst, ok := u.inherited[name]
+	if ok {
+		delete(u.inherited, name)
+	} else {
+		l, err := listen()
+		if err != nil {
+			return nil, err
+		}
+		lst = l
+	}
+	u.listeners[name] = lst
+	u.names = append(u.names, name)
+	return lst, nil
+}
+
+// Ready 通知父进程本进程已接管监听 socket，父进程随即开始排空；未被 Listen 取走的继承 socket 在此关闭。
+// 不是由父进程启动时什么也不做
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, lst := range u.inherited {
+		_ = lst.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	if cerr := u.ready.Close(); err == nil {
+		err = cerr
+	}
+	u.ready = nil
+	return err
+}
@@ -0,0 +1,147 @@
+package restart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Signals 触发热重启的信号
+func Signals() []os.Signal { return []os.Signal{syscall.SIGHUP, syscall.SIGUSR2} }
+
+// inherit 解析父进程传来的 socket 与就绪管道，并清除环境变量，避免再传给之后的子进程
+func (u *Upgrader) inherit() error {
+	spec, ready := os.Getenv(envListeners), os.Getenv(envReady)
+	_ = os.Unsetenv(envListeners)
+	_ = os.Unsetenv(envReady)
+	if ready == "" {
+		return nil
+	}
+	if spec != "" {
+		for _, kv := range strings.Split(spec, ",") {
+			name, v, ok := strings.Cut(kv, "=")
+			fd, err := strconv.Atoi(v)
+			if !ok || err != nil {
+				return fmt.Errorf("restart: bad %s entry %q", envListeners, kv)
+			}
+			f := os.NewFile(uintptr(fd), name)
+			lst, err := net.FileListener(f)
+			_ = f.Close()
+			if err != nil {
+				return fmt.Errorf("restart: inherit %s: %w", name, err)
+			}
+			u.inherited[name] = lst
+		}
+	}
+	fd, err := strconv.Atoi(ready)
+	if err != nil {
+		return fmt.Errorf("restart: bad %s %q", envReady, ready)
+	}
+	u.ready = os.NewFile(uintptr(fd), "ready")
+	return nil
+}
+
+// Upgrade 以相同的参数重新 exec 当前可执行文件（部署时已被替换为新版本），把监听 socket 交给它，
+// 等待其调用 Ready。成功后调用方应停止接受连接、排空已有连接并退出；
+// 失败时子进程已被终止，当前进程照常服务，可再次重试
+func (u *Upgrader) Upgrade(timeout time.Duration) error {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return ErrUpgrading
+	}
+	u.upgrading = true
+	names := append([]string(nil), u.names...)
+	lsts := make([]net.Listener, len(names))
+	for i, name := range names {
+		lsts[i] = u.listeners[name]
+	}
+	u.mu.Unlock()
+
+	err := u.spawn(names, lsts, timeout)
+	if err != nil {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}
+	return err
+}
+
+func (u *Upgrader) spawn(names []string, lsts []net.Listener, timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	spec := make([]string, len(names))
+	for i, lst := range lsts {
+		fl, ok := lst.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("restart: listener %s cannot be passed to a child", names[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		spec[i] = fmt.Sprintf("%s=%d", names[i], 3+i)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(spec, ","),
+		fmt.Sprintf("%s=%d", envReady, 3+len(lsts)),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// 关闭本进程持有的写端，子进程退出时读端才能收到 EOF
+	_ = w.Close()
+	files = files[:len(files)-1]
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			ready <- errors.New("restart: child exited before ready")
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err == nil {
+			return nil
+		}
+		_ = cmd.Process.Kill()
+		return err
+	case err := <-exited:
+		return fmt.Errorf("restart: child exited before ready: %v", err)
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("restart: child not ready after %s", timeout)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package restart
+
+import (
+	"os"
+	"time"
+)
+
+// Signals 触发热重启的信号，非 Linux 平台为空
+func Signals() []os.Signal { return nil }
+
+func (u *Upgrader) inherit() error { return nil }
+
+// Upgrade 非 Linux 平台不支持热重启
+func (u *Upgrader) Upgrade(timeout time.Duration) error { return ErrNotSupported }
@@ -0,0 +1,351 @@
+// Package sdk 连接 kupool 矿池的客户端：认证、订阅任务与难度、提交并取得结果、连接状态事件，
+// 支持 tcp 与 websocket 传输，Run 提供多矿池断线重连。
+//
+// 回调在 SDK 的内部协程中同步调用，不应阻塞；需要耗时处理时转交给自己的协程。
+package sdk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/tcp"
+	"github.com/JellyTony/kupool/websocket"
+)
+
+// jobHistory 每个连接保留可提交的最近任务数
+const jobHistory = 8
+
+var (
+	// ErrConnected 已有连接时再次 Connect
+	ErrConnected = errors.New("client has connected")
+	// ErrUnknownJob 提交的任务不是当前连接上收到的最近任务
+	ErrUnknownJob = errors.New("unknown job")
+)
+
+// ReconnectError 服务端下线前发出 client.reconnect，连接随之断开；Run 据此等待后重连
+type ReconnectError struct {
+	Host string        // 为空时重连原地址
+	Wait time.Duration // 重连前等待的时长
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("server asked to reconnect to %q after %s", e.Host, e.Wait)
+}
+
+// Client 矿池客户端，同一时间只有一条连接
+type Client struct {
+	username  string
+	transport Transport
+	clk       clock.Clock
+	calls     *callTable
+	pools     []Pool
+	reconnect ReconnectOptions
+	cli       kupool.Client
+
+	mu       sync.Mutex
+	sess     *session
+	state    State
+	handlers handlers
+	jobCh    chan Job
+}
+
+// session 一条已认证的连接，读协程退出时关闭 done
+type session struct {
+	addr       string
+	done       chan struct{}
+	err        error
+	closing    bool
+	jobs       map[int]Job
+	order      []int
+	difficulty float64
+}
+
+func (s *session) addJob(job Job) {
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	if len(s.order) > jobHistory {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *session) latest() (Job, bool) {
+	if len(s.order) == 0 {
+		return Job{}, false
+	}
+	return s.jobs[s.order[len(s.order)-1]], true
+}
+
+func (s *session) ended() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewClient 以 username 认证的客户端，默认使用 TCP 传输
+func NewClient(username string) *Client {
+	c := &Client{username: username, transport: TCP, clk: clock.Real(), reconnect: DefaultReconnectOptions(), jobCh: make(chan Job, 1)}
+	// 认证请求固定使用 id 1
+	c.calls = newCallTable(authorizeID+1, DefaultRequestTimeout, c.clk)
+	c.calls.onDone = c.completed
+	c.cli = c.newTransport()
+	return c
+}
+
+// SetTransport 设置传输（默认 TCP），需在 Connect 之前调用
+func (c *Client) SetTransport(t Transport) {
+	c.transport = t
+	c.cli = c.newTransport()
+}
+
+// SetClock 设置请求超时与重连退避使用的时钟（默认真实时钟），需在 Connect 之前调用
+func (c *Client) SetClock(clk clock.Clock) {
+	c.clk = clock.OrReal(clk)
+	c.calls.clk = c.clk
+}
+
+// SetRequestTimeout 设置等待每个请求响应的上限（默认 DefaultRequestTimeout），需在 Connect 之前调用
+func (c *Client) SetRequestTimeout(d time.Duration) {
+	if d > 0 {
+		c.calls.timeout = d
+	}
+}
+
+func (c *Client) newTransport() kupool.Client {
+	var cli kupool.Client
+	switch c.transport {
+	case WebSocket:
+		cli = websocket.NewClient(c.username, "sdk", websocket.ClientOptions{Heartbeat: kupool.DefaultHeartbeat})
+	default:
+		cli = tcp.NewClient(c.username, "sdk", tcp.ClientOptions{})
+	}
+	cli.SetDialer(&dialer{transport: c.transport, username: c.username})
+	return cli
+}
+
+// Connect 连接 addr 并完成认证，被拒绝时返回 ErrUnauthorized。连接断开后不会自动重连，
+// 可以再次 Connect；需要断线重连与矿池切换时使用 Run
+func (c *Client) Connect(addr string) error {
+	c.mu.Lock()
+	if s := c.sess; s != nil && !s.ended() {
+		c.mu.Unlock()
+		return ErrConnected
+	}
+	c.mu.Unlock()
+
+	c.setState(StateEvent{State: StateConnecting, Addr: addr})
+	if err := c.cli.Connect(c.transport.target(addr)); err != nil {
+		c.setState(StateEvent{State: StateDisconnected, Addr: addr, Err: err})
+		return err
+	}
+	s := &session{addr: addr, done: make(chan struct{}), jobs: make(map[int]Job)}
+	c.mu.Lock()
+	c.sess = s
+	c.mu.Unlock()
+	c.setState(StateEvent{State: StateConnected, Addr: addr})
+	go c.readloop(s)
+	return nil
+}
+
+// Close 断开当前连接并等待读协程退出，等待中的请求以 ErrConnectionLost 完成；
+// Run 期间调用时 Run 会重新连接，停止 Run 应取消其 ctx
+func (c *Client) Close() {
+	c.mu.Lock()
+	s := c.sess
+	if s != nil {
+		s.closing = true
+	}
+	c.mu.Unlock()
+	if s == nil {
+		return
+	}
+	c.cli.Close()
+	<-s.done
+}
+
+// State 当前连接状态
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Job 当前连接上收到的最新任务；断开或尚未收到任务时返回 false
+func (c *Client) Job() (Job, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess == nil || c.sess.ended() {
+		return Job{}, false
+	}
+	return c.sess.latest()
+}
+
+// Jobs 新任务的订阅：只保留最新的一个，来不及读取的旧任务被替换
+func (c *Client) Jobs() <-chan Job { return c.jobCh }
+
+// Difficulty 当前连接上服务端最近通知的难度，没有收到时为 0
+func (c *Client) Difficulty() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess == nil {
+		return 0
+	}
+	return c.sess.difficulty
+}
+
+// Stats 返回已发出请求的接受、拒绝、超时与断线计数
+func (c *Client) Stats() RequestStats { return c.calls.stats() }
+
+// Call 发送请求并登记，返回的 Call 在收到同 id 的响应、超时或连接断开时完成
+func (c *Client) Call(method string, params any) (*Call, error) {
+	raw, err := protocol.Encode(params)
+	if err != nil {
+		return nil, err
+	}
+	return c.calls.add(method, params, func(id int) error {
+		data, err := protocol.Encode(protocol.Request{ID: &id, Method: method, Params: raw})
+		if err != nil {
+			return err
+		}
+		return c.cli.Send(data)
+	})
+}
+
+// Submit 以 sha256(server_nonce + nonce) 提交 jobID 的结果；jobID 须是当前连接上收到的最近任务之一，
+// 否则返回 ErrUnknownJob
+func (c *Client) Submit(jobID int, nonce string) (*Submission, error) {
+	c.mu.Lock()
+	var job Job
+	ok := false
+	if c.sess != nil && !c.sess.ended() {
+		job, ok = c.sess.jobs[jobID]
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownJob, jobID)
+	}
+	p := protocol.SubmitParams{JobID: jobID, ClientNonce: nonce, Result: computeSHA256Hex(job.ServerNonce + nonce)}
+	call, err := c.Call("submit", p)
+	if err != nil {
+		return nil, err
+	}
+	return &Submission{call: call, p: p}, nil
+}
+
+// readloop 处理一条连接上的消息，连接断开后完成全部等待中的请求
+func (c *Client) readloop(s *session) {
+	err := c.serve(s)
+	c.cli.Close()
+	c.calls.failAll()
+
+	c.mu.Lock()
+	if s.closing {
+		err = nil
+	}
+	s.err = err
+	c.mu.Unlock()
+	c.setState(StateEvent{State: StateDisconnected, Addr: s.addr, Err: err})
+	close(s.done)
+}
+
+func (c *Client) serve(s *session) error {
+	log := logger.WithFields(logger.Fields{"module": "sdk", "pool": s.addr})
+	for {
+		frame, err := c.cli.Read()
+		if err != nil {
+			return err
+		}
+		if frame.GetOpCode() != kupool.OpBinary {
+			continue
+		}
+		// 带 method 的是服务端推送，否则是响应，按 id 交给等待中的请求
+		var msg protocol.Request
+		if err := protocol.Decode(frame.GetPayload(), &msg); err != nil {
+			continue
+		}
+		switch msg.Method {
+		case "":
+			var resp protocol.Response
+			if err := protocol.Decode(frame.GetPayload(), &resp); err == nil && !c.calls.resolve(resp) {
+				log.WithField("id", resp.ID).Warn("response to unknown or expired request")
+			}
+		case "job":
+			var p protocol.JobParams
+			if err := protocol.Decode(msg.Params, &p); err != nil {
+				continue
+			}
+			job := Job{ID: p.JobID, ServerNonce: p.ServerNonce, Pool: s.addr, Received: c.clk.Now()}
+			c.mu.Lock()
+			s.addJob(job)
+			c.mu.Unlock()
+			c.publish(job)
+		case "set_difficulty":
+			var p protocol.DifficultyParams
+			if err := protocol.Decode(msg.Params, &p); err != nil {
+				continue
+			}
+			c.mu.Lock()
+			s.difficulty = p.Difficulty
+			c.mu.Unlock()
+			for _, fn := range c.callbacks().difficulty {
+				fn(p.Difficulty)
+			}
+		case "client.reconnect":
+			var p protocol.ReconnectParams
+			_ = protocol.Decode(msg.Params, &p)
+			log.WithField("host", p.Host).WithField("wait", p.Wait).Info("reconnect requested")
+			return &ReconnectError{Host: p.Host, Wait: time.Duration(p.Wait) * time.Second}
+		default:
+			log.WithField("method", msg.Method).Debug("unknown notification")
+		}
+	}
+}
+
+func (c *Client) publish(job Job) {
+	// 只有读协程写入：先取走未读的旧任务，再放入新任务
+	select {
+	case <-c.jobCh:
+	default:
+	}
+	c.jobCh <- job
+	for _, fn := range c.callbacks().job {
+		fn(job)
+	}
+}
+
+func (c *Client) setState(ev StateEvent) {
+	c.mu.Lock()
+	c.state = ev.State
+	c.mu.Unlock()
+	for _, fn := range c.callbacks().state {
+		fn(ev)
+	}
+}
+
+// completed 请求完成，提交的结果交给 OnSubmitResult 回调
+func (c *Client) completed(call *Call) {
+	p, ok := call.params.(protocol.SubmitParams)
+	if !ok {
+		return
+	}
+	r := submitResult(call, p)
+	for _, fn := range c.callbacks().result {
+		fn(r)
+	}
+}
+
+func computeSHA256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
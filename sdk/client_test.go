@@ -0,0 +1,416 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/tcp"
+	"github.com/JellyTony/kupool/websocket"
+)
+
+// testPool 最小的矿池服务端：认证即通过，校验提交结果，由测试推送任务与难度
+type testPool struct {
+	t    *testing.T
+	addr string
+	srv  kupool.Server
+
+	mu      sync.Mutex
+	authed  int
+	deny    string // 非空时以该原因拒绝认证
+	respond func(protocol.SubmitParams) *protocol.Response
+}
+
+func startPool(t *testing.T, tr Transport, addr string) *testPool {
+	t.Helper()
+	p := &testPool{t: t, addr: addr}
+	var s kupool.Server
+	if tr == WebSocket {
+		s = websocket.NewServer(addr)
+	} else {
+		s = tcp.NewServer(addr)
+	}
+	s.SetAcceptor(p)
+	s.SetMessageListener(p)
+	s.SetStateListener(p)
+	p.srv = s
+	go func() { _ = s.Start() }()
+	t.Cleanup(p.kill)
+	waitFor(t, "pool listening", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return p
+}
+
+func (p *testPool) Accept(conn kupool.Conn, timeout time.Duration) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	f, err := conn.ReadFrame()
+	if err != nil {
+		return "", err
+	}
+	var req protocol.Request
+	if err := protocol.Decode(f.GetPayload(), &req); err != nil || req.Method != "authorize" {
+		return "", errors.New("unauthorized")
+	}
+	p.mu.Lock()
+	deny := p.deny
+	p.mu.Unlock()
+	resp := protocol.Response{ID: *req.ID, Result: deny == ""}
+	if deny != "" {
+		resp.Error = &deny
+	}
+	data, _ := protocol.Encode(resp)
+	if err := conn.WriteFrame(kupool.OpBinary, data); err != nil {
+		return "", err
+	}
+	if deny != "" {
+		return "", errors.New(deny)
+	}
+	p.mu.Lock()
+	p.authed++
+	p.mu.Unlock()
+	return conn.RemoteAddr().String(), nil
+}
+
+func (p *testPool) Receive(ag kupool.Agent, payload []byte) {
+	var req protocol.Request
+	var sp protocol.SubmitParams
+	if protocol.Decode(payload, &req) != nil || req.Method != "submit" || protocol.Decode(req.Params, &sp) != nil {
+		return
+	}
+	p.mu.Lock()
+	respond := p.respond
+	p.mu.Unlock()
+	resp := &protocol.Response{Result: true}
+	if respond != nil {
+		resp = respond(sp)
+	} else if sp.Result != computeSHA256Hex("nonce"+sp.ClientNonce) {
+		msg := "Invalid result"
+		resp = &protocol.Response{Error: &msg}
+	}
+	if resp == nil {
+		return
+	}
+	resp.ID = *req.ID
+	data, _ := protocol.Encode(resp)
+	_ = ag.Push(data)
+}
+
+func (p *testPool) Disconnect(string) error { return nil }
+
+// push 向全部连接推送通知
+func (p *testPool) push(method string, params any) {
+	raw, _ := protocol.Encode(params)
+	data, _ := protocol.Encode(protocol.Request{Method: method, Params: raw})
+	for _, ch := range p.srv.(kupool.ChannelMap).All() {
+		_ = ch.Push(data)
+	}
+}
+
+func (p *testPool) job(id int) {
+	p.push("job", protocol.JobParams{JobID: id, ServerNonce: "nonce"})
+}
+
+// kill 关闭全部连接（tcp 同时关闭监听），不发送任何通知
+func (p *testPool) kill() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = p.srv.Shutdown(ctx)
+}
+
+func (p *testPool) conns() int { return len(p.srv.(kupool.ChannelMap).All()) }
+
+func (p *testPool) authCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.authed
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func recvJob(t *testing.T, c *Client) Job {
+	t.Helper()
+	select {
+	case job := <-c.Jobs():
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for job")
+		return Job{}
+	}
+}
+
+func waitCtx(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// TestClient 两种传输上：认证、任务的订阅与回调、难度通知、提交结果与连接状态事件
+func TestClient(t *testing.T) {
+	for _, tr := range []Transport{TCP, WebSocket} {
+		t.Run(string(tr), func(t *testing.T) {
+			pool := startPool(t, tr, freeAddr(t))
+			c := NewClient("alice")
+			c.SetTransport(tr)
+			var mu sync.Mutex
+			var states []StateEvent
+			var jobs []int
+			var diffs []float64
+			var results []SubmitResult
+			c.OnState(func(ev StateEvent) { mu.Lock(); states = append(states, ev); mu.Unlock() })
+			c.OnJob(func(j Job) { mu.Lock(); jobs = append(jobs, j.ID); mu.Unlock() })
+			c.OnDifficulty(func(d float64) { mu.Lock(); diffs = append(diffs, d); mu.Unlock() })
+			c.OnSubmitResult(func(r SubmitResult) { mu.Lock(); results = append(results, r); mu.Unlock() })
+
+			if err := c.Connect(pool.addr); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Connect(pool.addr); !errors.Is(err, ErrConnected) {
+				t.Fatalf("expect ErrConnected, got %v", err)
+			}
+			waitFor(t, "registered", func() bool { return pool.conns() == 1 })
+			if _, err := c.Submit(1, "early"); !errors.Is(err, ErrUnknownJob) {
+				t.Fatalf("submit before any job: %v", err)
+			}
+
+			pool.job(1)
+			if job := recvJob(t, c); job.ID != 1 || job.ServerNonce != "nonce" || job.Pool != pool.addr {
+				t.Fatalf("unexpected job %+v", job)
+			}
+			pool.push("set_difficulty", protocol.DifficultyParams{Difficulty: 16})
+			waitFor(t, "difficulty", func() bool { return c.Difficulty() == 16 })
+
+			s, err := c.Submit(1, "n1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := s.Wait(waitCtx(t))
+			if err != nil || !r.Accepted || r.Err != nil || r.JobID != 1 || r.Nonce != "n1" || r.ID != s.ID() {
+				t.Fatalf("expect accepted submit, got %+v %v", r, err)
+			}
+
+			c.Close()
+			if c.State() != StateDisconnected {
+				t.Fatalf("state after Close: %v", c.State())
+			}
+			if _, ok := c.Job(); ok {
+				t.Fatal("no job after Close")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			want := []State{StateConnecting, StateConnected, StateDisconnected}
+			if len(states) != len(want) {
+				t.Fatalf("unexpected state events %+v", states)
+			}
+			for i, ev := range states {
+				if ev.State != want[i] || ev.Addr != pool.addr || ev.Err != nil {
+					t.Fatalf("unexpected state events %+v", states)
+				}
+			}
+			if len(jobs) != 1 || len(diffs) != 1 || diffs[0] != 16 || len(results) != 1 || results[0] != r {
+				t.Fatalf("callbacks: jobs %v, difficulty %v, results %+v", jobs, diffs, results)
+			}
+		})
+	}
+}
+
+// TestAuthorizeRoundTrip Connect 等待认证响应，被拒绝时返回带原因的 ErrUnauthorized
+func TestAuthorizeRoundTrip(t *testing.T) {
+	for _, tr := range []Transport{TCP, WebSocket} {
+		t.Run(string(tr), func(t *testing.T) {
+			pool := startPool(t, tr, freeAddr(t))
+			pool.deny = "banned until tomorrow"
+			c := NewClient("mallory")
+			c.SetTransport(tr)
+			var failed StateEvent
+			c.OnState(func(ev StateEvent) { failed = ev })
+			err := c.Connect(pool.addr)
+			if !errors.Is(err, ErrUnauthorized) || !strings.Contains(err.Error(), "banned until tomorrow") {
+				t.Fatalf("expect ErrUnauthorized with reason, got %v", err)
+			}
+			if failed.State != StateDisconnected || !errors.Is(failed.Err, ErrUnauthorized) {
+				t.Fatalf("expect a disconnected event, got %+v", failed)
+			}
+
+			pool.mu.Lock()
+			pool.deny = ""
+			pool.mu.Unlock()
+			if err := c.Connect(pool.addr); err != nil {
+				t.Fatalf("connect after a rejected attempt: %v", err)
+			}
+			c.Close()
+		})
+	}
+}
+
+// TestCalls 提交按 id 与响应关联：接受、拒绝、超时与断线分别完成对应的 Call 并计数
+func TestCalls(t *testing.T) {
+	pool := startPool(t, TCP, freeAddr(t))
+	pool.respond = func(sp protocol.SubmitParams) *protocol.Response {
+		switch sp.ClientNonce {
+		case "reject":
+			msg := "Invalid result"
+			return &protocol.Response{Error: &msg}
+		case "silent":
+			return nil
+		}
+		return &protocol.Response{Result: true}
+	}
+	c := NewClient("alice")
+	c.SetRequestTimeout(200 * time.Millisecond)
+	disconnected := make(chan StateEvent, 1)
+	c.OnState(func(ev StateEvent) {
+		if ev.State == StateDisconnected {
+			disconnected <- ev
+		}
+	})
+	if err := c.Connect(pool.addr); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(nonce string) *Call {
+		t.Helper()
+		call, err := c.Call("submit", protocol.SubmitParams{JobID: 1, ClientNonce: nonce})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return call
+	}
+	wait := func(call *Call) Result {
+		t.Helper()
+		r, err := call.Wait(waitCtx(t))
+		if err != nil {
+			t.Fatalf("call %d did not complete: %v", call.ID, err)
+		}
+		return r
+	}
+	ok, rejected, silent := call("ok"), call("reject"), call("silent")
+	if ok.ID == rejected.ID || ok.ID == 1 {
+		t.Fatalf("ids should be unique and skip the authorize id: %d %d", ok.ID, rejected.ID)
+	}
+	if r := wait(ok); !r.OK || r.Err != nil {
+		t.Fatalf("expect accepted, got %+v", r)
+	}
+	if r := wait(rejected); r.OK || r.Error != "Invalid result" {
+		t.Fatalf("expect rejected with reason, got %+v", r)
+	}
+	if r := wait(silent); !errors.Is(r.Err, ErrRequestTimeout) {
+		t.Fatalf("expect timeout, got %+v", r)
+	}
+
+	// 断线时等待中的请求以 ErrConnectionLost 完成
+	lost := call("silent")
+	pool.kill()
+	if r := wait(lost); !errors.Is(r.Err, ErrConnectionLost) {
+		t.Fatalf("expect connection lost, got %+v", r)
+	}
+	if ev := <-disconnected; ev.Err == nil {
+		t.Fatal("remote close should be reported with an error")
+	}
+	st := c.Stats()
+	if st != (RequestStats{Accepted: 1, Rejected: 1, TimedOut: 1, Lost: 1}) {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func startRunning(t *testing.T, pools ...Pool) *Client {
+	t.Helper()
+	c := NewClient("alice")
+	c.SetPools(pools...)
+	c.SetReconnect(ReconnectOptions{MinBackoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, ProbeInterval: 50 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run should stop with the context, got %v", err)
+		}
+	})
+	return c
+}
+
+// TestFailover 主矿池不可用时连备用矿池，主矿池恢复后切回，再次下线时回到备用矿池
+func TestFailover(t *testing.T) {
+	primaryAddr, backupAddr := freeAddr(t), freeAddr(t)
+	backup := startPool(t, TCP, backupAddr)
+	c := startRunning(t, Pool{Addr: backupAddr, Priority: 1}, Pool{Addr: primaryAddr, Priority: 0})
+
+	waitFor(t, "connected to backup", func() bool { return backup.conns() == 1 })
+	backup.job(1)
+	if job := recvJob(t, c); job.Pool != backupAddr {
+		t.Fatalf("job should come from the backup pool: %+v", job)
+	}
+
+	primary := startPool(t, TCP, primaryAddr)
+	waitFor(t, "switched to primary", func() bool { return primary.conns() == 1 && backup.conns() == 0 })
+	primary.job(7)
+	if job := recvJob(t, c); job.ID != 7 || job.Pool != primaryAddr {
+		t.Fatalf("job should come from the primary pool: %+v", job)
+	}
+	if _, err := c.Submit(1, "stale"); !errors.Is(err, ErrUnknownJob) {
+		t.Fatalf("jobs of the previous connection should not be submitted: %v", err)
+	}
+
+	primary.kill()
+	waitFor(t, "back on backup", func() bool { return backup.conns() == 1 && backup.authCount() == 2 })
+}
+
+func TestBackoffAndParsePools(t *testing.T) {
+	c := NewClient("alice")
+	c.SetReconnect(ReconnectOptions{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.5})
+	for attempt, base := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		base *= time.Millisecond
+		if attempt == 5 {
+			attempt = 40 // 不溢出
+		}
+		d := c.backoff(attempt)
+		if d < base/2 || d > base*3/2 {
+			t.Fatalf("attempt %d: %v not within 50%% of %v", attempt, d, base)
+		}
+	}
+
+	pools, err := ParsePools("a:1, b:2=5,c:3")
+	if err != nil || len(pools) != 3 || pools[1] != (Pool{Addr: "b:2", Priority: 5}) || pools[2] != (Pool{Addr: "c:3", Priority: 2}) {
+		t.Fatalf("unexpected pools %+v %v", pools, err)
+	}
+	if _, err := ParsePools("a:1=x"); err == nil {
+		t.Fatal("expect invalid priority error")
+	}
+	c.SetPools(pools...)
+	if c.pools[0].Addr != "a:1" || c.pools[2].Addr != "b:2" {
+		t.Fatalf("pools should be sorted by priority: %+v", c.pools)
+	}
+	if hostPort("ws://h:1/mine") != "h:1" || hostPort("h:1") != "h:1" || WebSocket.target("h:1") != "ws://h:1" {
+		t.Fatal("unexpected websocket address handling")
+	}
+}
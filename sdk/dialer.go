@@ -0,0 +1,151 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/protocol"
+	"github.com/JellyTony/kupool/tcp"
+	"github.com/JellyTony/kupool/websocket"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// Transport 连接矿池使用的传输
+type Transport string
+
+const (
+	TCP       Transport = "tcp"
+	WebSocket Transport = "ws"
+)
+
+// ParseTransport 解析 tcp、ws（或 websocket）
+func ParseTransport(s string) (Transport, error) {
+	switch s {
+	case "tcp":
+		return TCP, nil
+	case "ws", "websocket":
+		return WebSocket, nil
+	}
+	return "", fmt.Errorf("unknown transport %q", s)
+}
+
+// target 交给传输层的地址：websocket 需要 URL，矿池地址只写 host:port 时补上 ws://
+func (t Transport) target(addr string) string {
+	if t == WebSocket && !strings.Contains(addr, "://") {
+		return "ws://" + addr
+	}
+	return addr
+}
+
+// hostPort 探测矿池时建立 TCP 连接的地址
+func hostPort(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return addr
+}
+
+// authorizeID 认证请求的 id，连接上的第一个请求
+const authorizeID = 1
+
+// ErrUnauthorized 服务端拒绝认证（含被封禁、连接被准入控制拒绝）
+var ErrUnauthorized = errors.New("authorize rejected")
+
+// frameConn 认证往返需要的帧读写
+type frameConn interface {
+	ReadFrame() (kupool.Frame, error)
+	WriteFrame(kupool.OpCode, []byte) error
+	SetDeadline(time.Time) error
+}
+
+// wsClientConn 客户端一侧的 websocket 连接，写出的帧需要使用MASK
+type wsClientConn struct {
+	*websocket.WsConn
+}
+
+func (c wsClientConn) WriteFrame(code kupool.OpCode, payload []byte) error {
+	return wsutil.WriteClientMessage(c.Conn, ws.OpCode(code), payload)
+}
+
+type dialer struct {
+	transport Transport
+	username  string
+}
+
+// DialAndHandshake 建立连接并完成认证往返：收到 result 为 true 的响应才算成功，
+// 被拒绝或服务端直接关闭连接时返回 ErrUnauthorized
+func (d *dialer) DialAndHandshake(ctx kupool.DialerContext) (net.Conn, error) {
+	var conn net.Conn
+	var fc frameConn
+	switch d.transport {
+	case WebSocket:
+		raw, br, _, err := ws.Dialer{Timeout: ctx.Timeout}.Dial(context.Background(), ctx.Address)
+		if err != nil {
+			return nil, err
+		}
+		if br != nil {
+			// 服务端在收到认证前不会发送数据
+			ws.PutReader(br)
+		}
+		conn, fc = raw, wsClientConn{websocket.NewConn(raw)}
+	default:
+		raw, err := net.DialTimeout("tcp", ctx.Address, ctx.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn, fc = raw, tcp.NewConn(raw)
+	}
+	log := logger.WithFields(logger.Fields{"module": "sdk", "transport": d.transport, "address": conn.RemoteAddr().String()})
+	log.Debug("connected")
+
+	if err := authorize(fc, d.username, ctx.Timeout); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	log.WithField("username", d.username).Info("authorize ok")
+	return conn, nil
+}
+
+func authorize(conn frameConn, username string, timeout time.Duration) error {
+	id := authorizeID
+	p, _ := protocol.Encode(protocol.AuthorizeParams{Username: username})
+	data, _ := protocol.Encode(protocol.Request{ID: &id, Method: "authorize", Params: p})
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	if err := conn.WriteFrame(kupool.OpBinary, data); err != nil {
+		return err
+	}
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("read authorize response: %w", err)
+		}
+		switch frame.GetOpCode() {
+		case kupool.OpClose:
+			return fmt.Errorf("%w: %s", ErrUnauthorized, frame.GetPayload())
+		case kupool.OpBinary:
+		default:
+			continue
+		}
+		var resp protocol.Response
+		if err := protocol.Decode(frame.GetPayload(), &resp); err != nil || resp.ID != id {
+			continue
+		}
+		if !resp.Result {
+			reason := ""
+			if resp.Error != nil {
+				reason = *resp.Error
+			}
+			return fmt.Errorf("%w: %s", ErrUnauthorized, reason)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,135 @@
+package sdk
+
+import (
+	"context"
+	"time"
+
+	"github.com/JellyTony/kupool/protocol"
+)
+
+// State 连接状态
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// StateEvent 连接状态变化
+type StateEvent struct {
+	State State
+	Addr  string // 矿池地址
+	Err   error  // 连接失败或断开的原因；主动 Close 时为 nil，服务端通知重连时为 *ReconnectError
+}
+
+// Job 服务端下发的任务
+type Job struct {
+	ID          int
+	ServerNonce string
+	Pool        string    // 下发任务的矿池地址
+	Received    time.Time // 收到任务的时间
+}
+
+// SubmitResult 提交的结果：Err 非 nil 表示没有收到响应，否则 Accepted 与 Reason 为服务端的应答
+type SubmitResult struct {
+	ID       int
+	JobID    int
+	Nonce    string
+	Accepted bool
+	Reason   string        // 被拒绝的原因，如 Invalid result、Task does not exist
+	Err      error         // ErrRequestTimeout 或 ErrConnectionLost
+	Latency  time.Duration // 发出到完成的时长
+}
+
+func submitResult(call *Call, p protocol.SubmitParams) SubmitResult {
+	r := call.result
+	return SubmitResult{
+		ID: call.ID, JobID: p.JobID, Nonce: p.ClientNonce,
+		Accepted: r.OK, Reason: r.Error, Err: r.Err,
+		Latency: call.finished.Sub(call.Sent),
+	}
+}
+
+// Submission 已发出、等待响应的提交
+type Submission struct {
+	call *Call
+	p    protocol.SubmitParams
+}
+
+// ID 提交请求的 id
+func (s *Submission) ID() int { return s.call.ID }
+
+// Done 收到响应、超时或连接断开时关闭
+func (s *Submission) Done() <-chan struct{} { return s.call.Done() }
+
+// Result 提交的结果，Done 关闭之前为零值
+func (s *Submission) Result() SubmitResult {
+	select {
+	case <-s.call.done:
+		return submitResult(s.call, s.p)
+	default:
+		return SubmitResult{}
+	}
+}
+
+// Wait 等待提交完成或 ctx 结束
+func (s *Submission) Wait(ctx context.Context) (SubmitResult, error) {
+	if _, err := s.call.Wait(ctx); err != nil {
+		return SubmitResult{}, err
+	}
+	return submitResult(s.call, s.p), nil
+}
+
+// handlers 注册的回调
+type handlers struct {
+	job        []func(Job)
+	difficulty []func(float64)
+	state      []func(StateEvent)
+	result     []func(SubmitResult)
+}
+
+// OnJob 收到新任务时调用
+func (c *Client) OnJob(fn func(Job)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers.job = append(c.handlers.job, fn)
+}
+
+// OnDifficulty 服务端通知 set_difficulty 时调用
+func (c *Client) OnDifficulty(fn func(float64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers.difficulty = append(c.handlers.difficulty, fn)
+}
+
+// OnState 连接状态变化时调用
+func (c *Client) OnState(fn func(StateEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers.state = append(c.handlers.state, fn)
+}
+
+// OnSubmitResult 每个提交完成（接受、拒绝、超时或断线）时调用
+func (c *Client) OnSubmitResult(fn func(SubmitResult)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers.result = append(c.handlers.result, fn)
+}
+
+func (c *Client) callbacks() handlers {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.handlers
+}
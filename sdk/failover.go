@@ -0,0 +1,243 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JellyTony/kupool/logger"
+)
+
+// errPreferredPoolUp 连在备用矿池期间探测到更优先的矿池已恢复
+var errPreferredPoolUp = errors.New("preferred pool is up")
+
+// Pool 矿池地址，Priority 越小越优先，相同优先级按配置顺序
+type Pool struct {
+	Addr     string
+	Priority int
+}
+
+// ParsePools 解析逗号分隔的矿池列表，每项为 addr 或 addr=priority，省略优先级时取其序号
+func ParsePools(s string) ([]Pool, error) {
+	var pools []Pool
+	for i, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p := Pool{Addr: item, Priority: i}
+		if addr, prio, ok := strings.Cut(item, "="); ok {
+			n, err := strconv.Atoi(prio)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority in %q", item)
+			}
+			p = Pool{Addr: addr, Priority: n}
+		}
+		pools = append(pools, p)
+	}
+	if len(pools) == 0 {
+		return nil, errors.New("no pool address")
+	}
+	return pools, nil
+}
+
+// ReconnectOptions 断线重连与矿池切换参数
+type ReconnectOptions struct {
+	MinBackoff    time.Duration // 所有矿池都连不上时首次重试前的等待
+	MaxBackoff    time.Duration // 指数退避的上限
+	Jitter        float64       // 等待时长上下随机浮动的比例，取值 [0, 1]
+	ProbeInterval time.Duration // 连在备用矿池时探测更优先矿池的间隔
+	DialTimeout   time.Duration // 探测时建立 TCP 连接的超时
+}
+
+// DefaultReconnectOptions 退避 1 秒起、最长 30 秒、浮动 20%，每 30 秒探测一次主矿池
+func DefaultReconnectOptions() ReconnectOptions {
+	return ReconnectOptions{MinBackoff: time.Second, MaxBackoff: 30 * time.Second, Jitter: 0.2, ProbeInterval: 30 * time.Second, DialTimeout: 3 * time.Second}
+}
+
+// SetPools 设置 Run 使用的矿池列表，需在 Run 之前调用
+func (c *Client) SetPools(pools ...Pool) {
+	c.pools = append([]Pool(nil), pools...)
+	sort.SliceStable(c.pools, func(i, j int) bool { return c.pools[i].Priority < c.pools[j].Priority })
+}
+
+// SetReconnect 设置重连退避与探测参数，未设置的字段取默认值，需在 Run 之前调用
+func (c *Client) SetReconnect(opts ReconnectOptions) {
+	def := DefaultReconnectOptions()
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = def.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(def.MaxBackoff, opts.MinBackoff)
+	}
+	if opts.Jitter < 0 || opts.Jitter > 1 {
+		opts.Jitter = def.Jitter
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = def.ProbeInterval
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = def.DialTimeout
+	}
+	c.reconnect = opts
+}
+
+// Run 按优先级连接矿池并保持连接，直到 ctx 结束：
+//   - 连接断开后重新连接并认证，新连接上的任务经 Jobs/OnJob 送达；所有矿池都连不上时按带随机浮动的指数退避重试；
+//   - 优先的矿池不可用时依次尝试备用矿池，连在备用矿池期间定期探测更优先的矿池，恢复后切回；
+//   - 服务端通知 client.reconnect 时等待建议的时长，先尝试其指定的地址，再按优先级选择。
+func (c *Client) Run(ctx context.Context) error {
+	if len(c.pools) == 0 {
+		return errors.New("sdk: no pool configured")
+	}
+	log := logger.WithFields(logger.Fields{"module": "sdk", "username": c.username})
+	attempt := 0
+	redirect := ""
+	for {
+		cur, err := c.dial(redirect)
+		redirect = ""
+		if err != nil {
+			d := c.backoff(attempt)
+			attempt++
+			log.WithError(err).Warnf("no pool reachable, retrying in %v", d)
+			if !c.sleep(ctx, d) {
+				return ctx.Err()
+			}
+			continue
+		}
+		log.WithField("pool", cur).Info("connected")
+		c.mu.Lock()
+		s := c.sess
+		c.mu.Unlock()
+		probeCtx, stopProbe := context.WithCancel(ctx)
+		select {
+		case <-ctx.Done():
+		case <-c.probe(probeCtx, c.preferred(cur)):
+			err = errPreferredPoolUp
+		case <-s.done:
+			err = s.err
+		}
+		stopProbe()
+		c.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		c.mu.Lock()
+		gotJob := len(s.order) > 0
+		c.mu.Unlock()
+		var rc *ReconnectError
+		switch {
+		case errors.As(err, &rc):
+			attempt = 0
+			redirect = rc.Host
+			if !c.sleep(ctx, rc.Wait) {
+				return ctx.Err()
+			}
+		case errors.Is(err, errPreferredPoolUp):
+			attempt = 0
+			log.WithField("pool", cur).Info("preferred pool recovered, switching back")
+		case gotJob:
+			// 连接正常工作过，立即重连
+			attempt = 0
+			log.WithError(err).Warn("connection lost, reconnecting")
+		default:
+			// 连上后没收到任务就断开，退避后再试
+			d := c.backoff(attempt)
+			attempt++
+			log.WithError(err).Warnf("connection lost before any job, retrying in %v", d)
+			if !c.sleep(ctx, d) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// dial 先尝试 redirect，再按优先级尝试各矿池，返回连上的地址
+func (c *Client) dial(redirect string) (string, error) {
+	var errs []error
+	if redirect != "" {
+		err := c.Connect(redirect)
+		if err == nil {
+			return redirect, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", redirect, err))
+	}
+	for _, p := range c.pools {
+		if err := c.Connect(p.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Addr, err))
+			continue
+		}
+		return p.Addr, nil
+	}
+	return "", errors.Join(errs...)
+}
+
+// preferred 比 addr 更优先的矿池；addr 不在列表中（服务端指定的地址）时为全部矿池
+func (c *Client) preferred(addr string) []Pool {
+	for i, p := range c.pools {
+		if p.Addr == addr {
+			return c.pools[:i]
+		}
+	}
+	return c.pools
+}
+
+// probe 每隔 ProbeInterval 尝试与 pools 建立 TCP 连接，任一成功时关闭返回的 chan；pools 为空时返回 nil
+func (c *Client) probe(ctx context.Context, pools []Pool) <-chan struct{} {
+	if len(pools) == 0 {
+		return nil
+	}
+	up := make(chan struct{})
+	go func() {
+		tick := c.clk.NewTicker(c.reconnect.ProbeInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C():
+			}
+			for _, p := range pools {
+				conn, err := net.DialTimeout("tcp", hostPort(p.Addr), c.reconnect.DialTimeout)
+				if err == nil {
+					_ = conn.Close()
+					close(up)
+					return
+				}
+			}
+		}
+	}()
+	return up
+}
+
+// backoff 第 attempt 次重试前的等待：MinBackoff 按 2 的幂增长到 MaxBackoff，再上下浮动 Jitter
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.reconnect.MinBackoff
+	for i := 0; i < attempt && d < c.reconnect.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, c.reconnect.MaxBackoff)
+	if j := c.reconnect.Jitter; j > 0 {
+		d = time.Duration(float64(d) * (1 + j*(2*mathrand.Float64()-1)))
+	}
+	return d
+}
+
+func (c *Client) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-c.clk.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
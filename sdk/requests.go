@@ -0,0 +1,174 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/protocol"
+)
+
+// DefaultRequestTimeout 等待单个请求响应的默认上限
+const DefaultRequestTimeout = 10 * time.Second
+
+var (
+	// ErrRequestTimeout 超时未收到响应
+	ErrRequestTimeout = errors.New("request timed out")
+	// ErrConnectionLost 收到响应前连接已断开
+	ErrConnectionLost = errors.New("connection lost before response")
+)
+
+// Result 请求的结果：Err 非 nil 表示没有收到响应，否则 OK 与 Error 为服务端的应答
+type Result struct {
+	OK    bool
+	Error string
+	Err   error
+}
+
+// Call 已发出、等待响应的请求
+type Call struct {
+	ID     int
+	Method string
+	Sent   time.Time
+
+	params   any
+	done     chan struct{}
+	result   Result
+	finished time.Time
+	timer    clock.Timer
+}
+
+// Done 收到响应、超时或连接断开时关闭
+func (c *Call) Done() <-chan struct{} { return c.done }
+
+// Result 请求的结果，Done 关闭之前为零值
+func (c *Call) Result() Result {
+	select {
+	case <-c.done:
+		return c.result
+	default:
+		return Result{}
+	}
+}
+
+// Wait 等待请求完成或 ctx 结束
+func (c *Call) Wait(ctx context.Context) (Result, error) {
+	select {
+	case <-c.done:
+		return c.result, nil
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+}
+
+// RequestStats 请求结果计数
+type RequestStats struct {
+	Pending  int
+	Accepted uint64
+	Rejected uint64
+	TimedOut uint64
+	Lost     uint64 // 连接断开时仍在等待的请求
+}
+
+// callTable 按 id 关联请求与响应，每个请求单独计时
+type callTable struct {
+	clk     clock.Clock
+	timeout time.Duration
+	onDone  func(*Call)
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]*Call
+
+	accepted, rejected, timedOut, lost atomic.Uint64
+}
+
+// newCallTable id 从 first 开始分配（认证请求固定使用 1）
+func newCallTable(first int, timeout time.Duration, clk clock.Clock) *callTable {
+	return &callTable{clk: clk, timeout: timeout, nextID: first, pending: make(map[int]*Call)}
+}
+
+// add 分配 id 并登记请求，send 失败时撤销登记
+func (t *callTable) add(method string, params any, send func(id int) error) (*Call, error) {
+	t.mu.Lock()
+	id := t.nextID
+	t.nextID++
+	call := &Call{ID: id, Method: method, Sent: t.clk.Now(), params: params, done: make(chan struct{})}
+	t.pending[id] = call
+	t.mu.Unlock()
+
+	if err := send(id); err != nil {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+		return nil, err
+	}
+	t.mu.Lock()
+	if _, ok := t.pending[id]; ok {
+		call.timer = t.clk.AfterFunc(t.timeout, func() { t.finish(id, Result{Err: ErrRequestTimeout}) })
+	}
+	t.mu.Unlock()
+	return call, nil
+}
+
+// resolve 以响应完成对应的请求，id 未知（已超时或不是本连接发出）时返回 false
+func (t *callTable) resolve(resp protocol.Response) bool {
+	r := Result{OK: resp.Result}
+	if resp.Error != nil {
+		r.Error = *resp.Error
+	}
+	return t.finish(resp.ID, r)
+}
+
+// failAll 连接断开，全部等待中的请求以 ErrConnectionLost 完成
+func (t *callTable) failAll() {
+	t.mu.Lock()
+	ids := make([]int, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	t.mu.Unlock()
+	for _, id := range ids {
+		t.finish(id, Result{Err: ErrConnectionLost})
+	}
+}
+
+func (t *callTable) finish(id int, r Result) bool {
+	t.mu.Lock()
+	call, ok := t.pending[id]
+	delete(t.pending, id)
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if call.timer != nil {
+		call.timer.Stop()
+	}
+	switch {
+	case errors.Is(r.Err, ErrRequestTimeout):
+		t.timedOut.Add(1)
+	case r.Err != nil:
+		t.lost.Add(1)
+	case r.OK:
+		t.accepted.Add(1)
+	default:
+		t.rejected.Add(1)
+	}
+	call.result = r
+	call.finished = t.clk.Now()
+	close(call.done)
+	if t.onDone != nil {
+		t.onDone(call)
+	}
+	return true
+}
+
+func (t *callTable) stats() RequestStats {
+	t.mu.Lock()
+	n := len(t.pending)
+	t.mu.Unlock()
+	return RequestStats{Pending: n, Accepted: t.accepted.Load(), Rejected: t.rejected.Load(), TimedOut: t.timedOut.Load(), Lost: t.lost.Load()}
+}
@@ -0,0 +1,50 @@
+package sdk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/protocol"
+)
+
+func TestCallTable(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	tbl := newCallTable(2, time.Second, clk)
+	var completed []int
+	tbl.onDone = func(c *Call) { completed = append(completed, c.ID) }
+	send := func(int) error { return nil }
+
+	a, _ := tbl.add("submit", nil, send)
+	clk.Advance(500 * time.Millisecond)
+	b, _ := tbl.add("submit", nil, send)
+	if a.ID != 2 || b.ID != 3 {
+		t.Fatalf("unexpected ids %d %d", a.ID, b.ID)
+	}
+	if _, err := tbl.add("submit", nil, func(int) error { return errors.New("closed") }); err == nil {
+		t.Fatal("send error should be returned")
+	}
+	if st := tbl.stats(); st.Pending != 2 {
+		t.Fatalf("failed send should not stay pending: %+v", st)
+	}
+
+	// 每个请求单独计时：a 超时时 b 仍在等待
+	clk.Advance(500 * time.Millisecond)
+	if r := a.Result(); !errors.Is(r.Err, ErrRequestTimeout) {
+		t.Fatalf("expect a to time out, got %+v", r)
+	}
+	if tbl.resolve(protocol.Response{ID: a.ID, Result: true}) {
+		t.Fatal("late response to an expired request should be ignored")
+	}
+	if !tbl.resolve(protocol.Response{ID: b.ID, Result: true}) || !b.Result().OK {
+		t.Fatalf("b should be accepted, got %+v", b.Result())
+	}
+	clk.Advance(time.Second)
+	if st := tbl.stats(); st != (RequestStats{Accepted: 1, TimedOut: 1}) {
+		t.Fatalf("resolved request should not time out later: %+v", st)
+	}
+	if len(completed) != 2 || completed[0] != a.ID || completed[1] != b.ID {
+		t.Fatalf("unexpected completion order %v", completed)
+	}
+}
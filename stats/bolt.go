@@ -0,0 +1,526 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	DefaultBoltRetention     = 7 * 24 * time.Hour
+	DefaultBoltPruneInterval = 10 * time.Minute
+)
+
+var (
+	bucketSubmissions = []byte("submissions")        // username -> minute(unix, 8B) -> count(8B)
+	bucketHourly      = []byte("submissions_hourly") // username -> hour(unix, 8B) -> count(8B)
+	bucketDaily       = []byte("submissions_daily")  // username -> day(unix, 8B) -> count(8B)
+	bucketJobs        = []byte("jobs")               // job_id(8B) -> boltJob
+	bucketUserState   = []byte("user_state")         // username -> boltUserState
+	bucketUsedNonces  = []byte("used_nonces")        // username -> job_id(8B)+client_nonce -> created_at(unix, 8B)
+	bucketBans        = []byte("bans")               // kind+"\x00"+value -> server.Ban
+	bucketMeta        = []byte("meta")
+
+	keyLatestJob = []byte("latest_job_id")
+)
+
+// BoltOptions BoltStore 配置
+type BoltOptions struct {
+	Retention     time.Duration // 任务历史与已用 nonce 的保留时长，0 使用默认值；计数的保留期由 SetRetention 设置
+	PruneInterval time.Duration // 后台清理间隔，0 使用默认值，负数关闭后台清理
+	Clock         clock.Clock   // 后台清理与截止时间使用的时钟，nil 使用真实时钟
+	LockTimeout   time.Duration // 等待其他进程释放文件锁的时长（如热重启时的父进程），0 使用 1 秒
+}
+
+// BoltStore 基于嵌入式 bbolt 文件的 StatsStore/StateStore 实现，适用于不部署 Postgres 的小规模场景。
+// 小时/天计数在写入时同步累加，Rollup 只按各粒度保留期清理
+type BoltStore struct {
+	db        *bolt.DB
+	retention time.Duration
+	levels    server.Retention
+	clk       clock.Clock
+	stop      chan struct{}
+	done      chan struct{}
+	once      sync.Once
+}
+
+type boltJob struct {
+	Nonce     string    `json:"nonce"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type boltUserState struct {
+	LatestJobID       int       `json:"latest_job_id"`
+	LatestServerNonce string    `json:"latest_server_nonce"`
+	LastSubmitAt      time.Time `json:"last_submit_at"`
+}
+
+func NewBoltStore(path string, opts BoltOptions) (*BoltStore, error) {
+	if opts.Retention == 0 {
+		opts.Retention = DefaultBoltRetention
+	}
+	if opts.PruneInterval == 0 {
+		opts.PruneInterval = DefaultBoltPruneInterval
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = time.Second
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: opts.LockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		// 旧版本的文件没有小时/天计数，首次打开时由分钟计数补齐
+		backfill := tx.Bucket(bucketHourly) == nil
+		for _, b := range [][]byte{bucketSubmissions, bucketHourly, bucketDaily, bucketJobs, bucketUserState, bucketUsedNonces, bucketBans, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if !backfill {
+			return nil
+		}
+		subs := tx.Bucket(bucketSubmissions)
+		return subs.ForEachBucket(func(user []byte) error {
+			return subs.Bucket(user).ForEach(func(k, v []byte) error {
+				return addRollups(tx, string(user), keyTime(k), decodeCount(v))
+			})
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	s := &BoltStore{db: db, retention: opts.Retention, levels: server.DefaultRetention(), clk: clock.OrReal(opts.Clock), stop: make(chan struct{}), done: make(chan struct{})}
+	if opts.PruneInterval > 0 {
+		go s.pruneLoop(opts.PruneInterval)
+	} else {
+		close(s.done)
+	}
+	return s, nil
+}
+
+func (s *BoltStore) pruneLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := s.clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C():
+			if err := s.Prune(now); err != nil {
+				logger.WithFields(logger.Fields{"module": "stats.bolt"}).Warnf("prune failed: %v", err)
+			}
+		}
+	}
+}
+
+// Prune 删除早于 now-Retention 的任务历史和已用 nonce；最新任务始终保留。计数由 Rollup 按各粒度保留期清理
+func (s *BoltStore) Prune(now time.Time) error {
+	cutoff := now.Add(-s.retention)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		latest := tx.Bucket(bucketMeta).Get(keyLatestJob)
+		err := deleteWhere(tx.Bucket(bucketJobs), func(k, v []byte) bool {
+			var j boltJob
+			return json.Unmarshal(v, &j) == nil && j.CreatedAt.Before(cutoff) && !bytes.Equal(k, latest)
+		})
+		if err != nil {
+			return err
+		}
+		return pruneUserBuckets(tx.Bucket(bucketUsedNonces), func(_, v []byte) bool { return int64(decodeCount(v)) < cutoff.Unix() })
+	})
+}
+
+func (s *BoltStore) Increment(username string, minute time.Time) error {
+	return s.IncrementBy(username, minute, 1)
+}
+
+func (s *BoltStore) IncrementBy(username string, minute time.Time, n int) error {
+	return s.BatchIncrement([]server.StatDelta{{Username: username, Minute: minute, Count: n}})
+}
+
+// BatchIncrement 在一个写事务内累加整批增量，同时累加小时/天计数
+func (s *BoltStore) BatchIncrement(deltas []server.StatDelta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range deltas {
+			if err := addCount(tx.Bucket(bucketSubmissions), d.Username, minuteKey(d.Minute), d.Count); err != nil {
+				return err
+			}
+			if err := addRollups(tx, d.Username, d.Minute, d.Count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func addRollups(tx *bolt.Tx, username string, minute time.Time, n int) error {
+	if err := addCount(tx.Bucket(bucketHourly), username, timeKey(server.GranularityHour.Truncate(minute)), n); err != nil {
+		return err
+	}
+	return addCount(tx.Bucket(bucketDaily), username, timeKey(server.GranularityDay.Truncate(minute)), n)
+}
+
+func addCount(root *bolt.Bucket, username string, k []byte, n int) error {
+	ub, err := root.CreateBucketIfNotExists([]byte(username))
+	if err != nil {
+		return err
+	}
+	return ub.Put(k, encodeCount(decodeCount(ub.Get(k))+n))
+}
+
+// SetRetention 设置分钟/小时/天计数的保留时长，由 Rollup 执行
+func (s *BoltStore) SetRetention(r server.Retention) { s.levels = r }
+
+// Rollup 小时/天在写入时已同步累加，这里只按各粒度保留期清理过期计数
+func (s *BoltStore) Rollup(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, g := range []server.Granularity{server.GranularityMinute, server.GranularityHour, server.GranularityDay} {
+			keep := s.levels.Of(g)
+			if keep <= 0 {
+				continue
+			}
+			limit := timeKey(now.Add(-keep))
+			if err := pruneUserBuckets(tx.Bucket(granularityBucket(g)), func(k, _ []byte) bool { return bytes.Compare(k, limit) < 0 }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func granularityBucket(g server.Granularity) []byte {
+	switch g {
+	case server.GranularityHour:
+		return bucketHourly
+	case server.GranularityDay:
+		return bucketDaily
+	default:
+		return bucketSubmissions
+	}
+}
+
+// PickGranularity 按保留期与范围大小选择粒度
+func (s *BoltStore) PickGranularity(startTime, endTime time.Time) server.Granularity {
+	return s.levels.Pick(startTime, endTime, s.clk.Now())
+}
+
+// scan 按时间顺序遍历 [startTime, endTime] 内指定粒度的计数，username 为空时遍历全部用户
+func (s *BoltStore) scan(username string, startTime, endTime time.Time, g server.Granularity, fn func(username string, t time.Time, n int)) error {
+	if g == "" {
+		g = s.PickGranularity(startTime, endTime)
+	}
+	from, to := timeKey(g.Ceil(startTime)), timeKey(endTime)
+	return s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(granularityBucket(g))
+		each := func(user []byte) error {
+			ub := root.Bucket(user)
+			if ub == nil {
+				return nil
+			}
+			c := ub.Cursor()
+			for k, v := c.Seek(from); k != nil && bytes.Compare(k, to) <= 0; k, v = c.Next() {
+				fn(string(user), keyTime(k), decodeCount(v))
+			}
+			return nil
+		}
+		if username != "" {
+			return each([]byte(username))
+		}
+		return root.ForEachBucket(each)
+	})
+}
+
+// GetUserSubmissionsByTimeRange 获取用户在指定时间范围内按粒度聚合的提交计数
+func (s *BoltStore) GetUserSubmissionsByTimeRange(username string, startTime, endTime time.Time, g server.Granularity) (map[time.Time]int, error) {
+	out := make(map[time.Time]int)
+	err := s.scan(username, startTime, endTime, g, func(_ string, t time.Time, n int) { out[t] = n })
+	return out, err
+}
+
+// GetTopUsersBySubmissions 获取指定时间范围内提交次数最多的用户，总数相同时按用户名排序
+func (s *BoltStore) GetTopUsersBySubmissions(startTime, endTime time.Time, limit int, g server.Granularity) ([]server.UserTotal, error) {
+	totals := make(map[string]int)
+	if err := s.scan("", startTime, endTime, g, func(u string, _ time.Time, n int) { totals[u] += n }); err != nil {
+		return nil, err
+	}
+	out := make([]server.UserTotal, 0, len(totals))
+	for u, n := range totals {
+		out = append(out, server.UserTotal{Username: u, Total: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Total != out[j].Total {
+			return out[i].Total > out[j].Total
+		}
+		return out[i].Username < out[j].Username
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// GetTotalSubmissions 获取指定时间范围内的总提交次数
+func (s *BoltStore) GetTotalSubmissions(startTime, endTime time.Time, g server.Granularity) (int, error) {
+	total := 0
+	err := s.scan("", startTime, endTime, g, func(_ string, _ time.Time, n int) { total += n })
+	return total, err
+}
+
+func (s *BoltStore) Get(username string, minute time.Time) (int, error) {
+	cnt := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(bucketSubmissions).Bucket([]byte(username))
+		if ub != nil {
+			cnt = decodeCount(ub.Get(minuteKey(minute)))
+		}
+		return nil
+	})
+	return cnt, err
+}
+
+func (s *BoltStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+	return s.db.Close()
+}
+
+// StateStore impl
+func (s *BoltStore) SaveJob(jobID int, nonce string, createdAt time.Time) error {
+	v, err := json.Marshal(boltJob{Nonce: nonce, CreatedAt: createdAt})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		k := intKey(jobID)
+		if err := tx.Bucket(bucketJobs).Put(k, v); err != nil {
+			return err
+		}
+		meta := tx.Bucket(bucketMeta)
+		if decodeCount(meta.Get(keyLatestJob)) <= jobID {
+			return meta.Put(keyLatestJob, k)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) LoadJob(jobID int) (server.JobRecord, bool, error) {
+	var (
+		job boltJob
+		ok  bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketJobs).Get(intKey(jobID))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &job)
+	})
+	if err != nil || !ok {
+		return server.JobRecord{}, false, err
+	}
+	return server.JobRecord{Nonce: job.Nonce, CreatedAt: job.CreatedAt}, true, nil
+}
+
+func (s *BoltStore) LoadLatestJob() (int, string, time.Time, error) {
+	var (
+		id  int
+		job boltJob
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := tx.Bucket(bucketMeta).Get(keyLatestJob)
+		if k == nil {
+			return nil
+		}
+		v := tx.Bucket(bucketJobs).Get(k)
+		if v == nil {
+			return nil
+		}
+		id = decodeCount(k)
+		return json.Unmarshal(v, &job)
+	})
+	return id, job.Nonce, job.CreatedAt, err
+}
+
+func (s *BoltStore) LoadJobHistory(since time.Duration) (map[int]server.JobRecord, error) {
+	out := make(map[int]server.JobRecord)
+	cutoff := s.clk.Now().Add(-since)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobs).ForEach(func(k, v []byte) error {
+			var j boltJob
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if since == 0 || j.CreatedAt.After(cutoff) {
+				out[decodeCount(k)] = server.JobRecord{Nonce: j.Nonce, CreatedAt: j.CreatedAt}
+			}
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *BoltStore) LoadUserState(username string) (int, string, time.Time, error) {
+	var st boltUserState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketUserState).Get([]byte(username))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, &st)
+	})
+	return st.LatestJobID, st.LatestServerNonce, st.LastSubmitAt, err
+}
+
+func (s *BoltStore) SaveUserState(username string, latestJobID int, latestServerNonce string, lastSubmitAt time.Time) error {
+	v, err := json.Marshal(boltUserState{LatestJobID: latestJobID, LatestServerNonce: latestServerNonce, LastSubmitAt: lastSubmitAt})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUserState).Put([]byte(username), v)
+	})
+}
+
+func (s *BoltStore) SaveUsedNonce(username string, jobID int, clientNonce string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ub, err := tx.Bucket(bucketUsedNonces).CreateBucketIfNotExists([]byte(username))
+		if err != nil {
+			return err
+		}
+		return ub.Put(nonceKey(jobID, clientNonce), encodeCount(int(s.clk.Now().Unix())))
+	})
+}
+
+func (s *BoltStore) HasUsedNonce(username string, jobID int, clientNonce string) (bool, error) {
+	ok := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(bucketUsedNonces).Bucket([]byte(username))
+		ok = ub != nil && ub.Get(nonceKey(jobID, clientNonce)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+func (s *BoltStore) SaveBan(b server.Ban) error {
+	v, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Put([]byte(banKey(b.Kind, b.Value)), v)
+	})
+}
+
+func (s *BoltStore) DeleteBan(kind server.BanKind, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Delete([]byte(banKey(kind, value)))
+	})
+}
+
+func (s *BoltStore) LoadBans() ([]server.Ban, error) {
+	var out []server.Ban
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).ForEach(func(_, v []byte) error {
+			var b server.Ban
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			out = append(out, b)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// deleteWhere 先收集再删除，避免边遍历边删除导致游标跳过元素
+func deleteWhere(b *bolt.Bucket, match func(k, v []byte) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil && match(k, v) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneUserBuckets 在 root 下每个用户的子 bucket 中删除匹配的记录，删空的子 bucket 一并删除，
+// 避免为出现过的每个用户名永久保留一个空 bucket
+func pruneUserBuckets(root *bolt.Bucket, match func(k, v []byte) bool) error {
+	var users [][]byte
+	err := root.ForEachBucket(func(k []byte) error {
+		users = append(users, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		ub := root.Bucket(user)
+		if err = deleteWhere(ub, match); err != nil {
+			return err
+		}
+		if k, _ := ub.Cursor().First(); k == nil {
+			if err = root.DeleteBucket(user); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// minuteKey 以大端 unix 秒作为 key，保证按时间有序，便于范围扫描与清理
+func minuteKey(t time.Time) []byte {
+	return timeKey(t.Truncate(time.Minute))
+}
+
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+	return b
+}
+
+func keyTime(k []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(k)), 0).UTC()
+}
+
+func intKey(v int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func nonceKey(jobID int, clientNonce string) []byte {
+	return append(intKey(jobID), clientNonce...)
+}
+
+func encodeCount(v int) []byte { return intKey(v) }
+
+func decodeCount(b []byte) int {
+	if len(b) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(b))
+}
@@ -0,0 +1,269 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	serverpkg "github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStore(t *testing.T, path string) *BoltStore {
+	t.Helper()
+	s, err := NewBoltStore(path, BoltOptions{Retention: time.Hour, PruneInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBoltStoreCountersPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kupool.db")
+	s := newTestBoltStore(t, path)
+	now := time.Now().Truncate(time.Minute)
+	_ = s.Increment("u", now)
+	_ = s.Increment("u", now.Add(10*time.Second))
+	_ = s.BatchIncrement([]serverpkg.StatDelta{{Username: "u", Minute: now, Count: 3}, {Username: "v", Minute: now, Count: 1}})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestBoltStore(t, path)
+	defer s.Close()
+	if v, _ := s.Get("u", now); v != 5 {
+		t.Fatalf("expect 5 after reopen, got %d", v)
+	}
+	if v, _ := s.Get("v", now); v != 1 {
+		t.Fatalf("expect 1, got %d", v)
+	}
+	if v, _ := s.Get("u", now.Add(time.Minute)); v != 0 {
+		t.Fatal("next minute should be 0")
+	}
+}
+
+func TestBoltStoreState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kupool.db")
+	s := newTestBoltStore(t, path)
+	t1 := time.Now().Add(-2 * time.Hour)
+	t2 := time.Now().Add(-time.Minute)
+	_ = s.SaveJob(1, "nonce1", t1)
+	_ = s.SaveJob(2, "nonce2", t2)
+	_ = s.SaveUserState("u", 2, "nonce2", t2)
+	_ = s.SaveUsedNonce("u", 2, "abc")
+	_ = s.Close()
+
+	s = newTestBoltStore(t, path)
+	defer s.Close()
+	id, nonce, created, err := s.LoadLatestJob()
+	if err != nil || id != 2 || nonce != "nonce2" || !created.Equal(t2) {
+		t.Fatalf("latest job mismatch: %d %s %v", id, nonce, err)
+	}
+	if rec, ok, _ := s.LoadJob(1); !ok || rec.Nonce != "nonce1" {
+		t.Fatal("load job by id mismatch")
+	}
+	hist, _ := s.LoadJobHistory(90 * time.Minute)
+	if len(hist) != 1 || hist[2].Nonce != "nonce2" {
+		t.Fatal("history cutoff mismatch")
+	}
+	jid, jn, last, _ := s.LoadUserState("u")
+	if jid != 2 || jn != "nonce2" || !last.Equal(t2) {
+		t.Fatal("user state mismatch")
+	}
+	if ok, _ := s.HasUsedNonce("u", 2, "abc"); !ok {
+		t.Fatal("used nonce lost")
+	}
+	if ok, _ := s.HasUsedNonce("u", 1, "abc"); ok {
+		t.Fatal("nonce is scoped by job")
+	}
+}
+
+func TestBoltStorePrune(t *testing.T) {
+	s := newTestBoltStore(t, filepath.Join(t.TempDir(), "kupool.db"))
+	defer s.Close()
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	_ = s.Increment("u", old)
+	_ = s.Increment("u", now)
+	_ = s.SaveJob(1, "n1", old)
+	_ = s.SaveJob(2, "n2", old.Add(time.Minute))
+	_ = s.SaveUsedNonce("u", 1, "x")
+
+	if err := s.Prune(now); err != nil {
+		t.Fatal(err)
+	}
+	// 计数只由 Rollup 按 SetRetention 清理
+	if v, _ := s.Get("u", old); v != 1 {
+		t.Fatal("Prune must not touch counters")
+	}
+	hist, _ := s.LoadJobHistory(0)
+	if _, ok := hist[1]; ok {
+		t.Fatal("old job not pruned")
+	}
+	if _, ok := hist[2]; !ok {
+		t.Fatal("latest job must be kept")
+	}
+	// used nonce 在写入时打时间戳，用未来时间触发清理
+	if err := s.Prune(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.HasUsedNonce("u", 1, "x"); ok {
+		t.Fatal("used nonce not pruned")
+	}
+	if hasUserBucket(t, s, bucketUsedNonces, "u") {
+		t.Fatal("emptied used nonce bucket should be deleted")
+	}
+}
+
+func hasUserBucket(t *testing.T, s *BoltStore, root []byte, username string) bool {
+	t.Helper()
+	ok := false
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(root).Bucket([]byte(username)) != nil
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// TestBoltStorePruneLoop 后台清理由注入的时钟驱动
+func TestBoltStorePruneLoop(t *testing.T) {
+	clk := clock.NewFake(time.Time{})
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "kupool.db"), BoltOptions{Retention: time.Hour, PruneInterval: 70 * time.Minute, Clock: clk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_ = s.SaveUsedNonce("u", 1, "x")
+	clk.BlockUntil(1)
+	clk.Advance(70 * time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if ok, _ := s.HasUsedNonce("u", 1, "x"); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("used nonce older than retention not pruned by the background loop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestBoltStoreBansSurviveRestart 自动封禁写入 bolt，重启后由新的 BanManager 恢复
+func TestBoltStoreBansSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kupool.db")
+	s := newTestBoltStore(t, path)
+	policy := serverpkg.BanPolicy{Enabled: true, Window: time.Minute, MinRejects: 3, MaxRejectRatio: 0.5, BaseDuration: time.Hour, MaxDuration: 4 * time.Hour, ForgiveAfter: time.Hour}
+	m := serverpkg.NewBanManager(policy, s)
+	now := time.Now()
+	sess := &serverpkg.Session{ChannelID: "c1", Username: "cheater", RemoteIP: "10.0.0.9"}
+	for i := 0; i < 3; i++ {
+		m.Record(sess, true, "Invalid result", now)
+	}
+	if _, banned := m.Check("cheater", "", now); !banned {
+		t.Fatal("expect account ban")
+	}
+	_ = s.Close()
+
+	s = newTestBoltStore(t, path)
+	defer s.Close()
+	m = serverpkg.NewBanManager(policy, s)
+	if err := m.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, banned := m.Check("", "10.0.0.9", now); !banned {
+		t.Fatal("ip ban lost after restart")
+	}
+	if ok, err := m.Lift(serverpkg.BanIP, "10.0.0.9"); !ok || err != nil {
+		t.Fatalf("lift: %v %v", ok, err)
+	}
+	bans, _ := s.LoadBans()
+	if len(bans) != 1 || bans[0].Kind != serverpkg.BanAccount {
+		t.Fatalf("expect only the account ban left, got %+v", bans)
+	}
+}
+
+func TestBoltStoreQueryAndRollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kupool.db")
+	s, err := NewBoltStore(path, BoltOptions{Retention: 30 * 24 * time.Hour, PruneInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetRetention(serverpkg.Retention{Minute: time.Hour, Hour: 48 * time.Hour})
+	now := time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC)
+	old := now.Add(-3 * time.Hour)
+	_ = s.IncrementBy("u", old, 2)
+	_ = s.IncrementBy("u", old.Add(time.Minute), 3)
+	_ = s.IncrementBy("u", now, 1)
+	_ = s.IncrementBy("v", now, 4)
+
+	if n, _ := s.GetTotalSubmissions(old, now, serverpkg.GranularityMinute); n != 10 {
+		t.Fatalf("expect total 10, got %d", n)
+	}
+	// 粗粒度查询从 start 之后的第一个完整桶开始，这里从整点/零点查询
+	hourStart, dayStart := old.Truncate(time.Hour), now.Truncate(24*time.Hour)
+	hours, _ := s.GetUserSubmissionsByTimeRange("u", hourStart, now, serverpkg.GranularityHour)
+	if hours[old.Truncate(time.Hour)] != 5 || hours[now.Truncate(time.Hour)] != 1 {
+		t.Fatalf("hourly buckets mismatch: %v", hours)
+	}
+	top, _ := s.GetTopUsersBySubmissions(dayStart, now, 1, serverpkg.GranularityDay)
+	if len(top) != 1 || top[0].Username != "u" || top[0].Total != 6 {
+		t.Fatalf("top users mismatch: %v", top)
+	}
+
+	if err = s.Rollup(now); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("u", old); v != 0 {
+		t.Fatal("expired minute should be pruned")
+	}
+	if n, _ := s.GetTotalSubmissions(hourStart, now, serverpkg.GranularityHour); n != 10 {
+		t.Fatalf("hourly counts should survive minute retention, got %d", n)
+	}
+	// 一周后只剩天粒度
+	if err = s.Rollup(now.Add(7 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.GetTotalSubmissions(hourStart, now, serverpkg.GranularityHour); n != 0 {
+		t.Fatalf("hourly counts should be pruned, got %d", n)
+	}
+	if hasUserBucket(t, s, bucketSubmissions, "u") || hasUserBucket(t, s, bucketHourly, "v") {
+		t.Fatal("emptied per-user buckets should be deleted")
+	}
+	if n, _ := s.GetTotalSubmissions(dayStart, now, serverpkg.GranularityDay); n != 10 {
+		t.Fatalf("expect daily total 10, got %d", n)
+	}
+}
+
+// TestBoltStoreQuerySkipsPartialBucket start 落在小时中间时，该小时内 start 之前的提交不计入
+func TestBoltStoreQuerySkipsPartialBucket(t *testing.T) {
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "kupool.db"), BoltOptions{PruneInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	start := time.Date(2025, 6, 1, 10, 59, 0, 0, time.UTC)
+	_ = s.IncrementBy("u", start.Add(-30*time.Minute), 5)
+	_ = s.IncrementBy("u", start.Add(-time.Minute), 2)
+	_ = s.IncrementBy("u", start, 1)
+	_ = s.IncrementBy("u", start.Add(2*time.Minute), 3)
+	end := start.Add(time.Hour)
+
+	if n, _ := s.GetTotalSubmissions(start, end, serverpkg.GranularityMinute); n != 4 {
+		t.Fatalf("minute total should start at %s, got %d", start, n)
+	}
+	// 10:00 的小时桶只有一部分在范围内，整桶不计入
+	if n, _ := s.GetTotalSubmissions(start, end, serverpkg.GranularityHour); n != 3 {
+		t.Fatalf("partial leading hour must not be counted, got %d", n)
+	}
+	hours, _ := s.GetUserSubmissionsByTimeRange("u", start, end, serverpkg.GranularityHour)
+	if len(hours) != 1 || hours[start.Truncate(time.Hour).Add(time.Hour)] != 3 {
+		t.Fatalf("expect only the 11:00 bucket, got %v", hours)
+	}
+	if top, _ := s.GetTopUsersBySubmissions(start, end, 1, serverpkg.GranularityHour); len(top) != 1 || top[0].Total != 3 {
+		t.Fatalf("top users mismatch: %v", top)
+	}
+}
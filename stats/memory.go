@@ -1,15 +1,21 @@
 package stats
 
 import (
+	"sort"
 	"sync"
 	"time"
 
 	serverpkg "github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
 )
 
 type MemoryStore struct {
 	mu          sync.Mutex
-	data        map[string]map[time.Time]int
+	data        map[string]map[time.Time]int // 分钟粒度
+	hours       map[string]map[time.Time]int
+	days        map[string]map[time.Time]int
+	retention   serverpkg.Retention
+	clk         clock.Clock
 	jobHist     map[int]serverpkg.JobRecord
 	latestJobID int
 	latestNonce string
@@ -19,29 +25,172 @@ type MemoryStore struct {
 		lastSubmit  time.Time
 	}
 	used map[string]map[int]map[string]struct{}
+	bans map[string]serverpkg.Ban
 }
 
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{data: make(map[string]map[time.Time]int), jobHist: make(map[int]serverpkg.JobRecord), userStates: make(map[string]struct {
+	return &MemoryStore{data: make(map[string]map[time.Time]int), hours: make(map[string]map[time.Time]int), days: make(map[string]map[time.Time]int), retention: serverpkg.DefaultRetention(), clk: clock.Real(), jobHist: make(map[int]serverpkg.JobRecord), userStates: make(map[string]struct {
 		latestJobID int
 		latestNonce string
 		lastSubmit  time.Time
-	}), used: make(map[string]map[int]map[string]struct{})}
+	}), used: make(map[string]map[int]map[string]struct{}), bans: make(map[string]serverpkg.Ban)}
 }
 
 func (s *MemoryStore) Increment(username string, minute time.Time) error {
+	return s.IncrementBy(username, minute, 1)
+}
+
+func (s *MemoryStore) IncrementBy(username string, minute time.Time, n int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	m := minute.Truncate(time.Minute)
-	u, ok := s.data[username]
+	s.incrementLocked(username, minute, n)
+	return nil
+}
+
+// BatchIncrement 在一次加锁内写入整批增量
+func (s *MemoryStore) BatchIncrement(deltas []serverpkg.StatDelta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deltas {
+		s.incrementLocked(d.Username, d.Minute, d.Count)
+	}
+	return nil
+}
+
+// incrementLocked 同时累加分钟、小时、天三个粒度，小时/天无需额外的汇总步骤
+func (s *MemoryStore) incrementLocked(username string, minute time.Time, n int) {
+	addBucket(s.data, username, serverpkg.GranularityMinute.Truncate(minute), n)
+	addBucket(s.hours, username, serverpkg.GranularityHour.Truncate(minute), n)
+	addBucket(s.days, username, serverpkg.GranularityDay.Truncate(minute), n)
+}
+
+func addBucket(m map[string]map[time.Time]int, username string, bucket time.Time, n int) {
+	u, ok := m[username]
 	if !ok {
 		u = make(map[time.Time]int)
-		s.data[username] = u
+		m[username] = u
 	}
-	u[m] = u[m] + 1
+	u[bucket] = u[bucket] + n
+}
+
+// SetRetention 设置各粒度的保留时长
+func (s *MemoryStore) SetRetention(r serverpkg.Retention) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention = r
+}
+
+// Rollup 小时/天在写入时已同步累加，这里只按各粒度保留期清理过期桶，使内存占用有界
+func (s *MemoryStore) Rollup(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruneBuckets(s.data, s.retention.Minute, now)
+	pruneBuckets(s.hours, s.retention.Hour, now)
+	pruneBuckets(s.days, s.retention.Day, now)
 	return nil
 }
 
+func pruneBuckets(m map[string]map[time.Time]int, keep time.Duration, now time.Time) {
+	if keep <= 0 {
+		return
+	}
+	cutoff := now.Add(-keep)
+	for username, u := range m {
+		for t := range u {
+			if t.Before(cutoff) {
+				delete(u, t)
+			}
+		}
+		if len(u) == 0 {
+			delete(m, username)
+		}
+	}
+}
+
+func (s *MemoryStore) buckets(g serverpkg.Granularity) map[string]map[time.Time]int {
+	switch g {
+	case serverpkg.GranularityHour:
+		return s.hours
+	case serverpkg.GranularityDay:
+		return s.days
+	default:
+		return s.data
+	}
+}
+
+// SetClock 设置粒度选择与任务历史截止时间使用的时钟（默认真实时钟）
+func (s *MemoryStore) SetClock(clk clock.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clk = clock.OrReal(clk)
+}
+
+// PickGranularity 按保留期与范围大小选择粒度
+func (s *MemoryStore) PickGranularity(startTime, endTime time.Time) serverpkg.Granularity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retention.Pick(startTime, endTime, s.clk.Now())
+}
+
+// forEachBucket 遍历 [startTime, endTime] 内指定粒度的桶，调用方需持有锁
+func (s *MemoryStore) forEachBucket(startTime, endTime time.Time, g serverpkg.Granularity, fn func(username string, t time.Time, n int)) {
+	if g == "" {
+		g = s.retention.Pick(startTime, endTime, s.clk.Now())
+	}
+	from := g.Ceil(startTime)
+	for username, u := range s.buckets(g) {
+		for t, n := range u {
+			if !t.Before(from) && !t.After(endTime) {
+				fn(username, t, n)
+			}
+		}
+	}
+}
+
+// GetUserSubmissionsByTimeRange 获取用户在指定时间范围内按粒度聚合的提交计数
+func (s *MemoryStore) GetUserSubmissionsByTimeRange(username string, startTime, endTime time.Time, g serverpkg.Granularity) (map[time.Time]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[time.Time]int)
+	s.forEachBucket(startTime, endTime, g, func(u string, t time.Time, n int) {
+		if u == username {
+			out[t] = n
+		}
+	})
+	return out, nil
+}
+
+// GetTopUsersBySubmissions 获取指定时间范围内提交次数最多的用户，总数相同时按用户名排序
+func (s *MemoryStore) GetTopUsersBySubmissions(startTime, endTime time.Time, limit int, g serverpkg.Granularity) ([]serverpkg.UserTotal, error) {
+	s.mu.Lock()
+	totals := make(map[string]int)
+	s.forEachBucket(startTime, endTime, g, func(u string, _ time.Time, n int) { totals[u] += n })
+	s.mu.Unlock()
+	out := make([]serverpkg.UserTotal, 0, len(totals))
+	for u, n := range totals {
+		out = append(out, serverpkg.UserTotal{Username: u, Total: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Total != out[j].Total {
+			return out[i].Total > out[j].Total
+		}
+		return out[i].Username < out[j].Username
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// GetTotalSubmissions 获取指定时间范围内的总提交次数
+func (s *MemoryStore) GetTotalSubmissions(startTime, endTime time.Time, g serverpkg.Granularity) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	s.forEachBucket(startTime, endTime, g, func(_ string, _ time.Time, n int) { total += n })
+	return total, nil
+}
+
 func (s *MemoryStore) Get(username string, minute time.Time) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -72,11 +221,18 @@ func (s *MemoryStore) LoadLatestJob() (int, string, time.Time, error) {
 	return s.latestJobID, rec.Nonce, rec.CreatedAt, nil
 }
 
+func (s *MemoryStore) LoadJob(jobID int) (serverpkg.JobRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.jobHist[jobID]
+	return rec, ok, nil
+}
+
 func (s *MemoryStore) LoadJobHistory(since time.Duration) (map[int]serverpkg.JobRecord, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	out := make(map[int]serverpkg.JobRecord)
-	cutoff := time.Now().Add(-since)
+	cutoff := s.clk.Now().Add(-since)
 	for id, rec := range s.jobHist {
 		if since == 0 || rec.CreatedAt.After(cutoff) {
 			out[id] = rec
@@ -120,6 +276,28 @@ func (s *MemoryStore) SaveUsedNonce(username string, jobID int, clientNonce stri
 	return nil
 }
 
+// EvictJobsBefore 丢弃任务号小于 minJobID 的任务与已用 nonce，最新任务始终保留；
+// 由 Coordinator 在任务离开历史窗口时调用，使内存占用随轮换保持有界
+func (s *MemoryStore) EvictJobsBefore(minJobID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.jobHist {
+		if id < minJobID && id != s.latestJobID {
+			delete(s.jobHist, id)
+		}
+	}
+	for username, u := range s.used {
+		for id := range u {
+			if id < minJobID {
+				delete(u, id)
+			}
+		}
+		if len(u) == 0 {
+			delete(s.used, username)
+		}
+	}
+}
+
 func (s *MemoryStore) HasUsedNonce(username string, jobID int, clientNonce string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -128,3 +306,29 @@ func (s *MemoryStore) HasUsedNonce(username string, jobID int, clientNonce strin
 	_, ok := m[clientNonce]
 	return ok, nil
 }
+
+func banKey(kind serverpkg.BanKind, value string) string { return string(kind) + "\x00" + value }
+
+func (s *MemoryStore) SaveBan(b serverpkg.Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[banKey(b.Kind, b.Value)] = b
+	return nil
+}
+
+func (s *MemoryStore) DeleteBan(kind serverpkg.BanKind, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.bans, banKey(kind, value))
+	return nil
+}
+
+func (s *MemoryStore) LoadBans() ([]serverpkg.Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]serverpkg.Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		out = append(out, b)
+	}
+	return out, nil
+}
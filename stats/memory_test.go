@@ -3,6 +3,9 @@ package stats
 import (
 	"testing"
 	"time"
+
+	serverpkg "github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
 )
 
 func TestMemoryStoreIncrementGet(t *testing.T) {
@@ -22,9 +25,11 @@ func TestMemoryStoreIncrementGet(t *testing.T) {
 
 func TestMemoryStoreJobHistoryNonce(t *testing.T) {
 	s := NewMemoryStore()
+	clk := clock.NewFake(time.Time{})
+	s.SetClock(clk)
 	// save two jobs with different nonce
-	t1 := time.Now().Add(-2 * time.Hour)
-	t2 := time.Now().Add(-1 * time.Hour)
+	t1 := clk.Now().Add(-2 * time.Hour)
+	t2 := clk.Now().Add(-1 * time.Hour)
 	_ = s.SaveJob(1, "nonce1", t1)
 	_ = s.SaveJob(2, "nonce2", t2)
 	// latest
@@ -32,6 +37,12 @@ func TestMemoryStoreJobHistoryNonce(t *testing.T) {
 	if id != 2 || nonce != "nonce2" || !created.Equal(t2) {
 		t.Fatal("latest job mismatch")
 	}
+	if rec, ok, _ := s.LoadJob(1); !ok || rec.Nonce != "nonce1" {
+		t.Fatal("load job by id mismatch")
+	}
+	if _, ok, _ := s.LoadJob(3); ok {
+		t.Fatal("unknown job should not be found")
+	}
 	// history within 3h should include both with their own nonce
 	hist, _ := s.LoadJobHistory(3 * time.Hour)
 	if len(hist) != 2 {
@@ -48,4 +59,110 @@ func TestMemoryStoreJobHistoryNonce(t *testing.T) {
 	if len(hist2) != 1 || hist2[2].Nonce != "nonce2" {
 		t.Fatal("cutoff mismatch")
 	}
+	// 时间推进后 job 2 也超出 90m
+	clk.Advance(time.Hour)
+	if hist3, _ := s.LoadJobHistory(90 * time.Minute); len(hist3) != 0 {
+		t.Fatal("cutoff should follow the clock")
+	}
+}
+
+func TestMemoryStoreBatchIncrement(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	err := s.BatchIncrement([]serverpkg.StatDelta{
+		{Username: "u", Minute: now, Count: 3},
+		{Username: "u", Minute: now.Add(time.Minute), Count: 1},
+		{Username: "v", Minute: now, Count: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.IncrementBy("u", now, 2)
+	if v, _ := s.Get("u", now); v != 5 {
+		t.Fatalf("expect 5, got %d", v)
+	}
+	if v, _ := s.Get("u", now.Add(time.Minute)); v != 1 {
+		t.Fatalf("expect 1, got %d", v)
+	}
+	if v, _ := s.Get("v", now); v != 2 {
+		t.Fatalf("expect 2, got %d", v)
+	}
+}
+
+func TestMemoryStoreRollupRetention(t *testing.T) {
+	s := NewMemoryStore()
+	s.SetRetention(serverpkg.Retention{Minute: time.Hour, Hour: 48 * time.Hour})
+	now := time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC)
+	old := now.Add(-3 * time.Hour)
+	_ = s.IncrementBy("u", old, 2)
+	_ = s.IncrementBy("u", old.Add(time.Minute), 3)
+	_ = s.IncrementBy("u", now, 1)
+
+	if err := s.Rollup(now); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("u", old); v != 0 {
+		t.Fatal("expired minute should be pruned")
+	}
+	if len(s.data["u"]) != 1 {
+		t.Fatalf("expect 1 minute bucket left, got %d", len(s.data["u"]))
+	}
+	if s.hours["u"][old.Truncate(time.Hour)] != 5 {
+		t.Fatal("hourly rollup mismatch")
+	}
+	if s.days["u"][now.Truncate(24*time.Hour)] != 6 {
+		t.Fatal("daily rollup mismatch")
+	}
+
+	// 一周后只剩天粒度
+	if err := s.Rollup(now.Add(7 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.data) != 0 || len(s.hours) != 0 || len(s.days["u"]) != 1 {
+		t.Fatal("retention not applied")
+	}
+}
+
+func TestMemoryStoreRangePicksGranularity(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now().Truncate(time.Minute)
+	_ = s.Increment("u", now.Add(-2*time.Minute))
+	_ = s.Increment("u", now.Add(-time.Minute))
+	minutes, _ := s.GetUserSubmissionsByTimeRange("u", now.Add(-5*time.Minute), now, "")
+	if len(minutes) != 2 {
+		t.Fatalf("expect 2 minute buckets, got %d", len(minutes))
+	}
+	// 跨度超过分钟粒度的点数上限时按小时返回
+	hours, _ := s.GetUserSubmissionsByTimeRange("u", now.Add(-30*time.Hour), now, "")
+	total := 0
+	for ts, n := range hours {
+		if !ts.Equal(ts.Truncate(time.Hour)) {
+			t.Fatal("expect hourly buckets")
+		}
+		total += n
+	}
+	if total != 2 {
+		t.Fatalf("expect total 2, got %d", total)
+	}
+}
+
+// TestMemoryStoreQuerySkipsPartialBucket start 落在小时中间时，该小时内 start 之前的提交不计入
+func TestMemoryStoreQuerySkipsPartialBucket(t *testing.T) {
+	s := NewMemoryStore()
+	start := time.Date(2025, 6, 1, 10, 59, 0, 0, time.UTC)
+	_ = s.IncrementBy("u", start.Add(-30*time.Minute), 5)
+	_ = s.IncrementBy("u", start.Add(-time.Minute), 2)
+	_ = s.IncrementBy("u", start, 1)
+	_ = s.IncrementBy("u", start.Add(2*time.Minute), 3)
+	end := start.Add(time.Hour)
+
+	if n, _ := s.GetTotalSubmissions(start, end, serverpkg.GranularityMinute); n != 4 {
+		t.Fatalf("minute total should start at %s, got %d", start, n)
+	}
+	if n, _ := s.GetTotalSubmissions(start, end, serverpkg.GranularityHour); n != 3 {
+		t.Fatalf("partial leading hour must not be counted, got %d", n)
+	}
+	if top, _ := s.GetTopUsersBySubmissions(start.Add(30*time.Second), end, 1, serverpkg.GranularityMinute); len(top) != 1 || top[0].Total != 3 {
+		t.Fatalf("partial leading minute must not be counted, got %v", top)
+	}
 }
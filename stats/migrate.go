@@ -0,0 +1,209 @@
+package stats
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JellyTony/kupool/logger"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// migrationLockID 迁移时使用的 advisory lock，避免多个节点同时启动时重复执行
+const migrationLockID = 0x6b75706f6f6c // "kupool"
+
+// Migration 一个编号的 up/down 迁移，文件名形如 0001_init.up.sql / 0001_init.down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations 返回按版本排序的全部迁移
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		var dir string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			dir = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			dir = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(name, "."+dir+".sql")
+		num, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		v, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s", name)
+		}
+		body, err := fs.ReadFile(migrationFS, "migrations/"+name)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[v]
+		if m == nil {
+			m = &Migration{Version: v, Name: label}
+			byVersion[v] = m
+		}
+		if dir == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both up and down files", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	for i, m := range out {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be contiguous from 1, got %d at position %d", m.Version, i+1)
+		}
+	}
+	return out, nil
+}
+
+// Migrator 基于 schema_version 表管理 PGStore 的版本化迁移
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	ms, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`).Error
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: ms}, nil
+}
+
+// Latest 返回代码中最新的迁移版本
+func (m *Migrator) Latest() int { return len(m.migrations) }
+
+// Version 返回数据库当前的 schema 版本，未迁移时为 0
+func (m *Migrator) Version() (int, error) {
+	return currentVersion(m.db)
+}
+
+func currentVersion(tx *gorm.DB) (int, error) {
+	var v int
+	err := tx.Raw("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&v).Error
+	return v, err
+}
+
+// Up 依次执行尚未应用的迁移直到最新版本，返回本次应用的数量
+func (m *Migrator) Up() (int, error) {
+	return m.To(m.Latest())
+}
+
+// Down 回滚最近的 steps 个迁移
+func (m *Migrator) Down(steps int) (int, error) {
+	cur, err := m.Version()
+	if err != nil {
+		return 0, err
+	}
+	target := cur - steps
+	if target < 0 {
+		target = 0
+	}
+	return m.To(target)
+}
+
+// To 迁移到指定版本，每个迁移在独立事务中执行并持有 advisory lock
+func (m *Migrator) To(target int) (int, error) {
+	if target < 0 || target > m.Latest() {
+		return 0, fmt.Errorf("unknown schema version %d (latest %d)", target, m.Latest())
+	}
+	applied := 0
+	for {
+		done := false
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID).Error; err != nil {
+				return err
+			}
+			cur, err := currentVersion(tx)
+			if err != nil {
+				return err
+			}
+			log := logger.WithFields(logger.Fields{"module": "stats.migrate", "from": cur})
+			switch {
+			case cur < target:
+				mg := m.migrations[cur]
+				if err = tx.Exec(mg.Up).Error; err != nil {
+					return fmt.Errorf("migration %04d_%s up: %w", mg.Version, mg.Name, err)
+				}
+				if err = tx.Exec("INSERT INTO schema_version (version, name) VALUES (?, ?)", mg.Version, mg.Name).Error; err != nil {
+					return err
+				}
+				log.WithField("to", mg.Version).Info("migration applied")
+			case cur > target:
+				mg := m.migrations[cur-1]
+				if err = tx.Exec(mg.Down).Error; err != nil {
+					return fmt.Errorf("migration %04d_%s down: %w", mg.Version, mg.Name, err)
+				}
+				if err = tx.Exec("DELETE FROM schema_version WHERE version = ?", mg.Version).Error; err != nil {
+					return err
+				}
+				log.WithField("to", mg.Version-1).Info("migration reverted")
+			default:
+				done = true
+			}
+			return nil
+		})
+		if err != nil {
+			return applied, err
+		}
+		if done {
+			return applied, nil
+		}
+		applied++
+	}
+}
+
+// OpenMigrator 连接 dsn 并返回 Migrator，供 `kupool-server migrate` 子命令使用；closeFn 用于释放连接
+func OpenMigrator(dsn string) (mg *Migrator, closeFn func() error, err error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	mg, err = NewMigrator(db)
+	if err != nil {
+		_ = sqlDB.Close()
+		return nil, nil, err
+	}
+	return mg, sqlDB.Close, nil
+}
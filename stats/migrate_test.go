@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrationsEmbedded(t *testing.T) {
+	ms, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range ms {
+		if m.Version != i+1 {
+			t.Fatalf("version %d at position %d", m.Version, i)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Fatalf("migration %d missing up or down", m.Version)
+		}
+	}
+	// 范围与 top-N 查询依赖时间索引
+	if !strings.Contains(ms[0].Up, "idx_submissions_timestamp") {
+		t.Fatal("init migration must index submissions(timestamp)")
+	}
+}
+
+// TestMigratorUpDown 回滚最新迁移后再次升级，版本号随之变化且可重复执行
+func TestMigratorUpDown(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+	mg, closeFn, err := OpenMigrator(dsn)
+	if err != nil {
+		t.Fatalf("OpenMigrator failed: %v", err)
+	}
+	defer closeFn()
+
+	if _, err = mg.Up(); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if v, _ := mg.Version(); v != mg.Latest() {
+		t.Fatalf("expect version %d, got %d", mg.Latest(), v)
+	}
+	if n, err := mg.Down(1); err != nil || n != 1 {
+		t.Fatalf("Down(1) = %d, %v", n, err)
+	}
+	if v, _ := mg.Version(); v != mg.Latest()-1 {
+		t.Fatalf("expect version %d after down, got %d", mg.Latest()-1, v)
+	}
+	if n, err := mg.Up(); err != nil || n != 1 {
+		t.Fatalf("Up after down = %d, %v", n, err)
+	}
+	if n, err := mg.Up(); err != nil || n != 0 {
+		t.Fatalf("second Up should be a no-op, got %d, %v", n, err)
+	}
+	if _, err = mg.To(mg.Latest() + 1); err == nil {
+		t.Fatal("expect error for unknown version")
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS used_nonces;
+DROP TABLE IF EXISTS user_states;
+DROP TABLE IF EXISTS job_histories;
+DROP TABLE IF EXISTS submissions;
@@ -0,0 +1,38 @@
+-- 分钟级提交统计与 StateStore 基础表
+-- 表名与 gorm 模型一致，已由旧版本 AutoMigrate 创建的库可直接纳入版本管理
+
+CREATE TABLE IF NOT EXISTS submissions (
+    username VARCHAR(255) NOT NULL,
+    timestamp TIMESTAMP NOT NULL, -- 精确到分钟
+    submission_count BIGINT NOT NULL DEFAULT 1,
+    PRIMARY KEY (username, timestamp)
+);
+
+-- 范围查询与 top-N 查询按时间过滤
+CREATE INDEX IF NOT EXISTS idx_submissions_timestamp ON submissions (timestamp);
+
+CREATE TABLE IF NOT EXISTS job_histories (
+    job_id BIGINT PRIMARY KEY,
+    server_nonce VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+-- LoadJobHistory 按创建时间过滤
+CREATE INDEX IF NOT EXISTS idx_job_histories_created_at ON job_histories (created_at);
+
+CREATE TABLE IF NOT EXISTS user_states (
+    username VARCHAR(255) PRIMARY KEY,
+    latest_job_id BIGINT NOT NULL,
+    latest_server_nonce VARCHAR(64),
+    last_submit_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS used_nonces (
+    username VARCHAR(255) NOT NULL,
+    job_id BIGINT NOT NULL,
+    client_nonce VARCHAR(64) NOT NULL,
+    PRIMARY KEY (username, job_id, client_nonce)
+);
+
+-- 按任务清理已用 nonce
+CREATE INDEX IF NOT EXISTS idx_used_nonces_job_id ON used_nonces (job_id);
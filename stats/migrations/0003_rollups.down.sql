@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS submissions_daily;
+DROP TABLE IF EXISTS submissions_hourly;
@@ -0,0 +1,18 @@
+-- 小时/天汇总表，由 Rollup 从下一级表生成，各自按保留期清理
+CREATE TABLE IF NOT EXISTS submissions_hourly (
+    username VARCHAR(255) NOT NULL,
+    timestamp TIMESTAMP NOT NULL, -- 精确到小时
+    submission_count BIGINT NOT NULL,
+    PRIMARY KEY (username, timestamp)
+);
+
+CREATE INDEX IF NOT EXISTS idx_submissions_hourly_timestamp ON submissions_hourly (timestamp);
+
+CREATE TABLE IF NOT EXISTS submissions_daily (
+    username VARCHAR(255) NOT NULL,
+    timestamp TIMESTAMP NOT NULL, -- 精确到天
+    submission_count BIGINT NOT NULL,
+    PRIMARY KEY (username, timestamp)
+);
+
+CREATE INDEX IF NOT EXISTS idx_submissions_daily_timestamp ON submissions_daily (timestamp);
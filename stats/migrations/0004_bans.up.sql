@@ -0,0 +1,12 @@
+-- 自动封禁记录，until 之后失效，记录保留用于违规次数升级
+CREATE TABLE IF NOT EXISTS bans (
+    kind VARCHAR(16) NOT NULL, -- account / ip
+    value VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL,
+    offences INT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    until TIMESTAMP NOT NULL,
+    PRIMARY KEY (kind, value)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bans_until ON bans (until);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS processed_events;
+DROP INDEX IF EXISTS idx_outbox_sent_at;
+ALTER TABLE outbox DROP COLUMN IF EXISTS claimed_until;
@@ -0,0 +1,13 @@
+-- relay 先在短事务内认领一批消息（claimed_until 为租约），事务外逐条发布并逐条标记 sent_at
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
+
+-- 保留期清理按 sent_at 删除已发送的行
+CREATE INDEX IF NOT EXISTS idx_outbox_sent_at ON outbox (sent_at) WHERE sent_at IS NOT NULL;
+
+-- 统计消费者已处理的 outbox 事件，与分钟统计在同一事务内写入，重启或多节点消费时每个事件只计一次
+CREATE TABLE IF NOT EXISTS processed_events (
+    id VARCHAR(64) PRIMARY KEY,
+    processed_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_processed_events_at ON processed_events (processed_at);
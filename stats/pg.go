@@ -1,9 +1,14 @@
 package stats
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/events"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -15,39 +20,138 @@ type Submission struct {
 	SubmissionCount int       `gorm:"not null"`
 }
 
-type PGStore struct{ db *gorm.DB }
+// SubmissionHourly 小时汇总，由 Rollup 从分钟表生成
+type SubmissionHourly Submission
+
+func (SubmissionHourly) TableName() string { return "submissions_hourly" }
+
+// SubmissionDaily 天汇总，由 Rollup 从小时表生成
+type SubmissionDaily Submission
+
+func (SubmissionDaily) TableName() string { return "submissions_daily" }
+
+type PGStore struct {
+	db        *gorm.DB
+	retention server.Retention
+	clk       clock.Clock
+}
 
 func NewPGStore(dsn string) (*PGStore, error) {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
-	s := &PGStore{db: db}
+	s := &PGStore{db: db, retention: server.DefaultRetention(), clk: clock.Real()}
 	if err = s.ensureSchema(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+// ensureSchema 启动时执行一次版本化迁移（stats/migrations），替代 gorm AutoMigrate
 func (s *PGStore) ensureSchema() error {
-	return s.db.AutoMigrate(&Submission{})
+	m, err := NewMigrator(s.db)
+	if err != nil {
+		return err
+	}
+	_, err = m.Up()
+	return err
 }
 
 func (s *PGStore) Increment(username string, minute time.Time) error {
-	m := minute.Truncate(time.Minute)
+	return s.IncrementBy(username, minute, 1)
+}
 
-	sql := s.db.ToSQL(func(tx *gorm.DB) *gorm.DB {
-		return tx.Clauses(clause.OnConflict{
-			Columns:   []clause.Column{{Name: "username"}, {Name: "timestamp"}},
-			DoUpdates: clause.Assignments(map[string]interface{}{"submission_count": gorm.Expr("excluded.submission_count + 1")}),
-		}).Create(&Submission{
-			Username:        username,
-			Timestamp:       m,
-			SubmissionCount: 1,
-		})
-	})
+func (s *PGStore) IncrementBy(username string, minute time.Time, n int) error {
+	return s.BatchIncrement([]server.StatDelta{{Username: username, Minute: minute, Count: n}})
+}
 
-	return s.db.Exec(sql).Error
+// BatchIncrement 使用单条多行 UPSERT 写入整批增量；同一 (username, minute) 的多条增量会先合并，
+// 避免 ON CONFLICT 在同一语句中多次命中同一行
+func (s *PGStore) BatchIncrement(deltas []server.StatDelta) error {
+	return batchIncrement(s.db, deltas)
+}
+
+func batchIncrement(db *gorm.DB, deltas []server.StatDelta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	type key struct {
+		username string
+		minute   time.Time
+	}
+	index := make(map[key]int, len(deltas))
+	rows := make([]Submission, 0, len(deltas))
+	for _, d := range deltas {
+		k := key{username: d.Username, minute: d.Minute.Truncate(time.Minute)}
+		if i, ok := index[k]; ok {
+			rows[i].SubmissionCount += d.Count
+			continue
+		}
+		index[k] = len(rows)
+		rows = append(rows, Submission{Username: k.username, Timestamp: k.minute, SubmissionCount: d.Count})
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "username"}, {Name: "timestamp"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"submission_count": gorm.Expr("submissions.submission_count + excluded.submission_count")}),
+	}).Create(&rows).Error
+}
+
+// ProcessedEvent 统计消费者已处理的 outbox 事件
+type ProcessedEvent struct {
+	ID          string    `gorm:"primaryKey;size:64"`
+	ProcessedAt time.Time `gorm:"not null"`
+}
+
+func (ProcessedEvent) TableName() string { return "processed_events" }
+
+// IncrementOnce 在一个事务内登记事件 ID 并写入统计：登记时与已有 ID 冲突的事件已经计过数，跳过；
+// 没有 ID 的事件总是计数
+func (s *PGStore) IncrementOnce(evts []events.SubmitEvent) error {
+	if len(evts) == 0 {
+		return nil
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var ids []string
+		first := make(map[string]bool)
+		for _, e := range evts {
+			if e.ID != "" && !first[e.ID] {
+				first[e.ID] = true
+				ids = append(ids, e.ID)
+			}
+		}
+		fresh := make(map[string]bool, len(ids))
+		if len(ids) > 0 {
+			now := s.clk.Now()
+			values := make([]string, 0, len(ids))
+			args := make([]interface{}, 0, 2*len(ids))
+			for _, id := range ids {
+				values = append(values, "(?, ?)")
+				args = append(args, id, now)
+			}
+			var inserted []string
+			err := tx.Raw("INSERT INTO processed_events (id, processed_at) VALUES "+strings.Join(values, ", ")+" ON CONFLICT DO NOTHING RETURNING id", args...).
+				Scan(&inserted).Error
+			if err != nil {
+				return err
+			}
+			for _, id := range inserted {
+				fresh[id] = true
+			}
+		}
+		deltas := make([]server.StatDelta, 0, len(evts))
+		for _, e := range evts {
+			if e.ID != "" {
+				if !fresh[e.ID] {
+					continue
+				}
+				// 同一批内重复的 ID 只计第一次
+				delete(fresh, e.ID)
+			}
+			deltas = append(deltas, server.StatDelta{Username: e.Username, Minute: e.Time, Count: 1})
+		}
+		return batchIncrement(tx, deltas)
+	})
 }
 
 func (s *PGStore) Get(username string, minute time.Time) (int, error) {
@@ -68,10 +172,94 @@ func (s *PGStore) Close() error {
 	return sqlDB.Close()
 }
 
-// GetUserSubmissionsByTimeRange 获取用户在指定时间范围内的提交计数
-func (s *PGStore) GetUserSubmissionsByTimeRange(username string, startTime, endTime time.Time) (map[time.Time]int, error) {
+// SetRetention 设置各粒度的保留时长
+func (s *PGStore) SetRetention(r server.Retention) { s.retention = r }
+
+// SetClock 设置粒度选择、任务历史截止与 outbox 发送时间使用的时钟（默认真实时钟）
+func (s *PGStore) SetClock(clk clock.Clock) { s.clk = clock.OrReal(clk) }
+
+// rollupLookback 每次汇总重新计算的时间跨度，覆盖延迟写入的分钟数据
+const rollupLookback = 2 * time.Hour
+
+// Rollup 以幂等的重算方式把最近的分钟数据汇总进小时表、小时数据汇总进天表，
+// 再按各粒度保留期删除过期行。重算窗口不会早于下一级数据的保留起点，避免用残缺数据覆盖已有汇总
+func (s *PGStore) Rollup(now time.Time) error {
+	hourTo := now.Truncate(time.Hour).Add(time.Hour)
+	hourFrom := rollupFrom(hourTo.Add(-rollupLookback), now, s.retention.Minute, time.Hour)
+	if err := s.rollupInto("submissions_hourly", "submissions", "hour", hourFrom, hourTo); err != nil {
+		return err
+	}
+	dayTo := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	dayFrom := rollupFrom(hourFrom.Truncate(24*time.Hour), now, s.retention.Hour, 24*time.Hour)
+	if err := s.rollupInto("submissions_daily", "submissions_hourly", "day", dayFrom, dayTo); err != nil {
+		return err
+	}
+	for _, p := range []struct {
+		table string
+		keep  time.Duration
+	}{{"submissions", s.retention.Minute}, {"submissions_hourly", s.retention.Hour}, {"submissions_daily", s.retention.Day}} {
+		if p.keep <= 0 {
+			continue
+		}
+		if err := s.db.Exec("DELETE FROM "+p.table+" WHERE timestamp < ?", now.Add(-p.keep)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupFrom 把重算起点限制在源表保留期内且对齐到目标桶
+func rollupFrom(from, now time.Time, keep, bucket time.Duration) time.Time {
+	if keep <= 0 {
+		return from
+	}
+	oldest := now.Add(-keep).Truncate(bucket).Add(bucket)
+	if from.Before(oldest) {
+		return oldest
+	}
+	return from
+}
+
+func (s *PGStore) rollupInto(dst, src, unit string, from, to time.Time) error {
+	if !from.Before(to) {
+		return nil
+	}
+	return s.db.Exec(
+		"INSERT INTO "+dst+" (username, timestamp, submission_count) "+
+			"SELECT username, date_trunc('"+unit+"', timestamp), SUM(submission_count) FROM "+src+
+			" WHERE timestamp >= ? AND timestamp < ? GROUP BY 1, 2 "+
+			"ON CONFLICT (username, timestamp) DO UPDATE SET submission_count = excluded.submission_count",
+		from, to).Error
+}
+
+func granularityTable(g server.Granularity) string {
+	switch g {
+	case server.GranularityHour:
+		return "submissions_hourly"
+	case server.GranularityDay:
+		return "submissions_daily"
+	default:
+		return "submissions"
+	}
+}
+
+// PickGranularity 按保留期与范围大小选择粒度
+func (s *PGStore) PickGranularity(startTime, endTime time.Time) server.Granularity {
+	return s.retention.Pick(startTime, endTime, s.clk.Now())
+}
+
+func (s *PGStore) resolve(startTime, endTime time.Time, g server.Granularity) server.Granularity {
+	if g == "" {
+		return s.PickGranularity(startTime, endTime)
+	}
+	return g
+}
+
+// GetUserSubmissionsByTimeRange 获取用户在指定时间范围内按粒度聚合的提交计数
+func (s *PGStore) GetUserSubmissionsByTimeRange(username string, startTime, endTime time.Time, g server.Granularity) (map[time.Time]int, error) {
+	g = s.resolve(startTime, endTime, g)
 	var submissions []Submission
-	err := s.db.Where("username = ? AND timestamp >= ? AND timestamp <= ?", username, startTime, endTime).
+	err := s.db.Table(granularityTable(g)).Where("username = ? AND timestamp >= ? AND timestamp <= ?", username, g.Ceil(startTime), endTime).
 		Order("timestamp ASC").Find(&submissions).Error
 	if err != nil {
 		return nil, err
@@ -85,49 +273,26 @@ func (s *PGStore) GetUserSubmissionsByTimeRange(username string, startTime, endT
 }
 
 // GetTopUsersBySubmissions 获取指定时间范围内提交次数最多的用户
-func (s *PGStore) GetTopUsersBySubmissions(startTime, endTime time.Time, limit int) ([]struct {
-	Username string
-	Total    int
-}, error) {
-	type Result struct {
-		Username string
-		Total    int
-	}
-	var results []Result
-
-	err := s.db.Model(&Submission{}).
+func (s *PGStore) GetTopUsersBySubmissions(startTime, endTime time.Time, limit int, g server.Granularity) ([]server.UserTotal, error) {
+	g = s.resolve(startTime, endTime, g)
+	var results []server.UserTotal
+	err := s.db.Table(granularityTable(g)).
 		Select("username, SUM(submission_count) as total").
-		Where("timestamp >= ? AND timestamp <= ?", startTime, endTime).
+		Where("timestamp >= ? AND timestamp <= ?", g.Ceil(startTime), endTime).
 		Group("username").
-		Order("total DESC").
+		Order("total DESC, username ASC").
 		Limit(limit).
 		Scan(&results).Error
-
-	if err != nil {
-		return nil, err
-	}
-
-	// 转换为所需的返回类型
-	var finalResults []struct {
-		Username string
-		Total    int
-	}
-	for _, r := range results {
-		finalResults = append(finalResults, struct {
-			Username string
-			Total    int
-		}{Username: r.Username, Total: r.Total})
-	}
-
-	return finalResults, nil
+	return results, err
 }
 
 // GetTotalSubmissions 获取指定时间范围内的总提交次数
-func (s *PGStore) GetTotalSubmissions(startTime, endTime time.Time) (int, error) {
+func (s *PGStore) GetTotalSubmissions(startTime, endTime time.Time, g server.Granularity) (int, error) {
+	g = s.resolve(startTime, endTime, g)
 	var total int
-	err := s.db.Model(&Submission{}).
+	err := s.db.Table(granularityTable(g)).
 		Select("COALESCE(SUM(submission_count), 0)").
-		Where("timestamp >= ? AND timestamp <= ?", startTime, endTime).
+		Where("timestamp >= ? AND timestamp <= ?", g.Ceil(startTime), endTime).
 		Scan(&total).Error
 	return total, err
 }
@@ -154,12 +319,10 @@ type UsedNonce struct {
 
 // StateStore impl
 func (s *PGStore) SaveJob(jobID int, nonce string, createdAt time.Time) error {
-	_ = s.db.AutoMigrate(&JobHistory{})
 	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&JobHistory{JobID: jobID, ServerNonce: nonce, CreatedAt: createdAt}).Error
 }
 
 func (s *PGStore) LoadLatestJob() (int, string, time.Time, error) {
-	_ = s.db.AutoMigrate(&JobHistory{})
 	var j JobHistory
 	err := s.db.Order("job_id DESC").First(&j).Error
 	if err == gorm.ErrRecordNotFound {
@@ -168,12 +331,41 @@ func (s *PGStore) LoadLatestJob() (int, string, time.Time, error) {
 	return j.JobID, j.ServerNonce, j.CreatedAt, err
 }
 
+func (s *PGStore) LoadJob(jobID int) (server.JobRecord, bool, error) {
+	var j JobHistory
+	err := s.db.Where("job_id = ?", jobID).First(&j).Error
+	if err == gorm.ErrRecordNotFound {
+		return server.JobRecord{}, false, nil
+	}
+	if err != nil {
+		return server.JobRecord{}, false, err
+	}
+	return server.JobRecord{Nonce: j.ServerNonce, CreatedAt: j.CreatedAt}, true, nil
+}
+
+// jobLockID 分配任务号时使用的 advisory lock
+const jobLockID = 0x6b75706a6f62 // "kupjob"
+
+// CreateJob 在共享任务表中分配全局递增的任务号并写入，多节点共用同一 PG 时任务号不会冲突
+func (s *PGStore) CreateJob(nonce string, createdAt time.Time) (int, error) {
+	var id int
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", jobLockID).Error; err != nil {
+			return err
+		}
+		if err := tx.Raw("SELECT COALESCE(MAX(job_id), 0) + 1 FROM job_histories").Scan(&id).Error; err != nil {
+			return err
+		}
+		return tx.Create(&JobHistory{JobID: id, ServerNonce: nonce, CreatedAt: createdAt}).Error
+	})
+	return id, err
+}
+
 func (s *PGStore) LoadJobHistory(since time.Duration) (map[int]server.JobRecord, error) {
-	_ = s.db.AutoMigrate(&JobHistory{})
 	var js []JobHistory
 	q := s.db
 	if since > 0 {
-		q = q.Where("created_at >= ?", time.Now().Add(-since))
+		q = q.Where("created_at >= ?", s.clk.Now().Add(-since))
 	}
 	if err := q.Find(&js).Error; err != nil {
 		return nil, err
@@ -186,7 +378,6 @@ func (s *PGStore) LoadJobHistory(since time.Duration) (map[int]server.JobRecord,
 }
 
 func (s *PGStore) LoadUserState(username string) (int, string, time.Time, error) {
-	_ = s.db.AutoMigrate(&UserState{})
 	var u UserState
 	err := s.db.Where("username = ?", username).First(&u).Error
 	if err == gorm.ErrRecordNotFound {
@@ -196,17 +387,14 @@ func (s *PGStore) LoadUserState(username string) (int, string, time.Time, error)
 }
 
 func (s *PGStore) SaveUserState(username string, latestJobID int, latestServerNonce string, lastSubmitAt time.Time) error {
-	_ = s.db.AutoMigrate(&UserState{})
 	return s.db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "username"}}, DoUpdates: clause.Assignments(map[string]interface{}{"latest_job_id": latestJobID, "latest_server_nonce": latestServerNonce, "last_submit_at": lastSubmitAt})}).Create(&UserState{Username: username, LatestJobID: latestJobID, LatestServerNonce: latestServerNonce, LastSubmitAt: lastSubmitAt}).Error
 }
 
 func (s *PGStore) SaveUsedNonce(username string, jobID int, clientNonce string) error {
-	_ = s.db.AutoMigrate(&UsedNonce{})
 	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UsedNonce{Username: username, JobID: jobID, ClientNonce: clientNonce}).Error
 }
 
 func (s *PGStore) HasUsedNonce(username string, jobID int, clientNonce string) (bool, error) {
-	_ = s.db.AutoMigrate(&UsedNonce{})
 	var u UsedNonce
 	err := s.db.Where("username = ? AND job_id = ? AND client_nonce = ?", username, jobID, clientNonce).First(&u).Error
 	if err == gorm.ErrRecordNotFound {
@@ -214,3 +402,130 @@ func (s *PGStore) HasUsedNonce(username string, jobID int, clientNonce string) (
 	}
 	return err == nil, err
 }
+
+// BanRecord 自动封禁记录，重启后由 BanManager 恢复
+type BanRecord struct {
+	Kind      string    `gorm:"primaryKey;size:16"`
+	Value     string    `gorm:"primaryKey;size:255"`
+	Reason    string    `gorm:"not null"`
+	Offences  int       `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null"`
+	Until     time.Time `gorm:"not null"`
+}
+
+func (BanRecord) TableName() string { return "bans" }
+
+func (s *PGStore) SaveBan(b server.Ban) error {
+	rec := BanRecord{Kind: string(b.Kind), Value: b.Value, Reason: b.Reason, Offences: b.Offences, CreatedAt: b.CreatedAt, Until: b.Until}
+	return s.db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "kind"}, {Name: "value"}}, UpdateAll: true}).Create(&rec).Error
+}
+
+func (s *PGStore) DeleteBan(kind server.BanKind, value string) error {
+	return s.db.Where("kind = ? AND value = ?", string(kind), value).Delete(&BanRecord{}).Error
+}
+
+func (s *PGStore) LoadBans() ([]server.Ban, error) {
+	var rs []BanRecord
+	if err := s.db.Find(&rs).Error; err != nil {
+		return nil, err
+	}
+	out := make([]server.Ban, 0, len(rs))
+	for _, r := range rs {
+		out = append(out, server.Ban{Kind: server.BanKind(r.Kind), Value: r.Value, Reason: r.Reason, Offences: r.Offences, CreatedAt: r.CreatedAt, Until: r.Until})
+	}
+	return out, nil
+}
+
+// OutboxRecord transactional outbox 表，与已用 nonce、用户状态在同一事务内写入
+type OutboxRecord struct {
+	ID        int64     `gorm:"primaryKey;autoIncrement"`
+	Topic     string    `gorm:"size:64;not null"`
+	Payload   []byte    `gorm:"type:bytea;not null"`
+	CreatedAt time.Time `gorm:"not null"`
+	// ClaimedUntil relay 认领消息的租约，到期前其他 relay 不会取走；relay 崩溃时到期后重新认领
+	ClaimedUntil *time.Time
+	SentAt       *time.Time
+}
+
+func (OutboxRecord) TableName() string { return "outbox" }
+
+// outboxClaim relay 认领一批消息的租约时长
+const outboxClaim = 30 * time.Second
+
+// RecordSubmit 在一个事务内写入已用 nonce、用户状态和 outbox 消息；nonce 已存在时回滚并返回 ErrDuplicateSubmission
+func (s *PGStore) RecordSubmit(rec server.SubmitRecord, msgs []server.OutboxMessage) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&UsedNonce{Username: rec.Username, JobID: rec.JobID, ClientNonce: rec.ClientNonce})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return server.ErrDuplicateSubmission
+		}
+		err := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "username"}}, DoUpdates: clause.Assignments(map[string]interface{}{"latest_job_id": rec.LatestJobID, "latest_server_nonce": rec.LatestServerNonce, "last_submit_at": rec.SubmitAt})}).
+			Create(&UserState{Username: rec.Username, LatestJobID: rec.LatestJobID, LatestServerNonce: rec.LatestServerNonce, LastSubmitAt: rec.SubmitAt}).Error
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		rows := make([]OutboxRecord, 0, len(msgs))
+		for _, m := range msgs {
+			rows = append(rows, OutboxRecord{Topic: m.Topic, Payload: m.Payload, CreatedAt: rec.SubmitAt})
+		}
+		return tx.Create(&rows).Error
+	})
+}
+
+// RelayOutbox 在短事务内以 FOR UPDATE SKIP LOCKED 认领最早的未发送消息，提交后逐条 publish，
+// 每条成功后单独标记 sent_at；publish 失败时释放剩余的认领，下次从失败的那条继续。
+// 发布期间不持有行锁，多个节点可同时运行 relay 而不会重复投递
+func (s *PGStore) RelayOutbox(limit int, publish func(server.OutboxMessage) error) (int, error) {
+	now := s.clk.Now()
+	var rows []OutboxRecord
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL AND (claimed_until IS NULL OR claimed_until < ?)", now).Order("id ASC").Limit(limit).Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+		ids := make([]int64, 0, len(rows))
+		for _, r := range rows {
+			ids = append(ids, r.ID)
+		}
+		return tx.Model(&OutboxRecord{}).Where("id IN ?", ids).Update("claimed_until", now.Add(outboxClaim)).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range rows {
+		if err = publish(server.OutboxMessage{ID: r.ID, Topic: r.Topic, Payload: r.Payload}); err == nil {
+			err = s.db.Model(&OutboxRecord{}).Where("id = ?", r.ID).Update("sent_at", s.clk.Now()).Error
+		}
+		if err != nil {
+			ids := make([]int64, 0, len(rows)-i)
+			for _, rest := range rows[i:] {
+				ids = append(ids, rest.ID)
+			}
+			// 释放失败时这些消息要等租约到期才会重新认领，需要让调用方知道
+			if rerr := s.db.Model(&OutboxRecord{}).Where("id IN ? AND sent_at IS NULL", ids).Update("claimed_until", nil).Error; rerr != nil {
+				err = errors.Join(err, fmt.Errorf("release outbox claims: %w", rerr))
+			}
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+// SweepOutbox 删除 before 之前已发送的 outbox 消息，以及同样早于 before 的已处理事件记录
+func (s *PGStore) SweepOutbox(before time.Time) (int, error) {
+	res := s.db.Where("sent_at IS NOT NULL AND sent_at < ?", before).Delete(&OutboxRecord{})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if err := s.db.Where("processed_at < ?", before).Delete(&ProcessedEvent{}).Error; err != nil {
+		return int(res.RowsAffected), err
+	}
+	return int(res.RowsAffected), nil
+}
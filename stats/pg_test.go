@@ -1,9 +1,13 @@
 package stats
 
 import (
+	"errors"
 	"os"
 	"testing"
 	"time"
+
+	"github.com/JellyTony/kupool/app/server"
+	"github.com/JellyTony/kupool/events"
 )
 
 // TestPGStoreIncrementGet 测试基本的增加和获取功能
@@ -97,7 +101,7 @@ func TestPGStoreAnalytics(t *testing.T) {
 	startTime := now.Add(-6 * time.Minute)
 	endTime := now.Add(-1 * time.Minute)
 
-	user1Submissions, err := s.GetUserSubmissionsByTimeRange(user1, startTime, endTime)
+	user1Submissions, err := s.GetUserSubmissionsByTimeRange(user1, startTime, endTime, "")
 	if err != nil {
 		t.Fatalf("GetUserSubmissionsByTimeRange failed: %v", err)
 	}
@@ -108,7 +112,7 @@ func TestPGStoreAnalytics(t *testing.T) {
 	}
 
 	// 2. 测试GetTopUsersBySubmissions
-	topUsers, err := s.GetTopUsersBySubmissions(startTime, endTime, 2)
+	topUsers, err := s.GetTopUsersBySubmissions(startTime, endTime, 2, "")
 	if err != nil {
 		t.Fatalf("GetTopUsersBySubmissions failed: %v", err)
 	}
@@ -123,7 +127,7 @@ func TestPGStoreAnalytics(t *testing.T) {
 	}
 
 	// 3. 测试GetTotalSubmissions
-	total, err := s.GetTotalSubmissions(startTime, endTime)
+	total, err := s.GetTotalSubmissions(startTime, endTime, "")
 	if err != nil {
 		t.Fatalf("GetTotalSubmissions failed: %v", err)
 	}
@@ -182,3 +186,290 @@ func TestPGStoreMinuteAggregation(t *testing.T) {
 		t.Errorf("Expected count 0 for next minute, got %d", count)
 	}
 }
+
+// TestPGStoreBatchIncrement 测试批量 UPSERT 累加
+func TestPGStoreBatchIncrement(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+
+	username := "batch_test_" + time.Now().Format("150405.000")
+	minute := time.Now().Truncate(time.Minute)
+
+	// 同一批次中重复的 key 需要被合并，且与已有行累加
+	err = s.BatchIncrement([]server.StatDelta{
+		{Username: username, Minute: minute, Count: 2},
+		{Username: username, Minute: minute.Add(10 * time.Second), Count: 3},
+		{Username: username, Minute: minute.Add(time.Minute), Count: 1},
+	})
+	if err != nil {
+		t.Fatalf("BatchIncrement failed: %v", err)
+	}
+	if err = s.IncrementBy(username, minute, 4); err != nil {
+		t.Fatalf("IncrementBy failed: %v", err)
+	}
+
+	count, err := s.Get(username, minute)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if count != 9 {
+		t.Errorf("Expected count 9, got %d", count)
+	}
+	count, _ = s.Get(username, minute.Add(time.Minute))
+	if count != 1 {
+		t.Errorf("Expected count 1 for next minute, got %d", count)
+	}
+}
+
+// TestPGStoreOutbox 测试 outbox 事务写入与 relay
+func TestPGStoreOutbox(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+
+	// 先清空历史残留，避免影响计数
+	_, _ = s.RelayOutbox(1<<20, func(server.OutboxMessage) error { return nil })
+
+	username := "outbox_test_" + time.Now().Format("150405.000")
+	rec := server.SubmitRecord{Username: username, JobID: 1, ClientNonce: "n1", LatestJobID: 1, LatestServerNonce: "s", SubmitAt: time.Now()}
+	msgs := []server.OutboxMessage{{Topic: "submit", Payload: []byte(`{}`)}, {Topic: "share.accepted", Payload: []byte(`{}`)}}
+	if err = s.RecordSubmit(rec, msgs); err != nil {
+		t.Fatalf("RecordSubmit failed: %v", err)
+	}
+	if err = s.RecordSubmit(rec, msgs); err != server.ErrDuplicateSubmission {
+		t.Fatalf("Expected ErrDuplicateSubmission, got %v", err)
+	}
+
+	// 第二条 publish 失败：第一条已标记发送，第二条留待下次
+	var got []server.OutboxMessage
+	n, err := s.RelayOutbox(10, func(m server.OutboxMessage) error {
+		if m.Topic != "submit" {
+			return os.ErrDeadlineExceeded
+		}
+		got = append(got, m)
+		return nil
+	})
+	if err == nil || n != 1 {
+		t.Fatalf("Expected partial relay, got n=%d err=%v", n, err)
+	}
+	n, err = s.RelayOutbox(10, func(m server.OutboxMessage) error { got = append(got, m); return nil })
+	if err != nil || n != 1 || len(got) != 2 || got[1].Topic != "share.accepted" {
+		t.Fatalf("Expected the failed message relayed once, got n=%d err=%v", n, err)
+	}
+	n, _ = s.RelayOutbox(10, func(server.OutboxMessage) error { return nil })
+	if n != 0 {
+		t.Errorf("Expected empty outbox, got %d", n)
+	}
+	swept, err := s.SweepOutbox(time.Now().Add(time.Minute))
+	if err != nil || swept < 2 {
+		t.Errorf("Expected sent rows swept, got %d err=%v", swept, err)
+	}
+}
+
+// TestPGStoreOutboxReleasesClaims 批次中途 publish 失败时释放剩余消息的认领，不必等租约到期即可重新认领
+func TestPGStoreOutboxReleasesClaims(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+	_, _ = s.RelayOutbox(1<<20, func(server.OutboxMessage) error { return nil })
+
+	username := "outbox_release_" + time.Now().Format("150405.000")
+	// created_at 用于区分本测试写入的消息，截断到 PG 的微秒精度
+	rec := server.SubmitRecord{Username: username, JobID: 1, ClientNonce: "n1", LatestJobID: 1, LatestServerNonce: "s", SubmitAt: time.Now().Truncate(time.Microsecond)}
+	var msgs []server.OutboxMessage
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, server.OutboxMessage{Topic: "submit", Payload: []byte(`{}`)})
+	}
+	if err = s.RecordSubmit(rec, msgs); err != nil {
+		t.Fatalf("RecordSubmit failed: %v", err)
+	}
+
+	calls := 0
+	n, err := s.RelayOutbox(10, func(server.OutboxMessage) error {
+		if calls++; calls == 2 {
+			return os.ErrDeadlineExceeded
+		}
+		return nil
+	})
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 1 {
+		t.Fatalf("Expected failure on the second message, got n=%d err=%v", n, err)
+	}
+	var leased int64
+	if err = s.db.Model(&OutboxRecord{}).Where("created_at = ? AND sent_at IS NULL AND claimed_until IS NOT NULL", rec.SubmitAt).Count(&leased).Error; err != nil {
+		t.Fatal(err)
+	}
+	if leased != 0 {
+		t.Fatalf("Expected remaining claims released, %d rows still leased", leased)
+	}
+	// 租约未到期也能立即重新认领剩余 3 条
+	n, err = s.RelayOutbox(10, func(server.OutboxMessage) error { return nil })
+	if err != nil || n != 3 {
+		t.Fatalf("Expected the remaining 3 messages relayed, got n=%d err=%v", n, err)
+	}
+}
+
+// TestPGStoreIncrementOnce 同一事件 ID 只计一次，跨调用（相当于消费者重启）同样生效
+func TestPGStoreIncrementOnce(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+
+	username := "once_test_" + time.Now().Format("150405.000")
+	id := username + "-1"
+	now := time.Now().Truncate(time.Minute)
+	evts := []events.SubmitEvent{{ID: id, Username: username, Time: now}, {ID: id, Username: username, Time: now}, {Username: username, Time: now}}
+	for i := 0; i < 2; i++ {
+		if err = s.IncrementOnce(evts); err != nil {
+			t.Fatalf("IncrementOnce failed: %v", err)
+		}
+	}
+	count, err := s.Get(username, now)
+	if err != nil || count != 3 {
+		t.Fatalf("Expected count 3, got %d err=%v", count, err)
+	}
+}
+
+// TestPGStoreRollup 测试小时/天汇总与保留期
+func TestPGStoreRollup(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+
+	username := "rollup_test_" + time.Now().Format("150405.000")
+	now := time.Now().UTC()
+	hour := now.Truncate(time.Hour)
+	_ = s.IncrementBy(username, hour, 2)
+	_ = s.IncrementBy(username, hour.Add(time.Minute), 3)
+
+	if err = s.Rollup(now); err != nil {
+		t.Fatalf("Rollup failed: %v", err)
+	}
+	// 重复汇总应保持幂等
+	if err = s.Rollup(now); err != nil {
+		t.Fatalf("Rollup failed: %v", err)
+	}
+	var h SubmissionHourly
+	if err = s.db.Where("username = ? AND timestamp = ?", username, hour).First(&h).Error; err != nil {
+		t.Fatalf("hourly row missing: %v", err)
+	}
+	if h.SubmissionCount != 5 {
+		t.Errorf("Expected hourly count 5, got %d", h.SubmissionCount)
+	}
+	var d SubmissionDaily
+	if err = s.db.Where("username = ? AND timestamp = ?", username, now.Truncate(24*time.Hour)).First(&d).Error; err != nil {
+		t.Fatalf("daily row missing: %v", err)
+	}
+	if d.SubmissionCount < 5 {
+		t.Errorf("Expected daily count >= 5, got %d", d.SubmissionCount)
+	}
+}
+
+// TestPGStoreCreateJob 测试共享任务表的任务号分配与按 JobID 查询
+func TestPGStoreCreateJob(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	id1, err := s.CreateJob("create_job_1", now)
+	if err != nil {
+		t.Fatalf("CreateJob failed: %v", err)
+	}
+	id2, err := s.CreateJob("create_job_2", now)
+	if err != nil {
+		t.Fatalf("CreateJob failed: %v", err)
+	}
+	if id2 <= id1 {
+		t.Errorf("Expected increasing job ids, got %d then %d", id1, id2)
+	}
+	rec, ok, err := s.LoadJob(id2)
+	if err != nil || !ok || rec.Nonce != "create_job_2" {
+		t.Errorf("LoadJob mismatch: %+v %v %v", rec, ok, err)
+	}
+	if _, ok, _ = s.LoadJob(id2 + 1000000); ok {
+		t.Error("Expected missing job")
+	}
+}
+
+// TestPGStoreBans 测试封禁记录的写入、覆盖更新与删除
+func TestPGStoreBans(t *testing.T) {
+	dsn := os.Getenv("PG_DSN")
+	if dsn == "" {
+		t.Skip("PostgreSQL DSN not provided, skipping test")
+	}
+
+	s, err := NewPGStore(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create PGStore: %v", err)
+	}
+	defer s.Close()
+
+	now := time.Now().Truncate(time.Second)
+	b := server.Ban{Kind: server.BanAccount, Value: "pg_ban_user", Reason: "test", Offences: 1, CreatedAt: now, Until: now.Add(time.Hour)}
+	if err = s.SaveBan(b); err != nil {
+		t.Fatalf("SaveBan failed: %v", err)
+	}
+	b.Offences = 2
+	if err = s.SaveBan(b); err != nil {
+		t.Fatalf("SaveBan upsert failed: %v", err)
+	}
+	bans, err := s.LoadBans()
+	if err != nil {
+		t.Fatalf("LoadBans failed: %v", err)
+	}
+	found := false
+	for _, got := range bans {
+		if got.Kind == b.Kind && got.Value == b.Value {
+			found = got.Offences == 2
+		}
+	}
+	if !found {
+		t.Errorf("Expected upserted ban with 2 offences, got %+v", bans)
+	}
+	if err = s.DeleteBan(b.Kind, b.Value); err != nil {
+		t.Fatalf("DeleteBan failed: %v", err)
+	}
+}
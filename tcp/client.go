@@ -3,7 +3,7 @@ package tcp
 import (
 	"errors"
 	"fmt"
-	"net/url"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,7 +23,6 @@ type ClientOptions struct {
 type Client struct {
 	sync.Mutex
 	kupool.Dialer
-	once    sync.Once
 	id      string
 	name    string
 	conn    kupool.Conn
@@ -60,10 +59,9 @@ func (c *Client) Name() string {
 	return c.name
 }
 
-// Connect to server
+// Connect to server；连接断开并 Close 之后可以再次 Connect
 func (c *Client) Connect(addr string) error {
-	_, err := url.Parse(addr)
-	if err != nil {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
 		return err
 	}
 	// 这里是一个CAS原子操作，对比并设置值，是并发安全的。
@@ -82,13 +80,17 @@ func (c *Client) Connect(addr string) error {
 		return err
 	}
 	if rawconn == nil {
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
 		return fmt.Errorf("conn is nil")
 	}
-	c.conn = NewConn(rawconn)
+	conn := NewConn(rawconn)
+	c.Lock()
+	c.conn = conn
+	c.Unlock()
 
 	if c.options.Heartbeat > 0 {
 		go func() {
-			err := c.heartbealoop()
+			err := c.heartbealoop(conn)
 			if err != nil {
 				logger.WithField("module", "tcp.client").Warn("heartbealoop stopped - ", err)
 			}
@@ -107,63 +109,81 @@ func (c *Client) Send(payload []byte) error {
 	if atomic.LoadInt32(&c.state) == 0 {
 		return fmt.Errorf("connection is nil")
 	}
-	c.Lock()
-	defer c.Unlock()
-	err := c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
-	if err != nil {
-		return err
-	}
-	return c.conn.WriteFrame(kupool.OpBinary, payload)
+	return c.write(c.current(), kupool.OpBinary, payload)
 }
 
-// Close 关闭
+// Close 关闭当前连接
 func (c *Client) Close() {
-	c.once.Do(func() {
-		if c.conn == nil {
-			return
-		}
-		// graceful close connection
-		_ = WriteFrame(c.conn, kupool.OpClose, nil)
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		return
+	}
+	// graceful close connection
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	_ = WriteFrame(c.conn, kupool.OpClose, nil)
 
-		c.conn.Close()
-		atomic.CompareAndSwapInt32(&c.state, 1, 0)
-	})
+	c.conn.Close()
+	c.conn = nil
+	atomic.CompareAndSwapInt32(&c.state, 1, 0)
 }
 
+// Read 读取下一帧；服务端的 ping 在这里直接回复 pong，不返回给调用方
 func (c *Client) Read() (kupool.Frame, error) {
-	if c.conn == nil {
+	conn := c.current()
+	if conn == nil {
 		return nil, errors.New("connection is nil")
 	}
-	if c.options.Heartbeat > 0 {
-		_ = c.conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
-	}
-	frame, err := c.conn.ReadFrame()
-	if err != nil {
-		return nil, err
-	}
-	if frame.GetOpCode() == kupool.OpClose {
-		return nil, errors.New("remote side close the channel")
+	for {
+		if c.options.Heartbeat > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
+		}
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch frame.GetOpCode() {
+		case kupool.OpClose:
+			return nil, errors.New("remote side close the channel")
+		case kupool.OpPing:
+			if err := c.write(conn, kupool.OpPong, nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return frame, nil
 	}
-	return frame, nil
 }
 
-func (c *Client) heartbealoop() error {
+func (c *Client) current() kupool.Conn {
+	c.Lock()
+	defer c.Unlock()
+	return c.conn
+}
+
+func (c *Client) heartbealoop(conn kupool.Conn) error {
 	tick := time.NewTicker(c.options.Heartbeat)
+	defer tick.Stop()
 	for range tick.C {
-		// 发送一个ping的心跳包给服务端
-		if err := c.ping(); err != nil {
+		// 发送一个ping的心跳包给服务端；连接关闭或被替换后写入失败，循环随之退出
+		logger.WithField("module", "tcp.client").Debugf("%s send ping to server", c.id)
+		if err := c.write(conn, kupool.OpPing, nil); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) ping() error {
-	logger.WithField("module", "tcp.client").Debugf("%s send ping to server", c.id)
-
-	err := c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+// write 串行写入一帧，conn 已不是当前连接时返回错误
+func (c *Client) write(conn kupool.Conn, op kupool.OpCode, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if conn == nil || conn != c.conn {
+		return errors.New("connection is closed")
+	}
+	err := conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
 	if err != nil {
 		return err
 	}
-	return c.conn.WriteFrame(kupool.OpPing, nil)
+	return conn.WriteFrame(op, payload)
 }
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tcp
+
+import "net"
+
+// ListenReusePort 当前平台不支持，返回 ErrReusePortUnsupported
+func ListenReusePort(addr string) (net.Listener, error) {
+	return nil, ErrReusePortUnsupported
+}
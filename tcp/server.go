@@ -10,15 +10,26 @@ import (
 
 	kupool "github.com/JellyTony/kupool"
 	"github.com/JellyTony/kupool/logger"
+	"github.com/JellyTony/kupool/proxyproto"
+	"github.com/JellyTony/kupool/recorder"
 
 	"github.com/segmentio/ksuid"
 )
 
+var (
+	// ErrServerClosed StopAccept 或 Shutdown 之后 Start 返回的错误
+	ErrServerClosed = errors.New("tcp: server closed")
+	// ErrReusePortUnsupported 当前平台不支持 SO_REUSEPORT
+	ErrReusePortUnsupported = errors.New("tcp: SO_REUSEPORT is not supported on this platform")
+)
+
 // ServerOptions ServerOptions
 type ServerOptions struct {
-	loginwait time.Duration //登陆超时
-	readwait  time.Duration //读超时
-	writewait time.Duration //读超时
+	loginwait time.Duration           //登陆超时
+	readwait  time.Duration           //读超时
+	writewait time.Duration           //读超时
+	acceptors int                     //accept 循环数
+	heartbeat kupool.HeartbeatOptions //服务端心跳
 }
 
 // Server is a websocket implement of the Server
@@ -31,6 +42,11 @@ type Server struct {
 	once    sync.Once
 	options ServerOptions
 	quit    *kupool.Event
+	mu      sync.Mutex
+	lsts    []net.Listener
+	rec     *recorder.Recorder
+	proxy   *proxyproto.Policy
+	admit   *kupool.Admission
 }
 
 // NewServer NewServer
@@ -61,20 +77,138 @@ func (s *Server) Start() error {
 		s.Acceptor = new(defaultAcceptor)
 	}
 
-	lst, err := net.Listen("tcp", s.listen)
+	s.mu.Lock()
+	lsts := s.lsts
+	s.mu.Unlock()
+	if len(lsts) == 0 {
+		l, err := s.listenAll()
+		if err != nil {
+			return err
+		}
+		lsts = l
+	}
+	s.mu.Lock()
+	s.lsts = lsts
+	stopped := s.quit.HasFired()
+	s.mu.Unlock()
+	if stopped {
+		// Start 之前已经调用了 StopAccept
+		for _, lst := range lsts {
+			_ = lst.Close()
+		}
+		return ErrServerClosed
+	}
+	// 每个 socket 至少一个 accept 循环；socket 少于循环数时多个循环共享同一个 socket
+	loops := max(s.options.acceptors, len(lsts))
+	log.WithField("addr", lsts[0].Addr().String()).WithField("listeners", len(lsts)).WithField("loops", loops).Info("started")
+	var wg sync.WaitGroup
+	for i := 0; i < loops; i++ {
+		wg.Add(1)
+		go func(lst net.Listener) {
+			defer wg.Done()
+			s.acceptLoop(lst)
+		}(lsts[i%len(lsts)])
+	}
+	wg.Wait()
+	log.Info("listener closed")
+	return ErrServerClosed
+}
+
+// listenAll 按 accept 循环数监听：多于一个时以 SO_REUSEPORT 为每个循环各建一个 socket，
+// 平台不支持时退回到单个共享的 socket
+func (s *Server) listenAll() ([]net.Listener, error) {
+	if s.options.acceptors <= 1 {
+		lst, err := net.Listen("tcp", s.listen)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lst}, nil
+	}
+	first, err := ListenReusePort(s.listen)
+	if errors.Is(err, ErrReusePortUnsupported) {
+		lst, err := net.Listen("tcp", s.listen)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lst}, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Info("started")
+	lsts := []net.Listener{first}
+	for len(lsts) < s.options.acceptors {
+		// 监听 ":0" 时其余 socket 绑定第一个分配到的端口
+		lst, err := ListenReusePort(first.Addr().String())
+		if err != nil {
+			for _, l := range lsts {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		lsts = append(lsts, lst)
+	}
+	return lsts, nil
+}
+
+// acceptLoop 在 lst 上接受连接直到监听关闭
+func (s *Server) acceptLoop(lst net.Listener) {
+	log := logger.WithFields(logger.Fields{
+		"module": "tcp.server",
+		"listen": s.listen,
+	})
+	var backoff time.Duration
 	for {
 		rawconn, err := lst.Accept()
 		if err != nil {
-			rawconn.Close()
-			log.Warn(err)
+			if s.quit.HasFired() {
+				return
+			}
+			// 临时错误（如文件描述符耗尽）退避重试，避免空转
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Warnf("accept error: %v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
 		go func(rawconn net.Conn) {
-			conn := NewConn(rawconn)
+			// 读取 PROXY 头部前先占用全局与握手名额，慢速发送头部的连接同样受 MaxPending 限制；
+			// 按来源的限制等真实地址确定后再检查
+			var source net.Addr
+			if s.proxy == nil {
+				source = rawconn.RemoteAddr()
+			}
+			ticket, err := s.admit.Admit(source)
+			if err != nil {
+				log.Debugf("refuse %s: %v", rawconn.RemoteAddr(), err)
+				refuse(rawconn, err)
+				return
+			}
+			defer ticket.Release()
+			if s.proxy != nil {
+				pc, err := s.proxy.Wrap(rawconn)
+				if err != nil {
+					log.Warnf("proxy protocol from %s: %v", rawconn.RemoteAddr(), err)
+					_ = rawconn.Close()
+					return
+				}
+				rawconn = pc
+				if err := ticket.Bind(rawconn.RemoteAddr()); err != nil {
+					log.Debugf("refuse %s: %v", rawconn.RemoteAddr(), err)
+					refuse(rawconn, err)
+					return
+				}
+			}
+
+			var conn kupool.Conn = NewConn(rawconn)
+			var rc *recorder.Conn
+			if s.rec != nil {
+				rc = s.rec.Wrap(conn)
+				conn = rc
+			}
 
 			id, err := s.Accept(conn, s.options.loginwait)
 			if err != nil {
@@ -89,10 +223,17 @@ func (s *Server) Start() error {
 				conn.Close()
 				return
 			}
+			ticket.Established()
+			if rc != nil {
+				rc.SetChannelID(id)
+			}
 
 			channel := kupool.NewChannel(id, conn)
 			channel.SetReadWait(s.options.readwait)
 			channel.SetWriteWait(s.options.writewait)
+			if hb, ok := channel.(kupool.Heartbeater); ok {
+				hb.SetHeartbeat(s.options.heartbeat)
+			}
 
 			s.Add(channel)
 
@@ -105,40 +246,76 @@ func (s *Server) Start() error {
 			_ = s.Disconnect(channel.ID())
 			channel.Close()
 		}(rawconn)
+	}
+}
 
-		select {
-		case <-s.quit.Done():
-			return fmt.Errorf("listen exited")
-		default:
+// StopAccept 关闭监听，accept 循环随即退出并返回 ErrServerClosed；已建立的连接不受影响
+func (s *Server) StopAccept() error {
+	if !s.quit.Fire() {
+		return nil
+	}
+	s.mu.Lock()
+	lsts := s.lsts
+	s.mu.Unlock()
+	var errs []error
+	for _, lst := range lsts {
+		if err := lst.Close(); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return errors.Join(errs...)
+}
+
+// SetListeners 使用已有的监听 socket（如热重启时从父进程继承），Start 不再自行监听，
+// 每个 socket 至少一个 accept 循环；需在 Start 之前调用
+func (s *Server) SetListeners(lsts ...net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lsts = lsts
+}
+
+// SetAcceptLoops 设置 accept 循环数，大于 1 时 Start 以 SO_REUSEPORT 为每个循环各监听一个 socket，
+// 由内核分发新连接；需在 Start 之前调用
+func (s *Server) SetAcceptLoops(n int) {
+	s.options.acceptors = n
+}
 
+// Addr 返回实际监听地址（监听 ":0" 时可获取分配的端口），Start 之前且未 SetListeners 时返回 nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.lsts) == 0 {
+		return nil
+	}
+	return s.lsts[0].Addr()
 }
 
-// Shutdown Shutdown
+// Shutdown 停止接受新连接，写完每个连接发送队列中的消息后关闭；ctx 结束时直接关闭剩余连接
 func (s *Server) Shutdown(ctx context.Context) error {
 	log := logger.WithFields(logger.Fields{
 		"module": "tcp.server",
 	})
+	var err error
 	s.once.Do(func() {
 		defer func() {
 			log.Infoln("shutdown")
 		}()
-		// close channels
-		chanels := s.ChannelMap.All()
-		for _, ch := range chanels {
-			ch.Close()
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				continue
-			}
+		err = s.StopAccept()
+		var wg sync.WaitGroup
+		for _, ch := range s.ChannelMap.All() {
+			wg.Add(1)
+			go func(ch kupool.Channel) {
+				defer wg.Done()
+				if d, ok := ch.(interface{ Drain(context.Context) error }); ok {
+					_ = d.Drain(ctx)
+					return
+				}
+				_ = ch.Close()
+			}(ch)
 		}
-
+		wg.Wait()
 	})
-	return nil
+	return err
 }
 
 // string channelID
@@ -171,11 +348,40 @@ func (s *Server) SetReadWait(readwait time.Duration) {
 	s.options.readwait = readwait
 }
 
+// SetHeartbeat 之后建立的连接空闲时由服务端发送 ping，并关闭不回 pong 或长时间没有业务消息的连接
+func (s *Server) SetHeartbeat(opts kupool.HeartbeatOptions) {
+	s.options.heartbeat = opts
+}
+
+// SetRecorder 记录之后建立的连接上的每一帧，需在 Start 之前调用
+func (s *Server) SetRecorder(r *recorder.Recorder) {
+	s.rec = r
+}
+
+// SetProxyPolicy 对来自可信网段的连接先解析 PROXY protocol 头部，Acceptor 与之后的 RemoteAddr 为真实客户端地址；
+// 需在 Start 之前调用
+func (s *Server) SetProxyPolicy(p proxyproto.Policy) {
+	s.proxy = &p
+}
+
+// SetAdmission 在 Acceptor 之前按全局、来源、握手数与速率限制新连接，被拒绝的连接收到带原因的 OpClose；
+// 需在 Start 之前调用
+func (s *Server) SetAdmission(a *kupool.Admission) {
+	s.admit = a
+}
+
 // SetChannels SetChannels
 func (s *Server) SetChannelMap(channels kupool.ChannelMap) {
 	s.ChannelMap = channels
 }
 
+// refuse 以 OpClose 告知拒绝原因后关闭连接
+func refuse(conn net.Conn, reason error) {
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = WriteFrame(conn, kupool.OpClose, []byte(reason.Error()))
+	_ = conn.Close()
+}
+
 type defaultAcceptor struct {
 }
 
@@ -0,0 +1,402 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	kupool "github.com/JellyTony/kupool"
+	"github.com/JellyTony/kupool/clock"
+	"github.com/JellyTony/kupool/proxyproto"
+)
+
+type nopListener struct{}
+
+func (nopListener) Receive(kupool.Agent, []byte) {}
+func (nopListener) Disconnect(string) error      { return nil }
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestShutdownFlushesAndStopsAccept Shutdown 写完已排队的消息后关闭连接，accept 循环退出并关闭监听
+func TestShutdownFlushesAndStopsAccept(t *testing.T) {
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetMessageListener(nopListener{})
+	s.SetStateListener(nopListener{})
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+	waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+	addr := s.Addr().String()
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	cli := NewConn(raw)
+	waitUntil(t, "channel", func() bool { return len(s.All()) == 1 })
+	id := s.All()[0].ID()
+	for _, p := range []string{"a", "b", "c"} {
+		if err := s.Push(id, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"a", "b", "c"} {
+		f, err := cli.ReadFrame()
+		if err != nil {
+			t.Fatalf("queued message %q lost: %v", want, err)
+		}
+		if string(f.GetPayload()) != want {
+			t.Fatalf("expect %q, got %q", want, f.GetPayload())
+		}
+	}
+	if _, err := cli.ReadFrame(); err == nil {
+		t.Fatal("connection should be closed after the queue is flushed")
+	}
+	select {
+	case err := <-started:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Fatalf("expect ErrServerClosed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("accept loop should exit on shutdown")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("listener should be closed")
+	}
+}
+
+// TestAcceptLoops 多个 accept 循环在 Linux 上各自监听一个 SO_REUSEPORT socket，连接都能被接受，
+// StopAccept 关闭全部 socket
+func TestAcceptLoops(t *testing.T) {
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetMessageListener(nopListener{})
+	s.SetStateListener(nopListener{})
+	s.SetAcceptLoops(4)
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+	waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+	addr := s.Addr().String()
+
+	s.mu.Lock()
+	listeners := len(s.lsts)
+	s.mu.Unlock()
+	if runtime.GOOS == "linux" && listeners != 4 {
+		t.Fatalf("expect 4 SO_REUSEPORT listeners, got %d", listeners)
+	}
+
+	const conns = 64
+	for i := 0; i < conns; i++ {
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raw.Close()
+	}
+	waitUntil(t, "channels", func() bool { return s.ChannelMap.(*kupool.ChannelsImpl).Len() == conns })
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-started:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Fatalf("expect ErrServerClosed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("all accept loops should exit on shutdown")
+	}
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("listeners should be closed")
+	}
+}
+
+// addrAcceptor 记录 Acceptor 看到的客户端地址
+type addrAcceptor chan string
+
+func (a addrAcceptor) Accept(conn kupool.Conn, _ time.Duration) (string, error) {
+	a <- conn.RemoteAddr().String()
+	return conn.RemoteAddr().String(), nil
+}
+
+// TestProxyProtocol 可信来源的连接以 PROXY 头部中的地址作为 RemoteAddr，缺少头部时断开；
+// 不可信来源不解析头部
+func TestProxyProtocol(t *testing.T) {
+	start := func(trusted string) (string, addrAcceptor) {
+		s := NewServer("127.0.0.1:0").(*Server)
+		acc := make(addrAcceptor, 1)
+		s.SetAcceptor(acc)
+		s.SetMessageListener(nopListener{})
+		s.SetStateListener(nopListener{})
+		s.SetProxyPolicy(proxyproto.Policy{Trusted: []netip.Prefix{netip.MustParsePrefix(trusted)}, Timeout: time.Second})
+		go func() { _ = s.Start() }()
+		t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+		waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+		return s.Addr().String(), acc
+	}
+	send := func(addr string, header []byte) net.Conn {
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { raw.Close() })
+		if _, err := raw.Write(header); err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	expect := func(acc addrAcceptor, want string) {
+		t.Helper()
+		select {
+		case got := <-acc:
+			if got != want {
+				t.Fatalf("expect remote %s, got %s", want, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("acceptor not called")
+		}
+	}
+
+	addr, acc := start("127.0.0.0/8")
+	send(addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 8080\r\n"))
+	expect(acc, "203.0.113.7:4000")
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0, 36)
+	v2 = append(v2, net.ParseIP("2001:db8::1").To16()...)
+	v2 = append(v2, net.ParseIP("2001:db8::2").To16()...)
+	v2 = append(v2, 0x0f, 0xa0, 0x1f, 0x90)
+	send(addr, v2)
+	expect(acc, "[2001:db8::1]:4000")
+
+	// 可信来源缺少头部：不调用 Acceptor，直接断开
+	raw := send(addr, []byte("\x02\x00\x00\x00\x00\x00\x00\x00"))
+	_ = raw.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := raw.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection without a PROXY header should be closed")
+	}
+	select {
+	case got := <-acc:
+		t.Fatalf("acceptor should not run, got %s", got)
+	default:
+	}
+
+	// 不可信来源：头部当作普通数据，RemoteAddr 为真实对端
+	addr, acc = start("10.0.0.0/8")
+	send(addr, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 8080\r\n"))
+	select {
+	case got := <-acc:
+		if host, _, _ := net.SplitHostPort(got); host != "127.0.0.1" {
+			t.Fatalf("untrusted source must not be rewritten, got %s", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("acceptor not called")
+	}
+}
+
+// TestAdmissionRefuses 超过来源限制的连接收到带原因的 OpClose 并计数，名额在连接关闭后归还
+func TestAdmissionRefuses(t *testing.T) {
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetMessageListener(nopListener{})
+	s.SetStateListener(nopListener{})
+	adm := kupool.NewAdmission(kupool.AdmissionOptions{MaxConnsPerIP: 1})
+	s.SetAdmission(adm)
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+	addr := s.Addr().String()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "first channel", func() bool { return len(s.All()) == 1 })
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	_ = raw.SetReadDeadline(time.Now().Add(3 * time.Second))
+	f, err := NewConn(raw).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GetOpCode() != kupool.OpClose || string(f.GetPayload()) != kupool.ErrTooManyConnsFromIP.Error() {
+		t.Fatalf("expect OpClose with reason, got op=%d %q", f.GetOpCode(), f.GetPayload())
+	}
+	if st := adm.Stats(); st.Refused[kupool.ErrTooManyConnsFromIP.Error()] != 1 || st.Active != 1 || st.Pending != 0 {
+		t.Fatalf("unexpected admission stats %+v", st)
+	}
+
+	first.Close()
+	waitUntil(t, "slot released", func() bool { return adm.Stats().Active == 0 })
+	again, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	waitUntil(t, "channel after release", func() bool { return len(s.All()) == 1 && adm.Stats().Admitted == 2 })
+}
+
+// TestProxyHeaderCountsAsPending 等待 PROXY 头部的连接占用握手名额，慢速发送头部的连接不能绕过 MaxPending
+func TestProxyHeaderCountsAsPending(t *testing.T) {
+	s := NewServer("127.0.0.1:0").(*Server)
+	acc := make(addrAcceptor, 1)
+	s.SetAcceptor(acc)
+	s.SetMessageListener(nopListener{})
+	s.SetStateListener(nopListener{})
+	s.SetProxyPolicy(proxyproto.Policy{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, Timeout: 3 * time.Second})
+	adm := kupool.NewAdmission(kupool.AdmissionOptions{MaxPending: 2})
+	s.SetAdmission(adm)
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+	addr := s.Addr().String()
+
+	// 两个连接只发送半个头部
+	var slow []net.Conn
+	for i := 0; i < 2; i++ {
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raw.Close()
+		if _, err := raw.Write([]byte("PROXY TCP4 ")); err != nil {
+			t.Fatal(err)
+		}
+		slow = append(slow, raw)
+	}
+	waitUntil(t, "slow headers pending", func() bool { return adm.Stats().Pending == 2 })
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	_ = raw.SetReadDeadline(time.Now().Add(3 * time.Second))
+	f, err := NewConn(raw).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GetOpCode() != kupool.OpClose || string(f.GetPayload()) != kupool.ErrTooManyPending.Error() {
+		t.Fatalf("expect OpClose with pending reason, got op=%d %q", f.GetOpCode(), f.GetPayload())
+	}
+
+	// 头部补全后进入握手，真实地址用于按来源计数
+	if _, err := slow[0].Write([]byte("203.0.113.7 10.0.0.1 4000 8080\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-acc:
+		if got != "203.0.113.7:4000" {
+			t.Fatalf("expect remote from header, got %s", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("acceptor not called")
+	}
+	if st := adm.Stats(); st.Admitted != 1 || st.Refused[kupool.ErrTooManyPending.Error()] != 1 {
+		t.Fatalf("unexpected admission stats %+v", st)
+	}
+}
+
+// TestHeartbeatClock 活动时间与空闲巡检使用 HeartbeatOptions.Clock
+func TestHeartbeatClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := clock.NewFake(start)
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetMessageListener(nopListener{})
+	s.SetStateListener(nopListener{})
+	s.SetHeartbeat(kupool.HeartbeatOptions{IdleTimeout: time.Minute, Clock: clk})
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+
+	raw, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	waitUntil(t, "channel", func() bool { return len(s.All()) == 1 })
+	if lv := s.All()[0].(kupool.Heartbeater).Liveness(); !lv.LastMessage.Equal(start) {
+		t.Fatalf("expect activity stamped by the fake clock, got %+v", lv)
+	}
+	clk.BlockUntil(1)
+	waitUntil(t, "idle close", func() bool {
+		clk.Advance(30 * time.Second)
+		return len(s.All()) == 0
+	})
+}
+
+// TestHeartbeat 空闲连接收到服务端 ping：回复 pong 的连接保持并测得 RTT，不回复的连接在连续丢失后被关闭
+func TestHeartbeat(t *testing.T) {
+	s := NewServer("127.0.0.1:0").(*Server)
+	s.SetMessageListener(nopListener{})
+	s.SetStateListener(nopListener{})
+	s.SetHeartbeat(kupool.HeartbeatOptions{Interval: 50 * time.Millisecond, MaxMissed: 2})
+	go func() { _ = s.Start() }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	waitUntil(t, "listen", func() bool { return s.Addr() != nil })
+
+	alive, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	go func() {
+		c := NewConn(alive)
+		for {
+			f, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.GetOpCode() == kupool.OpPing {
+				_ = c.WriteFrame(kupool.OpPong, nil)
+			}
+		}
+	}()
+	silent, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	channelOf := func(c net.Conn) (kupool.Channel, bool) {
+		for _, ch := range s.All() {
+			if ch.RemoteAddr().String() == c.LocalAddr().String() {
+				return ch, true
+			}
+		}
+		return nil, false
+	}
+	waitUntil(t, "both channels", func() bool { return len(s.All()) == 2 })
+	waitUntil(t, "silent channel closed", func() bool {
+		_, ok := channelOf(silent)
+		return !ok
+	})
+	ch, ok := channelOf(alive)
+	if !ok {
+		t.Fatal("channel answering pings should stay open")
+	}
+	waitUntil(t, "rtt", func() bool { return ch.(kupool.Heartbeater).Liveness().RTT > 0 })
+	if lv := ch.(kupool.Heartbeater).Liveness(); lv.LastRead.Before(lv.LastMessage) {
+		t.Fatalf("pongs should count as reads: %+v", lv)
+	}
+}
@@ -26,13 +26,11 @@ type ClientOptions struct {
 type Client struct {
 	sync.Mutex
 	kupool.Dialer
-	once    sync.Once
 	id      string
 	name    string
 	conn    net.Conn
 	state   int32
 	options ClientOptions
-	dc      *kupool.DialerContext
 }
 
 // NewClient NewClient
@@ -62,7 +60,7 @@ func (c *Client) Name() string {
 	return c.name
 }
 
-// Connect to server
+// Connect to server；连接断开并 Close 之后可以再次 Connect
 func (c *Client) Connect(addr string) error {
 	_, err := url.Parse(addr)
 	if err != nil {
@@ -83,9 +81,12 @@ func (c *Client) Connect(addr string) error {
 		return err
 	}
 	if conn == nil {
+		atomic.CompareAndSwapInt32(&c.state, 1, 0)
 		return fmt.Errorf("conn is nil")
 	}
+	c.Lock()
 	c.conn = conn
+	c.Unlock()
 
 	if c.options.Heartbeat > 0 {
 		go func() {
@@ -108,67 +109,83 @@ func (c *Client) Send(payload []byte) error {
 	if atomic.LoadInt32(&c.state) == 0 {
 		return fmt.Errorf("connection is nil")
 	}
-	c.Lock()
-	defer c.Unlock()
-	err := c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
-	if err != nil {
-		return err
-	}
-	// 客户端消息需要使用MASK
-	return wsutil.WriteClientMessage(c.conn, ws.OpBinary, payload)
+	return c.write(c.current(), ws.OpBinary, payload)
 }
 
-// Close 关闭
+// Close 关闭当前连接
 func (c *Client) Close() {
-	c.once.Do(func() {
-		if c.conn == nil {
-			return
-		}
-		// graceful close connection
-		_ = wsutil.WriteClientMessage(c.conn, ws.OpClose, nil)
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil {
+		return
+	}
+	// graceful close connection
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	_ = wsutil.WriteClientMessage(c.conn, ws.OpClose, nil)
 
-		c.conn.Close()
-		atomic.CompareAndSwapInt32(&c.state, 1, 0)
-	})
+	c.conn.Close()
+	c.conn = nil
+	atomic.CompareAndSwapInt32(&c.state, 1, 0)
 }
 
+// Read 读取下一帧；服务端的 ping 在这里直接回复 pong，不返回给调用方
 func (c *Client) Read() (kupool.Frame, error) {
-	if c.conn == nil {
+	conn := c.current()
+	if conn == nil {
 		return nil, errors.New("connection is nil")
 	}
-	if c.options.Heartbeat > 0 {
-		_ = c.conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
-	}
-	frame, err := ws.ReadFrame(c.conn)
-	if err != nil {
-		return nil, err
-	}
-	if frame.Header.OpCode == ws.OpClose {
-		return nil, errors.New("remote side close the channel")
+	for {
+		if c.options.Heartbeat > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(c.options.ReadWait))
+		}
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch frame.Header.OpCode {
+		case ws.OpClose:
+			return nil, errors.New("remote side close the channel")
+		case ws.OpPing:
+			if err := c.write(conn, ws.OpPong, frame.Payload); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return &Frame{
+			raw: frame,
+		}, nil
 	}
-	return &Frame{
-		raw: frame,
-	}, nil
+}
+
+func (c *Client) current() net.Conn {
+	c.Lock()
+	defer c.Unlock()
+	return c.conn
 }
 
 func (c *Client) heartbealoop(conn net.Conn) error {
 	tick := time.NewTicker(c.options.Heartbeat)
+	defer tick.Stop()
 	for range tick.C {
-		// 发送一个ping的心跳包给服务端
-		if err := c.ping(conn); err != nil {
+		// 发送一个ping的心跳包给服务端；连接关闭或被替换后写入失败，循环随之退出
+		logger.Tracef("%s send ping to server", c.id)
+		if err := c.write(conn, ws.OpPing, nil); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) ping(conn net.Conn) error {
+// write 串行写入一帧（客户端消息需要使用MASK），conn 已不是当前连接时返回错误
+func (c *Client) write(conn net.Conn, op ws.OpCode, payload []byte) error {
 	c.Lock()
 	defer c.Unlock()
+	if conn == nil || conn != c.conn {
+		return errors.New("connection is closed")
+	}
 	err := conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
 	if err != nil {
 		return err
 	}
-	logger.Tracef("%s send ping to server", c.id)
-	return wsutil.WriteClientMessage(conn, ws.OpPing, nil)
+	return wsutil.WriteClientMessage(conn, op, payload)
 }
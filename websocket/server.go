@@ -16,9 +16,10 @@ import (
 
 // ServerOptions ServerOptions
 type ServerOptions struct {
-	loginwait time.Duration //登陆超时
-	readwait  time.Duration //读超时
-	writewait time.Duration //写超时
+	loginwait time.Duration           //登陆超时
+	readwait  time.Duration           //读超时
+	writewait time.Duration           //写超时
+	heartbeat kupool.HeartbeatOptions //服务端心跳
 }
 
 // Server is a websocket implement of the Server
@@ -30,6 +31,7 @@ type Server struct {
 	kupool.StateListener
 	once    sync.Once
 	options ServerOptions
+	admit   *kupool.Admission
 }
 
 // NewServer NewServer
@@ -73,23 +75,39 @@ func (s *Server) Start() error {
 		// step 2 包装conn
 		conn := NewConn(rawconn)
 
+		// 准入控制：拒绝时以 OpClose 告知原因
+		ticket, err := s.admit.Admit(rawconn.RemoteAddr())
+		if err != nil {
+			log.Debugf("refuse %s: %v", rawconn.RemoteAddr(), err)
+			_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_ = conn.WriteFrame(kupool.OpClose, []byte(err.Error()))
+			conn.Close()
+			return
+		}
+
 		// step 3
 		id, err := s.Accept(conn, s.options.loginwait)
 		if err != nil {
 			_ = conn.WriteFrame(kupool.OpClose, []byte(err.Error()))
 			conn.Close()
+			ticket.Release()
 			return
 		}
 		if _, ok := s.Get(id); ok {
 			log.Warnf("channel %s existed", id)
 			_ = conn.WriteFrame(kupool.OpClose, []byte("channelId is repeated"))
 			conn.Close()
+			ticket.Release()
 			return
 		}
+		ticket.Established()
 		// step 4
 		channel := kupool.NewChannel(id, conn)
 		channel.SetWriteWait(s.options.writewait)
 		channel.SetReadWait(s.options.readwait)
+		if hb, ok := channel.(kupool.Heartbeater); ok {
+			hb.SetHeartbeat(s.options.heartbeat)
+		}
 		s.Add(channel)
 
 		go func(ch kupool.Channel) {
@@ -105,6 +123,7 @@ func (s *Server) Start() error {
 				log.Warn(err)
 			}
 			ch.Close()
+			ticket.Release()
 		}(channel)
 
 	})
@@ -168,6 +187,17 @@ func (s *Server) SetChannelMap(channels kupool.ChannelMap) {
 	s.ChannelMap = channels
 }
 
+// SetAdmission 在 Acceptor 之前按全局、来源、握手数与速率限制新连接（在 HTTP 升级之后），
+// 被拒绝的连接收到带原因的 OpClose；需在 Start 之前调用
+func (s *Server) SetAdmission(a *kupool.Admission) {
+	s.admit = a
+}
+
+// SetHeartbeat 之后建立的连接空闲时由服务端发送 ping，并关闭不回 pong 或长时间没有业务消息的连接
+func (s *Server) SetHeartbeat(opts kupool.HeartbeatOptions) {
+	s.options.heartbeat = opts
+}
+
 // SetReadWait set read wait duration
 func (s *Server) SetReadWait(readwait time.Duration) {
 	s.options.readwait = readwait